@@ -0,0 +1,185 @@
+package singularity
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nccgroup/singularity/golang"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Certificates are obtained by the embedded ACME client if ACMEAutocertCacheDir
+// is set (see NewAutocertTLSConfig), or with an external ACME client
+// (e.g. certbot or lego) and picked up without restart:
+//   - HTTP-01 challenges are answered from files written in ACMEChallengeDir
+//     under acmeHTTPChallengePath, e.g. with "certbot certonly --webroot".
+//   - DNS-01 challenges, required for wildcard certificates of the attack domain
+//     (e.g. "*.rebind.it"), are answered by the DNS server from the file
+//     "_acme-challenge.<domain>" in ACMEChallengeDir, one TXT value per line,
+//     or from TXT records set with the /api/dns/txt API (see txtrecords.go).
+//   - Certificate and key files are reloaded when they change on disk.
+
+// acmeHTTPChallengePath is the route of ACME HTTP-01 challenges (RFC 8555)
+const acmeHTTPChallengePath = "/.well-known/acme-challenge/"
+
+// acmeTokenRegexp matches ACME challenge tokens (base64url)
+var acmeTokenRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ACMEChallengeHandler is a HTTP handler answering ACME HTTP-01 challenges
+// with the key authorizations written in Dir by an ACME client.
+type ACMEChallengeHandler struct {
+	Dir string
+}
+
+func (ach *ACMEChallengeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	token := strings.TrimPrefix(r.URL.Path, acmeHTTPChallengePath)
+	if r.Method != "GET" || !acmeTokenRegexp.MatchString(token) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	keyAuthorization, err := ioutil.ReadFile(filepath.Join(ach.Dir, token))
+	if err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(keyAuthorization)
+}
+
+// acmeDNSChallenge returns the TXT values of an ACME DNS-01 challenge query name
+// e.g. "_acme-challenge.rebind.it." and false if the name is not a challenge
+// of an allowed domain.
+func acmeDNSChallenge(appConfig *AppConfig, qname string) ([]string, bool) {
+	if appConfig.ACMEChallengeDir == "" {
+		return nil, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	domain := strings.TrimPrefix(name, "_acme-challenge.")
+	if domain == name || !golang.IsDomainName(domain) || strings.ContainsAny(domain, `/\`) ||
+		!nameUnderAllowedDomains(domain, appConfig.AllowedDomains) {
+		return nil, false
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(appConfig.ACMEChallengeDir, name))
+	if err != nil {
+		return nil, false
+	}
+	values := []string{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			values = append(values, line)
+		}
+	}
+	return values, true
+}
+
+// certReloadInterval bounds how often certificate files are checked for changes
+const certReloadInterval = time.Second * 10
+
+// certReloader serves a certificate loaded from PEM files
+// and reloads it when the files change, e.g. after an ACME renewal.
+type certReloader struct {
+	sync.Mutex
+	certFile  string
+	keyFile   string
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+// newCertReloader loads a certificate and its private key from PEM files
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// filesModTime returns the latest modification time of the certificate and key files
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// load reads the certificate files. Must hold cr mutex unless not shared yet.
+func (cr *certReloader) load() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// GetCertificate returns the current certificate, reloading it if its files changed.
+// The previous certificate is kept if the new files cannot be loaded,
+// e.g. while they are being written.
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.Lock()
+	defer cr.Unlock()
+
+	if time.Since(cr.lastCheck) >= certReloadInterval {
+		cr.lastCheck = time.Now()
+		if modTime, err := cr.filesModTime(); err == nil && !modTime.Equal(cr.modTime) {
+			if err := cr.load(); err != nil {
+				logEvent(LogError, "HTTP", LogFields{"file": cr.certFile}, "could not reload certificate %v: %v", cr.certFile, err)
+			} else {
+				logEvent(LogInfo, "HTTP", LogFields{"file": cr.certFile}, "reloaded certificate %v", cr.certFile)
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// NewAutocertTLSConfig returns the TLS configuration of HTTPS servers
+// obtaining their certificates from Let's Encrypt, cached in cacheDir.
+// ACME TLS-ALPN-01 challenges are answered by the HTTPS servers,
+// which must be reachable on port 443.
+// Certificates are only requested for names under allowedDomains,
+// on the first request of each name: DNS rebinding names need their own
+// certificate, within the rate limits of Let's Encrypt. Use a wildcard
+// certificate obtained with DNS-01 challenges to serve many sessions.
+func NewAutocertTLSConfig(cacheDir string, email string, allowedDomains []string) *tls.Config {
+	m := &autocert.Manager{
+		Prompt: autocert.AcceptTOS,
+		Cache:  autocert.DirCache(cacheDir),
+		Email:  email,
+		HostPolicy: func(ctx context.Context, host string) error {
+			if !nameUnderAllowedDomains(host, allowedDomains) {
+				return fmt.Errorf("host %q is not under the allowed domains", host)
+			}
+			return nil
+		},
+	}
+	// net/http adds the HTTP/2, if enabled, and HTTP/1.1 protocols
+	return &tls.Config{GetCertificate: m.GetCertificate, NextProtos: []string{acme.ALPNProto}}
+}
@@ -0,0 +1,124 @@
+package singularity
+
+import (
+	"net"
+	"net/http"
+)
+
+// AdminHandler is a HTTP middleware protecting the management endpoints
+// (e.g. /servers, /metrics and /api/*) served alongside victim-facing routes.
+// Clients must connect from AppConfig.AdminAllowedFrom if set
+// and supply AuthToken or an operator token, as a bearer token or basic auth password,
+// unless DisableAdminAuth is set and there are no operators.
+// Targets may request dynamic servers from the origin of their DNS session without token
+// if AllowDynamicHTTPServers is set.
+type AdminHandler struct {
+	NextHandler http.Handler
+	hss         *HTTPServerStoreHandler
+	// reserved to AuthToken: the endpoint is not filtered per operator
+	administratorOnly bool
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !ah.hss.authorizeAdmin(w, r) {
+		return
+	}
+	if ah.administratorOnly && ah.hss.requestOperator(r) != nil {
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "rejected %v %v from %v: reserved to the administrator",
+			r.Method, r.URL.Path, r.RemoteAddr)
+		writeServerError(w, http.StatusForbidden, "forbidden", "reserved to the administrator")
+		return
+	}
+	ah.NextHandler.ServeHTTP(w, r)
+}
+
+// adminRoutes returns the management endpoints by path.
+// The loot handler authorizes operators itself since payloads post loot to it.
+// Endpoints changing or describing the whole instance are reserved to the administrator.
+// Configuration validation reserves the same paths, so that they cannot be the payload path.
+func adminRoutes(hss *HTTPServerStoreHandler) map[string]http.Handler {
+	return map[string]http.Handler{
+		"/servers":            &AdminHandler{NextHandler: hss, hss: hss},
+		"/sessionpayloads":    &AdminHandler{NextHandler: &SessionPayloadHandler{hss: hss}, hss: hss},
+		"/metrics":            &AdminHandler{NextHandler: &MetricsHandler{hss: hss}, hss: hss, administratorOnly: true},
+		sessionsAPIPath:       &AdminHandler{NextHandler: &SessionsAPIHandler{hss: hss}, hss: hss},
+		sessionsAPIPath + "/": &AdminHandler{NextHandler: &SessionsAPIHandler{hss: hss}, hss: hss},
+		configReloadPath: &AdminHandler{NextHandler: &ConfigReloadHandler{hss: hss}, hss: hss,
+			administratorOnly: true},
+		payloadsAPIPath:       &AdminHandler{NextHandler: &PayloadsAPIHandler{hss: hss}, hss: hss},
+		payloadsAPIPath + "/": &AdminHandler{NextHandler: &PayloadsAPIHandler{hss: hss}, hss: hss},
+		txtRecordsAPIPath: &AdminHandler{NextHandler: &TXTRecordsAPIHandler{hss: hss}, hss: hss,
+			administratorOnly: true},
+		txtRecordsAPIPath + "/": &AdminHandler{NextHandler: &TXTRecordsAPIHandler{hss: hss}, hss: hss,
+			administratorOnly: true},
+		attacksAPIPath:       &AdminHandler{NextHandler: &AttacksAPIHandler{hss: hss}, hss: hss},
+		attacksAPIPath + "/": &AdminHandler{NextHandler: &AttacksAPIHandler{hss: hss}, hss: hss},
+		lootAPIPath:          &LootHandler{hss: hss},
+		lootAPIPath + "/":    &LootHandler{hss: hss},
+	}
+}
+
+// handleAdminRoutes registers the management endpoints on h.
+func handleAdminRoutes(h *http.ServeMux, hss *HTTPServerStoreHandler) {
+	for path, handler := range adminRoutes(hss) {
+		h.Handle(path, handler)
+	}
+}
+
+// NewAdminServer configures a HTTP server dedicated to operators on AppConfig.AdminAddr.
+// It serves the management endpoints and the manager interface,
+// so that they are not exposed on the victim-facing attack servers.
+// Clients must connect from AppConfig.AdminAllowedFrom if set.
+func NewAdminServer(hss *HTTPServerStoreHandler) *http.Server {
+	appConfig := hss.appConfig()
+	assets := NewAssetsFS(appConfig.HTMLDir)
+	h := http.NewServeMux()
+	h.Handle("/", &DefaultHeadersHandler{NextHandler: http.FileServer(http.FS(assets)),
+		ExtraHeaders: appConfig.CustomResponseHeaders})
+	h.Handle("/healthz", &HealthHandler{hss: hss})
+	handleAdminRoutes(h, hss)
+
+	ach := &AllowedClientsHandler{NextHandler: h, AllowedNets: appConfig.AdminAllowedFrom}
+	return &http.Server{Addr: appConfig.AdminAddr, Handler: ach}
+}
+
+// StartAdminServer starts the admin HTTP server
+func StartAdminServer(s *http.Server) error {
+	l, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logEvent(LogInfo, "HTTP", LogFields{"addr": s.Addr}, "starting admin HTTP Server on %v", s.Addr)
+		s.Serve(l)
+	}()
+	return nil
+}
+
+// authorizeAdmin checks that a request may access the management endpoints,
+// replying with an error otherwise.
+func (hss *HTTPServerStoreHandler) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if allowed := hss.appConfig().AdminAllowedFrom; len(allowed) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !addrInIPNetList(ip, allowed) {
+			logEvent(LogWarn, "HTTP", httpRequestFields(r), "rejected %v %v from %v: not in allowed admin clients",
+				r.Method, r.URL.Path, r.RemoteAddr)
+			writeServerError(w, http.StatusForbidden, "forbidden", "client address not allowed")
+			return false
+		}
+	}
+
+	// dynamic server requests of targets may omit the token if allowed,
+	// their servers then belong to their session and its operator
+	sessionServerRequest := hss.AllowDynamicHTTPServers && r.URL.Path == "/servers" && r.Method == "PUT" &&
+		hss.requestSession(r) != ""
+	if !sessionServerRequest && !hss.authorized(r) {
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "unauthorized request to %v from %v", r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="singularity"`)
+		writeServerError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,29 @@
+package singularity
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"os"
+)
+
+// embeddedAssets holds the manager interface and payloads
+// so that singularity can be deployed as a single binary.
+//
+//go:embed html
+var embeddedAssets embed.FS
+
+// NewAssetsFS returns the filesystem serving the manager interface and payloads,
+// read from htmlDir if set, e.g. "./html" while developing payloads,
+// and compiled into the binary otherwise.
+func NewAssetsFS(htmlDir string) fs.FS {
+	if htmlDir != "" {
+		return os.DirFS(htmlDir)
+	}
+	assets, err := fs.Sub(embeddedAssets, "html")
+	if err != nil {
+		// cannot happen, the html directory is embedded at build time
+		log.Fatalf("HTTP: could not open embedded assets: %v\n", err)
+	}
+	return assets
+}
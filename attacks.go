@@ -0,0 +1,323 @@
+package singularity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// attacksAPIPath is the route of the attack orchestration API
+const attacksAPIPath = "/api/attacks"
+
+const (
+	defaultAttackPayload  = "Simple Fetch Get"
+	defaultAttackInterval = 20 // seconds, see manager-config.json
+)
+
+// AttackSpec describes an attack launched with the attacks API
+type AttackSpec struct {
+	Target    string            // host to rebind to, e.g. "127.0.0.1" or "fd00::1"
+	Port      int               // port of the target service and of the attack origin, 80 if not set
+	Strategy  string            // DNS rebinding strategy, "fs" if not set
+	Payload   string            // attack payload, "Simple Fetch Get" if not set
+	Variables map[string]string `json:",omitempty"` // payload variables
+	Interval  int               // seconds between rebinding checks of the victim, 20 if not set
+	Scheme    string            // of the attack origin, the scheme of the server on Port or "http" if not set
+	Domain    string            // attack domain, the first AllowedDomains if not set
+	Session   string            // DNS session of the attack, random if not set
+}
+
+// Attack is a launched attack: the victim browses to URL
+// to run Payload against Target once rebound.
+type Attack struct {
+	AttackSpec
+	Hostname      string // rebinding host name, without trailing dot
+	URL           string // victim URL
+	ServerStarted bool   // a dynamic HTTP server was started on Port
+}
+
+// AttacksAPIHandler is a HTTP handler to launch attacks server-side:
+//
+//	POST /api/attacks       launches the attack of the AttackSpec body and returns the Attack
+//	GET  /api/attacks/url   returns the Attack of the AttackSpec query parameters
+//	                        (target, port, strategy, scheme, domain and session) without launching it
+//
+// Launching an attack generates its rebinding host name, starts a dynamic HTTP server
+// on the attack port unless a server already listens on it
+// and configures the payload, variables and interval of the attack session.
+// The victim URL then opens the attack frame directly, without the manager.
+// It is served behind AdminHandler and launching attacks requires the AuthToken.
+type AttacksAPIHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+func (aah *AttacksAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	switch path := strings.Trim(strings.TrimPrefix(r.URL.Path, attacksAPIPath), "/"); {
+	case path == "" && r.Method == "POST":
+		aah.launch(w, r)
+	case path == "url" && r.Method == "GET":
+		aah.buildURL(w, r)
+	case path == "" || path == "url":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+// buildURL replies with the attack of the query parameters
+func (aah *AttacksAPIHandler) buildURL(w http.ResponseWriter, r *http.Request) {
+	if aah.hss.AppConfig == nil {
+		writeServerError(w, http.StatusInternalServerError, "internal_error", "attacks are not configured")
+		return
+	}
+
+	query := r.URL.Query()
+	spec := AttackSpec{Target: query.Get("target"), Strategy: query.Get("strategy"), Scheme: query.Get("scheme"),
+		Domain: query.Get("domain"), Session: query.Get("session")}
+	if port := query.Get("port"); port != "" {
+		var err error
+		if spec.Port, err = strconv.Atoi(port); err != nil {
+			writeServerError(w, 400, "bad_attack", fmt.Sprintf("invalid port %q", port))
+			return
+		}
+	}
+
+	op := aah.hss.requestOperator(r)
+	if spec.Session != "" && !op.owns(spec.Session) {
+		writeServerError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("DNS session %q is not yours", spec.Session))
+		return
+	}
+	appConfig := aah.hss.appConfig()
+	attack, err := newAttack(spec, appConfig, op)
+	if err != nil {
+		writeServerError(w, 400, "bad_attack", err.Error())
+		return
+	}
+	if attack.Scheme == "" {
+		attack.Scheme, _ = aah.hss.listeningScheme(attack.Port)
+	}
+	attack.setURL(appConfig.payloadPath())
+	writeJSON(w, attack)
+}
+
+// launch launches the attack of the request body
+func (aah *AttacksAPIHandler) launch(w http.ResponseWriter, r *http.Request) {
+	hss := aah.hss
+	// attacks configure session payloads, which are reserved to operators
+	if !hss.authorized(r) {
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "unauthorized request to %v from %v", attacksAPIPath, r.RemoteAddr)
+		writeServerError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+		return
+	}
+	if hss.AppConfig == nil || hss.SessionPayloads == nil {
+		writeServerError(w, http.StatusInternalServerError, "internal_error", "attacks are not configured")
+		return
+	}
+
+	body, err := hss.readRequestBody(r)
+	if err == errRequestBodyTooLarge {
+		writeServerError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+			"request body exceeds the maximum size (MaxRequestBodyBytes)")
+		return
+	}
+	if err != nil {
+		writeServerError(w, 400, "bad_request", "could not read request body")
+		return
+	}
+
+	spec := AttackSpec{}
+	if err := json.Unmarshal(body, &spec); err != nil {
+		writeServerError(w, 400, "bad_json", "could not parse request body")
+		return
+	}
+
+	_, privileged := hss.tokenOperator(requestToken(r))
+	attack, serr := hss.launchAttack(spec, hss.requestOperator(r), privileged)
+	if serr != nil {
+		writeServerError(w, serr.status, serr.code, serr.Error())
+		return
+	}
+	writeJSON(w, attack)
+}
+
+// launchAttack launches the attack of spec for op, starting a dynamic HTTP server
+// on its port unless a server already listens on it.
+// hss.AppConfig and hss.SessionPayloads must be set.
+func (hss *HTTPServerStoreHandler) launchAttack(spec AttackSpec, op *Operator, privileged bool) (*Attack, *dynamicServerError) {
+	if spec.Session != "" && !op.owns(spec.Session) {
+		return nil, &dynamicServerError{http.StatusForbidden, "forbidden",
+			fmt.Errorf("DNS session %q is not yours", spec.Session)}
+	}
+	appConfig := hss.appConfig()
+	attack, err := newAttack(spec, appConfig, op)
+	if err != nil {
+		return nil, &dynamicServerError{400, "bad_attack", err}
+	}
+
+	if scheme, ok := hss.listeningScheme(attack.Port); ok {
+		if attack.Scheme != "" && attack.Scheme != scheme {
+			return nil, &dynamicServerError{http.StatusConflict, "port_conflict",
+				fmt.Errorf("port %v is used by a %v server", attack.Port, scheme)}
+		}
+		attack.Scheme = scheme
+	} else {
+		if !hss.AllowDynamicHTTPServers {
+			return nil, &dynamicServerError{400, "dynamic_servers_disabled",
+				fmt.Errorf("no HTTP server listens on port %v and dynamic HTTP servers are not allowed", attack.Port)}
+		}
+		serverInfo := httpServerInfo{Port: strconv.Itoa(attack.Port), Scheme: attack.Scheme}
+		if err := hss.startDynamicServer(attack.Port, &serverInfo, op, privileged); err != nil {
+			return nil, err
+		}
+		attack.Scheme = serverInfo.Scheme
+		attack.ServerStarted = true
+	}
+
+	hss.SessionPayloads.Set(attack.Session, attack.Payload)
+	if attack.Variables != nil {
+		hss.SessionPayloads.SetVariables(attack.Session, attack.Variables)
+	}
+	hss.SessionPayloads.SetInterval(attack.Session, attack.Interval)
+
+	attack.setURL(appConfig.payloadPath())
+	logEvent(LogInfo, "HTTP", LogFields{"session": attack.Session, "port": attack.Port},
+		"launched attack of session %v against %v:%v: %v", attack.Session, attack.Target, attack.Port, attack.URL)
+	return attack, nil
+}
+
+// setURL sets the victim URL of the attack, served on payloadPath
+func (attack *Attack) setURL(payloadPath string) {
+	scheme := attack.Scheme
+	if scheme == "" {
+		scheme = "http"
+	}
+	attack.URL = fmt.Sprintf("%v://%v%v", scheme, net.JoinHostPort(attack.Hostname, strconv.Itoa(attack.Port)),
+		payloadPath)
+}
+
+// newAttack validates spec, sets its defaults and generates its rebinding host name.
+// Random sessions are in the namespace of op. The attack scheme is set later from the server of the attack port.
+func newAttack(spec AttackSpec, appConfig *AppConfig, op *Operator) (*Attack, error) {
+	if spec.Target == "" {
+		return nil, errors.New("missing target")
+	}
+	if spec.Port == 0 {
+		spec.Port = 80
+	}
+	if !validPort(spec.Port) {
+		return nil, fmt.Errorf("invalid port %v", spec.Port)
+	}
+	if spec.Strategy == "" {
+		spec.Strategy = "fs"
+	}
+	if spec.Payload == "" {
+		spec.Payload = defaultAttackPayload
+	}
+	if spec.Interval == 0 {
+		spec.Interval = defaultAttackInterval
+	}
+	if spec.Interval < 0 {
+		return nil, fmt.Errorf("invalid interval %v", spec.Interval)
+	}
+	if spec.Scheme != "" && spec.Scheme != "http" && spec.Scheme != "https" {
+		return nil, fmt.Errorf("invalid scheme %q", spec.Scheme)
+	}
+	if spec.Domain == "" {
+		if len(appConfig.AllowedDomains) == 0 {
+			return nil, errors.New("missing domain and no allowed domains are configured")
+		}
+		spec.Domain = appConfig.AllowedDomains[0]
+	}
+	if !domainAllowed(spec.Domain, appConfig.AllowedDomains) {
+		return nil, fmt.Errorf("domain %q is not allowed", spec.Domain)
+	}
+	if spec.Session == "" {
+		session, err := GenerateRandomString()
+		if err != nil {
+			return nil, err
+		}
+		spec.Session = op.namespacedSession(session)
+	}
+
+	hostname, err := BuildAttackHostname(appConfig.ResponseIPAddr, spec.Target, spec.Session, spec.Strategy,
+		spec.Domain)
+	if err != nil {
+		return nil, err
+	}
+	return &Attack{AttackSpec: spec, Hostname: hostname}, nil
+}
+
+// BuildAttackHostname returns the rebinding host name (without trailing dot)
+// of a DNS session answering responseIPAddr (the Singularity server)
+// then target (an IP address, e.g. net.IP.String(), or a host name)
+// with strategy, e.g. "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it".
+// It encodes IPv6 addresses and escapes "-" in elements as NewDNSQuery expects
+// and checks that NewDNSQuery decodes the host name back.
+func BuildAttackHostname(responseIPAddr string, target string, session string, strategy string,
+	domain string) (string, error) {
+	if net.ParseIP(responseIPAddr) == nil {
+		return "", fmt.Errorf("invalid Singularity server address %q", responseIPAddr)
+	}
+	if target == "" {
+		return "", errors.New("missing target")
+	}
+	if session == "" {
+		return "", errors.New("missing session")
+	}
+	if _, ok := LookupRebindingStrategy(strategy); !ok {
+		return "", fmt.Errorf("unknown rebinding strategy %q", strategy)
+	}
+	if strings.Trim(domain, ".") == "" {
+		return "", errors.New("missing domain")
+	}
+
+	name := &DNSQuery{ResponseIPAddr: responseIPAddr, ResponseReboundIPAddr: target,
+		Session: session, DNSRebindingStrategy: strategy, Domain: "." + dns.Fqdn(strings.TrimPrefix(domain, "."))}
+	hostname := name.Encode()
+	decoded, err := NewDNSQuery(hostname)
+	if err != nil || decoded.ResponseReboundIPAddr != target || decoded.Session != session {
+		return "", fmt.Errorf("invalid target %q or session %q", target, session)
+	}
+	if _, ok := dns.IsDomainName(hostname); !ok {
+		return "", fmt.Errorf("invalid target %q or session %q", target, session)
+	}
+	return strings.TrimSuffix(hostname, "."), nil
+}
+
+// BuildAttackURL returns the URL of the attack origin of a DNS session,
+// e.g. "http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080/",
+// where port is the port of the target service. See BuildAttackHostname.
+func BuildAttackURL(responseIPAddr string, target string, session string, strategy string, domain string,
+	port int) (string, error) {
+	if !validPort(port) {
+		return "", fmt.Errorf("invalid port %v", port)
+	}
+	hostname, err := BuildAttackHostname(responseIPAddr, target, session, strategy, domain)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("http://%v/", net.JoinHostPort(hostname, strconv.Itoa(port))), nil
+}
+
+// listeningScheme returns the scheme of the HTTP server listening on port, if any
+func (hss *HTTPServerStoreHandler) listeningScheme(port int) (string, bool) {
+	addr := ":" + strconv.Itoa(port)
+	hss.RLock()
+	defer hss.RUnlock()
+	for _, servers := range [][]*http.Server{hss.StaticServers, hss.DynamicServers} {
+		for _, server := range servers {
+			if server != nil && server.Addr == addr {
+				return hss.serverScheme(server), true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,170 @@
+package singularity
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultDNSAuditLogMaxSize is the size of the DNS audit log file
+// beyond which it is rotated, if not configured
+const defaultDNSAuditLogMaxSize = 100 << 20
+
+// Actions taken on audited DNS queries
+const (
+	dnsAuditActionAnswered    = "answered"
+	dnsAuditActionIgnored     = "ignored"      // not answered, e.g. from IgnoreDNSRequestFrom clients
+	dnsAuditActionRateLimited = "rate_limited" // not answered, see DNSRateLimit
+)
+
+// DNSAuditEntry records a DNS query and the answer served, for reporting.
+// Queries which are not answered have an empty Rcode and no answers.
+type DNSAuditEntry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	QName    string    `json:"qname"`
+	QType    string    `json:"qtype"`
+	Session  string    `json:"session,omitempty"`
+	Strategy string    `json:"strategy,omitempty"`
+	Action   string    `json:"action"`
+	Rcode    string    `json:"rcode"`
+	Answers  []string  `json:"answers"`
+}
+
+// DNSAuditLog writes DNS audit entries to a file, one JSON object per line.
+// The file is rotated once larger than MaxSize bytes, to "<path>.1",
+// "<path>.2"..., keeping MaxBackups rotated files.
+type DNSAuditLog struct {
+	sync.Mutex
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewDNSAuditLog opens the DNS audit log file at path, appending to it.
+// maxSize of 0 or less rotates the file beyond defaultDNSAuditLogMaxSize.
+func NewDNSAuditLog(path string, maxSize int64, maxBackups int) (*DNSAuditLog, error) {
+	if maxSize <= 0 {
+		maxSize = defaultDNSAuditLogMaxSize
+	}
+	al := &DNSAuditLog{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := al.open(); err != nil {
+		return nil, err
+	}
+	return al, nil
+}
+
+// open opens the log file. Must hold al mutex.
+func (al *DNSAuditLog) open() error {
+	file, err := os.OpenFile(al.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	al.file = file
+	al.size = info.Size()
+	return nil
+}
+
+// rotate renames the log file to "<path>.1", shifting older files
+// and removing the oldest one, then opens a new file.
+// If the file cannot be renamed, it is opened again to append to it.
+// al.file is nil if no file could be opened. Must hold al mutex.
+func (al *DNSAuditLog) rotate() error {
+	al.file.Close()
+	al.file = nil
+	var err error
+	if al.MaxBackups > 0 {
+		for i := al.MaxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%v.%v", al.Path, i), fmt.Sprintf("%v.%v", al.Path, i+1))
+		}
+		err = os.Rename(al.Path, al.Path+".1")
+	} else {
+		err = os.Remove(al.Path)
+	}
+	if openErr := al.open(); openErr != nil {
+		return openErr
+	}
+	return err
+}
+
+// Log writes an entry, rotating the file if it becomes too large
+func (al *DNSAuditLog) Log(entry *DNSAuditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	al.Lock()
+	defer al.Unlock()
+	if al.file == nil {
+		return
+	}
+	if al.size > 0 && al.size+int64(len(line)) > al.MaxSize {
+		if err := al.rotate(); err != nil {
+			logEvent(LogError, "DNS", LogFields{"file": al.Path}, "could not rotate audit log %v: %v", al.Path, err)
+			if al.file == nil {
+				return
+			}
+		}
+	}
+	n, err := al.file.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		logEvent(LogError, "DNS", LogFields{"file": al.Path}, "could not write audit log %v: %v", al.Path, err)
+	}
+}
+
+// Close closes the log file
+func (al *DNSAuditLog) Close() error {
+	al.Lock()
+	defer al.Unlock()
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	return err
+}
+
+// auditDNSQuery logs the questions of a DNS query, the action taken
+// and the answers of the response m, nil if the query was not answered.
+// The session and strategy are those of Singularity names, with the default strategy if not set.
+func auditDNSQuery(al *DNSAuditLog, appConfig *AppConfig, clientIP string, r *dns.Msg, m *dns.Msg, action string) {
+	now := time.Now()
+	if m == nil {
+		m = &dns.Msg{Question: r.Question}
+	}
+	for _, q := range m.Question {
+		entry := &DNSAuditEntry{Time: now, ClientIP: clientIP, QName: q.Name, QType: dns.TypeToString[q.Qtype],
+			Action: action, Answers: []string{}}
+		if action == dnsAuditActionAnswered {
+			entry.Rcode = dns.RcodeToString[m.Rcode]
+		}
+		if name, err := NewDNSQuery(q.Name); err == nil {
+			entry.Session = name.Session
+			entry.Strategy = appConfig.RebindingFnName
+			if _, ok := LookupRebindingStrategy(name.DNSRebindingStrategy); ok {
+				entry.Strategy = name.DNSRebindingStrategy
+			}
+		}
+		for _, rr := range append(append([]dns.RR{}, m.Answer...), m.Extra...) {
+			if strings.EqualFold(rr.Header().Name, q.Name) {
+				entry.Answers = append(entry.Answers, rr.String())
+			}
+		}
+		al.Log(entry)
+	}
+}
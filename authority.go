@@ -0,0 +1,94 @@
+package singularity
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// TTL of the NS records and glue of the attacker domain.
+// Rebinding answers use a TTL of 0 instead.
+const nsRecordTTL = 3600
+
+// zoneOf returns the allowed domain (e.g. "rebind.it.") a DNS query name
+// (e.g. "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.") belongs to,
+// or an empty string if none or no domain is configured.
+func zoneOf(qname string, allowed []string) string {
+	name := strings.ToLower(strings.Trim(qname, "."))
+	zone := ""
+	for _, d := range allowed {
+		d = strings.ToLower(strings.Trim(d, "."))
+		// the most specific domain wins
+		if (name == d || strings.HasSuffix(name, "."+d)) && len(d) > len(zone) {
+			zone = d
+		}
+	}
+	if zone == "" {
+		return ""
+	}
+	return zone + "."
+}
+
+// nameServers returns the name servers of zone,
+// AppConfig.NameServers if set, "ns.<zone>" otherwise.
+func (appConfig *AppConfig) nameServers(zone string) []string {
+	if len(appConfig.NameServers) == 0 {
+		return []string{"ns." + zone}
+	}
+	servers := []string{}
+	for _, server := range appConfig.NameServers {
+		servers = append(servers, dns.Fqdn(server))
+	}
+	return servers
+}
+
+// soaRecord returns the SOA record of zone. Its minimum TTL is 0
+// so that resolvers do not cache negative answers during rebinding.
+func soaRecord(appConfig *AppConfig, zone string) (dns.RR, error) {
+	return dns.NewRR(fmt.Sprintf("%s %d IN SOA %s hostmaster.%s 1 3600 600 86400 0",
+		zone, nsRecordTTL, appConfig.nameServers(zone)[0], zone))
+}
+
+// answerAuthority answers NS and SOA queries for the apex of the allowed domains,
+// with the glue of name servers within the zone, which resolve to ResponseIPAddr.
+// Other queries of the zone get a NODATA response with the SOA record
+// in the authority section.
+func answerAuthority(appConfig *AppConfig, q dns.Question, m *dns.Msg) {
+	zone := zoneOf(q.Name, appConfig.AllowedDomains)
+	if zone == "" {
+		return
+	}
+	soa, err := soaRecord(appConfig, zone)
+	if err != nil {
+		return
+	}
+	apex := strings.EqualFold(q.Name, zone)
+
+	switch {
+	case apex && q.Qtype == dns.TypeSOA:
+		m.Answer = append(m.Answer, soa)
+	case apex && q.Qtype == dns.TypeNS:
+		glueType := "A"
+		if ip := net.ParseIP(appConfig.ResponseIPAddr); ip == nil {
+			glueType = ""
+		} else if ip.To4() == nil {
+			glueType = "AAAA"
+		}
+		for _, server := range appConfig.nameServers(zone) {
+			if rr, err := dns.NewRR(fmt.Sprintf("%s %d IN NS %s", zone, nsRecordTTL, server)); err == nil {
+				m.Answer = append(m.Answer, rr)
+			}
+			if glueType == "" || zoneOf(server, []string{zone}) == "" {
+				continue
+			}
+			if rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", server, nsRecordTTL, glueType,
+				appConfig.ResponseIPAddr)); err == nil {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	default:
+		m.Ns = append(m.Ns, soa)
+	}
+}
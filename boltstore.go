@@ -0,0 +1,127 @@
+package singularity
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the BoltDB database of sessions and loot
+var (
+	sessionsBucket = []byte("sessions")
+	lootBucket     = []byte("loot")     // JSON metadata by loot identifier
+	lootDataBucket = []byte("lootdata") // captured data by loot identifier
+)
+
+// OpenBoltDB opens the BoltDB database at path, creating it if needed.
+// It fails if the database is already open, e.g. by another instance.
+func OpenBoltDB(path string) (*bolt.DB, error) {
+	return bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+}
+
+// BoltSessionPersister persists DNS sessions in the "sessions" bucket
+// of a BoltDB database, as JSON values keyed by session,
+// which can also be inspected offline, e.g. with the bbolt command.
+type BoltSessionPersister struct {
+	DB *bolt.DB
+}
+
+// Save replaces the sessions of the database in a single transaction
+func (p *BoltSessionPersister) Save(sessions map[string]*DNSClientState) error {
+	return p.DB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(sessionsBucket) != nil {
+			if err := tx.DeleteBucket(sessionsBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(sessionsBucket)
+		if err != nil {
+			return err
+		}
+		for sk, sv := range sessions {
+			data, err := json.Marshal(sv)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(sk), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Load reads sessions from the database, none if they were never saved
+func (p *BoltSessionPersister) Load() (map[string]*DNSClientState, error) {
+	sessions := make(map[string]*DNSClientState)
+	err := p.DB.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sessionsBucket)
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(sk, data []byte) error {
+			state := &DNSClientState{}
+			if err := json.Unmarshal(data, state); err != nil {
+				return fmt.Errorf("session %s: %v", sk, err)
+			}
+			sessions[string(sk)] = state
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// NewBoltLootStore returns a loot store persisting loot in the "loot"
+// and "lootdata" buckets of db, loaded with the loot previously saved there.
+func NewBoltLootStore(db *bolt.DB) (*LootStore, error) {
+	ls := &LootStore{DB: db, items: make(map[string]*Loot), sessionSizes: make(map[string]int64)}
+	err := db.Update(func(tx *bolt.Tx) error {
+		metadata, err := tx.CreateBucketIfNotExists(lootBucket)
+		if err != nil {
+			return err
+		}
+		data, err := tx.CreateBucketIfNotExists(lootDataBucket)
+		if err != nil {
+			return err
+		}
+		return metadata.ForEach(func(id, value []byte) error {
+			loot := &Loot{}
+			if err := json.Unmarshal(value, loot); err != nil {
+				return fmt.Errorf("loot %s: %v", id, err)
+			}
+			// values are only valid during the transaction
+			loot.data = append([]byte{}, data.Get(id)...)
+			ls.load(loot)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ls, nil
+}
+
+// putBoltLoot saves the metadata and data of loot in its buckets
+func putBoltLoot(db *bolt.DB, id string, metadata []byte, data []byte) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(lootDataBucket).Put([]byte(id), data); err != nil {
+			return err
+		}
+		return tx.Bucket(lootBucket).Put([]byte(id), metadata)
+	})
+}
+
+// deleteBoltLoot removes loot from its buckets
+func deleteBoltLoot(db *bolt.DB, id string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(lootBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		return tx.Bucket(lootDataBucket).Delete([]byte(id))
+	})
+}
@@ -0,0 +1,455 @@
+// singularity-cli drives a Singularity server from the command line
+// through its management API, e.g.
+//
+//	singularity-cli -url http://rebind.it:8080 -token <secret> sessions
+//	singularity-cli attack -domain rebind.it -port 8080 127.0.0.1
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nccgroup/singularity"
+)
+
+// client calls the management API of a Singularity server
+type client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// apiError is the JSON error of the /servers endpoint
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// do sends a request with a JSON body if set
+// and decodes the JSON response into out if set
+func (c *client) do(method string, path string, body interface{}, out interface{}) error {
+	resp, err := c.send(method, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send sends a request and returns the response if successful
+func (c *client) send(method string, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.baseURL, "/")+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		e := apiError{}
+		if json.Unmarshal(data, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("%v %v: %v (%v)", method, path, e.Message, e.Code)
+		}
+		return nil, fmt.Errorf("%v %v: %v: %v", method, path, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp, nil
+}
+
+// session is a DNS session as listed by /api/sessions
+type session struct {
+	Session               string
+	FirstQueryTime        time.Time
+	LastQueryTime         time.Time
+	Strategy              string
+	ResponseIPAddr        string
+	ResponseReboundIPAddr string
+	Rebound               bool
+	QueryCount            int
+	LastAnswers           []string
+}
+
+// server is an HTTP server as listed by /servers
+type server struct {
+	Port      string
+	Scheme    string `json:",omitempty"`
+	KeepAlive bool   `json:",omitempty"`
+	Session   string `json:",omitempty"`
+}
+
+type serversConfig struct {
+	ServerInformation       []server
+	AllowDynamicHTTPServers bool
+	PayloadPath             string
+}
+
+// loot is captured data as listed by /api/loot
+type loot struct {
+	ID          string
+	Session     string
+	Time        time.Time
+	URL         string
+	ContentType string
+	Size        int
+}
+
+// stringsFlag is a repeatable flag
+type stringsFlag []string
+
+func (s *stringsFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringsFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+const usage = `Usage: singularity-cli [-url URL] [-token TOKEN] <command> [arguments]
+
+Commands:
+  sessions                  list DNS sessions
+  session <id>              show a DNS session
+  session-reset <id>        restart the rebinding of a session
+  session-delete <id>       delete a session
+  events                    print session events as they happen
+  attack [flags] <target>   launch an attack against target and print its URL
+  loot [-session <id>]      list captured data
+  loot-get [-o file] <id>   download captured data
+  servers                   list HTTP servers
+  server-start [flags] [<port>]
+                            start a dynamic HTTP server
+  server-stop <port>        stop a dynamic HTTP server
+
+Run "singularity-cli <command> -h" for the flags of a command.
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	baseURL := flag.String("url", envOrDefault("SINGULARITY_URL", "http://127.0.0.1:8080"),
+		"Specify the URL of the Singularity server or its admin server. Defaults to $SINGULARITY_URL.")
+	token := flag.String("token", os.Getenv("SINGULARITY_TOKEN"),
+		"Specify the management token printed by the server at startup, or an operator token. Defaults to $SINGULARITY_TOKEN.")
+	timeout := flag.Duration("timeout", 30*time.Second, "Specify the timeout of requests to the server.")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &client{baseURL: *baseURL, token: *token, http: &http.Client{Timeout: *timeout}}
+	commands := map[string]func(*client, []string) error{
+		"sessions":       listSessions,
+		"session":        showSession,
+		"session-reset":  resetSession,
+		"session-delete": deleteSession,
+		"events":         tailEvents,
+		"attack":         attack,
+		"loot":           listLoot,
+		"loot-get":       getLoot,
+		"servers":        listServers,
+		"server-start":   startServer,
+		"server-stop":    stopServer,
+	}
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err := command(c, flag.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "singularity-cli: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func envOrDefault(name string, value string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return value
+}
+
+// oneArg returns the single argument of a command
+func oneArg(args []string, name string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected a %v argument", name)
+	}
+	return args[0], nil
+}
+
+func listSessions(c *client, args []string) error {
+	sessions := []session{}
+	if err := c.do("GET", "/api/sessions", nil, &sessions); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SESSION\tSTRATEGY\tFIRST HOST\tREBOUND HOST\tREBOUND\tQUERIES\tLAST QUERY")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", s.Session, s.Strategy, s.ResponseIPAddr,
+			s.ResponseReboundIPAddr, s.Rebound, s.QueryCount, formatTime(s.LastQueryTime))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// printJSON prints the raw JSON response of a request
+func printJSON(c *client, method string, path string) error {
+	var out json.RawMessage
+	if err := c.do(method, path, nil, &out); err != nil {
+		return err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, out, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(indented.String())
+	return nil
+}
+
+func showSession(c *client, args []string) error {
+	id, err := oneArg(args, "session")
+	if err != nil {
+		return err
+	}
+	return printJSON(c, "GET", "/api/sessions/"+url.PathEscape(id))
+}
+
+func resetSession(c *client, args []string) error {
+	id, err := oneArg(args, "session")
+	if err != nil {
+		return err
+	}
+	return c.do("POST", "/api/sessions/"+url.PathEscape(id)+"/reset", nil, nil)
+}
+
+func deleteSession(c *client, args []string) error {
+	id, err := oneArg(args, "session")
+	if err != nil {
+		return err
+	}
+	return c.do("DELETE", "/api/sessions/"+url.PathEscape(id), nil, nil)
+}
+
+// tailEvents polls the sessions of the server and prints
+// new, rebound and expired sessions
+func tailEvents(c *client, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	interval := fs.Duration("interval", time.Second, "Specify how often sessions are polled.")
+	fs.Parse(args)
+
+	known := map[string]session{}
+	for first := true; ; first = false {
+		sessions := []session{}
+		if err := c.do("GET", "/api/sessions", nil, &sessions); err != nil {
+			return err
+		}
+		current := map[string]session{}
+		for _, s := range sessions {
+			current[s.Session] = s
+			previous, ok := known[s.Session]
+			switch {
+			case !ok && !first:
+				printEvent("session", s, fmt.Sprintf("%v -> %v", s.ResponseIPAddr, s.ResponseReboundIPAddr))
+			case ok && s.Rebound && !previous.Rebound:
+				printEvent("rebound", s, strings.Join(s.LastAnswers, ","))
+			}
+		}
+		ids := []string{}
+		for id := range known {
+			if _, ok := current[id]; !ok {
+				ids = append(ids, id)
+			}
+		}
+		sort.Strings(ids)
+		for _, id := range ids {
+			printEvent("expired", known[id], "")
+		}
+		known = current
+		time.Sleep(*interval)
+	}
+}
+
+func printEvent(event string, s session, details string) {
+	fmt.Printf("%v %-8v session=%v strategy=%v %v\n", time.Now().Format(time.RFC3339), event,
+		s.Session, s.Strategy, details)
+}
+
+// attack launches an attack with the attacks API
+// and prints the URL to make a victim browse to.
+func attack(c *client, args []string) error {
+	fs := flag.NewFlagSet("attack", flag.ExitOnError)
+	domain := fs.String("domain", "", "Specify the attack domain, the first allowed domain of the server if not set.")
+	strategy := fs.String("strategy", "fs", "Specify the DNS rebinding strategy, e.g. fs, ma, rr or qc.")
+	port := fs.Int("port", 80, "Specify the port of the target service, which the attack origin uses.")
+	scheme := fs.String("scheme", "", "Specify the scheme of the attack origin, http or https.")
+	payload := fs.String("payload", "", "Specify the attack payload, \"Simple Fetch Get\" if not set.")
+	interval := fs.Int("interval", 0, "Specify the seconds between rebinding checks of the victim, 20 if not set.")
+	sessionID := fs.String("session", "", "Specify the session, random if not set.")
+	var variables stringsFlag
+	fs.Var(&variables, "var", "Specify a payload variable as NAME=VALUE. Repeat this flag to set more than one variable.")
+	fs.Parse(args)
+
+	target, err := oneArg(fs.Args(), "target")
+	if err != nil {
+		return err
+	}
+	spec := singularity.AttackSpec{Target: target, Port: *port, Strategy: *strategy, Payload: *payload,
+		Interval: *interval, Scheme: *scheme, Domain: *domain, Session: *sessionID}
+	for _, v := range variables {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("invalid variable %q: expected NAME=VALUE", v)
+		}
+		if spec.Variables == nil {
+			spec.Variables = map[string]string{}
+		}
+		spec.Variables[kv[0]] = kv[1]
+	}
+
+	launched := singularity.Attack{}
+	if err := c.do("POST", "/api/attacks", spec, &launched); err != nil {
+		return err
+	}
+	if launched.ServerStarted {
+		fmt.Fprintf(os.Stderr, "started a dynamic HTTP server on port %v\n", launched.Port)
+	}
+	fmt.Fprintf(os.Stderr, "session %v\n", launched.Session)
+	fmt.Println(launched.URL)
+	return nil
+}
+
+func listLoot(c *client, args []string) error {
+	fs := flag.NewFlagSet("loot", flag.ExitOnError)
+	sessionID := fs.String("session", "", "List the loot of this session only.")
+	fs.Parse(args)
+
+	path := "/api/loot"
+	if *sessionID != "" {
+		path += "?session=" + url.QueryEscape(*sessionID)
+	}
+	items := []loot{}
+	if err := c.do("GET", path, nil, &items); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSESSION\tTIME\tSIZE\tTYPE\tURL")
+	for _, l := range items {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\n", l.ID, l.Session, formatTime(l.Time), l.Size,
+			l.ContentType, l.URL)
+	}
+	return tw.Flush()
+}
+
+func getLoot(c *client, args []string) error {
+	fs := flag.NewFlagSet("loot-get", flag.ExitOnError)
+	output := fs.String("o", "", "Write the data to this file instead of the standard output.")
+	fs.Parse(args)
+
+	id, err := oneArg(fs.Args(), "loot")
+	if err != nil {
+		return err
+	}
+	resp, err := c.send("GET", "/api/loot/"+url.PathEscape(id)+"/download", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func listServers(c *client, args []string) error {
+	config := serversConfig{}
+	if err := c.do("GET", "/servers", nil, &config); err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PORT\tSCHEME\tSESSION")
+	for _, s := range config.ServerInformation {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", s.Port, s.Scheme, s.Session)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("dynamic servers allowed: %v\n", config.AllowDynamicHTTPServers)
+	return nil
+}
+
+func startServer(c *client, args []string) error {
+	fs := flag.NewFlagSet("server-start", flag.ExitOnError)
+	scheme := fs.String("scheme", "http", "Specify the scheme of the server, http or https.")
+	keepAlive := fs.Bool("keepAlive", false, "Keep connections alive.")
+	fs.Parse(args)
+
+	s := server{Scheme: *scheme, KeepAlive: *keepAlive}
+	if fs.NArg() > 1 {
+		return errors.New("expected at most a port argument")
+	}
+	// without port, the server picks a free one of its dynamic server ports
+	if fs.NArg() == 1 {
+		s.Port = fs.Arg(0)
+	}
+	started := server{}
+	if err := c.do("PUT", "/servers", s, &started); err != nil {
+		return err
+	}
+	fmt.Printf("started %v server on port %v\n", started.Scheme, started.Port)
+	return nil
+}
+
+func stopServer(c *client, args []string) error {
+	port, err := oneArg(args, "port")
+	if err != nil {
+		return err
+	}
+	return c.do("DELETE", "/servers", server{Port: port}, nil)
+}
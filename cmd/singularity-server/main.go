@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/nccgroup/singularity"
-
-	"github.com/miekg/dns"
+	bolt "go.etcd.io/bbolt"
 )
 
 type arrayPortFlags []int
@@ -19,42 +25,322 @@ func (a *arrayPortFlags) String() string {
 	return fmt.Sprintf("%T", a)
 }
 
+// Set accepts a port, or a list of ports and port ranges (e.g. "80,8000-8010")
 func (a *arrayPortFlags) Set(value string) error {
-	i, err := strconv.Atoi(value)
+	ports, err := singularity.ParsePortsSpec(value)
+	if err != nil {
+		return err
+	}
+	for _, port := range ports {
+		if !a.contains(port) {
+			*a = append(*a, port)
+		}
+	}
+	return nil
+}
+
+func (a *arrayPortFlags) contains(port int) bool {
+	for _, p := range *a {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+type arrayStringFlags []string
+
+func (a *arrayStringFlags) String() string {
+	return fmt.Sprintf("%T", a)
+}
+
+func (a *arrayStringFlags) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+type staticRecordFlags []singularity.StaticDNSRecord
+
+func (a *staticRecordFlags) String() string {
+	return fmt.Sprintf("%T", a)
+}
+
+// Set accepts a record written as "<name> [<ttl>] <type> <value>"
+func (a *staticRecordFlags) Set(value string) error {
+	record, err := singularity.ParseStaticDNSRecord(value)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, record)
+	return nil
+}
+
+type operatorFlags []singularity.Operator
+
+func (a *operatorFlags) String() string {
+	return fmt.Sprintf("%T", a)
+}
+
+// Set accepts an operator written as "<name>:<token>[:<max dynamic servers>]"
+func (a *operatorFlags) Set(value string) error {
+	op, err := singularity.ParseOperator(value)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, op)
+	return nil
+}
+
+type ignoreDNSRequestFromFlags struct {
+	ips  []net.IP
+	nets []*net.IPNet
+}
+
+func (a *ignoreDNSRequestFromFlags) String() string {
+	return fmt.Sprintf("%T", a)
+}
+
+func (a *ignoreDNSRequestFromFlags) Set(value string) error {
+	if strings.Contains(value, "/") {
+		_, ipNet, err := net.ParseCIDR(value)
+		if err != nil {
+			return err
+		}
+		a.nets = append(a.nets, ipNet)
+		return nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return fmt.Errorf("invalid IP address: %v", value)
+	}
+	a.ips = append(a.ips, ip)
+	return nil
+}
+
+type ipNetFlags []*net.IPNet
+
+func (a *ipNetFlags) String() string {
+	return fmt.Sprintf("%T", a)
+}
+
+// Set accepts a CIDR network or a single IP address
+func (a *ipNetFlags) Set(value string) error {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address: %v", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		*a = append(*a, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(value)
 	if err != nil {
-		log.Fatal("Could not convert port number string to int")
+		return err
 	}
-	*a = append(*a, i)
+	*a = append(*a, ipNet)
+	return nil
+}
+
+type responseHeaderFlags map[string]string
+
+func (a responseHeaderFlags) String() string {
+	return fmt.Sprintf("%T", a)
+}
+
+func (a responseHeaderFlags) Set(value string) error {
+	split := strings.SplitN(value, ":", 2)
+	if len(split) != 2 || strings.TrimSpace(split[0]) == "" {
+		return fmt.Errorf("invalid header, expected \"Name: value\": %v", value)
+	}
+	a[strings.TrimSpace(split[0])] = strings.TrimSpace(split[1])
 	return nil
 }
 
 // Parse command line arguments and capture these into a runtime structure
-func initFromCmdLine() *singularity.AppConfig {
-	var appConfig = singularity.AppConfig{}
+func initFromCmdLine() (*singularity.AppConfig, string, string) {
+	defaults := singularity.DefaultAppConfig()
+	var appConfig = *defaults
 	var myArrayPortFlags arrayPortFlags
+	var myIgnoreDNSRequestFromFlags ignoreDNSRequestFromFlags
+	var myHTTPSArrayPortFlags arrayPortFlags
+	var myResponseHeaderFlags = responseHeaderFlags{}
+	var myAllowedDomainFlags arrayStringFlags
+	var myNameServerFlags arrayStringFlags
+	var myStaticRecordFlags staticRecordFlags
+	var myOperatorFlags operatorFlags
+	var myWebhookEventFlags arrayStringFlags
+	var myTProxyRelayPortFlags arrayPortFlags
+	myTProxyExcludePortFlags := append(arrayPortFlags(nil), defaults.LinuxTProxyExcludePorts...)
+	var myAllowHTTPClientsFromFlags ipNetFlags
+	var myAdminAllowedFromFlags ipNetFlags
+	var myKeepAlivePortFlags arrayPortFlags
+	var myDynamicPortFlags arrayPortFlags
 
-	var responseIPAddr = flag.String("ResponseIPAddr", "192.168.0.1",
+	var responseIPAddr = flag.String("ResponseIPAddr", defaults.ResponseIPAddr,
 		"Specify the attacker host IP address that will be rebound to the victim host address using strategy specified by flag \"-DNSRebingStrategy\"")
-	var responseReboundIPAddr = flag.String("ResponseReboundIPAddr", "127.0.0.1",
+	var responseReboundIPAddr = flag.String("ResponseReboundIPAddr", defaults.ResponseReboundIPAddr,
 		"Specify the victim host IP address that is rebound from the attacker host address")
-	var responseReboundIPAddrtimeOut = flag.Int("responseReboundIPAddrtimeOut", 300,
+	var responseReboundIPAddrtimeOut = flag.Int("responseReboundIPAddrtimeOut", defaults.ResponseReboundIPAddrtimeOut,
 		"Specify delay (s) for which we will keep responding with Rebound IP Address after last query. After delay, we will respond with  ResponseReboundIPAddr.")
 	var dangerouslyAllowDynamicHTTPServers = flag.Bool("dangerouslyAllowDynamicHTTPServers", false, "DANGEROUS if the flag is set (to anything). Specify if any target can dynamically request Singularity to allocate an HTTP Server on a new port.")
-	var WsHttpProxyServerPort = flag.Int("WsHttpProxyServerPort", 3129,
+	var WsHttpProxyServerPort = flag.Int("WsHttpProxyServerPort", defaults.WsHTTPProxyServerPort,
 		"Specify the attacker HTTP Proxy Server and Websockets port that permits to browse hijacked client services.")
+	var adminAddr = flag.String("adminAddr", "",
+		"Specify the address (e.g. 127.0.0.1:8090) of a dedicated HTTP server for management endpoints (/servers, /sessionpayloads, /metrics and /api/*) and the manager interface. Attack servers then no longer serve management endpoints. Not set by default.")
+	var gRPCAddr = flag.String("gRPCAddr", "",
+		"Specify the address (e.g. 127.0.0.1:8091) of the gRPC control API server (proto/singularity.proto). Authenticate with the temporary secret or an operator token as bearer token in the \"authorization\" metadata. Disabled if not set.")
+	var SOCKSBridgeAddr = flag.String("SOCKSBridgeAddr", "",
+		"Specify the address (e.g. 127.0.0.1:1080) of a SOCKS5 server relaying HTTP requests of local tools through hijacked clients. Authenticate with any username and the temporary secret as password. Disabled if not set.")
 	var enableLinuxTProxySupport = flag.Bool("enableLinuxTProxySupport", false, "Specify whether to enable Linux TProxy support or not. Useful to listen on many ports with an appropriate iptables configuration.")
-	flag.Var(&myArrayPortFlags, "HTTPServerPort", "Specify the attacker HTTP Server port that will serve HTML/JavaScript files. Repeat this flag to listen on more than one HTTP port.")
-	var dnsServerBindAddr = flag.String("DNSServerBindAddr", "0.0.0.0", "Specify the IP address the DNS server will bind to, defaults to 0.0.0.0")
+	flag.Var(&myArrayPortFlags, "HTTPServerPort", "Specify the attacker HTTP Server port that will serve HTML/JavaScript files. Repeat this flag or use a list of ports and ranges (e.g. 80,8000-8010) to listen on more than one HTTP port.")
+	var dnsServerBindAddr = flag.String("DNSServerBindAddr", defaults.DNSServerBindAddr, "Specify the IP address the DNS server will bind to, defaults to 0.0.0.0")
+	var maxSessions = flag.Int("maxSessions", defaults.MaxSessions,
+		"Specify the maximum number of DNS sessions kept in memory. The least recently active sessions are evicted first. 0 for no limit.")
+	var webhookURL = flag.String("webhookURL", "",
+		"Specify a URL notified with a JSON POST request on DNS session events, e.g. when a session first serves the rebound host.")
+	flag.Var(&myWebhookEventFlags, "webhookEvent", "Specify a DNS session event notified to the webhook URL: session, rebinding, firewall or callback. Repeat this flag to notify more than one event. All events are notified if not set.")
+	var htmlDir = flag.String("htmlDir", "",
+		"Specify a directory (e.g. \"./html\") to serve the manager interface and payloads from instead of the copies compiled into the binary, e.g. while developing payloads.")
+	var useEmbeddedAssets = flag.Bool("useEmbeddedAssets", defaults.UseEmbeddedAssets,
+		"Deprecated: the manager interface and payloads compiled into the binary are served unless \"-htmlDir\" is set. \"-useEmbeddedAssets=false\" is the same as \"-htmlDir ./html\".")
+	var payloadCacheSeconds = flag.Int("payloadCacheSeconds", 0,
+		"Specify the time (s) payloads are cached before being read again. 0 caches payloads until restart. Payloads served from \"-htmlDir\" are also read again once changed.")
+	flag.Var(&myKeepAlivePortFlags, "keepAliveHTTPServerPort", "Specify an HTTP(S) server port that keeps connections alive, e.g. for payloads requiring persistent connections. Repeat this flag or use a list of ports and ranges to specify more than one port. Other servers drop connections to facilitate rebinding.")
+	var refuseNonSingularityQueries = flag.Bool("refuseNonSingularityQueries", defaults.RefuseNonSingularityQueries,
+		"Refuse all DNS queries for names that are not Singularity names, e.g. QNAME minimization queries. Otherwise they are answered with \"-ResponseIPAddr\" and names outside \"-allowedDomain\" are refused.")
+	var maxRequestBodyBytes = flag.Int("maxRequestBodyBytes", defaults.MaxRequestBodyBytes,
+		"Specify the maximum size in bytes of request bodies accepted by the management endpoints, e.g. /servers")
+	var selfTest = flag.Bool("selfTest", false,
+		"Check at startup that the DNS and HTTP(S) servers answer locally and that \"-ResponseIPAddr\" is assigned to a local interface")
+	var enableHTTP2 = flag.Bool("enableHTTP2", false,
+		"Specify whether attack servers serve HTTP/2: h2 on HTTPS servers and h2c on HTTP servers. Idle HTTP/2 connections are closed after 1s on ports without keep-alives.")
+	var enableHTTP3 = flag.Bool("enableHTTP3", false,
+		"Specify whether HTTPS attack servers also serve HTTP/3 (QUIC) on the same UDP port, advertised with Alt-Svc headers. Idle QUIC connections are closed after 1s on ports without keep-alives. The multiple A records strategy requires HTTP/1.1.")
+	var enableDNSOverHTTPS = flag.Bool("enableDNSOverHTTPS", false,
+		"Answer DNS-over-HTTPS queries (RFC 8484) on /dns-query of the HTTP(S) servers, sharing DNS sessions with the DNS server. Use with \"-HTTPSServerPort\" for resolvers and browsers.")
+	var enableDNSOverTLS = flag.Bool("enableDNSOverTLS", false,
+		"Start a DNS-over-TLS server sharing DNS sessions with the DNS server. Requires flags \"-DNSOverTLSCertFile\" and \"-DNSOverTLSKeyFile\".")
+	var dnsOverTLSPort = flag.Int("DNSOverTLSPort", defaults.DNSOverTLSPort, "Specify the TCP port the DNS-over-TLS server will listen on")
+	var dnsOverTLSCertFile = flag.String("DNSOverTLSCertFile", "", "Specify the DNS-over-TLS server certificate file in PEM format")
+	var dnsOverTLSKeyFile = flag.String("DNSOverTLSKeyFile", "", "Specify the DNS-over-TLS server private key file in PEM format")
+	var logFormat = flag.String("logFormat", defaults.LogFormat,
+		"Specify the log format: text, or json to ship logs to a log collector")
+	var logLevel = flag.String("logLevel", defaults.LogLevel, "Specify the minimum level of logged events: debug, info, warn or error")
+	var acmeChallengeDir = flag.String("ACMEChallengeDir", "",
+		"Answer ACME HTTP-01 and DNS-01 challenges from files written in this directory by an external ACME client (e.g. certbot), "+
+			"to obtain certificates for the HTTPS servers. Certificate files are reloaded when renewed.")
+	var lootDir = flag.String("lootDir", "",
+		"Specify a directory where data captured by payloads and POSTed to /api/loot is persisted. Data is kept in memory only if neither this flag nor \"-lootStoreFile\" is set.")
+	var lootStoreFile = flag.String("lootStoreFile", "",
+		"Specify a BoltDB database file where data captured by payloads is persisted instead of \"-lootDir\". It may be the \"-sessionStoreFile\" database.")
+	var lootMaxSizeMB = flag.Int("lootMaxSizeMB", defaults.LootMaxSizeMB,
+		"Specify the maximum size (MB) of all loot. Loot beyond is rejected. 0 for no limit.")
+	var lootMaxSessionSizeMB = flag.Int("lootMaxSessionSizeMB", defaults.LootMaxSessionSizeMB,
+		"Specify the maximum size (MB) of the loot of a DNS session. Loot beyond is rejected. 0 for no limit.")
+	var dnsAuditLogFile = flag.String("DNSAuditLogFile", "",
+		"Specify a file to which every DNS query and the answer served are appended as JSON lines, e.g. for post-engagement reporting. Disabled if not set.")
+	var dnsAuditLogMaxSizeMB = flag.Int("DNSAuditLogMaxSizeMB", defaults.DNSAuditLogMaxSizeMB,
+		"Specify the size (MB) beyond which the DNS audit log file is rotated.")
+	var dnsAuditLogMaxBackups = flag.Int("DNSAuditLogMaxBackups", defaults.DNSAuditLogMaxBackups,
+		"Specify how many rotated DNS audit log files are kept.")
+	var dnsRateLimit = flag.Int("DNSRateLimit", 0,
+		"Specify the maximum number of DNS queries a client IP address can make per interval. Queries beyond are dropped. 0 disables rate limiting.")
+	var dnsRateLimitInterval = flag.Int("DNSRateLimitInterval", defaults.DNSRateLimitInterval,
+		"Specify the interval (s) over which DNS queries are rate limited.")
+	var sessionStoreFile = flag.String("sessionStoreFile", "",
+		"Save DNS sessions to this file periodically and restore them at startup so that rebinding state survives restarts. The file is a BoltDB database, or a JSON document if it has the \".json\" extension.")
+	var payloadPath = flag.String("payloadPath", defaults.PayloadPath,
+		"Specify the HTTP path serving the attack payload, e.g. to evade URL blocklists. The manager interface learns it from /servers.")
+	flag.Var(&myAllowedDomainFlags, "allowedDomain", "Specify a domain (e.g. rebind.it) for which DNS queries are answered. Repeat this flag to allow more than one domain. All domains are allowed if not set.")
+	flag.Var(&myStaticRecordFlags, "staticRecord", "Specify a fixed DNS answer as \"<name> [<ttl>] <type> <value>\" (e.g. \"www.rebind.it A 1.2.3.4\"), of type A, AAAA, CNAME or TXT. The name may start with \"*.\" to match any name under a domain except Singularity names. Repeat this flag to specify more than one record.")
+	flag.Var(&myOperatorFlags, "operator", "Share the instance with an operator specified as \"<name>:<token>[:<max dynamic servers>]\" (e.g. \"alice:s3cret:2\"). Operators manage the DNS sessions named \"<name>_<id>\" with their token, and the dynamic HTTP servers they start. Repeat this flag to specify more than one operator.")
+	var staticZoneFile = flag.String("staticZoneFile", "",
+		"Specify a file of fixed DNS answers, one per line in the format of \"-staticRecord\". Lines starting with \"#\" are ignored. Overrides \"StaticZoneFile\" of \"-config\". The file is read again on SIGHUP.")
+	flag.Var(&myNameServerFlags, "nameServer", "Specify a name server (e.g. ns.rebind.it) of the allowed domains returned in NS and SOA records. Repeat this flag to specify more than one name server. Defaults to \"ns.<domain>\".")
+	var linuxTProxyPortRange = flag.String("linuxTProxyPortRange", "",
+		"Specify external ports (e.g. \"1-65535\") redirected to the first HTTP server port with Linux TProxy. The iptables and policy routing rules are installed at startup and removed at shutdown. Requires \"-enableLinuxTProxySupport\".")
+	flag.Var(&myTProxyExcludePortFlags, "linuxTProxyExcludePort", "Specify a port (e.g. SSH) that is not redirected by \"-linuxTProxyPortRange\". Repeat this flag to exclude more than one port. Port 22 and the ports of the other Singularity listeners (HTTP(S), dynamic, proxy, admin, SOCKS and DNS-over-TLS servers) are always excluded.")
+	var linuxTProxyRulesDryRun = flag.Bool("linuxTProxyRulesDryRun", false,
+		"Log the TProxy rules of \"-linuxTProxyPortRange\" instead of installing them.")
+	flag.Var(&myTProxyRelayPortFlags, "linuxTProxyRelayPort", "Specify a port for which connections intercepted with Linux TProxy are relayed to their original destination on this host instead of being served by Singularity. Repeat this flag to relay more than one port. Requires \"-enableLinuxTProxySupport\".")
+	var rebindJitterMs = flag.Int("rebindJitterMs", 0,
+		"Specify a window (ms) within which the first then second timeout and round robin rotation are randomly perturbed. 0 disables jitter.")
+	var dnsServerPort = flag.Int("DNSServerPort", defaults.DNSServerPort, "Specify the UDP port the DNS server will listen on, defaults to 53")
+	flag.Var(&myIgnoreDNSRequestFromFlags, "ignoreDNSRequestFrom", "Specify an IP address or CIDR network (e.g. 10.0.0.0/8) from which DNS requests are ignored. Repeat this flag to ignore more than one address or network.")
+	flag.Var(&myAllowHTTPClientsFromFlags, "allowHTTPClientsFrom", "Specify an IP address or CIDR network (e.g. 10.0.0.0/8) from which HTTP requests are served. All clients are served if not set. Repeat this flag to allow more than one address or network.")
+	flag.Var(&myAdminAllowedFromFlags, "adminAllowedFrom", "Specify an IP address or CIDR network (e.g. 127.0.0.1) from which management endpoints (/servers, /sessionpayloads, /metrics and /api/*) are served. Note that the manager interface running in target browsers uses /servers. All clients are served if not set. Repeat this flag to allow more than one address or network.")
+	var mapV4ToV6 = flag.Bool("mapV4ToV6", false,
+		"Answer AAAA queries with IPv4-mapped IPv6 addresses (::ffff:a.b.c.d) to rebind targets that only resolve AAAA records to IPv4 hosts")
+	flag.Var(&myHTTPSArrayPortFlags, "HTTPSServerPort", "Specify the attacker HTTPS Server port that will serve HTML/JavaScript files over TLS. Repeat this flag to listen on more than one HTTPS port. Requires flags \"-HTTPSCertFile\" and \"-HTTPSKeyFile\", or \"-ACMEAutocertCacheDir\".")
+	var httpsCertFile = flag.String("HTTPSCertFile", "", "Specify the PEM encoded certificate file of the HTTPS servers.")
+	var httpsKeyFile = flag.String("HTTPSKeyFile", "", "Specify the PEM encoded private key file of the HTTPS servers.")
+	var acmeAutocertCacheDir = flag.String("ACMEAutocertCacheDir", "",
+		"Obtain the certificates of the HTTPS servers from Let's Encrypt and cache them in this directory, instead of \"-HTTPSCertFile\" and \"-HTTPSKeyFile\". "+
+			"Requires \"-allowedDomain\" and an HTTPS server reachable on port 443. Each DNS rebinding host name needs its own certificate, within the Let's Encrypt rate limits.")
+	var acmeEmail = flag.String("ACMEEmail", "", "Specify the contact email of the Let's Encrypt account of \"-ACMEAutocertCacheDir\".")
+	flag.Var(myResponseHeaderFlags, "customResponseHeader", "Specify a header added to HTTP responses e.g. \"Access-Control-Allow-Origin: *\". Overrides default headers. Repeat this flag to add more than one header.")
+	var dynamicHTTPServersRateLimit = flag.Int("dynamicHTTPServersRateLimit", defaults.DynamicHTTPServersRateLimit,
+		"Specify the maximum number of dynamic HTTP server requests a client IP address can make per interval. 0 disables rate limiting.")
+	var dynamicHTTPServersRateLimitInterval = flag.Int("dynamicHTTPServersRateLimitInterval", defaults.DynamicHTTPServersRateLimitInterval,
+		"Specify the interval (s) over which dynamic HTTP server requests are rate limited.")
+	var dynamicHTTPServersPoolSize = flag.Int("dynamicHTTPServersPoolSize", defaults.DynamicHTTPServersPoolSize,
+		"Specify the maximum number of dynamic HTTP servers running at once, e.g. one per concurrent target. The oldest server is stopped when the pool is full.")
+	var dynamicHTTPServersPerSession = flag.Int("dynamicHTTPServersPerSession", defaults.DynamicHTTPServersPerSession,
+		"Specify the maximum number of dynamic HTTP servers a target can request from its DNS session. Servers of a session are stopped when it expires. 0 for no limit.")
+	flag.Var(&myDynamicPortFlags, "dynamicHTTPServerPorts", "Specify the ports or port ranges (e.g. 8000-8010) dynamic HTTP servers may listen on. Servers requested without a port get the first free one. Any port if not set.")
+	var delayDOMLoadSeconds = flag.Int("delayDOMLoadSeconds", defaults.DelayDOMLoadSeconds,
+		"Specify the delay (s) for which the /delaydomload endpoint holds browser connections open to delay the DOM load event.")
+	var firewallRuleDurationSeconds = flag.Int("firewallRuleDurationSeconds", defaults.FirewallRuleDurationSeconds,
+		"Specify the duration (s) of firewall rules blocking browsers in the multiple A records DNS rebinding strategy.")
+	var firewallBackend = flag.String("firewallBackend", defaults.FirewallBackend,
+		"Specify the firewall used by the multiple A records DNS rebinding strategy: "+
+			strings.Join(singularity.ListFirewallBackends(), ", ")+", or auto to select the first available one.")
+	var firewallSourcePortRange = flag.Int("firewallSourcePortRange", 0,
+		"Specify how many source ports above the browser connection port firewall rules match in the multiple A records DNS rebinding strategy, or 0 for all source ports.")
+	var firewallDryRun = flag.Bool("firewallDryRun", false,
+		"Specify whether to log firewall rules instead of applying them, e.g. for testing.")
+	var configFile string
+	flag.StringVar(&configFile, "config", "",
+		"Specify a JSON or YAML (.yaml, .yml) configuration file. Other command line parameters except \"-staticZoneFile\" are rejected when set.")
+	var deprecatedConfigFile = flag.String("configFile", "", "Deprecated: use \"-config\".")
+	var protectServersEndpoint = flag.Bool("protectServersEndpoint", false,
+		"Deprecated: management endpoints always require the temporary secret unless \"-dangerouslyDisableAdminAuth\" is set.")
+	var dangerouslyDisableAdminAuth = flag.Bool("dangerouslyDisableAdminAuth", false,
+		"DANGEROUS if the flag is set. Specify whether management endpoints (/servers, /sessionpayloads, /metrics and /api/*) are served without the temporary secret, e.g. behind an authenticating reverse proxy. Otherwise clients such as the manager interface must supply it as a bearer token or basic auth password.")
 
 	flag.Parse()
 	flagset := make(map[string]bool)
 	flag.Visit(func(f *flag.Flag) { flagset[f.Name] = true })
 
-	appConfig.RebindingFn = singularity.DNSRebindFromQueryFirstThenSecond
-	appConfig.RebindingFnName = "fs"
+	if flagset["configFile"] {
+		log.Printf("Main: -configFile is deprecated, use -config\n")
+		if flagset["config"] {
+			log.Fatalf("Main: \"-configFile\" cannot be combined with \"-config\"")
+		}
+		configFile = *deprecatedConfigFile
+	}
+
+	if configFile != "" {
+		// the configuration file replaces the other parameters
+		for name := range flagset {
+			if name != "config" && name != "configFile" && name != "staticZoneFile" {
+				log.Fatalf("Main: \"-%v\" cannot be combined with a configuration file, set it in %v instead", name, configFile)
+			}
+		}
+		fileConfig, err := loadConfigFile(configFile, *staticZoneFile)
+		if err != nil {
+			log.Fatalf("Main: could not load configuration: %v", err)
+		}
+		return fileConfig, configFile, *staticZoneFile
+	}
 
 	if !flagset["HTTPServerPort"] {
-		myArrayPortFlags = arrayPortFlags{8080}
+		myArrayPortFlags = defaults.HTTPServerPorts
 	}
 
 	appConfig.ResponseIPAddr = *responseIPAddr
@@ -63,76 +349,421 @@ func initFromCmdLine() *singularity.AppConfig {
 	appConfig.HTTPServerPorts = myArrayPortFlags
 	appConfig.AllowDynamicHTTPServers = *dangerouslyAllowDynamicHTTPServers
 	appConfig.DNSServerBindAddr = *dnsServerBindAddr
+	appConfig.DNSServerPort = *dnsServerPort
+	appConfig.MaxSessions = *maxSessions
+	appConfig.WebhookURL = *webhookURL
+	appConfig.WebhookEvents = myWebhookEventFlags
+	appConfig.HTMLDir = *htmlDir
+	appConfig.UseEmbeddedAssets = *useEmbeddedAssets
+	if flagset["useEmbeddedAssets"] {
+		log.Printf("Main: -useEmbeddedAssets is deprecated, use -htmlDir to serve assets from a directory\n")
+		if !*useEmbeddedAssets && appConfig.HTMLDir == "" {
+			appConfig.HTMLDir = "./html"
+		}
+	}
+	appConfig.PayloadCacheSeconds = *payloadCacheSeconds
+	appConfig.PayloadPath = *payloadPath
+	appConfig.SelfTest = *selfTest
+	appConfig.EnableDNSOverHTTPS = *enableDNSOverHTTPS
+	appConfig.EnableHTTP2 = *enableHTTP2
+	appConfig.EnableHTTP3 = *enableHTTP3
+	appConfig.EnableDNSOverTLS = *enableDNSOverTLS
+	appConfig.DNSOverTLSPort = *dnsOverTLSPort
+	appConfig.DNSOverTLSCertFile = *dnsOverTLSCertFile
+	appConfig.DNSOverTLSKeyFile = *dnsOverTLSKeyFile
+	appConfig.MaxRequestBodyBytes = *maxRequestBodyBytes
+	appConfig.RefuseNonSingularityQueries = *refuseNonSingularityQueries
+	appConfig.KeepAliveHTTPServerPorts = myKeepAlivePortFlags
+	appConfig.SessionStoreFile = *sessionStoreFile
+	appConfig.DNSAuditLogFile = *dnsAuditLogFile
+	appConfig.DNSAuditLogMaxSizeMB = *dnsAuditLogMaxSizeMB
+	appConfig.DNSAuditLogMaxBackups = *dnsAuditLogMaxBackups
+	appConfig.DNSRateLimit = *dnsRateLimit
+	appConfig.DNSRateLimitInterval = *dnsRateLimitInterval
+	appConfig.LootDir = *lootDir
+	appConfig.LootStoreFile = *lootStoreFile
+	appConfig.LootMaxSizeMB = *lootMaxSizeMB
+	appConfig.LootMaxSessionSizeMB = *lootMaxSessionSizeMB
+	appConfig.LogFormat = *logFormat
+	appConfig.LogLevel = *logLevel
+	appConfig.ACMEChallengeDir = *acmeChallengeDir
+	appConfig.AllowedDomains = myAllowedDomainFlags
+	appConfig.NameServers = myNameServerFlags
+	appConfig.StaticRecords = myStaticRecordFlags
+	appConfig.StaticZoneFile = *staticZoneFile
+	if err := appConfig.ReadStaticZoneFile(); err != nil {
+		log.Fatalf("Main: could not load static zone file: %v", err)
+	}
+	appConfig.LinuxTProxyRelayPorts = myTProxyRelayPortFlags
+	appConfig.LinuxTProxyPortRange = *linuxTProxyPortRange
+	appConfig.LinuxTProxyExcludePorts = myTProxyExcludePortFlags
+	appConfig.LinuxTProxyRulesDryRun = *linuxTProxyRulesDryRun
+	appConfig.Operators = myOperatorFlags
+	appConfig.RebindJitterMs = *rebindJitterMs
+	appConfig.MapV4ToV6 = *mapV4ToV6
 	appConfig.WsHTTPProxyServerPort = *WsHttpProxyServerPort
+	appConfig.SOCKSBridgeAddr = *SOCKSBridgeAddr
+	appConfig.AdminAddr = *adminAddr
+	appConfig.GRPCAddr = *gRPCAddr
 	appConfig.EnableLinuxTProxySupport = *enableLinuxTProxySupport
+	appConfig.DynamicHTTPServersRateLimit = *dynamicHTTPServersRateLimit
+	appConfig.DynamicHTTPServersRateLimitInterval = *dynamicHTTPServersRateLimitInterval
+	appConfig.DynamicHTTPServersPoolSize = *dynamicHTTPServersPoolSize
+	appConfig.DynamicHTTPServerPorts = myDynamicPortFlags
+	appConfig.DynamicHTTPServersPerSession = *dynamicHTTPServersPerSession
+	appConfig.ProtectServersEndpoint = *protectServersEndpoint
+	if flagset["protectServersEndpoint"] {
+		log.Printf("Main: -protectServersEndpoint is deprecated, management endpoints always require the temporary secret\n")
+	}
+	appConfig.DisableAdminAuth = *dangerouslyDisableAdminAuth
+	appConfig.DelayDOMLoadSeconds = *delayDOMLoadSeconds
+	appConfig.FirewallRuleDurationSeconds = *firewallRuleDurationSeconds
+	appConfig.FirewallBackend = *firewallBackend
+	appConfig.FirewallDryRun = *firewallDryRun
+	appConfig.FirewallSourcePortRange = *firewallSourcePortRange
+	appConfig.IgnoreDNSRequestFrom = myIgnoreDNSRequestFromFlags.ips
+	appConfig.IgnoreDNSRequestFromCIDR = myIgnoreDNSRequestFromFlags.nets
+	appConfig.AllowHTTPClientsFrom = myAllowHTTPClientsFromFlags
+	appConfig.AdminAllowedFrom = myAdminAllowedFromFlags
+	appConfig.HTTPSServerPorts = myHTTPSArrayPortFlags
+	appConfig.HTTPSCertFile = *httpsCertFile
+	appConfig.ACMEAutocertCacheDir = *acmeAutocertCacheDir
+	appConfig.ACMEEmail = *acmeEmail
+	appConfig.HTTPSKeyFile = *httpsKeyFile
+	appConfig.CustomResponseHeaders = myResponseHeaderFlags
 
-	return &appConfig
+	return &appConfig, "", *staticZoneFile
+}
+
+// shutdownTimeout bounds how long in-flight requests are drained on shutdown
+const shutdownTimeout = 10 * time.Second
+
+// installedTProxyRules are the TProxy rules installed at startup, if any.
+// They outlive the process, so every exit path removes them with removeTProxyRules.
+var installedTProxyRules struct {
+	sync.Mutex
+	rules *singularity.LinuxTProxyRules
+}
+
+// removeTProxyRules removes the TProxy rules installed at startup, if not removed yet
+func removeTProxyRules() {
+	installedTProxyRules.Lock()
+	defer installedTProxyRules.Unlock()
+	if installedTProxyRules.rules == nil {
+		return
+	}
+	if err := installedTProxyRules.rules.Remove(); err != nil {
+		log.Printf("Main: could not remove TProxy rules: %v", err)
+	}
+	installedTProxyRules.rules = nil
+}
+
+// fatalf is log.Fatalf removing the TProxy rules before exiting
+func fatalf(format string, v ...interface{}) {
+	removeTProxyRules()
+	log.Fatalf(format, v...)
+}
+
+// loadConfigFile loads the configuration file at path, with the static
+// zone file of the command line, if set, instead of that of the configuration
+func loadConfigFile(path string, staticZoneFile string) (*singularity.AppConfig, error) {
+	fileConfig, err := singularity.LoadConfig(path)
+	if err != nil || staticZoneFile == "" {
+		return fileConfig, err
+	}
+	fileConfig.StaticZoneFile = staticZoneFile
+	if err := fileConfig.ReadStaticZoneFile(); err != nil {
+		return nil, fmt.Errorf("could not load static zone file: %v", err)
+	}
+	if err := singularity.ValidateAppConfig(fileConfig); err != nil {
+		return nil, err
+	}
+	return fileConfig, nil
 }
 
 func main() {
+	defer removeTProxyRules()
+
+	appConfig, configFile, staticZoneFile := initFromCmdLine()
+	if err := singularity.ValidateAppConfig(appConfig); err != nil {
+		fatalf("Main: invalid configuration: %v", err)
+	}
+	if err := singularity.ConfigureLogging(appConfig.LogFormat, appConfig.LogLevel); err != nil {
+		fatalf("Main: %v", err)
+	}
 
-	appConfig := initFromCmdLine()
 	authToken, err := singularity.GenerateRandomString()
 	if err != nil {
 		panic(fmt.Sprintf("could not generate a random number: %v", err))
 	}
 	fmt.Printf("Temporary secret: %v\n", authToken)
+	if appConfig.DisableAdminAuth && len(appConfig.Operators) == 0 {
+		log.Printf("Main: management endpoints are served without the temporary secret (-dangerouslyDisableAdminAuth)\n")
+	} else {
+		log.Printf("Main: management endpoints require the temporary secret as a bearer token or basic auth password\n")
+	}
+	appConfig.TXTRecords = singularity.NewTXTRecordStore()
+	appConfig.DNSRateLimiter = singularity.NewRateLimiter(appConfig.DNSRateLimit,
+		time.Duration(appConfig.DNSRateLimitInterval)*time.Second)
+	if appConfig.DNSAuditLogFile != "" {
+		appConfig.DNSAuditLog, err = singularity.NewDNSAuditLog(appConfig.DNSAuditLogFile,
+			int64(appConfig.DNSAuditLogMaxSizeMB)<<20, appConfig.DNSAuditLogMaxBackups)
+		if err != nil {
+			fatalf("Main: could not open DNS audit log: %v", err)
+		}
+		defer appConfig.DNSAuditLog.Close()
+	}
 	dcss := &singularity.DNSClientStateStore{Sessions: make(map[string]*singularity.DNSClientState)}
+	// BoltDB databases by path, shared by sessions and loot stored in the same file
+	databases := map[string]*bolt.DB{}
+	openDatabase := func(path string) *bolt.DB {
+		if databases[path] == nil {
+			db, err := singularity.OpenBoltDB(path)
+			if err != nil {
+				fatalf("Main: could not open database %v: %v", path, err)
+			}
+			databases[path] = db
+		}
+		return databases[path]
+	}
+	defer func() {
+		for _, db := range databases {
+			db.Close()
+		}
+	}()
+
+	var sessionPersister singularity.SessionPersister
+	if appConfig.SessionStoreFile != "" {
+		if strings.EqualFold(filepath.Ext(appConfig.SessionStoreFile), ".json") {
+			sessionPersister = &singularity.FileSessionPersister{Path: appConfig.SessionStoreFile}
+		} else {
+			sessionPersister = &singularity.BoltSessionPersister{DB: openDatabase(appConfig.SessionStoreFile)}
+		}
+		restored, err := dcss.RestoreSessions(sessionPersister)
+		if err != nil {
+			fatalf("Main: could not restore DNS sessions from %v: %v", appConfig.SessionStoreFile, err)
+		}
+		log.Printf("Main: restored %v DNS session(s) from %v", restored, appConfig.SessionStoreFile)
+	}
 	wscss := &singularity.WebsocketClientStateStore{Sessions: make(map[string]*singularity.WebsocketClientState)}
-	hss := &singularity.HTTPServerStoreHandler{DynamicServers: make([]*http.Server, 2),
+	hss := &singularity.HTTPServerStoreHandler{DynamicServers: make([]*http.Server, appConfig.DynamicHTTPServersPoolSize),
 		StaticServers:           make([]*http.Server, 1),
 		Errc:                    make(chan singularity.HTTPServerError, 1),
+		Firewallc:               make(chan singularity.FirewallRuleResult, 16),
 		AllowDynamicHTTPServers: appConfig.AllowDynamicHTTPServers,
 		Dcss:                    dcss,
 		Wscss:                   wscss,
 		WsHTTPProxyServerPort:   appConfig.WsHTTPProxyServerPort,
 		AuthToken:               authToken,
+		RateLimiter: singularity.NewRateLimiter(appConfig.DynamicHTTPServersRateLimit,
+			time.Duration(appConfig.DynamicHTTPServersRateLimitInterval)*time.Second),
+		ProtectServersEndpoint: appConfig.ProtectServersEndpoint,
+		DisableAdminAuth:       appConfig.DisableAdminAuth,
+		AppConfig:              appConfig,
+		SessionPayloads:        singularity.NewSessionPayloadStore(),
+	}
+	var loot *singularity.LootStore
+	if appConfig.LootStoreFile != "" {
+		loot, err = singularity.NewBoltLootStore(openDatabase(appConfig.LootStoreFile))
+	} else {
+		loot, err = singularity.NewLootStore(appConfig.LootDir)
+	}
+	if err != nil {
+		fatalf("Main: could not load loot: %v", err)
+	}
+	loot.MaxBytes = int64(appConfig.LootMaxSizeMB) << 20
+	loot.MaxSessionBytes = int64(appConfig.LootMaxSessionSizeMB) << 20
+	hss.Loot = loot
+	if configFile != "" {
+		hss.ReloadConfig = func() error {
+			newConfig, err := loadConfigFile(configFile, staticZoneFile)
+			if err != nil {
+				return err
+			}
+			appConfig.Reload(newConfig)
+			return nil
+		}
+	} else if staticZoneFile != "" {
+		hss.ReloadConfig = appConfig.ReloadStaticZoneFile
 	}
 
-	// Attach DNS handler function
-	dns.HandleFunc(".", singularity.MakeRebindDNSHandler(appConfig, dcss))
+	if appConfig.ACMEAutocertCacheDir != "" {
+		hss.TLSConfig = singularity.NewAutocertTLSConfig(appConfig.ACMEAutocertCacheDir, appConfig.ACMEEmail,
+			appConfig.AllowedDomains)
+	} else if appConfig.HTTPSCertFile != "" || appConfig.HTTPSKeyFile != "" {
+		hss.TLSConfig, err = singularity.NewTLSConfig(appConfig.HTTPSCertFile, appConfig.HTTPSKeyFile)
+		if err != nil {
+			fatalf("Main: could not load HTTPS certificate: %v", err)
+		}
+	}
+
+	if !appConfig.FirewallDryRun {
+		if backend, err := singularity.LookupFirewallBackend(appConfig.FirewallBackend); err != nil {
+			log.Printf("Main: the multiple A records strategy will not work: %v", err)
+		} else {
+			log.Printf("Main: using firewall backend %v", backend.Name())
+		}
+	}
+
+	server := singularity.NewServer(hss)
+	server.SessionPersister = sessionPersister
 
 	// Start DNS server
-	dnsServerPort := 53
-	dnsServer := &dns.Server{Addr: appConfig.DNSServerBindAddr + ":" + strconv.Itoa(dnsServerPort), Net: "udp"}
-	log.Printf("Main: Starting DNS Server at %v\n", dnsServerPort)
+	dnsServer := singularity.NewDNSServer(appConfig, dcss)
+	dnsServer.NotifyStartedFunc = func() { hss.SetDNSServerRunning(true) }
+	log.Printf("Main: Starting DNS Server at %v\n", dnsServer.Addr)
 
-	go func() {
-		dnsServerErr := dnsServer.ListenAndServe()
+	server.StartDNSServer(dnsServer, func(dnsServerErr error) {
+		hss.SetDNSServerRunning(false)
 		if dnsServerErr != nil {
-			log.Fatalf("Main: Failed to start DNS server: %s\n ", dnsServerErr.Error())
+			fatalf("Main: Failed to start DNS server: %s\n ", dnsServerErr.Error())
 		}
-	}()
-
-	defer dnsServer.Shutdown()
-
-	for _, port := range appConfig.HTTPServerPorts {
-		// Start HTTP Servers
-		httpServer := singularity.NewHTTPServer(port, hss, dcss, wscss)
-		httpServerErr := singularity.StartHTTPServer(httpServer, hss, false, appConfig.EnableLinuxTProxySupport)
+	})
 
-		if httpServerErr != nil {
-			log.Fatalf("Main: Could not start main HTTP Server instance: %v", httpServerErr)
+	// Start DNS-over-TLS server
+	if appConfig.EnableDNSOverTLS {
+		dotTLSConfig, err := singularity.NewTLSConfig(appConfig.DNSOverTLSCertFile, appConfig.DNSOverTLSKeyFile)
+		if err != nil {
+			fatalf("Main: could not load DNS-over-TLS certificate: %v", err)
 		}
+		dotServer := singularity.NewDNSOverTLSServer(appConfig, dcss, dotTLSConfig)
+		log.Printf("Main: Starting DNS-over-TLS Server at %v\n", dotServer.Addr)
+		server.StartDNSServer(dotServer, func(err error) {
+			if err != nil {
+				fatalf("Main: Failed to start DNS-over-TLS server: %v\n", err)
+			}
+		})
+	}
+
+	// Start HTTP Servers
+	_, httpServerErr := singularity.StartAllHTTPServers(appConfig.HTTPServerPorts, hss, dcss, wscss,
+		nil, appConfig.EnableLinuxTProxySupport)
+	if httpServerErr != nil {
+		fatalf("Main: Could not start main HTTP Server instances: %v", httpServerErr)
+	}
 
+	// Start HTTPS Servers
+	_, httpServerErr = singularity.StartAllHTTPServers(appConfig.HTTPSServerPorts, hss, dcss, wscss,
+		hss.TLSConfig, appConfig.EnableLinuxTProxySupport)
+	if httpServerErr != nil {
+		fatalf("Main: Could not start main HTTPS Server instances: %v", httpServerErr)
 	}
 
 	wsHTTPProxyServer := singularity.NewHTTPProxyServer(hss.WsHTTPProxyServerPort, dcss, wscss, hss)
 	wsHTTPProxyServerErr := singularity.StartHTTPProxyServer(wsHTTPProxyServer)
 
 	if wsHTTPProxyServerErr != nil {
-		log.Fatalf("Main: Could not start proxy Webssockets/HTTP Server instance: %v", wsHTTPProxyServerErr)
+		fatalf("Main: Could not start proxy Webssockets/HTTP Server instance: %v", wsHTTPProxyServerErr)
+	}
+	server.ProxyServer = wsHTTPProxyServer
+
+	if appConfig.LinuxTProxyPortRange != "" {
+		tproxyRules, err := singularity.NewLinuxTProxyRules(appConfig)
+		if err != nil {
+			fatalf("Main: %v", err)
+		}
+		installedTProxyRules.Lock()
+		err = tproxyRules.Install()
+		if err == nil {
+			installedTProxyRules.rules = tproxyRules
+		}
+		installedTProxyRules.Unlock()
+		if err != nil {
+			fatalf("Main: could not install TProxy rules: %v", err)
+		}
+		log.Printf("Main: redirecting ports %v with TProxy to port %v, except ports %v",
+			appConfig.LinuxTProxyPortRange, tproxyRules.OnPort, tproxyRules.ExcludePorts)
+	}
+
+	if appConfig.AdminAddr != "" {
+		adminServer := singularity.NewAdminServer(hss)
+		if err := singularity.StartAdminServer(adminServer); err != nil {
+			fatalf("Main: Could not start admin HTTP Server: %v", err)
+		}
+		server.AdminServer = adminServer
+	}
+
+	if appConfig.GRPCAddr != "" {
+		grpcServer := singularity.NewGRPCServer(hss)
+		if err := singularity.StartGRPCServer(grpcServer, appConfig.GRPCAddr); err != nil {
+			fatalf("Main: Could not start gRPC control API server: %v", err)
+		}
+		server.GRPCServer = grpcServer
+	}
+
+	if appConfig.SOCKSBridgeAddr != "" {
+		l, err := net.Listen("tcp", appConfig.SOCKSBridgeAddr)
+		if err != nil {
+			fatalf("Main: Could not start SOCKS5 bridge: %v", err)
+		}
+		server.SOCKSBridge = &singularity.SOCKSBridge{Wscss: wscss, AuthToken: authToken}
+		go server.SOCKSBridge.Serve(l)
+	}
+
+	if appConfig.SelfTest {
+		go func() {
+			// give the DNS server time to start
+			time.Sleep(time.Second)
+			problems := singularity.SelfTest(appConfig)
+			for _, problem := range problems {
+				log.Printf("Main: %v", problem)
+			}
+			log.Printf("Main: self-test found %v problem(s)", len(problems))
+		}()
 	}
 
 	expiryDuration := time.Duration(appConfig.ResponseReboundIPAddrtimeOut) * time.Second
 	expireClientStateTicker := time.NewTicker(expiryDuration)
 
+	reloadc := make(chan os.Signal, 1)
+	signal.Notify(reloadc, syscall.SIGHUP)
+	shutdownc := make(chan os.Signal, 1)
+	signal.Notify(shutdownc, syscall.SIGTERM, os.Interrupt)
+
 	for {
 		select {
 		case <-expireClientStateTicker.C:
 			dcss.ExpireOldEntries(expiryDuration)
+			hss.RateLimiter.ExpireOldEntries(expiryDuration)
+			appConfig.DNSRateLimiter.ExpireOldEntries(expiryDuration)
+			hss.StopExpiredDynamicServers()
+			if sessionPersister != nil {
+				if err := dcss.PersistSessions(sessionPersister); err != nil {
+					log.Printf("Main: could not save DNS sessions to %v: %v", appConfig.SessionStoreFile, err)
+				}
+			}
+		case sig := <-shutdownc:
+			log.Printf("Main: %v received, shutting down", sig)
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			err := server.Shutdown(ctx)
+			cancel()
+			removeTProxyRules()
+			if err != nil {
+				log.Printf("Main: shutdown: %v", err)
+				os.Exit(1)
+			}
+			log.Printf("Main: shutdown complete")
+			return
+		case <-reloadc:
+			if hss.ReloadConfig == nil {
+				log.Printf("Main: ignoring SIGHUP: no configuration file to reload")
+			} else if err := hss.ReloadConfig(); err != nil {
+				log.Printf("Main: could not reload configuration: %v", err)
+			} else if configFile != "" {
+				log.Printf("Main: reloaded configuration from %v", configFile)
+			} else {
+				log.Printf("Main: reloaded static zone file %v", staticZoneFile)
+			}
 		case err := <-hss.Errc:
 			log.Printf("Main: HTTP server (%v): %v", err.Port, err.Err)
+		case result := <-hss.Firewallc:
+			if result.Err != nil {
+				log.Printf("Main: firewall rule %v failed for %v to %v:%v: %v",
+					result.Action, result.SrcAddr, result.DstAddr, result.DstPort, result.Err)
+			} else {
+				log.Printf("Main: firewall rule %v succeeded for %v to %v:%v",
+					result.Action, result.SrcAddr, result.DstAddr, result.DstPort)
+			}
 		}
 	}
 
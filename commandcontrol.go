@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"html/template"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -29,11 +28,35 @@ type WebsocketClientStateStore struct {
 	Sessions map[string]*WebsocketClientState
 }
 
+// addSession registers a hooked target, replacing and closing
+// any previous websocket connection of the same session.
+func (wscss *WebsocketClientStateStore) addSession(sessionID string, state *WebsocketClientState) {
+	wscss.Lock()
+	previous, ok := wscss.Sessions[sessionID]
+	wscss.Sessions[sessionID] = state
+	wscss.Unlock()
+	if ok && previous.WSClient != nil && previous.WSClient != state.WSClient {
+		previous.WSClient.conn.Close()
+	}
+}
+
+// removeSession forgets about a hooked target
+// only if it is still served by the provided websocket client.
+func (wscss *WebsocketClientStateStore) removeSession(sessionID string, client *WSClient) {
+	wscss.Lock()
+	if state, ok := wscss.Sessions[sessionID]; ok && state.WSClient == client {
+		delete(wscss.Sessions, sessionID)
+	}
+	wscss.Unlock()
+}
+
 // WebsocketClientState maintains information about a target hooked via websockets
 type WebsocketClientState struct {
 	LastSeenTime time.Time
 	Host         string
-	WSClient     *WSClient
+	// Scheme of the attack origin, "http" or "https"
+	Scheme   string
+	WSClient *WSClient
 }
 
 type hookedClientHandler struct {
@@ -62,7 +85,7 @@ func (hch *hookedClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	t, err := template.New("webpage").Funcs(funcMap).Parse(tpl)
 
 	if err != nil {
-		log.Printf("hookedClientHandler: could not parse template: %v\n", err)
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not parse hooked clients template: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
@@ -70,7 +93,7 @@ func (hch *hookedClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	host, _, err := net.SplitHostPort(r.Host)
 
 	if err != nil {
-		log.Printf("hookedClientHandler: could not parse host: %v\n", err)
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "could not parse host of hooked clients request: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
@@ -83,7 +106,7 @@ func (hch *hookedClientHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	hch.wscss.RUnlock()
 
 	if err != nil {
-		log.Printf("hookedClientHandler: could not execute template: %v\n", err)
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not execute hooked clients template: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
@@ -257,12 +280,12 @@ type LoginHandler struct {
 func (lh *LoginHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	proxiedURL, err := url.Parse(r.RequestURI)
 	if err != nil {
-		log.Printf("LoginHandler: could not parse url: %v\n", err)
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "could not parse login url: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 	url := proxiedURL.RequestURI()
-	log.Printf("Proxy: %v %v%v\n", r.Method, r.Host, url)
+	logEvent(LogInfo, "Proxy", httpRequestFields(r), "%v %v%v", r.Method, r.Host, url)
 	switch m := r.Method; m {
 	case "GET":
 		fmt.Fprintf(w, loginPage)
@@ -328,7 +351,7 @@ func (c *WSClient) Request(op *websocketOperation) (interface{}, error) {
 	select {
 	case <-call.Done:
 	case <-time.After(90 * time.Second):
-		log.Printf("websockets: timeout ID:%v, %v\n", call.Req.ID, op.Payload.URL)
+		logEvent(LogWarn, "Websocket", nil, "timeout ID:%v, %v", call.Req.ID, op.Payload.URL)
 		call.Error = errors.New("websockets: time out")
 	}
 
@@ -384,12 +407,7 @@ func (c *WSClient) keepAlive(wscss *WebsocketClientStateStore, sessionID string)
 		select {
 		case <-ticker.C:
 			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				wscss.Lock()
-				_, ok := wscss.Sessions[sessionID]
-				if ok {
-					delete(wscss.Sessions, sessionID)
-				}
-				wscss.Unlock()
+				wscss.removeSession(sessionID, c)
 				return
 			}
 		}
@@ -410,7 +428,7 @@ func (t *ProxytoWebsocketTransport) RoundTrip(req *http.Request) (*http.Response
 	if req.Body != nil {
 		b, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			log.Printf("Error reading body: %v", err)
+			logEvent(LogWarn, "Proxy", nil, "could not read request body: %v", err)
 			return nil, err
 		}
 
@@ -490,17 +508,17 @@ func (t *ProxytoWebsocketTransport) RoundTrip(req *http.Request) (*http.Response
 }
 
 func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+	logHTTPRequest(r)
 
 	proxiedURL, err := url.Parse(r.RequestURI)
 	if err != nil {
-		log.Printf("ProxyHandler: could not parse url: %v\n", err)
+		logEvent(LogWarn, "Proxy", httpRequestFields(r), "could not parse url: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 
 	url := proxiedURL.RequestURI()
-	log.Printf("Proxy: %v %v%v\n", r.Method, r.Host, url)
+	logEvent(LogInfo, "Proxy", httpRequestFields(r), "%v %v%v", r.Method, r.Host, url)
 
 	re := regexp.MustCompile(`^([0-9]+)\.(.*)$`)
 	matched := (re.FindStringSubmatch(r.Host))
@@ -532,7 +550,7 @@ func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		req.URL.Path = MatchedURLRest
 	}
 
-	log.Printf("director: %v %v\n", session.Host, MatchedURLRest)
+	logEvent(LogDebug, "Proxy", httpRequestFields(r), "director: %v %v", session.Host, MatchedURLRest)
 
 	proxy := &httputil.ReverseProxy{Director: director, Transport: transport}
 
@@ -550,7 +568,8 @@ func NewHTTPProxyServer(port int, dcss *DNSClientStateStore,
 	hookedClientHandler := &hookedClientHandler{wscss: wscss, wsHTTPProxyServerPort: hss.WsHTTPProxyServerPort}
 	hookedClientAuthHandler := &AuthHandler{NextHandler: hookedClientHandler}
 
-	websocketHandler := &WebsocketHandler{dcss: dcss, wscss: wscss}
+	websocketHandler := &WebsocketHandler{dcss: dcss, wscss: wscss, notify: hss.AppConfig.notifyWebhook,
+		sessionKeyFn: hss.appConfig().SessionKeyFn}
 
 	router := mux.NewRouter()
 
@@ -580,7 +599,7 @@ func StartHTTPProxyServer(s *http.Server) error {
 	}
 
 	go func() {
-		log.Printf("HTTP: starting HTTP Websockets/Proxy Server on %v\n", s.Addr)
+		logEvent(LogInfo, "HTTP", LogFields{"addr": s.Addr}, "starting HTTP Websockets/Proxy Server on %v", s.Addr)
 		s.Serve(l)
 		//hss.Errc <- HTTPServerError{Err: routineErr, Port: s.Addr}
 	}()
@@ -592,6 +611,10 @@ func StartHTTPProxyServer(s *http.Server) error {
 type WebsocketHandler struct {
 	wscss *WebsocketClientStateStore
 	dcss  *DNSClientStateStore
+	// notify receives callback webhook events if set
+	notify func(event *RebindingEvent)
+	// derives the session key of clients, see AppConfig.SessionKeyFn
+	sessionKeyFn func(name *DNSQuery, remote net.Addr) string
 }
 
 func (ws *WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -603,49 +626,70 @@ func (ws *WebsocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c, err := upgrader.Upgrade(w, r, nil)
 
 	if err != nil {
-		log.Print("could not upgrade the HTTP connection to a websocket connection: ", err)
+		logEvent(LogWarn, "Websocket", httpRequestFields(r), "could not upgrade the HTTP connection to a websocket connection: %v", err)
 		return
 	}
 	defer c.Close()
 
-	name, err := NewDNSQuery(r.Header.Get("origin"))
+	name, err := NewDNSQueryFromOrigin(r.Header.Get("origin"))
 
 	if err != nil {
-		log.Printf("websockets: could not parse origin hostname: %v\n", err)
+		logEvent(LogWarn, "Websocket", httpRequestFields(r), "could not parse origin hostname: %v", err)
 		return
 	}
 
 	ws.dcss.RLock()
-	_, keyExists := ws.dcss.Sessions[name.Session]
+	_, keyExists := ws.dcss.Sessions[sessionKey(ws.sessionKeyFn, name, httpRemoteAddr(r))]
 	ws.dcss.RUnlock()
 
 	if keyExists != true {
-		log.Printf("websockets: does not have a matching DNS Session")
+		logEvent(LogWarn, "Websocket", LogFields{"session": name.Session}, "does not have a matching DNS Session")
 		return
 	}
 
 	u, err := url.Parse(r.Header.Get("origin"))
 
 	if err != nil {
-		log.Printf("websockets: could not parse origin header")
+		logEvent(LogWarn, "Websocket", LogFields{"session": name.Session}, "could not parse origin header")
 		return
 	}
 
-	host := fmt.Sprintf("%v:%v", u.Hostname(), u.Port())
+	// requests are proxied to the target port of the DNS name if set,
+	// e.g. when attack servers receive all ports with TProxy,
+	// and to the port of the origin otherwise
+	port := u.Port()
+	if name.TargetPort > 0 {
+		port = strconv.Itoa(name.TargetPort)
+	} else if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	host := net.JoinHostPort(u.Hostname(), port)
 
 	client := NewWSClient()
 	client.conn = c
 
-	log.Printf("websockets: started a new session %v\n", name.Session)
+	logEvent(LogInfo, "Websocket", LogFields{"session": name.Session}, "started a new session %v", name.Session)
+
+	if ws.notify != nil {
+		event := &RebindingEvent{Event: webhookEventCallback, Session: name.Session,
+			Strategy: name.DNSRebindingStrategy, Port: u.Port(), Timestamp: time.Now()}
+		if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			event.ClientIP = clientIP
+		}
+		ws.notify(event)
+	}
 
-	ws.wscss.Lock()
-	ws.wscss.Sessions[name.Session] = &WebsocketClientState{LastSeenTime: time.Now(),
-		Host: host, WSClient: client}
-	ws.wscss.Unlock()
+	ws.wscss.addSession(name.Session, &WebsocketClientState{LastSeenTime: time.Now(),
+		Host: host, Scheme: u.Scheme, WSClient: client})
 
 	go client.keepAlive(ws.wscss, name.Session)
 
-	for {
-		client.read()
-	}
+	// read returns once the connection is broken
+	client.read()
+
+	ws.wscss.removeSession(name.Session, client)
+	logEvent(LogInfo, "Websocket", LogFields{"session": name.Session}, "ended session %v", name.Session)
 }
@@ -0,0 +1,504 @@
+package singularity
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/nccgroup/singularity/golang"
+)
+
+// reservedPaths are the HTTP routes singularity registers on attack servers
+// besides the payload path and the management endpoints of adminRoutes
+var reservedPaths = map[string]bool{
+	"/clientinfo":   true,
+	"/delaydomload": true,
+	"/healthz":      true,
+	"/rebind":       true,
+	dohPath:         true,
+	"/soows":        true,
+}
+
+// isReservedPath returns whether path is registered by singularity
+// on attack servers or on the admin server.
+func isReservedPath(path string) bool {
+	_, admin := adminRoutes(nil)[path]
+	return reservedPaths[path] || admin
+}
+
+// validPort checks that a TCP/UDP port number is within range
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+// ParsePortsSpec expands a comma-separated list of ports and port ranges
+// (e.g. "80,443,8000-8010") into a list of unique ports, in order of first appearance.
+func ParsePortsSpec(spec string) ([]int, error) {
+	ports := []int{}
+	seen := make(map[int]bool)
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		bounds := strings.SplitN(item, "-", 2)
+
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || !validPort(first) {
+			return nil, fmt.Errorf("invalid port %q in ports specification %q", bounds[0], spec)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || !validPort(last) {
+				return nil, fmt.Errorf("invalid port %q in ports specification %q", bounds[1], spec)
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid port range %q in ports specification %q", item, spec)
+			}
+		}
+
+		for port := first; port <= last; port++ {
+			if !seen[port] {
+				seen[port] = true
+				ports = append(ports, port)
+			}
+		}
+	}
+
+	return ports, nil
+}
+
+// ValidateAppConfig checks the running parameters of singularity server
+// and returns a descriptive error for the first invalid parameter found.
+// Callers should validate the configuration at startup to fail fast
+// instead of silently ignoring DNS queries later on.
+func ValidateAppConfig(appConfig *AppConfig) error {
+	if net.ParseIP(appConfig.ResponseIPAddr) == nil {
+		return fmt.Errorf("invalid ResponseIPAddr %q: not an IP address", appConfig.ResponseIPAddr)
+	}
+
+	if appConfig.ResponseReboundIPAddr != "localhost" &&
+		net.ParseIP(appConfig.ResponseReboundIPAddr) == nil &&
+		!golang.IsDomainName(appConfig.ResponseReboundIPAddr) {
+		return fmt.Errorf("invalid ResponseReboundIPAddr %q: not an IP address or host name",
+			appConfig.ResponseReboundIPAddr)
+	}
+
+	if net.ParseIP(appConfig.DNSServerBindAddr) == nil {
+		return fmt.Errorf("invalid DNSServerBindAddr %q: not an IP address", appConfig.DNSServerBindAddr)
+	}
+
+	if appConfig.DNSServerPort != 0 && !validPort(appConfig.DNSServerPort) {
+		return fmt.Errorf("invalid DNSServerPort: port %v is not between 1 and 65535", appConfig.DNSServerPort)
+	}
+
+	for _, port := range appConfig.HTTPServerPorts {
+		if !validPort(port) {
+			return fmt.Errorf("invalid HTTPServerPorts: port %v is not between 1 and 65535", port)
+		}
+	}
+
+	for _, port := range appConfig.HTTPSServerPorts {
+		if !validPort(port) {
+			return fmt.Errorf("invalid HTTPSServerPorts: port %v is not between 1 and 65535", port)
+		}
+	}
+
+	if appConfig.ACMEAutocertCacheDir != "" {
+		if appConfig.HTTPSCertFile != "" || appConfig.HTTPSKeyFile != "" {
+			return errors.New("ACMEAutocertCacheDir excludes HTTPSCertFile and HTTPSKeyFile")
+		}
+		if len(appConfig.AllowedDomains) == 0 {
+			return errors.New("ACMEAutocertCacheDir requires AllowedDomains")
+		}
+	} else if len(appConfig.HTTPSServerPorts) > 0 && (appConfig.HTTPSCertFile == "" || appConfig.HTTPSKeyFile == "") {
+		return errors.New("HTTPSServerPorts requires both HTTPSCertFile and HTTPSKeyFile, or ACMEAutocertCacheDir")
+	}
+
+	if appConfig.EnableHTTP3 && appConfig.ACMEAutocertCacheDir == "" && (appConfig.HTTPSCertFile == "" || appConfig.HTTPSKeyFile == "") {
+		return errors.New("EnableHTTP3 requires both HTTPSCertFile and HTTPSKeyFile, or ACMEAutocertCacheDir")
+	}
+
+	if appConfig.EnableLinuxTProxySupport && runtime.GOOS != "linux" {
+		return errors.New("EnableLinuxTProxySupport requires Linux")
+	}
+
+	for _, port := range appConfig.LinuxTProxyRelayPorts {
+		if !validPort(port) {
+			return fmt.Errorf("invalid LinuxTProxyRelayPorts: port %v is not between 1 and 65535", port)
+		}
+	}
+
+	for _, port := range appConfig.LinuxTProxyExcludePorts {
+		if !validPort(port) {
+			return fmt.Errorf("invalid LinuxTProxyExcludePorts: port %v is not between 1 and 65535", port)
+		}
+	}
+
+	if appConfig.LinuxTProxyPortRange != "" {
+		if !appConfig.EnableLinuxTProxySupport {
+			return errors.New("LinuxTProxyPortRange requires EnableLinuxTProxySupport")
+		}
+		if _, _, err := ParseTProxyPortRange(appConfig.LinuxTProxyPortRange); err != nil {
+			return err
+		}
+	}
+
+	if !validPort(appConfig.WsHTTPProxyServerPort) {
+		return fmt.Errorf("invalid WsHTTPProxyServerPort: port %v is not between 1 and 65535",
+			appConfig.WsHTTPProxyServerPort)
+	}
+
+	if _, ok := LookupRebindingStrategy(appConfig.RebindingFnName); !ok {
+		return fmt.Errorf("invalid RebindingFnName %q: unknown DNS rebinding strategy", appConfig.RebindingFnName)
+	}
+
+	// also used as the expiry interval of DNS sessions
+	if appConfig.ResponseReboundIPAddrtimeOut <= 0 {
+		return fmt.Errorf("invalid ResponseReboundIPAddrtimeOut %v: must be positive",
+			appConfig.ResponseReboundIPAddrtimeOut)
+	}
+
+	if appConfig.MaxSessions < 0 {
+		return fmt.Errorf("invalid MaxSessions %v: must not be negative", appConfig.MaxSessions)
+	}
+
+	if appConfig.WebhookURL != "" {
+		u, err := url.Parse(appConfig.WebhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid WebhookURL %q: not an HTTP(S) URL", appConfig.WebhookURL)
+		}
+	}
+
+	for _, event := range appConfig.WebhookEvents {
+		if !stringInSlice(event, webhookEvents) {
+			return fmt.Errorf("invalid WebhookEvents %q: must be one of %v", event, strings.Join(webhookEvents, ", "))
+		}
+	}
+
+	if appConfig.RebindJitterMs < 0 {
+		return fmt.Errorf("invalid RebindJitterMs %v: must not be negative", appConfig.RebindJitterMs)
+	}
+
+	if appConfig.PayloadCacheSeconds < 0 {
+		return fmt.Errorf("invalid PayloadCacheSeconds %v: must not be negative", appConfig.PayloadCacheSeconds)
+	}
+
+	if appConfig.EnableDNSOverTLS {
+		if appConfig.DNSOverTLSPort != 0 && !validPort(appConfig.DNSOverTLSPort) {
+			return fmt.Errorf("invalid DNSOverTLSPort %v: must be between 1 and 65535", appConfig.DNSOverTLSPort)
+		}
+		if appConfig.DNSOverTLSCertFile == "" || appConfig.DNSOverTLSKeyFile == "" {
+			return errors.New("DNS-over-TLS requires both DNSOverTLSCertFile and DNSOverTLSKeyFile")
+		}
+	}
+
+	switch appConfig.LogFormat {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("invalid LogFormat %q: must be text or json", appConfig.LogFormat)
+	}
+	switch appConfig.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		return fmt.Errorf("invalid LogLevel %q: must be debug, info, warn or error", appConfig.LogLevel)
+	}
+
+	if appConfig.ACMEChallengeDir != "" {
+		if info, err := os.Stat(appConfig.ACMEChallengeDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("invalid ACMEChallengeDir %q: not a directory", appConfig.ACMEChallengeDir)
+		}
+	}
+
+	if appConfig.MaxRequestBodyBytes < 0 {
+		return fmt.Errorf("invalid MaxRequestBodyBytes %v: must not be negative", appConfig.MaxRequestBodyBytes)
+	}
+
+	for _, port := range appConfig.KeepAliveHTTPServerPorts {
+		if !validPort(port) {
+			return fmt.Errorf("invalid KeepAliveHTTPServerPorts: port %v is not between 1 and 65535", port)
+		}
+	}
+
+	if appConfig.PayloadPath != "" {
+		switch {
+		case !strings.HasPrefix(appConfig.PayloadPath, "/") || appConfig.PayloadPath == "/":
+			return fmt.Errorf("invalid PayloadPath %q: must be an absolute path other than /", appConfig.PayloadPath)
+		case isReservedPath(appConfig.PayloadPath):
+			return fmt.Errorf("invalid PayloadPath %q: reserved by singularity", appConfig.PayloadPath)
+		}
+	}
+
+	if appConfig.DelayDOMLoadSeconds < 0 {
+		return fmt.Errorf("invalid DelayDOMLoadSeconds %v: must not be negative", appConfig.DelayDOMLoadSeconds)
+	}
+
+	if appConfig.FirewallBackend != autoFirewallBackend {
+		backend, err := LookupFirewallBackend(appConfig.FirewallBackend)
+		if err != nil {
+			return fmt.Errorf("invalid FirewallBackend %q: must be auto or one of %v",
+				appConfig.FirewallBackend, strings.Join(ListFirewallBackends(), ", "))
+		}
+		// a backend selected by name must work on this host, "" keeps the iptables default
+		if appConfig.FirewallBackend != "" && !appConfig.FirewallDryRun && !backend.Available() {
+			return fmt.Errorf("invalid FirewallBackend %q: not available on this host", appConfig.FirewallBackend)
+		}
+	}
+
+	if appConfig.FirewallRuleDurationSeconds < 0 {
+		return fmt.Errorf("invalid FirewallRuleDurationSeconds %v: must not be negative",
+			appConfig.FirewallRuleDurationSeconds)
+	}
+
+	if appConfig.AdminAddr != "" {
+		_, port, err := net.SplitHostPort(appConfig.AdminAddr)
+		if p, perr := strconv.Atoi(port); err != nil || perr != nil || !validPort(p) {
+			return fmt.Errorf("invalid AdminAddr %q: must be an address and port", appConfig.AdminAddr)
+		}
+	}
+
+	if appConfig.GRPCAddr != "" {
+		_, port, err := net.SplitHostPort(appConfig.GRPCAddr)
+		if p, perr := strconv.Atoi(port); err != nil || perr != nil || !validPort(p) {
+			return fmt.Errorf("invalid GRPCAddr %q: must be an address and port", appConfig.GRPCAddr)
+		}
+	}
+
+	if appConfig.DNSAuditLogMaxSizeMB < 0 || appConfig.DNSAuditLogMaxBackups < 0 {
+		return fmt.Errorf("invalid DNSAuditLogMaxSizeMB %v or DNSAuditLogMaxBackups %v: must not be negative",
+			appConfig.DNSAuditLogMaxSizeMB, appConfig.DNSAuditLogMaxBackups)
+	}
+
+	if appConfig.LootMaxSizeMB < 0 || appConfig.LootMaxSessionSizeMB < 0 {
+		return fmt.Errorf("invalid LootMaxSizeMB %v or LootMaxSessionSizeMB %v: must not be negative",
+			appConfig.LootMaxSizeMB, appConfig.LootMaxSessionSizeMB)
+	}
+
+	if appConfig.LootDir != "" && appConfig.LootStoreFile != "" {
+		return fmt.Errorf("invalid LootStoreFile %v: LootDir is also set", appConfig.LootStoreFile)
+	}
+
+	if err := validateOperators(appConfig.Operators); err != nil {
+		return err
+	}
+
+	for _, record := range append(append([]StaticDNSRecord{}, appConfig.StaticRecords...), appConfig.staticZoneRecords...) {
+		if err := record.validate(); err != nil {
+			return err
+		}
+		if !nameUnderAllowedDomains(strings.TrimPrefix(record.Name, "*."), appConfig.AllowedDomains) {
+			return fmt.Errorf("invalid static record %v: not under the allowed domains", record.Name)
+		}
+	}
+
+	if appConfig.HTMLDir != "" {
+		if info, err := os.Stat(appConfig.HTMLDir); err != nil || !info.IsDir() {
+			return fmt.Errorf("invalid HTMLDir %q: must be a directory", appConfig.HTMLDir)
+		}
+	}
+
+	if appConfig.SOCKSBridgeAddr != "" {
+		_, port, err := net.SplitHostPort(appConfig.SOCKSBridgeAddr)
+		if p, perr := strconv.Atoi(port); err != nil || perr != nil || !validPort(p) {
+			return fmt.Errorf("invalid SOCKSBridgeAddr %q: must be an address and port", appConfig.SOCKSBridgeAddr)
+		}
+	}
+
+	if appConfig.FirewallSourcePortRange < 0 || appConfig.FirewallSourcePortRange > maxFirewallSourcePortRange {
+		return fmt.Errorf("invalid FirewallSourcePortRange %v: must be between 0 and %v",
+			appConfig.FirewallSourcePortRange, maxFirewallSourcePortRange)
+	}
+
+	if appConfig.DynamicHTTPServersRateLimit < 0 {
+		return fmt.Errorf("invalid DynamicHTTPServersRateLimit %v: must not be negative",
+			appConfig.DynamicHTTPServersRateLimit)
+	}
+
+	if appConfig.DynamicHTTPServersRateLimitInterval < 0 {
+		return fmt.Errorf("invalid DynamicHTTPServersRateLimitInterval %v: must not be negative",
+			appConfig.DynamicHTTPServersRateLimitInterval)
+	}
+
+	if appConfig.DNSRateLimit < 0 {
+		return fmt.Errorf("invalid DNSRateLimit %v: must not be negative", appConfig.DNSRateLimit)
+	}
+
+	if appConfig.DNSRateLimitInterval < 0 {
+		return fmt.Errorf("invalid DNSRateLimitInterval %v: must not be negative", appConfig.DNSRateLimitInterval)
+	}
+
+	if appConfig.DynamicHTTPServersPerSession < 0 {
+		return fmt.Errorf("invalid DynamicHTTPServersPerSession %v: must not be negative",
+			appConfig.DynamicHTTPServersPerSession)
+	}
+
+	if appConfig.DynamicHTTPServersPoolSize < 0 {
+		return fmt.Errorf("invalid DynamicHTTPServersPoolSize %v: must not be negative",
+			appConfig.DynamicHTTPServersPoolSize)
+	}
+
+	for _, port := range appConfig.DynamicHTTPServerPorts {
+		if !validPort(port) {
+			return fmt.Errorf("invalid DynamicHTTPServerPorts: port %v is not between 1 and 65535", port)
+		}
+	}
+
+	return nil
+}
+
+// DefaultAppConfig returns the default running parameters of singularity server,
+// those of the command line flags and of the fields not set in configuration files.
+func DefaultAppConfig() *AppConfig {
+	return &AppConfig{
+		HTTPServerPorts:                     []int{8080},
+		ResponseIPAddr:                      "192.168.0.1",
+		ResponseReboundIPAddr:               "127.0.0.1",
+		RebindingFn:                         DNSRebindFromQueryFirstThenSecond,
+		RebindingFnName:                     "fs",
+		ResponseReboundIPAddrtimeOut:        300,
+		DNSServerBindAddr:                   "0.0.0.0",
+		DNSServerPort:                       53,
+		MaxSessions:                         100000,
+		UseEmbeddedAssets:                   true,
+		WsHTTPProxyServerPort:               3129,
+		DynamicHTTPServersRateLimit:         5,
+		DynamicHTTPServersRateLimitInterval: 60,
+		DelayDOMLoadSeconds:                 90,
+		FirewallRuleDurationSeconds:         10,
+		FirewallBackend:                     "auto",
+		PayloadPath:                         "/soopayload.html",
+		MaxRequestBodyBytes:                 5000,
+		DNSOverTLSPort:                      853,
+		LogFormat:                           "text",
+		LogLevel:                            "info",
+		DynamicHTTPServersPoolSize:          1,
+		DynamicHTTPServersPerSession:        1,
+		DNSAuditLogMaxSizeMB:                100,
+		DNSAuditLogMaxBackups:               10,
+		DNSRateLimitInterval:                1,
+		LinuxTProxyExcludePorts:             []int{22},
+		LootMaxSizeMB:                       1024,
+		LootMaxSessionSizeMB:                100,
+	}
+}
+
+// LoadConfig reads the running parameters of singularity server
+// from a JSON or YAML (".yaml" or ".yml" extension) file and validates them.
+// See LoadAppConfigFromFile for the file format, YAML files have the same keys.
+func LoadConfig(path string) (*AppConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		values, err := parseYAMLConfig(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse config file %v: %v", path, err)
+		}
+		if data, err = json.Marshal(values); err != nil {
+			return nil, fmt.Errorf("could not parse config file %v: %v", path, err)
+		}
+	}
+
+	appConfig, err := parseAppConfig(data, path)
+	if err != nil {
+		return nil, err
+	}
+	if err := appConfig.ReadStaticZoneFile(); err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+	if err := ValidateAppConfig(appConfig); err != nil {
+		return nil, fmt.Errorf("invalid config file %v: %v", path, err)
+	}
+	return appConfig, nil
+}
+
+// LoadAppConfigFromFile reads the running parameters of singularity server
+// from a JSON file. Keys are AppConfig field names,
+// networks in IgnoreDNSRequestFromCIDR, AllowHTTPClientsFrom and AdminAllowedFrom are written in CIDR notation
+// and RebindingFnName is resolved to its DNS rebinding strategy.
+// Fields not present in the file keep their DefaultAppConfig value.
+func LoadAppConfigFromFile(path string) (*AppConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseAppConfig(data, path)
+}
+
+// parseAppConfig parses a JSON configuration read from path
+func parseAppConfig(data []byte, path string) (*AppConfig, error) {
+	appConfig := DefaultAppConfig()
+	fileConfig := struct {
+		*AppConfig
+		IgnoreDNSRequestFromCIDR []string
+		AllowHTTPClientsFrom     []string
+		AdminAllowedFrom         []string
+	}{AppConfig: appConfig}
+
+	if err := json.Unmarshal(data, &fileConfig); err != nil {
+		return nil, fmt.Errorf("could not parse config file %v: %v", path, err)
+	}
+
+	for _, cidr := range fileConfig.IgnoreDNSRequestFromCIDR {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IgnoreDNSRequestFromCIDR in config file %v: %v", path, err)
+		}
+		appConfig.IgnoreDNSRequestFromCIDR = append(appConfig.IgnoreDNSRequestFromCIDR, ipNet)
+	}
+
+	for _, cidr := range fileConfig.AllowHTTPClientsFrom {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AllowHTTPClientsFrom in config file %v: %v", path, err)
+		}
+		appConfig.AllowHTTPClientsFrom = append(appConfig.AllowHTTPClientsFrom, ipNet)
+	}
+
+	for _, cidr := range fileConfig.AdminAllowedFrom {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AdminAllowedFrom in config file %v: %v", path, err)
+		}
+		appConfig.AdminAllowedFrom = append(appConfig.AdminAllowedFrom, ipNet)
+	}
+
+	if appConfig.RebindingFnName != "" {
+		strategy, ok := LookupRebindingStrategy(appConfig.RebindingFnName)
+		if !ok {
+			return nil, fmt.Errorf("invalid RebindingFnName %q in config file %v: unknown DNS rebinding strategy",
+				appConfig.RebindingFnName, path)
+		}
+		appConfig.RebindingFn = strategy.Answer
+	}
+
+	return appConfig, nil
+}
+
+// ParseTProxyPortRange parses the external ports redirected with TProxy,
+// a port or a port range, e.g. "8080" or "1-65535".
+func ParseTProxyPortRange(spec string) (int, int, error) {
+	bounds := strings.SplitN(spec, "-", 2)
+	first, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil || !validPort(first) {
+		return 0, 0, fmt.Errorf("invalid TProxy port range %q", spec)
+	}
+	last := first
+	if len(bounds) == 2 {
+		last, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		if err != nil || !validPort(last) || last < first {
+			return 0, 0, fmt.Errorf("invalid TProxy port range %q", spec)
+		}
+	}
+	return first, last, nil
+}
@@ -0,0 +1,112 @@
+package singularity
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/miekg/dns"
+)
+
+// dohPath is the route of DNS-over-HTTPS queries (RFC 8484)
+const dohPath = "/dns-query"
+
+// dohMaxMessageSize is the maximum size of a DNS message
+const dohMaxMessageSize = 65535
+
+// DNSOverHTTPSHandler is a HTTP handler answering DNS-over-HTTPS queries (RFC 8484)
+// with DNSHandler, e.g. the handler returned by MakeRebindDNSHandler
+// so that queries share the DNS session store and rebinding strategies.
+type DNSOverHTTPSHandler struct {
+	DNSHandler dns.Handler
+}
+
+// dohResponseWriter captures the DNS response of a DNS-over-HTTPS query
+type dohResponseWriter struct {
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	msg        *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.localAddr }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remoteAddr }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	w.msg = m
+	return len(b), nil
+}
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
+
+// HTTP Handler for "/dns-query"
+func (h *DNSOverHTTPSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	var wire []byte
+	var err error
+
+	switch r.Method {
+	case "GET":
+		wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case "POST":
+		if r.Header.Get("Content-Type") != "application/dns-message" {
+			http.Error(w, "Unsupported media type", http.StatusUnsupportedMediaType)
+			return
+		}
+		wire, err = ioutil.ReadAll(io.LimitReader(r.Body, dohMaxMessageSize))
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err == nil {
+		err = req.Unpack(wire)
+	}
+	if err != nil {
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "could not parse DNS-over-HTTPS query: %v", err)
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	remoteAddr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		remoteAddr = &net.TCPAddr{}
+	}
+	localAddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		localAddr = &net.TCPAddr{}
+	}
+
+	rw := &dohResponseWriter{localAddr: localAddr, remoteAddr: remoteAddr}
+	h.DNSHandler.ServeDNS(rw, req)
+
+	// the DNS handler does not answer some queries, e.g. from ignored clients
+	if rw.msg == nil {
+		rw.msg = new(dns.Msg)
+		rw.msg.SetRcode(req, dns.RcodeRefused)
+	}
+
+	packed, err := rw.msg.Pack()
+	if err != nil {
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not pack DNS-over-HTTPS response: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dns-message")
+	// rebinding answers must not be cached
+	w.Header().Set("Cache-Control", "max-age=0")
+	w.Write(packed)
+}
@@ -1,12 +1,193 @@
 package singularity
 
 import (
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// FirewallRule is a firewall rule rejecting connections from a browser
+// used by the multiple A records DNS rebinding strategy
+type FirewallRule interface {
+	AddRule() error
+	RemoveRule() error
+}
+
+// FirewallRuleResult reports the outcome of adding or removing a firewall rule
+type FirewallRuleResult struct {
+	Action  string // "add" or "remove"
+	SrcAddr string
+	DstAddr string
+	DstPort string
+	Err     error // nil if the firewall command succeeded
+}
+
+// FirewallBackend creates firewall rules rejecting connections from a browser
+// used by the multiple A records DNS rebinding strategy.
+// Available reports whether the firewall can be used on this host.
+// Rules in dry run mode log the commands they would run instead of running them.
+// Rules match the source ports from srcPort to srcPort+srcPortRange,
+// or all source ports if srcPortRange is 0.
+// Other backends can be added with RegisterFirewallBackend.
+type FirewallBackend interface {
+	Name() string
+	Available() bool
+	NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+		dstAddr string, dstPort string) FirewallRule
+}
+
+// autoFirewallBackend selects the first available registered firewall backend
+const autoFirewallBackend = "auto"
+
+// firewallBackends are the registered firewall backends in order of preference
+// for automatic selection. Use RegisterFirewallBackend and LookupFirewallBackend
+// to access it safely.
+var firewallBackends = []FirewallBackend{}
+
+// firewallBackendsMutex guards firewallBackends
+var firewallBackendsMutex sync.RWMutex
+
+func init() {
+	for _, backend := range []FirewallBackend{&nftablesBackend{}, &iptablesBackend{},
+		&pfBackend{}, &windowsFirewallBackend{}} {
+		if err := RegisterFirewallBackend(backend); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterFirewallBackend adds a firewall backend, selected automatically
+// only if previously registered backends are not available.
+// It returns an error if a backend with the same name already exists.
+func RegisterFirewallBackend(backend FirewallBackend) error {
+	if backend == nil || backend.Name() == "" || backend.Name() == autoFirewallBackend {
+		return errors.New("firewall backend requires a name")
+	}
+
+	firewallBackendsMutex.Lock()
+	defer firewallBackendsMutex.Unlock()
+
+	for _, b := range firewallBackends {
+		if b.Name() == backend.Name() {
+			return fmt.Errorf("firewall backend %q already registered", backend.Name())
+		}
+	}
+	firewallBackends = append(firewallBackends, backend)
+	return nil
+}
+
+// LookupFirewallBackend returns the firewall backend registered under name.
+// "auto" selects the first available backend and "" selects iptables.
+func LookupFirewallBackend(name string) (FirewallBackend, error) {
+	if name == "" {
+		name = "iptables"
+	}
+
+	firewallBackendsMutex.RLock()
+	defer firewallBackendsMutex.RUnlock()
+
+	for _, backend := range firewallBackends {
+		if name == backend.Name() || (name == autoFirewallBackend && backend.Available()) {
+			return backend, nil
+		}
+	}
+	if name == autoFirewallBackend {
+		return nil, errors.New("no firewall backend available")
+	}
+	return nil, fmt.Errorf("unknown firewall backend %q", name)
+}
+
+// ListFirewallBackends returns the names of all firewall backends in order of preference
+func ListFirewallBackends() []string {
+	firewallBackendsMutex.RLock()
+	defer firewallBackendsMutex.RUnlock()
+
+	names := make([]string, 0, len(firewallBackends))
+	for _, backend := range firewallBackends {
+		names = append(names, backend.Name())
+	}
+	return names
+}
+
+// NewFirewallRule populates a firewall rule for the provided backend,
+// e.g. "iptables" (the default), "nftables", "pf", "windows", "ebpf" or "auto".
+// Rules in dry run mode log the commands they would run instead of running them.
+func NewFirewallRule(backend string, dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) (FirewallRule, error) {
+	b, err := LookupFirewallBackend(backend)
+	if err != nil {
+		return nil, err
+	}
+	return b.NewRule(dryRun, srcAddr, srcPort, srcPortRange, dstAddr, dstPort), nil
+}
+
+// maxFirewallSourcePortRange is the widest source port range of firewall rules
+const maxFirewallSourcePortRange = 65535
+
+// sourcePortRangeEnd returns the last source port matched by a firewall rule,
+// or "" if the rule matches all source ports.
+func sourcePortRangeEnd(srcPort string, srcPortRange int) string {
+	port, err := strconv.Atoi(srcPort)
+	if srcPortRange <= 0 || err != nil {
+		return ""
+	}
+	if port+srcPortRange > 65535 {
+		return "65535"
+	}
+	return strconv.Itoa(port + srcPortRange)
+}
+
+// commandAvailable checks that a firewall command is installed
+func commandAvailable(path string) bool {
+	_, err := exec.LookPath(path)
+	return err == nil
+}
+
+// runFirewallCommand runs a firewall command and returns its output,
+// or only logs it in dry run mode.
+// Errors include the command and its output.
+func runFirewallCommand(dryRun bool, cmd *exec.Cmd) (string, error) {
+	if dryRun {
+		logEvent(LogInfo, "Firewall", nil, "dry run: %v", cmd.String())
+		return "", nil
+	}
+	out, err := cmd.CombinedOutput()
+	logEvent(LogDebug, "Firewall", nil, "`%v` finished with return code: %v", filepath.Base(cmd.Path), err)
+	if err != nil {
+		return string(out), fmt.Errorf("`%v` failed: %v: %v", cmd.String(), err, strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// iptablesBackend creates Linux iptables rules
+type iptablesBackend struct{}
+
+func (*iptablesBackend) Name() string    { return "iptables" }
+func (*iptablesBackend) Available() bool { return commandAvailable(iptablesCommand) }
+func (*iptablesBackend) NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) FirewallRule {
+	rule := NewIPTableRule(srcAddr, srcPort, dstAddr, dstPort)
+	rule.dryRun = dryRun
+	if srcPortRange > 0 {
+		rule.generateSourcePortRange(srcPortRange)
+		rule.matchSrcPortRange = true
+	}
+	return rule
+}
+
+const iptablesCommand = "/sbin/iptables"
+
+// ip6tablesCommand manages the rules of IPv6 connections
+const ip6tablesCommand = "/sbin/ip6tables"
+
 //IPTablesRule is a struct representing a linux iptable firewall rule
 type IPTablesRule struct {
 	srcAddr      string
@@ -14,6 +195,9 @@ type IPTablesRule struct {
 	dstAddr      string
 	dstPort      string
 	srcPortRange string
+	dryRun       bool
+	// restrict the rule to srcPortRange, otherwise all source ports match
+	matchSrcPortRange bool
 }
 
 //NewIPTableRule populate an iptables rule
@@ -47,21 +231,262 @@ func (ipt *IPTablesRule) generateSourcePortRange(max int) {
 
 }
 
-func (ipt *IPTablesRule) makeAndRunRule(command string) {
-	rule := exec.Command("/sbin/iptables",
-		command, "INPUT", "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset",
-		"--source", ipt.srcAddr, //"--sport" srcPortRange,
-		"--destination", ipt.dstAddr, "--destination-port", ipt.dstPort)
-	err := rule.Run()
-	log.Printf("Firewall: `iptables` finished with return code: %v", err)
+// command returns the iptables command of the address family of the rule
+func (ipt *IPTablesRule) command() string {
+	if ip := net.ParseIP(ipt.srcAddr); ip != nil && ip.To4() == nil {
+		return ip6tablesCommand
+	}
+	return iptablesCommand
+}
+
+func (ipt *IPTablesRule) makeAndRunRule(command string) error {
+	args := []string{command, "INPUT", "-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset",
+		"--source", ipt.srcAddr,
+		"--destination", ipt.dstAddr, "--destination-port", ipt.dstPort}
+	if ipt.matchSrcPortRange {
+		args = append(args, "--source-port", ipt.srcPortRange)
+	}
+	_, err := runFirewallCommand(ipt.dryRun, exec.Command(ipt.command(), args...))
+	return err
 }
 
 //AddRule adds an iptables rule in Linux iptable
-func (ipt *IPTablesRule) AddRule() {
-	ipt.makeAndRunRule("-A")
+func (ipt *IPTablesRule) AddRule() error {
+	return ipt.makeAndRunRule("-A")
 }
 
 //RemoveRule removes an iptables rule in Linux iptable
-func (ipt *IPTablesRule) RemoveRule() {
-	ipt.makeAndRunRule("-D")
+func (ipt *IPTablesRule) RemoveRule() error {
+	return ipt.makeAndRunRule("-D")
+}
+
+// nftablesBackend creates Linux nftables rules
+type nftablesBackend struct{}
+
+func (*nftablesBackend) Name() string    { return "nftables" }
+func (*nftablesBackend) Available() bool { return commandAvailable(nftCommand) }
+func (*nftablesBackend) NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) FirewallRule {
+	rule := NewNFTablesRule(srcAddr, srcPort, dstAddr, dstPort)
+	rule.dryRun = dryRun
+	rule.srcPortEnd = sourcePortRangeEnd(srcPort, srcPortRange)
+	return rule
+}
+
+const nftCommand = "/usr/sbin/nft"
+
+// nftables rules live in their own table so they do not interfere
+// with the rest of the host's ruleset.
+const (
+	nftablesTable = "singularity"
+	nftablesChain = "input"
+)
+
+var nftablesHandleRegexp = regexp.MustCompile(`# handle (\d+)`)
+
+//NFTablesRule is a struct representing a linux nftables firewall rule
+type NFTablesRule struct {
+	srcAddr string
+	srcPort string
+	dstAddr string
+	dstPort string
+	handle  string
+	dryRun  bool
+	// last source port matched by the rule, all source ports if empty
+	srcPortEnd string
+}
+
+//NewNFTablesRule populates an nftables rule
+func NewNFTablesRule(srcAddr string, srcPort string,
+	dstAddr string, dstPort string) *NFTablesRule {
+	return &NFTablesRule{srcAddr: srcAddr, srcPort: srcPort,
+		dstAddr: dstAddr, dstPort: dstPort}
+}
+
+func (nft *NFTablesRule) run(args ...string) (string, error) {
+	return runFirewallCommand(nft.dryRun, exec.Command(nftCommand, args...))
+}
+
+// addressFamily returns the nftables address family keyword of an IP address
+func (nft *NFTablesRule) addressFamily() string {
+	if ip := net.ParseIP(nft.srcAddr); ip != nil && ip.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+//AddRule adds an nftables rule and records its handle for later removal
+func (nft *NFTablesRule) AddRule() error {
+	if _, err := nft.run("add", "table", "inet", nftablesTable); err != nil {
+		return err
+	}
+	if _, err := nft.run("add", "chain", "inet", nftablesTable, nftablesChain,
+		"{ type filter hook input priority 0 ; }"); err != nil {
+		return err
+	}
+
+	args := []string{"--echo", "--handle", "add", "rule", "inet", nftablesTable, nftablesChain,
+		nft.addressFamily(), "saddr", nft.srcAddr,
+		nft.addressFamily(), "daddr", nft.dstAddr,
+		"tcp", "dport", nft.dstPort}
+	if nft.srcPortEnd != "" {
+		args = append(args, "tcp", "sport", nft.srcPort+"-"+nft.srcPortEnd)
+	}
+	out, err := nft.run(append(args, "reject", "with", "tcp", "reset")...)
+	if err != nil {
+		return err
+	}
+
+	if nft.dryRun {
+		nft.handle = "<handle>"
+		return nil
+	}
+
+	match := nftablesHandleRegexp.FindStringSubmatch(out)
+	if match == nil {
+		return errors.New("could not find handle of nftables rule")
+	}
+	nft.handle = match[1]
+	return nil
+}
+
+//RemoveRule removes a previously added nftables rule
+func (nft *NFTablesRule) RemoveRule() error {
+	if nft.handle == "" {
+		return errors.New("nftables rule was not added")
+	}
+	_, err := nft.run("delete", "rule", "inet", nftablesTable, nftablesChain, "handle", nft.handle)
+	return err
+}
+
+// pfBackend creates pf rules on macOS and BSD hosts.
+// Rules are loaded in sub-anchors of pfAnchor, which must be referenced
+// from the main ruleset, e.g. with 'anchor "singularity/*"' in /etc/pf.conf,
+// and pf must be enabled with "pfctl -e".
+type pfBackend struct{}
+
+func (*pfBackend) Name() string { return "pf" }
+func (*pfBackend) Available() bool {
+	return runtime.GOOS != "linux" && runtime.GOOS != "windows" && commandAvailable(pfctlCommand)
+}
+func (*pfBackend) NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) FirewallRule {
+	rule := NewPFRule(srcAddr, srcPort, dstAddr, dstPort)
+	rule.dryRun = dryRun
+	rule.srcPortEnd = sourcePortRangeEnd(srcPort, srcPortRange)
+	return rule
+}
+
+const (
+	pfctlCommand = "/sbin/pfctl"
+	pfAnchor     = "singularity"
+)
+
+// firewallRuleNameReplacer makes addresses usable in pf anchor and Windows rule names
+var firewallRuleNameReplacer = strings.NewReplacer(".", "_", ":", "_")
+
+//PFRule is a struct representing a pf firewall rule
+type PFRule struct {
+	srcAddr string
+	srcPort string
+	dstAddr string
+	dstPort string
+	dryRun  bool
+	// last source port matched by the rule, all source ports if empty
+	srcPortEnd string
+}
+
+//NewPFRule populates a pf rule
+func NewPFRule(srcAddr string, srcPort string,
+	dstAddr string, dstPort string) *PFRule {
+	return &PFRule{srcAddr: srcAddr, srcPort: srcPort,
+		dstAddr: dstAddr, dstPort: dstPort}
+}
+
+// anchor returns the sub-anchor holding the rule, unique per browser connection
+func (pf *PFRule) anchor() string {
+	return fmt.Sprintf("%v/%v_%v_%v", pfAnchor, firewallRuleNameReplacer.Replace(pf.srcAddr),
+		pf.srcPort, pf.dstPort)
+}
+
+//AddRule loads a pf rule in its own anchor
+func (pf *PFRule) AddRule() error {
+	cmd := exec.Command(pfctlCommand, "-a", pf.anchor(), "-f", "-")
+	from := pf.srcAddr
+	if pf.srcPortEnd != "" {
+		from = fmt.Sprintf("%v port %v:%v", pf.srcAddr, pf.srcPort, pf.srcPortEnd)
+	}
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("block return-rst in quick proto tcp from %v to %v port %v\n",
+		from, pf.dstAddr, pf.dstPort))
+	_, err := runFirewallCommand(pf.dryRun, cmd)
+	return err
+}
+
+//RemoveRule flushes the anchor of a pf rule
+func (pf *PFRule) RemoveRule() error {
+	_, err := runFirewallCommand(pf.dryRun, exec.Command(pfctlCommand, "-a", pf.anchor(), "-F", "rules"))
+	return err
+}
+
+// windowsFirewallBackend creates Windows Defender Firewall rules,
+// enforced by the Windows Filtering Platform, with netsh.
+// Blocked connections are dropped rather than reset,
+// so browsers fall back to the other address after a connection timeout.
+type windowsFirewallBackend struct{}
+
+func (*windowsFirewallBackend) Name() string { return "windows" }
+func (*windowsFirewallBackend) Available() bool {
+	return runtime.GOOS == "windows" && commandAvailable(netshCommand)
+}
+func (*windowsFirewallBackend) NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) FirewallRule {
+	rule := NewWindowsFirewallRule(srcAddr, srcPort, dstAddr, dstPort)
+	rule.dryRun = dryRun
+	rule.srcPortEnd = sourcePortRangeEnd(srcPort, srcPortRange)
+	return rule
+}
+
+const netshCommand = "netsh"
+
+//WindowsFirewallRule is a struct representing a Windows Defender Firewall rule
+type WindowsFirewallRule struct {
+	srcAddr string
+	srcPort string
+	dstAddr string
+	dstPort string
+	dryRun  bool
+	// last source port matched by the rule, all source ports if empty
+	srcPortEnd string
+}
+
+//NewWindowsFirewallRule populates a Windows Defender Firewall rule
+func NewWindowsFirewallRule(srcAddr string, srcPort string,
+	dstAddr string, dstPort string) *WindowsFirewallRule {
+	return &WindowsFirewallRule{srcAddr: srcAddr, srcPort: srcPort,
+		dstAddr: dstAddr, dstPort: dstPort}
+}
+
+// name returns the name of the rule, unique per browser connection
+func (wf *WindowsFirewallRule) name() string {
+	return fmt.Sprintf("name=singularity_%v_%v_%v", firewallRuleNameReplacer.Replace(wf.srcAddr),
+		wf.srcPort, wf.dstPort)
+}
+
+//AddRule adds an inbound blocking rule with netsh
+func (wf *WindowsFirewallRule) AddRule() error {
+	args := []string{"advfirewall", "firewall", "add", "rule",
+		wf.name(), "dir=in", "action=block", "protocol=TCP",
+		"remoteip=" + wf.srcAddr, "localip=" + wf.dstAddr, "localport=" + wf.dstPort}
+	if wf.srcPortEnd != "" {
+		args = append(args, "remoteport="+wf.srcPort+"-"+wf.srcPortEnd)
+	}
+	_, err := runFirewallCommand(wf.dryRun, exec.Command(netshCommand, args...))
+	return err
+}
+
+//RemoveRule deletes a previously added rule with netsh
+func (wf *WindowsFirewallRule) RemoveRule() error {
+	_, err := runFirewallCommand(wf.dryRun, exec.Command(netshCommand, "advfirewall", "firewall", "delete", "rule",
+		wf.name()))
+	return err
 }
@@ -0,0 +1,425 @@
+//go:build linux
+// +build linux
+
+package singularity
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"github.com/cilium/ebpf/link"
+	"github.com/cilium/ebpf/rlimit"
+)
+
+func init() {
+	if err := RegisterFirewallBackend(&ebpfBackend{}); err != nil {
+		panic(err)
+	}
+}
+
+// ebpfBackend drops the connections of browsers with an eBPF program
+// attached to the TC ingress hook of the network interfaces,
+// without spawning firewall processes: rules are entries of a map
+// looked up by the program, effective as soon as AddRule returns.
+// The program and its rules are removed when singularity exits.
+// It requires Linux 6.6 or later (TCX links) and CAP_BPF and CAP_NET_ADMIN.
+// Blocked connections are dropped rather than reset,
+// so browsers fall back to the other address after a connection timeout.
+type ebpfBackend struct {
+	sync.Mutex
+	// rules maps connections to the source ports dropped,
+	// nil until the program is loaded
+	rules ebpfRuleMap
+	prog  *ebpf.Program
+	// TC ingress links of the program by interface index
+	links map[int]link.Link
+	// source port ranges of the rules added per connection,
+	// the map holds the smallest range spanning them
+	active map[ebpfRuleKey][]ebpfPortRange
+}
+
+// ebpfRuleMap is the map of dropped connections, an *ebpf.Map
+type ebpfRuleMap interface {
+	Put(key, value interface{}) error
+	Delete(key interface{}) error
+}
+
+// ebpfRuleKey is a connection dropped by the eBPF program.
+// IPv4 addresses are stored as IPv4-mapped IPv6 addresses.
+type ebpfRuleKey struct {
+	SrcAddr [16]byte
+	DstAddr [16]byte
+	DstPort [2]byte // network byte order
+	_       [2]byte
+}
+
+// ebpfPortRange are the source ports dropped for a connection, in host byte order
+type ebpfPortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (*ebpfBackend) Name() string    { return "ebpf" }
+func (*ebpfBackend) Available() bool { return haveTCXLinks() == nil }
+
+// haveTCXLinks checks that TC programs can be loaded and attached with TCX links
+// by attaching a program to a missing interface:
+// the kernel fails with ENODEV if it supports TCX links.
+func haveTCXLinks() error {
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{Type: ebpf.SchedCLS, License: "GPL",
+		Instructions: asm.Instructions{asm.Mov.Imm(asm.R0, tcActOK), asm.Return()}})
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	l, err := link.AttachTCX(link.TCXOptions{Interface: math.MaxInt32, Program: prog,
+		Attach: ebpf.AttachTCXIngress})
+	if err == nil {
+		l.Close()
+		return nil
+	}
+	if errors.Is(err, syscall.ENODEV) {
+		return nil
+	}
+	return err
+}
+func (b *ebpfBackend) NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) FirewallRule {
+	rule := &ebpfRule{backend: b, srcAddr: srcAddr, srcPort: srcPort, dstAddr: dstAddr, dstPort: dstPort,
+		dryRun: dryRun}
+	rule.srcPortEnd = sourcePortRangeEnd(srcPort, srcPortRange)
+	return rule
+}
+
+// ebpfRule is a connection dropped by the eBPF program of ebpfBackend
+type ebpfRule struct {
+	backend *ebpfBackend
+	srcAddr string
+	srcPort string
+	dstAddr string
+	dstPort string
+	dryRun  bool
+	// last source port matched by the rule, all source ports if empty
+	srcPortEnd string
+}
+
+// keyAndRange returns the map key of the rule and the source ports it drops
+func (r *ebpfRule) keyAndRange() (ebpfRuleKey, ebpfPortRange, error) {
+	var key ebpfRuleKey
+	srcIP, dstIP := net.ParseIP(r.srcAddr), net.ParseIP(r.dstAddr)
+	if srcIP == nil || dstIP == nil {
+		return key, ebpfPortRange{}, fmt.Errorf("invalid addresses %q and %q", r.srcAddr, r.dstAddr)
+	}
+	copy(key.SrcAddr[:], srcIP.To16())
+	copy(key.DstAddr[:], dstIP.To16())
+	dstPort, err := strconv.ParseUint(r.dstPort, 10, 16)
+	if err != nil {
+		return key, ebpfPortRange{}, fmt.Errorf("invalid destination port %q", r.dstPort)
+	}
+	binary.BigEndian.PutUint16(key.DstPort[:], uint16(dstPort))
+
+	ports := ebpfPortRange{First: 0, Last: 65535}
+	if r.srcPortEnd != "" {
+		first, err1 := strconv.ParseUint(r.srcPort, 10, 16)
+		last, err2 := strconv.ParseUint(r.srcPortEnd, 10, 16)
+		if err1 != nil || err2 != nil {
+			return key, ebpfPortRange{}, fmt.Errorf("invalid source ports %v-%v", r.srcPort, r.srcPortEnd)
+		}
+		ports = ebpfPortRange{First: uint16(first), Last: uint16(last)}
+	}
+	return key, ports, nil
+}
+
+// String describes the rule, e.g. in dry run mode
+func (r *ebpfRule) String() string {
+	ports := "any port"
+	if r.srcPortEnd != "" {
+		ports = "ports " + r.srcPort + "-" + r.srcPortEnd
+	}
+	return fmt.Sprintf("drop tcp from %v %v to %v",
+		r.srcAddr, ports, net.JoinHostPort(r.dstAddr, r.dstPort))
+}
+
+// AddRule drops the connections of the rule
+func (r *ebpfRule) AddRule() error {
+	key, ports, err := r.keyAndRange()
+	if err != nil {
+		return err
+	}
+	if r.dryRun {
+		logEvent(LogInfo, "Firewall", nil, "dry run: ebpf add: %v", r)
+		return nil
+	}
+	return r.backend.add(key, ports)
+}
+
+// RemoveRule stops dropping the connections of the rule
+func (r *ebpfRule) RemoveRule() error {
+	key, ports, err := r.keyAndRange()
+	if err != nil {
+		return err
+	}
+	if r.dryRun {
+		logEvent(LogInfo, "Firewall", nil, "dry run: ebpf remove: %v", r)
+		return nil
+	}
+	return r.backend.remove(key, ports)
+}
+
+// add records the source ports of a rule and updates the map.
+// The program is loaded and attached on first use.
+func (b *ebpfBackend) add(key ebpfRuleKey, ports ebpfPortRange) error {
+	b.Lock()
+	defer b.Unlock()
+	if b.rules == nil {
+		if err := b.load(); err != nil {
+			return err
+		}
+	}
+	if b.active == nil {
+		b.active = make(map[ebpfRuleKey][]ebpfPortRange)
+	}
+	b.active[key] = append(b.active[key], ports)
+	if err := b.rules.Put(key, spanPortRanges(b.active[key])); err != nil {
+		b.active[key] = b.active[key][:len(b.active[key])-1]
+		if len(b.active[key]) == 0 {
+			delete(b.active, key)
+		}
+		return fmt.Errorf("could not add eBPF firewall rule: %v", err)
+	}
+	return nil
+}
+
+// remove forgets the source ports of a rule and updates the map,
+// deleting the connection once no rule drops it.
+func (b *ebpfBackend) remove(key ebpfRuleKey, ports ebpfPortRange) error {
+	b.Lock()
+	defer b.Unlock()
+	rules := b.active[key]
+	found := -1
+	for i, r := range rules {
+		if r == ports {
+			found = i
+			break
+		}
+	}
+	if found == -1 {
+		return errors.New("eBPF firewall rule was not added")
+	}
+	rules = append(rules[:found:found], rules[found+1:]...)
+	if len(rules) == 0 {
+		delete(b.active, key)
+		if err := b.rules.Delete(key); err != nil {
+			return fmt.Errorf("could not remove eBPF firewall rule: %v", err)
+		}
+		return nil
+	}
+	b.active[key] = rules
+	if err := b.rules.Put(key, spanPortRanges(rules)); err != nil {
+		return fmt.Errorf("could not remove eBPF firewall rule: %v", err)
+	}
+	return nil
+}
+
+// spanPortRanges returns the smallest port range spanning ranges
+func spanPortRanges(ranges []ebpfPortRange) ebpfPortRange {
+	span := ranges[0]
+	for _, r := range ranges[1:] {
+		if r.First < span.First {
+			span.First = r.First
+		}
+		if r.Last > span.Last {
+			span.Last = r.Last
+		}
+	}
+	return span
+}
+
+// ebpfMaxRules bounds the number of connections dropped at once
+const ebpfMaxRules = 4096
+
+// load creates the map and the program and attaches it to the TC ingress hook
+// of the loopback and Ethernet interfaces.
+// Interfaces added afterwards are not covered.
+// Must hold b mutex.
+func (b *ebpfBackend) load() error {
+	if err := rlimit.RemoveMemlock(); err != nil {
+		return fmt.Errorf("could not load eBPF firewall: %v", err)
+	}
+	rules, err := ebpf.NewMap(&ebpf.MapSpec{Name: "singularity_fw", Type: ebpf.Hash,
+		KeySize: uint32(binary.Size(ebpfRuleKey{})), ValueSize: uint32(binary.Size(ebpfPortRange{})),
+		MaxEntries: ebpfMaxRules})
+	if err != nil {
+		return fmt.Errorf("could not create eBPF firewall map: %v", err)
+	}
+	prog, err := newEBPFFirewallProgram(rules)
+	if err != nil {
+		rules.Close()
+		return err
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		prog.Close()
+		rules.Close()
+		return err
+	}
+	links := make(map[int]link.Link)
+	for _, iface := range ifaces {
+		// the program parses Ethernet frames
+		if iface.Flags&net.FlagLoopback == 0 && len(iface.HardwareAddr) != 6 {
+			continue
+		}
+		l, err := link.AttachTCX(link.TCXOptions{Interface: iface.Index, Program: prog,
+			Attach: ebpf.AttachTCXIngress})
+		if err != nil {
+			for _, l := range links {
+				l.Close()
+			}
+			prog.Close()
+			rules.Close()
+			return fmt.Errorf("could not attach eBPF firewall to %v: %v", iface.Name, err)
+		}
+		links[iface.Index] = l
+	}
+	logEvent(LogInfo, "Firewall", nil, "eBPF firewall attached to %v interfaces", len(links))
+
+	b.rules, b.prog, b.links = rules, prog, links
+	return nil
+}
+
+// htons converts a 16-bit value to network byte order as read by eBPF programs
+func htons(v uint16) uint16 {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return binary.NativeEndian.Uint16(b[:])
+}
+
+// TC actions returned by the eBPF program
+const (
+	tcActOK   = 0
+	tcActShot = 2
+)
+
+// Stack offsets of the eBPF program: the map key,
+// the TCP source and destination ports and the IP header
+const (
+	ebpfKeyOff    = -40
+	ebpfPortsOff  = -48
+	ebpfHeaderOff = -104
+)
+
+// newEBPFFirewallProgram returns a TC program dropping the TCP packets
+// of the connections in rules, from source ports within their range.
+// IPv6 packets with extension headers are not inspected.
+func newEBPFFirewallProgram(rules *ebpf.Map) (*ebpf.Program, error) {
+	const ethHeaderLen = 14
+	insns := asm.Instructions{
+		asm.Mov.Reg(asm.R6, asm.R1),
+		asm.StoreImm(asm.RFP, ebpfKeyOff, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+8, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+16, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+24, 0, asm.DWord),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+32, 0, asm.Word),
+		// skb->protocol
+		asm.LoadMem(asm.R2, asm.R6, 16, asm.Word),
+		asm.JEq.Imm(asm.R2, int32(htons(0x0800)), "ipv4"),
+		asm.JEq.Imm(asm.R2, int32(htons(0x86dd)), "ipv6"),
+		asm.Ja.Label("pass"),
+
+		// IPv4 header without options
+		asm.Mov.Reg(asm.R1, asm.R6).WithSymbol("ipv4"),
+		asm.Mov.Imm(asm.R2, ethHeaderLen),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, ebpfHeaderOff),
+		asm.Mov.Imm(asm.R4, 20),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		// TCP, not a fragment
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+9, asm.Byte),
+		asm.JNE.Imm(asm.R2, 6, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+6, asm.Byte),
+		asm.And.Imm(asm.R2, 0x1f),
+		asm.JNE.Imm(asm.R2, 0, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+7, asm.Byte),
+		asm.JNE.Imm(asm.R2, 0, "pass"),
+		// IPv4-mapped source and destination addresses
+		asm.StoreImm(asm.RFP, ebpfKeyOff+10, 0xff, asm.Byte),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+11, 0xff, asm.Byte),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+12, asm.Word),
+		asm.StoreMem(asm.RFP, ebpfKeyOff+12, asm.R2, asm.Word),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+26, 0xff, asm.Byte),
+		asm.StoreImm(asm.RFP, ebpfKeyOff+27, 0xff, asm.Byte),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+16, asm.Word),
+		asm.StoreMem(asm.RFP, ebpfKeyOff+28, asm.R2, asm.Word),
+		// TCP header offset from the header length
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff, asm.Byte),
+		asm.And.Imm(asm.R2, 0x0f),
+		asm.LSh.Imm(asm.R2, 2),
+		asm.JLT.Imm(asm.R2, 20, "pass"),
+		asm.Add.Imm(asm.R2, ethHeaderLen),
+		asm.Ja.Label("ports"),
+
+		// IPv6 header
+		asm.Mov.Reg(asm.R1, asm.R6).WithSymbol("ipv6"),
+		asm.Mov.Imm(asm.R2, ethHeaderLen),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, ebpfHeaderOff),
+		asm.Mov.Imm(asm.R4, 40),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+6, asm.Byte),
+		asm.JNE.Imm(asm.R2, 6, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+8, asm.DWord),
+		asm.StoreMem(asm.RFP, ebpfKeyOff, asm.R2, asm.DWord),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+16, asm.DWord),
+		asm.StoreMem(asm.RFP, ebpfKeyOff+8, asm.R2, asm.DWord),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+24, asm.DWord),
+		asm.StoreMem(asm.RFP, ebpfKeyOff+16, asm.R2, asm.DWord),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfHeaderOff+32, asm.DWord),
+		asm.StoreMem(asm.RFP, ebpfKeyOff+24, asm.R2, asm.DWord),
+		asm.Mov.Imm(asm.R2, ethHeaderLen+40),
+
+		// TCP ports at offset R2
+		asm.Mov.Reg(asm.R1, asm.R6).WithSymbol("ports"),
+		asm.Mov.Reg(asm.R3, asm.RFP),
+		asm.Add.Imm(asm.R3, ebpfPortsOff),
+		asm.Mov.Imm(asm.R4, 4),
+		asm.FnSkbLoadBytes.Call(),
+		asm.JNE.Imm(asm.R0, 0, "pass"),
+		asm.LoadMem(asm.R2, asm.RFP, ebpfPortsOff+2, asm.Half),
+		asm.StoreMem(asm.RFP, ebpfKeyOff+32, asm.R2, asm.Half),
+		asm.LoadMapPtr(asm.R1, rules.FD()),
+		asm.Mov.Reg(asm.R2, asm.RFP),
+		asm.Add.Imm(asm.R2, ebpfKeyOff),
+		asm.FnMapLookupElem.Call(),
+		asm.JEq.Imm(asm.R0, 0, "pass"),
+		// drop source ports within the range of the rule
+		asm.LoadMem(asm.R2, asm.RFP, ebpfPortsOff, asm.Half),
+		asm.HostTo(asm.BE, asm.R2, asm.Half),
+		asm.LoadMem(asm.R3, asm.R0, 0, asm.Half),
+		asm.JLT.Reg(asm.R2, asm.R3, "pass"),
+		asm.LoadMem(asm.R3, asm.R0, 2, asm.Half),
+		asm.JGT.Reg(asm.R2, asm.R3, "pass"),
+		asm.Mov.Imm(asm.R0, tcActShot),
+		asm.Return(),
+
+		asm.Mov.Imm(asm.R0, tcActOK).WithSymbol("pass"),
+		asm.Return(),
+	}
+
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{Name: "singularity_fw", Type: ebpf.SchedCLS,
+		License: "GPL", Instructions: insns})
+	if err != nil {
+		return nil, fmt.Errorf("could not load eBPF firewall program: %v", err)
+	}
+	return prog, nil
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package singularity
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/cilium/ebpf"
+)
+
+// fakeEBPFRuleMap records the entries of the map of dropped connections
+type fakeEBPFRuleMap map[ebpfRuleKey]ebpfPortRange
+
+func (m fakeEBPFRuleMap) Put(key, value interface{}) error {
+	m[key.(ebpfRuleKey)] = value.(ebpfPortRange)
+	return nil
+}
+
+func (m fakeEBPFRuleMap) Delete(key interface{}) error {
+	delete(m, key.(ebpfRuleKey))
+	return nil
+}
+
+func TestEBPFFirewallRuleLifecycle(t *testing.T) {
+	rules := fakeEBPFRuleMap{}
+	backend := &ebpfBackend{rules: rules}
+
+	wide := backend.NewRule(false, "192.0.2.1", "40000", 0, "198.51.100.1", "80")
+	narrow := backend.NewRule(false, "192.0.2.1", "40000", 10, "198.51.100.1", "80")
+	dryRun := backend.NewRule(true, "192.0.2.2", "40000", 0, "198.51.100.1", "80")
+
+	key, _, err := narrow.(*ebpfRule).keyAndRange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if net.IP(key.SrcAddr[:]).String() != "192.0.2.1" || binary.BigEndian.Uint16(key.DstPort[:]) != 80 {
+		t.Fatalf("unexpected key %+v", key)
+	}
+
+	if err := narrow.AddRule(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rules[key]; got != (ebpfPortRange{40000, 40010}) {
+		t.Errorf("expected source ports 40000-40010, got %v", got)
+	}
+	if err := wide.AddRule(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rules[key]; got != (ebpfPortRange{0, 65535}) {
+		t.Errorf("expected all source ports, got %v", got)
+	}
+	if err := dryRun.AddRule(); err != nil || len(rules) != 1 {
+		t.Errorf("expected dry run rules to leave the map unchanged, got %v (%v)", rules, err)
+	}
+
+	// the connection is dropped until both rules are removed
+	if err := wide.RemoveRule(); err != nil {
+		t.Fatal(err)
+	}
+	if got := rules[key]; got != (ebpfPortRange{40000, 40010}) {
+		t.Errorf("expected source ports 40000-40010 after removing a rule, got %v", got)
+	}
+	if err := narrow.RemoveRule(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 0 || len(backend.active) != 0 {
+		t.Errorf("expected no rules left, got %v", rules)
+	}
+	if err := narrow.RemoveRule(); err == nil {
+		t.Error("expected an error removing a rule twice")
+	}
+}
+
+func TestEBPFBackendAvailable(t *testing.T) {
+	backend := &ebpfBackend{}
+	if !backend.Available() {
+		t.Skip("cannot attach eBPF programs with TCX links")
+	}
+	backend.Lock()
+	err := backend.load()
+	backend.Unlock()
+	if err != nil {
+		t.Fatalf("expected an available backend to attach its program, got %v", err)
+	}
+	for _, l := range backend.links {
+		l.Close()
+	}
+	backend.prog.Close()
+	backend.rules.(*ebpf.Map).Close()
+}
+
+// tcpFrame returns an Ethernet frame carrying a TCP SYN from src to dst
+func tcpFrame(src, dst net.IP, srcPort, dstPort uint16) []byte {
+	frame := make([]byte, 14)
+	var ip []byte
+	if src.To4() != nil {
+		binary.BigEndian.PutUint16(frame[12:], 0x0800)
+		ip = make([]byte, 20)
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], 40)
+		ip[8] = 64
+		ip[9] = 6
+		copy(ip[12:], src.To4())
+		copy(ip[16:], dst.To4())
+	} else {
+		binary.BigEndian.PutUint16(frame[12:], 0x86dd)
+		ip = make([]byte, 40)
+		ip[0] = 0x60
+		binary.BigEndian.PutUint16(ip[4:], 20)
+		ip[6] = 6
+		ip[7] = 64
+		copy(ip[8:], src.To16())
+		copy(ip[24:], dst.To16())
+	}
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x02
+	return append(append(frame, ip...), tcp...)
+}
+
+func TestEBPFFirewallProgram(t *testing.T) {
+	rules, err := ebpf.NewMap(&ebpf.MapSpec{Type: ebpf.Hash, KeySize: uint32(binary.Size(ebpfRuleKey{})),
+		ValueSize: uint32(binary.Size(ebpfPortRange{})), MaxEntries: 8})
+	if err != nil {
+		t.Skipf("cannot create eBPF maps: %v", err)
+	}
+	defer rules.Close()
+	prog, err := newEBPFFirewallProgram(rules)
+	if err != nil {
+		t.Skipf("cannot load eBPF programs: %v", err)
+	}
+	defer prog.Close()
+
+	backend := &ebpfBackend{rules: rules}
+	tests := []struct {
+		src, dst string
+	}{
+		{"192.0.2.1", "198.51.100.1"},
+		{"2001:db8::1", "2001:db8::2"},
+	}
+	for _, tt := range tests {
+		src, dst := net.ParseIP(tt.src), net.ParseIP(tt.dst)
+		run := func(srcPort, dstPort uint16) uint32 {
+			ret, _, err := prog.Test(tcpFrame(src, dst, srcPort, dstPort))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return ret
+		}
+
+		rule := backend.NewRule(false, tt.src, "40000", 10, tt.dst, "80")
+		if err := rule.AddRule(); err != nil {
+			t.Fatal(err)
+		}
+		if ret := run(40005, 80); ret != tcActShot {
+			t.Errorf("%v: expected packets of the rule to be dropped, got %v", tt.src, ret)
+		}
+		if ret := run(40011, 80); ret != tcActOK {
+			t.Errorf("%v: expected packets from other source ports to pass, got %v", tt.src, ret)
+		}
+		if ret := run(40005, 443); ret != tcActOK {
+			t.Errorf("%v: expected packets to other ports to pass, got %v", tt.src, ret)
+		}
+		if err := rule.RemoveRule(); err != nil {
+			t.Fatal(err)
+		}
+		if ret := run(40005, 80); ret != tcActOK {
+			t.Errorf("%v: expected packets to pass once the rule is removed, got %v", tt.src, ret)
+		}
+	}
+}
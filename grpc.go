@@ -0,0 +1,308 @@
+package singularity
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nccgroup/singularity/proto/singularityv1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// NewGRPCServer returns a gRPC server of the control API (proto/singularity.proto)
+// managing the servers, DNS sessions, loot and session payloads of hss.
+// Calls are authorized like the management endpoints behind AdminHandler:
+// clients must connect from AppConfig.AdminAllowedFrom if set and supply AuthToken
+// or an operator token as a bearer token in the "authorization" metadata,
+// unless DisableAdminAuth is set and there are no operators.
+// Operators only see and manage their own sessions, loot and dynamic servers.
+func NewGRPCServer(hss *HTTPServerStoreHandler) *grpc.Server {
+	s := grpc.NewServer(grpc.UnaryInterceptor(hss.authorizeGRPC))
+	singularityv1.RegisterControlServer(s, &ControlServer{hss: hss})
+	return s
+}
+
+// StartGRPCServer serves the gRPC server s on addr
+func StartGRPCServer(s *grpc.Server, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		logEvent(LogInfo, "gRPC", LogFields{"addr": addr}, "starting gRPC Server on %v", addr)
+		s.Serve(l)
+	}()
+	return nil
+}
+
+// grpcOperatorKey is the context key of the operator of a gRPC call
+type grpcOperatorKey struct{}
+
+// grpcOperator returns the operator of an authorized gRPC call, nil for the administrator
+func grpcOperator(ctx context.Context) *Operator {
+	op, _ := ctx.Value(grpcOperatorKey{}).(*Operator)
+	return op
+}
+
+// authorizeGRPC is a gRPC interceptor authorizing calls like authorizeAdmin
+// and recording the operator of the call in its context
+func (hss *HTTPServerStoreHandler) authorizeGRPC(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	remoteAddr := ""
+	fields := LogFields{}
+	if p, ok := peer.FromContext(ctx); ok {
+		remoteAddr = p.Addr.String()
+		fields = connFields(p.Addr)
+	}
+	fields["method"] = info.FullMethod
+
+	if allowed := hss.appConfig().AdminAllowedFrom; len(allowed) > 0 {
+		host, _, err := net.SplitHostPort(remoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !addrInIPNetList(ip, allowed) {
+			logEvent(LogWarn, "gRPC", fields, "rejected %v from %v: not in allowed admin clients",
+				info.FullMethod, remoteAddr)
+			return nil, status.Error(codes.PermissionDenied, "client address not allowed")
+		}
+	}
+
+	token := ""
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) > 0 && strings.HasPrefix(auth[0], "Bearer ") {
+		token = strings.TrimPrefix(auth[0], "Bearer ")
+	}
+	var op *Operator
+	if !hss.DisableAdminAuth || len(hss.operators()) > 0 {
+		var ok bool
+		if op, ok = hss.tokenOperator(token); !ok {
+			logEvent(LogWarn, "gRPC", fields, "unauthorized call to %v from %v", info.FullMethod, remoteAddr)
+			return nil, status.Error(codes.Unauthenticated, "missing or invalid token")
+		}
+	}
+
+	logEvent(LogInfo, "gRPC", fields, "%v from %v", info.FullMethod, remoteAddr)
+	return handler(context.WithValue(ctx, grpcOperatorKey{}, op), req)
+}
+
+// ControlServer implements the Control service of the gRPC control API
+type ControlServer struct {
+	singularityv1.UnimplementedControlServer
+	hss *HTTPServerStoreHandler
+}
+
+// grpcError converts an error of a management request to a gRPC status
+func grpcError(err *dynamicServerError) error {
+	code := codes.Internal
+	switch err.status {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusForbidden:
+		code = codes.PermissionDenied
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusConflict:
+		code = codes.FailedPrecondition
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		code = codes.ResourceExhausted
+	}
+	return status.Error(code, err.Error())
+}
+
+// grpcHTTPServer converts the description of an HTTP server
+func grpcHTTPServer(info httpServerInfo) *singularityv1.HTTPServer {
+	port, _ := strconv.Atoi(info.Port)
+	return &singularityv1.HTTPServer{Port: uint32(port), Scheme: info.Scheme, KeepAlive: info.KeepAlive,
+		Session: info.Session}
+}
+
+// ListHTTPServers lists the servers like GET /servers
+func (cs *ControlServer) ListHTTPServers(ctx context.Context,
+	req *singularityv1.ListHTTPServersRequest) (*singularityv1.ListHTTPServersResponse, error) {
+	config := cs.hss.serversConfig(grpcOperator(ctx))
+	resp := &singularityv1.ListHTTPServersResponse{AllowDynamicHttpServers: config.AllowDynamicHTTPServers,
+		PayloadPath: config.PayloadPath}
+	for _, info := range config.ServerInformation {
+		resp.Servers = append(resp.Servers, grpcHTTPServer(info))
+	}
+	return resp, nil
+}
+
+// CreateHTTPServer starts a dynamic server like PUT /servers
+func (cs *ControlServer) CreateHTTPServer(ctx context.Context,
+	req *singularityv1.CreateHTTPServerRequest) (*singularityv1.HTTPServer, error) {
+	hss := cs.hss
+	if !hss.AllowDynamicHTTPServers {
+		return nil, status.Error(codes.FailedPrecondition, "dynamic HTTP servers are not allowed")
+	}
+
+	// servers requested without port get a free port of DynamicHTTPServerPorts
+	port := int(req.Port)
+	if port == 0 && len(hss.appConfig().DynamicHTTPServerPorts) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "missing port")
+	}
+
+	op := grpcOperator(ctx)
+	if req.Session != "" && !op.owns(req.Session) {
+		return nil, status.Errorf(codes.PermissionDenied, "DNS session %q is not yours", req.Session)
+	}
+	if req.Session != "" && !hss.sessionExists(req.Session) {
+		return nil, status.Errorf(codes.NotFound, "no DNS session %q", req.Session)
+	}
+
+	serverInfo := httpServerInfo{Scheme: req.Scheme, KeepAlive: req.KeepAlive, Session: req.Session}
+	if err := hss.startDynamicServer(port, &serverInfo, op, true); err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcHTTPServer(serverInfo), nil
+}
+
+// StopHTTPServer stops a server like DELETE /servers
+func (cs *ControlServer) StopHTTPServer(ctx context.Context,
+	req *singularityv1.StopHTTPServerRequest) (*singularityv1.StopHTTPServerResponse, error) {
+	if _, ok := cs.hss.stopServer(int(req.Port), grpcOperator(ctx)); !ok {
+		return nil, status.Errorf(codes.NotFound, "no HTTP server on port %v", req.Port)
+	}
+	return &singularityv1.StopHTTPServerResponse{}, nil
+}
+
+// grpcSession converts the description of a DNS session
+func grpcSession(info sessionInfo) *singularityv1.Session {
+	return &singularityv1.Session{Session: info.Session, FirstQueryTime: timestamppb.New(info.FirstQueryTime),
+		LastQueryTime: timestamppb.New(info.LastQueryTime), Strategy: info.Strategy,
+		ResponseIpAddr: info.ResponseIPAddr, ResponseReboundIpAddr: info.ResponseReboundIPAddr,
+		FirewalledOnce: info.FirewalledOnce, Rebound: info.Rebound, RebindArmed: info.RebindArmed,
+		QueryCount: int64(info.QueryCount), LastAnswers: info.LastAnswers, ClientSubnet: info.ClientSubnet}
+}
+
+// ListSessions lists the DNS sessions like GET /api/sessions
+func (cs *ControlServer) ListSessions(ctx context.Context,
+	req *singularityv1.ListSessionsRequest) (*singularityv1.ListSessionsResponse, error) {
+	dcss := cs.hss.Dcss
+	if dcss == nil {
+		return nil, status.Error(codes.Internal, "DNS sessions are not configured")
+	}
+	op := grpcOperator(ctx)
+	dcss.RLock()
+	sessions := make([]sessionInfo, 0, len(dcss.Sessions))
+	for sk, sv := range dcss.Sessions {
+		if op.owns(sk) {
+			sessions = append(sessions, newSessionInfo(sk, sv))
+		}
+	}
+	dcss.RUnlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Session < sessions[j].Session })
+
+	resp := &singularityv1.ListSessionsResponse{}
+	for _, info := range sessions {
+		resp.Sessions = append(resp.Sessions, grpcSession(info))
+	}
+	return resp, nil
+}
+
+// GetSession returns a DNS session like GET /api/sessions/<id>
+func (cs *ControlServer) GetSession(ctx context.Context,
+	req *singularityv1.GetSessionRequest) (*singularityv1.Session, error) {
+	dcss := cs.hss.Dcss
+	if dcss == nil {
+		return nil, status.Error(codes.Internal, "DNS sessions are not configured")
+	}
+	if !grpcOperator(ctx).owns(req.Session) {
+		return nil, status.Errorf(codes.NotFound, "no DNS session %q", req.Session)
+	}
+	dcss.Lock()
+	state, ok := dcss.Sessions[req.Session]
+	var info sessionInfo
+	if ok {
+		info = newSessionInfo(req.Session, state)
+	}
+	dcss.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no DNS session %q", req.Session)
+	}
+	return grpcSession(info), nil
+}
+
+// grpcLoot converts the metadata of loot
+func grpcLoot(item *Loot) *singularityv1.Loot {
+	return &singularityv1.Loot{Id: item.ID, Session: item.Session, Time: timestamppb.New(item.Time), Url: item.URL,
+		ContentType: item.ContentType, Size: int64(item.Size)}
+}
+
+// ListLoot lists loot like GET /api/loot
+func (cs *ControlServer) ListLoot(ctx context.Context,
+	req *singularityv1.ListLootRequest) (*singularityv1.ListLootResponse, error) {
+	if cs.hss.Loot == nil {
+		return nil, status.Error(codes.Internal, "loot is not configured")
+	}
+	op := grpcOperator(ctx)
+	resp := &singularityv1.ListLootResponse{}
+	for _, item := range cs.hss.Loot.List(req.Session) {
+		if op.owns(item.Session) {
+			resp.Loot = append(resp.Loot, grpcLoot(item))
+		}
+	}
+	return resp, nil
+}
+
+// FetchLoot returns loot and its data like GET /api/loot/<id>/download
+func (cs *ControlServer) FetchLoot(ctx context.Context,
+	req *singularityv1.FetchLootRequest) (*singularityv1.LootData, error) {
+	if cs.hss.Loot == nil {
+		return nil, status.Error(codes.Internal, "loot is not configured")
+	}
+	item, ok := cs.hss.Loot.Get(req.Id)
+	if !ok || !grpcOperator(ctx).owns(item.Session) {
+		return nil, status.Errorf(codes.NotFound, "no loot %q", req.Id)
+	}
+	return &singularityv1.LootData{Loot: grpcLoot(item), Data: item.data}, nil
+}
+
+// SetSessionPayload sets the payload and variables of a session like PUT /sessionpayloads
+func (cs *ControlServer) SetSessionPayload(ctx context.Context,
+	req *singularityv1.SessionPayload) (*singularityv1.SessionPayload, error) {
+	sps := cs.hss.SessionPayloads
+	if sps == nil {
+		return nil, status.Error(codes.Internal, "session payloads are not configured")
+	}
+	if req.Session == "" || (req.Payload == "" && req.Variables == nil) {
+		return nil, status.Error(codes.InvalidArgument, "missing session, or payload and variables")
+	}
+	if !grpcOperator(ctx).owns(req.Session) {
+		return nil, status.Errorf(codes.PermissionDenied, "DNS session %q is not yours", req.Session)
+	}
+	if req.Payload != "" {
+		sps.Set(req.Session, req.Payload)
+	}
+	if req.Variables != nil {
+		sps.SetVariables(req.Session, req.Variables)
+	}
+	return req, nil
+}
+
+// LaunchAttack launches an attack like POST /api/attacks
+func (cs *ControlServer) LaunchAttack(ctx context.Context,
+	req *singularityv1.AttackSpec) (*singularityv1.Attack, error) {
+	if cs.hss.AppConfig == nil || cs.hss.SessionPayloads == nil {
+		return nil, status.Error(codes.Internal, "attacks are not configured")
+	}
+	spec := AttackSpec{Target: req.Target, Port: int(req.Port), Strategy: req.Strategy, Payload: req.Payload,
+		Variables: req.Variables, Interval: int(req.Interval), Scheme: req.Scheme, Domain: req.Domain,
+		Session: req.Session}
+	attack, err := cs.hss.launchAttack(spec, grpcOperator(ctx), true)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &singularityv1.Attack{Spec: &singularityv1.AttackSpec{Target: attack.Target, Port: uint32(attack.Port),
+		Strategy: attack.Strategy, Payload: attack.Payload, Variables: attack.Variables,
+		Interval: uint32(attack.Interval), Scheme: attack.Scheme, Domain: attack.Domain, Session: attack.Session},
+		Hostname: attack.Hostname, Url: attack.URL, ServerStarted: attack.ServerStarted}, nil
+}
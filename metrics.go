@@ -0,0 +1,97 @@
+package singularity
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// counters are updated atomically so the DNS hot path does not take locks.
+// Only uint64 fields are used so they stay aligned for atomic access.
+type counters struct {
+	dnsQueries        uint64
+	dnsQueriesA       uint64
+	dnsQueriesAAAA    uint64
+	dnsQueriesOther   uint64
+	dnsParseErrors    uint64
+	dnsRateLimited    uint64
+	rebindTransitions uint64
+	sessionsEvicted   uint64
+	httpRequests      uint64
+}
+
+var metrics counters
+
+// countDNSQuery records a DNS question of query type qtype
+func (c *counters) countDNSQuery(qtype uint16) {
+	atomic.AddUint64(&c.dnsQueries, 1)
+	switch qtype {
+	case dns.TypeA:
+		atomic.AddUint64(&c.dnsQueriesA, 1)
+	case dns.TypeAAAA:
+		atomic.AddUint64(&c.dnsQueriesAAAA, 1)
+	default:
+		atomic.AddUint64(&c.dnsQueriesOther, 1)
+	}
+}
+
+// MetricsHandler is a HTTP handler exporting counters in the Prometheus text format.
+// It is served behind AdminHandler.
+type MetricsHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+func (mh *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	sessions := 0
+	if mh.hss.Dcss != nil {
+		mh.hss.Dcss.RLock()
+		sessions = len(mh.hss.Dcss.Sessions)
+		mh.hss.Dcss.RUnlock()
+	}
+
+	serversUp := 0
+	mh.hss.RLock()
+	for _, servers := range [][]*http.Server{mh.hss.StaticServers, mh.hss.DynamicServers} {
+		for _, server := range servers {
+			if server != nil {
+				serversUp++
+			}
+		}
+	}
+	mh.hss.RUnlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeMetric(w, "singularity_dns_queries_total", "counter", "DNS queries received.",
+		atomic.LoadUint64(&metrics.dnsQueries))
+	fmt.Fprintf(w, "# HELP singularity_dns_queries_by_type_total DNS queries received by query type.\n")
+	fmt.Fprintf(w, "# TYPE singularity_dns_queries_by_type_total counter\n")
+	fmt.Fprintf(w, "singularity_dns_queries_by_type_total{type=\"A\"} %v\n", atomic.LoadUint64(&metrics.dnsQueriesA))
+	fmt.Fprintf(w, "singularity_dns_queries_by_type_total{type=\"AAAA\"} %v\n", atomic.LoadUint64(&metrics.dnsQueriesAAAA))
+	fmt.Fprintf(w, "singularity_dns_queries_by_type_total{type=\"other\"} %v\n", atomic.LoadUint64(&metrics.dnsQueriesOther))
+	writeMetric(w, "singularity_dns_parse_errors_total", "counter", "DNS queries that could not be parsed.",
+		atomic.LoadUint64(&metrics.dnsParseErrors))
+	writeMetric(w, "singularity_dns_rate_limited_total", "counter", "DNS queries dropped by rate limiting.",
+		atomic.LoadUint64(&metrics.dnsRateLimited))
+	writeMetric(w, "singularity_rebind_transitions_total", "counter", "DNS sessions rebound to the target host.",
+		atomic.LoadUint64(&metrics.rebindTransitions))
+	writeMetric(w, "singularity_dns_sessions_evicted_total", "counter", "DNS sessions evicted to stay within the maximum number of sessions.",
+		atomic.LoadUint64(&metrics.sessionsEvicted))
+	writeMetric(w, "singularity_http_requests_total", "counter", "HTTP requests received.",
+		atomic.LoadUint64(&metrics.httpRequests))
+	writeMetric(w, "singularity_dns_sessions", "gauge", "Active DNS sessions.",
+		uint64(sessions))
+	writeMetric(w, "singularity_http_servers_up", "gauge", "HTTP servers running.",
+		uint64(serversUp))
+}
+
+// writeMetric writes a single sample metric with its help and type lines
+func writeMetric(w http.ResponseWriter, name string, metricType string, help string, value uint64) {
+	fmt.Fprintf(w, "# HELP %v %v\n", name, help)
+	fmt.Fprintf(w, "# TYPE %v %v\n", name, metricType)
+	fmt.Fprintf(w, "%v %v\n", name, value)
+}
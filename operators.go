@@ -0,0 +1,170 @@
+package singularity
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Operator is one of several operators sharing a Singularity instance, e.g. a team server.
+// Operators authenticate with their own token instead of the AuthToken
+// and only see and manage the DNS sessions of their namespace,
+// their loot and payloads, and the dynamic HTTP servers they started.
+// Management endpoints changing the whole instance are reserved to the AuthToken.
+type Operator struct {
+	// Name of the operator, also the namespace of its DNS sessions:
+	// operator "alice" owns the sessions "alice_<id>", e.g. "alice_123"
+	Name  string
+	Token string
+	// Maximum number of dynamic HTTP servers started by the operator and its sessions
+	// running at once, 0 for no limit
+	MaxDynamicHTTPServers int
+}
+
+// operatorSessionSeparator separates the operator name and the session of a namespaced session.
+// It is literal in DNS query names, see queryElementSeparator.
+const operatorSessionSeparator = "_"
+
+// operatorNameRegexp matches valid operator names,
+// which must survive the case randomization of DNS query names by resolvers
+var operatorNameRegexp = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// owns checks whether a DNS session is in the namespace of the operator.
+// The administrator (nil operator) owns all sessions.
+func (op *Operator) owns(session string) bool {
+	return op == nil || (op.Name != "" && strings.HasPrefix(session, op.Name+operatorSessionSeparator))
+}
+
+// displayName returns the name of the operator for logs
+func (op *Operator) displayName() string {
+	if op == nil {
+		return "administrator"
+	}
+	return "operator " + op.Name
+}
+
+// namespacedSession returns session in the namespace of the operator
+func (op *Operator) namespacedSession(session string) string {
+	if op == nil {
+		return session
+	}
+	return op.Name + operatorSessionSeparator + session
+}
+
+// ownsServer checks whether the operator may manage a dynamic server it started.
+// Must hold hss mutex.
+func (op *Operator) ownsServer(hss *HTTPServerStoreHandler, server *http.Server) bool {
+	return op == nil || (op.Name != "" && hss.dynamicOperators[server] == op.Name)
+}
+
+// validateOperators checks that operators have distinct valid names and tokens
+func validateOperators(operators []Operator) error {
+	names := map[string]bool{}
+	tokens := map[string]bool{}
+	for _, op := range operators {
+		if !operatorNameRegexp.MatchString(op.Name) {
+			return fmt.Errorf("invalid operator name %q: must be lowercase letters and digits", op.Name)
+		}
+		if names[op.Name] {
+			return fmt.Errorf("duplicate operator name %q", op.Name)
+		}
+		names[op.Name] = true
+		if op.Token == "" || tokens[op.Token] {
+			return fmt.Errorf("operator %q requires a distinct token", op.Name)
+		}
+		tokens[op.Token] = true
+		if op.MaxDynamicHTTPServers < 0 {
+			return fmt.Errorf("invalid MaxDynamicHTTPServers %v of operator %q: must not be negative",
+				op.MaxDynamicHTTPServers, op.Name)
+		}
+	}
+	return nil
+}
+
+// ParseOperator parses an operator from a command line specification
+// "<name>:<token>[:<max dynamic servers>]", e.g. "alice:s3cret:2"
+func ParseOperator(spec string) (Operator, error) {
+	elements := strings.SplitN(spec, ":", 3)
+	if len(elements) < 2 {
+		return Operator{}, fmt.Errorf("invalid operator %q: expected <name>:<token>[:<max dynamic servers>]", spec)
+	}
+	op := Operator{Name: elements[0], Token: elements[1]}
+	if len(elements) == 3 {
+		max, err := strconv.Atoi(elements[2])
+		if err != nil {
+			return Operator{}, fmt.Errorf("invalid operator %q: invalid max dynamic servers %q", spec, elements[2])
+		}
+		op.MaxDynamicHTTPServers = max
+	}
+	if err := validateOperators([]Operator{op}); err != nil {
+		return Operator{}, err
+	}
+	return op, nil
+}
+
+// operators returns the configured operators, none if the instance is not shared
+func (hss *HTTPServerStoreHandler) operators() []Operator {
+	if hss.AppConfig == nil {
+		return nil
+	}
+	appConfigMutex.RLock()
+	defer appConfigMutex.RUnlock()
+	return hss.AppConfig.Operators
+}
+
+// requestToken returns the management token of a request
+// either as a bearer token or as the basic auth password
+func requestToken(r *http.Request) string {
+	if _, password, ok := r.BasicAuth(); ok {
+		return password
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// tokenOperator authenticates a token: it returns nil for the AuthToken,
+// the operator of an operator token, and false for other tokens.
+// The comparisons are constant-time to avoid leaking tokens.
+func (hss *HTTPServerStoreHandler) tokenOperator(token string) (*Operator, bool) {
+	if hss.AuthToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(hss.AuthToken)) == 1 {
+		return nil, true
+	}
+	operators := hss.operators()
+	for i := range operators {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(operators[i].Token)) == 1 {
+			op := operators[i]
+			return &op, true
+		}
+	}
+	return nil, false
+}
+
+// requestOperator returns the operator of a request whose view of the management endpoints is filtered:
+// the operator of its token, nil for the administrator (AuthToken) and for all requests
+// if no operators are configured, and an operator owning nothing for requests without valid token.
+func (hss *HTTPServerStoreHandler) requestOperator(r *http.Request) *Operator {
+	if len(hss.operators()) == 0 {
+		return nil
+	}
+	if op, ok := hss.tokenOperator(requestToken(r)); ok {
+		return op
+	}
+	return &Operator{}
+}
+
+// sessionOperator returns the operator owning a DNS session, nil for sessions outside namespaces
+func (hss *HTTPServerStoreHandler) sessionOperator(session string) *Operator {
+	operators := hss.operators()
+	for i := range operators {
+		if operators[i].owns(session) {
+			op := operators[i]
+			return &op
+		}
+	}
+	return nil
+}
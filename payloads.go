@@ -0,0 +1,95 @@
+package singularity
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+)
+
+// payloadsAPIPath is the route of the attack payloads API
+const payloadsAPIPath = "/api/payloads"
+
+// payloadsDir is the directory of attack payloads in the assets filesystem
+const payloadsDir = "payloads"
+
+// PayloadManifest describes an attack payload. It is read from
+// a "<payload>.json" manifest file next to the "<payload>.js" payload.
+type PayloadManifest struct {
+	ID          string // payload file name without extension, e.g. "etcd"
+	Name        string // name of the payload in the JavaScript Registry
+	Description string
+	Fingerprint string `json:",omitempty"` // how the payload recognizes the target service
+	Ports       []int  // default ports of the target service, if any
+	Author      string `json:",omitempty"`
+}
+
+// loadPayloadManifests reads the manifests of the payloads in assets, sorted by ID
+func loadPayloadManifests(assets fs.FS) ([]*PayloadManifest, error) {
+	files, err := fs.Glob(assets, path.Join(payloadsDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := []*PayloadManifest{}
+	for _, file := range files {
+		data, err := fs.ReadFile(assets, file)
+		if err != nil {
+			return nil, err
+		}
+		manifest := &PayloadManifest{}
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return nil, fmt.Errorf("%v: %v", file, err)
+		}
+		manifest.ID = strings.TrimSuffix(path.Base(file), ".json")
+		if manifest.Ports == nil {
+			manifest.Ports = []int{}
+		}
+		manifests = append(manifests, manifest)
+	}
+	sort.Slice(manifests, func(i, j int) bool { return manifests[i].ID < manifests[j].ID })
+	return manifests, nil
+}
+
+// PayloadsAPIHandler is a HTTP handler enumerating attack payloads from their manifests:
+//
+//	GET    /api/payloads              lists payloads
+//	GET    /api/payloads/<id>         returns a payload
+//
+// It is served behind AdminHandler.
+type PayloadsAPIHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+func (pah *PayloadsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// read on every request so that manifests in HTMLDir can be edited while developing
+	manifests, err := loadPayloadManifests(NewAssetsFS(pah.hss.appConfig().HTMLDir))
+	if err != nil {
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not read payload manifests: %v", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, payloadsAPIPath), "/")
+	if id == "" {
+		writeJSON(w, manifests)
+		return
+	}
+	for _, manifest := range manifests {
+		if manifest.ID == id {
+			writeJSON(w, manifest)
+			return
+		}
+	}
+	http.Error(w, "Not found", http.StatusNotFound)
+}
@@ -0,0 +1,77 @@
+package singularity
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// PayloadWatcher counts changes of the payload files under a directory,
+// e.g. the "payloads" directory of HTMLDir, so that cached payloads are
+// rebuilt once their files change without reading them on every request.
+type PayloadWatcher struct {
+	changes uint64 // first for 64-bit alignment of atomic operations
+	watcher *fsnotify.Watcher
+}
+
+// NewPayloadWatcher watches dir and its subdirectories for changes
+func NewPayloadWatcher(dir string) (*PayloadWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	pw := &PayloadWatcher{watcher: watcher}
+	// fsnotify does not watch subdirectories
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go pw.watch()
+	return pw, nil
+}
+
+// watch counts the events of the watched directories until the watcher is closed
+func (pw *PayloadWatcher) watch() {
+	for {
+		select {
+		case event, ok := <-pw.watcher.Events:
+			if !ok {
+				return
+			}
+			if info, err := os.Stat(event.Name); err == nil && info.IsDir() && event.Op&fsnotify.Create != 0 {
+				pw.watcher.Add(event.Name)
+			}
+			atomic.AddUint64(&pw.changes, 1)
+			logEvent(LogDebug, "HTTP", nil, "payload file changed: %v", event)
+		case err, ok := <-pw.watcher.Errors:
+			if !ok {
+				return
+			}
+			// events may have been dropped
+			atomic.AddUint64(&pw.changes, 1)
+			logEvent(LogWarn, "HTTP", nil, "could not watch payload files: %v", err)
+		}
+	}
+}
+
+// Changes returns the number of changes seen so far
+func (pw *PayloadWatcher) Changes() uint64 {
+	return atomic.LoadUint64(&pw.changes)
+}
+
+// Close stops watching
+func (pw *PayloadWatcher) Close() error {
+	return pw.watcher.Close()
+}
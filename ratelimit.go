@@ -0,0 +1,101 @@
+package singularity
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket rate limiter keyed on client IP address.
+// Each key may perform at most Rate requests per Interval.
+// A Rate of zero or less disables rate limiting.
+// Must use mutex to access.
+type RateLimiter struct {
+	sync.Mutex
+	Rate     int
+	Interval time.Duration
+	// Maximum number of keys tracked at once, e.g. spoofed DNS client addresses.
+	// Keys beyond evict other keys, which start over with a full bucket.
+	MaxBuckets int
+	buckets    map[string]*tokenBucket
+}
+
+// defaultMaxRateLimiterBuckets is the default maximum number of keys tracked by a rate limiter
+const defaultMaxRateLimiterBuckets = 100000
+
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// NewRateLimiter returns a rate limiter allowing rate requests per interval
+func NewRateLimiter(rate int, interval time.Duration) *RateLimiter {
+	return &RateLimiter{Rate: rate, Interval: interval, MaxBuckets: defaultMaxRateLimiterBuckets,
+		buckets: make(map[string]*tokenBucket)}
+}
+
+// Allow reports whether a request identified by key may proceed
+// and consumes a token if so.
+func (rl *RateLimiter) Allow(key string) bool {
+	if rl == nil || rl.Rate <= 0 || rl.Interval <= 0 {
+		return true
+	}
+
+	now := time.Now()
+
+	rl.Lock()
+	defer rl.Unlock()
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		if rl.MaxBuckets > 0 && len(rl.buckets) >= rl.MaxBuckets {
+			rl.evictBucket(now)
+		}
+		bucket = &tokenBucket{tokens: float64(rl.Rate), lastRefill: now}
+		rl.buckets[key] = bucket
+	}
+
+	// Refill proportionally to the time elapsed since last request.
+	elapsed := now.Sub(bucket.lastRefill)
+	bucket.tokens += float64(rl.Rate) * float64(elapsed) / float64(rl.Interval)
+	if bucket.tokens > float64(rl.Rate) {
+		bucket.tokens = float64(rl.Rate)
+	}
+	bucket.lastRefill = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// evictBucket makes room for a new key. It forgets a key whose bucket is full again
+// among a few random keys, or the last of them, so that floods of new keys stay cheap.
+// Must hold mutex.
+func (rl *RateLimiter) evictBucket(now time.Time) {
+	evicted := ""
+	i := 0
+	for k, v := range rl.buckets {
+		evicted = k
+		i++
+		if now.Sub(v.lastRefill) >= rl.Interval || i >= 16 {
+			break
+		}
+	}
+	delete(rl.buckets, evicted)
+}
+
+// ExpireOldEntries forgets about keys that have not been seen
+// for longer than duration so the bucket map does not grow unbounded.
+func (rl *RateLimiter) ExpireOldEntries(duration time.Duration) {
+	if rl == nil {
+		return
+	}
+	rl.Lock()
+	for k, v := range rl.buckets {
+		if time.Since(v.lastRefill) > duration {
+			delete(rl.buckets, k)
+		}
+	}
+	rl.Unlock()
+}
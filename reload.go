@@ -0,0 +1,85 @@
+package singularity
+
+import (
+	"net/http"
+	"sync"
+)
+
+// appConfigMutex guards the AppConfig fields changed by Reload.
+// DNS handlers read them from a snapshot taken for every query
+// and HTTP handlers from a snapshot taken with HTTPServerStoreHandler.appConfig.
+var appConfigMutex sync.RWMutex
+
+// Reload applies the parameters of newConfig that can change at runtime
+// without dropping sessions or listeners: the default rebinding strategy and timeout,
+// the ignore lists, the allowed domains, their name servers and static records, the hosts answered to
+// non-Singularity queries, the session limit, the webhook and the operators.
+// Validate newConfig before reloading it.
+// Other parameters, such as ports, require a restart.
+// HTTP servers serve the assets compiled into the binary unless HTMLDir is set,
+// in which case changes to the payload files are picked up without reload.
+func (appConfig *AppConfig) Reload(newConfig *AppConfig) {
+	appConfigMutex.Lock()
+	defer appConfigMutex.Unlock()
+
+	appConfig.ResponseIPAddr = newConfig.ResponseIPAddr
+	appConfig.ResponseReboundIPAddr = newConfig.ResponseReboundIPAddr
+	appConfig.ResponseReboundIPAddrtimeOut = newConfig.ResponseReboundIPAddrtimeOut
+	appConfig.RebindingFn = newConfig.RebindingFn
+	appConfig.RebindingFnName = newConfig.RebindingFnName
+	appConfig.RebindJitterMs = newConfig.RebindJitterMs
+	appConfig.IgnoreDNSRequestFrom = newConfig.IgnoreDNSRequestFrom
+	appConfig.IgnoreDNSRequestFromCIDR = newConfig.IgnoreDNSRequestFromCIDR
+	appConfig.AllowedDomains = newConfig.AllowedDomains
+	appConfig.NameServers = newConfig.NameServers
+	appConfig.StaticRecords = newConfig.StaticRecords
+	appConfig.StaticZoneFile = newConfig.StaticZoneFile
+	appConfig.staticZoneRecords = newConfig.staticZoneRecords
+	appConfig.RefuseNonSingularityQueries = newConfig.RefuseNonSingularityQueries
+	appConfig.MaxSessions = newConfig.MaxSessions
+	appConfig.WebhookURL = newConfig.WebhookURL
+	appConfig.WebhookEvents = newConfig.WebhookEvents
+	appConfig.MapV4ToV6 = newConfig.MapV4ToV6
+	appConfig.Operators = newConfig.Operators
+}
+
+// snapshot returns a copy of appConfig that is safe to read while it is reloaded
+func (appConfig *AppConfig) snapshot() *AppConfig {
+	appConfigMutex.RLock()
+	defer appConfigMutex.RUnlock()
+	c := *appConfig
+	return &c
+}
+
+// configReloadPath is the route of the configuration reload API
+const configReloadPath = "/api/config/reload"
+
+// ConfigReloadHandler is a HTTP handler reloading the configuration
+// with ReloadConfig on POST, e.g. from the configuration file.
+// It is served behind AdminHandler.
+type ConfigReloadHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+func (crh *ConfigReloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if crh.hss.ReloadConfig == nil {
+		http.Error(w, "Configuration reload is not available", http.StatusNotImplemented)
+		return
+	}
+
+	if err := crh.hss.ReloadConfig(); err != nil {
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not reload configuration: %v", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	logEvent(LogInfo, "HTTP", httpRequestFields(r), "reloaded configuration")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,120 @@
+package singularity
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const selfTestTimeout = time.Second * 5
+
+// SelfTest checks that a running singularity server is reachable and consistent
+// with its configuration. It queries the local DNS server for a Singularity name,
+// fetches "/" from each local HTTP(S) server and checks that ResponseIPAddr
+// is assigned to a local interface. It returns the problems found.
+func SelfTest(appConfig *AppConfig) []error {
+	appConfig = appConfig.snapshot()
+	problems := []error{}
+
+	if err := selfTestDNS(appConfig); err != nil {
+		problems = append(problems, err)
+	}
+
+	for _, port := range appConfig.HTTPServerPorts {
+		if err := selfTestHTTP("http", port); err != nil {
+			problems = append(problems, err)
+		}
+	}
+	for _, port := range appConfig.HTTPSServerPorts {
+		if err := selfTestHTTP("https", port); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if err := selfTestResponseIPAddr(appConfig.ResponseIPAddr); err != nil {
+		problems = append(problems, err)
+	}
+
+	return problems
+}
+
+// selfTestDNS queries the local DNS server for a new session
+// and expects ResponseIPAddr as first host.
+func selfTestDNS(appConfig *AppConfig) error {
+	host := appConfig.DNSServerBindAddr
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	port := appConfig.DNSServerPort
+	if port == 0 {
+		port = defaultDNSServerPort
+	}
+
+	domain := "selftest.invalid"
+	if len(appConfig.AllowedDomains) > 0 {
+		domain = appConfig.AllowedDomains[0]
+	}
+	session, err := GenerateRandomString()
+	if err != nil {
+		return fmt.Errorf("self-test: could not generate session: %v", err)
+	}
+	name := &DNSQuery{ResponseIPAddr: appConfig.ResponseIPAddr, ResponseReboundIPAddr: appConfig.ResponseReboundIPAddr,
+		Session: session, DNSRebindingStrategy: "fs", Domain: "." + dns.Fqdn(domain)}
+
+	m := new(dns.Msg)
+	m.SetQuestion(name.Encode(), dns.TypeA)
+	c := &dns.Client{Timeout: selfTestTimeout}
+	r, _, err := c.Exchange(m, net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("self-test: DNS server on %v:%v did not answer: %v", host, port, err)
+	}
+
+	for _, rr := range r.Answer {
+		if a, ok := rr.(*dns.A); ok && a.A.Equal(net.ParseIP(appConfig.ResponseIPAddr)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("self-test: DNS server on %v:%v answered %v to %v, expected %v",
+		host, port, r.Answer, name.Encode(), appConfig.ResponseIPAddr)
+}
+
+// selfTestHTTP fetches "/" from a local HTTP(S) server
+// and expects a response served by singularity.
+func selfTestHTTP(scheme string, port int) error {
+	client := &http.Client{Timeout: selfTestTimeout,
+		// certificates do not match the loopback address
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+
+	url := fmt.Sprintf("%v://%v/", scheme, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("self-test: could not fetch %v: %v", url, err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Singularity-Of-Origin") != "t" {
+		return fmt.Errorf("self-test: unexpected response from %v: %v", url, resp.Status)
+	}
+	return nil
+}
+
+// selfTestResponseIPAddr checks that ResponseIPAddr is assigned to a local interface.
+// This is expected to fail behind NAT, e.g. on cloud instances.
+func selfTestResponseIPAddr(responseIPAddr string) error {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("self-test: could not list interface addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(net.ParseIP(responseIPAddr)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("self-test: ResponseIPAddr %v is not assigned to a local interface "+
+		"(expected if the server is behind NAT)", responseIPAddr)
+}
@@ -0,0 +1,150 @@
+package singularity
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+)
+
+// Server owns the running DNS and HTTP servers of singularity
+// so that they can be shut down gracefully, e.g. on SIGTERM.
+type Server struct {
+	HTTPServers *HTTPServerStoreHandler
+	// Websockets/HTTP proxy server, if started
+	ProxyServer *http.Server
+	// DNS sessions are flushed with SessionPersister on shutdown if set
+	SessionPersister SessionPersister
+	// SOCKS5 bridge to hooked targets, if started
+	SOCKSBridge *SOCKSBridge
+	// Admin HTTP server, if started
+	AdminServer *http.Server
+	// gRPC control API server, if started
+	GRPCServer *grpc.Server
+
+	dnsCtx     context.Context
+	stopDNS    context.CancelFunc
+	dnsServers sync.WaitGroup
+}
+
+// NewServer returns a Server owning the HTTP servers of hss
+func NewServer(hss *HTTPServerStoreHandler) *Server {
+	dnsCtx, stopDNS := context.WithCancel(context.Background())
+	return &Server{HTTPServers: hss, dnsCtx: dnsCtx, stopDNS: stopDNS}
+}
+
+// StartDNSServer serves s until the Server is shut down.
+// onExit, if set, is called with the error returned by ServeDNSServer.
+func (srv *Server) StartDNSServer(s *dns.Server, onExit func(error)) {
+	srv.dnsServers.Add(1)
+	go func() {
+		defer srv.dnsServers.Done()
+		err := ServeDNSServer(srv.dnsCtx, s)
+		if onExit != nil {
+			onExit(err)
+		}
+	}()
+}
+
+// Shutdown stops accepting DNS queries and HTTP connections,
+// waits for in-flight requests to complete until ctx is done
+// and flushes DNS sessions to SessionPersister.
+// Remaining HTTP connections are closed when ctx is done.
+// It returns the first error encountered.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	var firstErr error
+	keep := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	srv.stopDNS()
+
+	keep(srv.HTTPServers.Shutdown(ctx))
+	if srv.ProxyServer != nil {
+		if err := srv.ProxyServer.Shutdown(ctx); err != nil {
+			srv.ProxyServer.Close()
+			keep(err)
+		}
+	}
+
+	if srv.AdminServer != nil {
+		if err := srv.AdminServer.Shutdown(ctx); err != nil {
+			srv.AdminServer.Close()
+			keep(err)
+		}
+	}
+	if srv.GRPCServer != nil {
+		stopped := make(chan struct{})
+		go func() {
+			srv.GRPCServer.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-ctx.Done():
+			srv.GRPCServer.Stop()
+			keep(ctx.Err())
+		}
+	}
+	if srv.SOCKSBridge != nil {
+		keep(srv.SOCKSBridge.Close())
+	}
+
+	dnsStopped := make(chan struct{})
+	go func() {
+		srv.dnsServers.Wait()
+		close(dnsStopped)
+	}()
+	select {
+	case <-dnsStopped:
+	case <-ctx.Done():
+		keep(ctx.Err())
+	}
+
+	if srv.SessionPersister != nil && srv.HTTPServers.Dcss != nil {
+		keep(srv.HTTPServers.Dcss.PersistSessions(srv.SessionPersister))
+	}
+	return firstErr
+}
+
+// Shutdown gracefully shuts down all static and dynamic HTTP servers,
+// closing them if ctx is done before their connections are idle.
+func (hss *HTTPServerStoreHandler) Shutdown(ctx context.Context) error {
+	hss.Lock()
+	servers := []*http.Server{}
+	for _, server := range append(append([]*http.Server{}, hss.StaticServers...), hss.DynamicServers...) {
+		if server != nil {
+			servers = append(servers, server)
+		}
+	}
+	// HTTP/3 servers cannot shut down gracefully, QUIC connections are closed
+	for _, h3 := range hss.http3Servers {
+		h3.Close()
+	}
+	hss.Unlock()
+
+	var firstErr error
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			logEvent(LogInfo, "HTTP", LogFields{"addr": server.Addr}, "shutting down HTTP Server on %v", server.Addr)
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return firstErr
+}
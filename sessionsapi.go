@@ -0,0 +1,167 @@
+package singularity
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sessionsAPIPath is the route of the DNS sessions management API
+const sessionsAPIPath = "/api/sessions"
+
+// SessionsAPIHandler is a HTTP handler to inspect and manage DNS sessions:
+//
+//	GET    /api/sessions              lists all sessions
+//	DELETE /api/sessions              deletes all sessions
+//	GET    /api/sessions/<id>         returns a session
+//	DELETE /api/sessions/<id>         deletes a session
+//	POST   /api/sessions/<id>/reset   resets the rebinding state of a session
+//
+// It is served behind AdminHandler.
+type SessionsAPIHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+// sessionInfo is the JSON representation of a DNS session
+type sessionInfo struct {
+	Session               string
+	FirstQueryTime        time.Time
+	LastQueryTime         time.Time
+	Strategy              string
+	ResponseIPAddr        string
+	ResponseReboundIPAddr string
+	FirewalledOnce        bool
+	Rebound               bool
+	RebindArmed           bool
+	QueryCount            int
+	LastAnswers           []string
+	ClientSubnet          string `json:",omitempty"`
+}
+
+// newSessionInfo describes a session. Must hold dcss mutex.
+func newSessionInfo(session string, state *DNSClientState) sessionInfo {
+	return sessionInfo{Session: session, FirstQueryTime: state.FirstQueryTime, LastQueryTime: state.LastQueryTime,
+		Strategy: state.Strategy, ResponseIPAddr: state.ResponseIPAddr,
+		ResponseReboundIPAddr: state.ResponseReboundIPAddr, FirewalledOnce: state.FirewalledOnce,
+		Rebound: state.Rebound, RebindArmed: state.RebindArmed, QueryCount: state.QueryCount,
+		LastAnswers: append([]string{}, state.LastAnswers...), ClientSubnet: state.ClientSubnet}
+}
+
+// resetRebinding restarts the rebinding of a session from the first host.
+// Must hold dcss mutex.
+func (cs *DNSClientState) resetRebinding() {
+	cs.LastQueryTime = time.Time{}
+	cs.LastResponseReboundIPAddr = 0
+	cs.FirewalledOnce = false
+	cs.Rebound = false
+	cs.RebindArmed = false
+	cs.LastAnswers = nil
+	cs.QueryCount = 0
+}
+
+func (sah *SessionsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	dcss := sah.hss.Dcss
+	if dcss == nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, sessionsAPIPath), "/")
+	elements := []string{}
+	if path != "" {
+		elements = strings.Split(path, "/")
+	}
+
+	// operators only see the sessions of their namespace
+	op := sah.hss.requestOperator(r)
+	if len(elements) > 0 && !op.owns(elements[0]) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case len(elements) == 0 && r.Method == "GET":
+		dcss.RLock()
+		sessions := make([]sessionInfo, 0, len(dcss.Sessions))
+		for sk, sv := range dcss.Sessions {
+			if op.owns(sk) {
+				sessions = append(sessions, newSessionInfo(sk, sv))
+			}
+		}
+		dcss.RUnlock()
+		sort.Slice(sessions, func(i, j int) bool { return sessions[i].Session < sessions[j].Session })
+		writeJSON(w, sessions)
+
+	case len(elements) == 0 && r.Method == "DELETE":
+		dcss.Lock()
+		if op == nil {
+			dcss.Sessions = make(map[string]*DNSClientState)
+		} else {
+			for sk := range dcss.Sessions {
+				if op.owns(sk) {
+					delete(dcss.Sessions, sk)
+				}
+			}
+		}
+		dcss.Unlock()
+		logEvent(LogInfo, "HTTP", httpRequestFields(r), "deleted all DNS sessions of %v", op.displayName())
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(elements) == 1 && r.Method == "GET":
+		dcss.Lock()
+		state, ok := dcss.Sessions[elements[0]]
+		var info sessionInfo
+		if ok {
+			info = newSessionInfo(elements[0], state)
+		}
+		dcss.Unlock()
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, info)
+
+	case len(elements) == 1 && r.Method == "DELETE":
+		dcss.Lock()
+		_, ok := dcss.Sessions[elements[0]]
+		delete(dcss.Sessions, elements[0])
+		dcss.Unlock()
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		logEvent(LogInfo, "HTTP", LogFields{"session": elements[0]}, "deleted DNS session: %v", elements[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(elements) == 2 && elements[1] == "reset" && r.Method == "POST":
+		dcss.Lock()
+		state, ok := dcss.Sessions[elements[0]]
+		if ok {
+			state.resetRebinding()
+		}
+		dcss.Unlock()
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		logEvent(LogInfo, "HTTP", LogFields{"session": elements[0]}, "reset DNS session: %v", elements[0])
+		w.WriteHeader(http.StatusNoContent)
+
+	case len(elements) > 2 || (len(elements) == 2 && elements[1] != "reset"):
+		http.Error(w, "Not found", http.StatusNotFound)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeJSON replies with v encoded as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,95 @@
+package singularity
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// SessionPersister saves and loads DNS sessions
+// so that rebinding state survives restarts of the server.
+// Websocket sessions are not persisted: hooked targets reconnect
+// to the new server instance on their own.
+type SessionPersister interface {
+	Save(sessions map[string]*DNSClientState) error
+	Load() (map[string]*DNSClientState, error)
+}
+
+// FileSessionPersister persists DNS sessions as a JSON document,
+// which can also be inspected offline.
+// The file is replaced atomically so that a crash while saving
+// does not lose the previous snapshot.
+type FileSessionPersister struct {
+	Path string
+}
+
+// Save writes sessions to the file
+func (p *FileSessionPersister) Save(sessions map[string]*DNSClientState) error {
+	data, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p.Path), filepath.Base(p.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), p.Path)
+}
+
+// Load reads sessions from the file.
+// A missing file is not an error and returns no session.
+func (p *FileSessionPersister) Load() (map[string]*DNSClientState, error) {
+	sessions := make(map[string]*DNSClientState)
+	data, err := ioutil.ReadFile(p.Path)
+	if os.IsNotExist(err) {
+		return sessions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+// PersistSessions saves a snapshot of all DNS sessions with persister
+func (dcss *DNSClientStateStore) PersistSessions(persister SessionPersister) error {
+	dcss.RLock()
+	snapshot := make(map[string]*DNSClientState, len(dcss.Sessions))
+	for sk, sv := range dcss.Sessions {
+		state := *sv
+		state.LastAnswers = append([]string(nil), sv.LastAnswers...)
+		snapshot[sk] = &state
+	}
+	dcss.RUnlock()
+	return persister.Save(snapshot)
+}
+
+// RestoreSessions loads the DNS sessions saved with persister.
+// Restored sessions replace current sessions with the same key.
+func (dcss *DNSClientStateStore) RestoreSessions(persister SessionPersister) (int, error) {
+	sessions, err := persister.Load()
+	if err != nil {
+		return 0, err
+	}
+	dcss.Lock()
+	for sk, sv := range sessions {
+		if sv != nil {
+			dcss.Sessions[sk] = sv
+		}
+	}
+	dcss.Unlock()
+	return len(sessions), nil
+}
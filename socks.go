@@ -0,0 +1,292 @@
+package singularity
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol values (RFC 1928 and RFC 1929)
+const (
+	socksVersion             = 5
+	socksAuthVersion         = 1
+	socksMethodUserPass      = 2
+	socksMethodNoAcceptable  = 0xff
+	socksCommandConnect      = 1
+	socksAddrIPv4            = 1
+	socksAddrDomain          = 3
+	socksAddrIPv6            = 4
+	socksReplySucceeded      = 0
+	socksReplyFailure        = 1
+	socksReplyHostUnreach    = 4
+	socksReplyCmdUnsupported = 7
+	socksReplyAddrUnsupport  = 8
+)
+
+// socksHandshakeTimeout bounds the SOCKS negotiation of a client
+const socksHandshakeTimeout = time.Second * 10
+
+// SOCKSBridge is a SOCKS5 server tunneling connections of local tools
+// (e.g. curl, Burp) through targets hooked via websockets.
+// Browsers cannot open raw TCP connections, so only HTTP requests
+// are relayed, with fetch() in the hooked browser like ProxyHandler does.
+//
+// The destination of a CONNECT request selects the hooked target either
+// by its session, e.g. "<session>.hooked:80", or by the rebound address
+// and port of its DNS name, e.g. "127.0.0.1:8080".
+// Clients authenticate with username/password, the password being AuthToken.
+type SOCKSBridge struct {
+	Wscss     *WebsocketClientStateStore
+	AuthToken string
+
+	mutex    sync.Mutex
+	listener net.Listener
+}
+
+// ListenAndServe accepts SOCKS5 clients on addr until Close is called
+func (sb *SOCKSBridge) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return sb.Serve(l)
+}
+
+// Serve accepts SOCKS5 clients on l until Close is called
+func (sb *SOCKSBridge) Serve(l net.Listener) error {
+	sb.mutex.Lock()
+	sb.listener = l
+	sb.mutex.Unlock()
+
+	logEvent(LogInfo, "SOCKS", LogFields{"addr": l.Addr().String()}, "starting SOCKS5 bridge on %v", l.Addr())
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go sb.serveConn(conn)
+	}
+}
+
+// Close stops accepting SOCKS5 clients
+func (sb *SOCKSBridge) Close() error {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	if sb.listener == nil {
+		return nil
+	}
+	return sb.listener.Close()
+}
+
+func (sb *SOCKSBridge) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := sb.authenticate(rw); err != nil {
+		logEvent(LogWarn, "SOCKS", connFields(conn.RemoteAddr()), "could not authenticate %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	host, port, err := readSOCKSRequest(rw)
+	if err != nil {
+		logEvent(LogWarn, "SOCKS", connFields(conn.RemoteAddr()), "invalid request from %v: %v", conn.RemoteAddr(), err)
+		return
+	}
+
+	session, state, ok := sb.lookupTarget(host, port)
+	if !ok {
+		logEvent(LogWarn, "SOCKS", LogFields{"port": port}, "no hooked target for %v", net.JoinHostPort(host, port))
+		writeSOCKSReply(rw, socksReplyHostUnreach)
+		return
+	}
+	if err := writeSOCKSReply(rw, socksReplySucceeded); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	fields := connFields(conn.RemoteAddr())
+	fields["session"] = session
+	logEvent(LogInfo, "SOCKS", fields, "relaying %v to hooked target %v (session %v)", conn.RemoteAddr(), state.Host, session)
+	transport := &ProxytoWebsocketTransport{WSClient: state.WSClient}
+	for {
+		req, err := http.ReadRequest(rw.Reader)
+		if err != nil {
+			if err != io.EOF {
+				logEvent(LogWarn, "SOCKS", fields, "could not read HTTP request from %v: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		req.RequestURI = req.URL.RequestURI()
+
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			logEvent(LogWarn, "SOCKS", fields, "could not relay %v %v: %v", req.Method, req.RequestURI, err)
+			resp = &http.Response{StatusCode: http.StatusBadGateway, ProtoMajor: 1, ProtoMinor: 1,
+				Request: req, Header: http.Header{}, Close: true}
+		}
+		if err := resp.Write(rw); err != nil || rw.Flush() != nil || resp.Close || req.Close {
+			return
+		}
+	}
+}
+
+// authenticate negotiates the username/password method
+// and checks that the password is AuthToken
+func (sb *SOCKSBridge) authenticate(rw *bufio.ReadWriter) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion {
+		return fmt.Errorf("unsupported SOCKS version %v", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return err
+	}
+	if !strings.Contains(string(methods), string([]byte{socksMethodUserPass})) {
+		rw.Write([]byte{socksVersion, socksMethodNoAcceptable})
+		rw.Flush()
+		return errors.New("client does not support username/password authentication")
+	}
+	rw.Write([]byte{socksVersion, socksMethodUserPass})
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	version, err := rw.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != socksAuthVersion {
+		return fmt.Errorf("unsupported authentication version %v", version)
+	}
+	if _, err := readSOCKSString(rw); err != nil {
+		return err
+	}
+	password, err := readSOCKSString(rw)
+	if err != nil {
+		return err
+	}
+	if sb.AuthToken == "" || subtle.ConstantTimeCompare([]byte(password), []byte(sb.AuthToken)) != 1 {
+		rw.Write([]byte{socksAuthVersion, socksReplyFailure})
+		rw.Flush()
+		return errors.New("invalid credentials")
+	}
+	rw.Write([]byte{socksAuthVersion, socksReplySucceeded})
+	return rw.Flush()
+}
+
+// readSOCKSString reads a string prefixed by its length
+func readSOCKSString(r *bufio.ReadWriter) (string, error) {
+	length, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, length)
+	if _, err := io.ReadFull(r, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// readSOCKSRequest reads a CONNECT request and returns its destination.
+// Other commands are rejected.
+func readSOCKSRequest(rw *bufio.ReadWriter) (string, string, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %v", header[0])
+	}
+	if header[1] != socksCommandConnect {
+		writeSOCKSReply(rw, socksReplyCmdUnsupported)
+		return "", "", fmt.Errorf("unsupported command %v", header[1])
+	}
+
+	var host string
+	switch header[3] {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if header[3] == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", "", err
+		}
+		host = ip.String()
+	case socksAddrDomain:
+		domain, err := readSOCKSString(rw)
+		if err != nil {
+			return "", "", err
+		}
+		host = domain
+	default:
+		writeSOCKSReply(rw, socksReplyAddrUnsupport)
+		return "", "", fmt.Errorf("unsupported address type %v", header[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(rw, port); err != nil {
+		return "", "", err
+	}
+	return host, strconv.Itoa(int(binary.BigEndian.Uint16(port))), nil
+}
+
+// writeSOCKSReply replies to a request, with an unspecified bound address
+func writeSOCKSReply(rw *bufio.ReadWriter, reply byte) error {
+	rw.Write([]byte{socksVersion, reply, 0, socksAddrIPv4, 0, 0, 0, 0, 0, 0})
+	return rw.Flush()
+}
+
+// lookupTarget returns the hooked target of a CONNECT destination
+func (sb *SOCKSBridge) lookupTarget(host string, port string) (string, *WebsocketClientState, bool) {
+	sb.Wscss.RLock()
+	defer sb.Wscss.RUnlock()
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		session := strings.SplitN(host, ".", 2)[0]
+		if state, ok := sb.Wscss.Sessions[session]; ok {
+			return session, state, true
+		}
+	}
+
+	for session, state := range sb.Wscss.Sessions {
+		name, err := NewDNSQueryFromHost(state.Host)
+		if err != nil {
+			continue
+		}
+		// the origin has no port if it uses the default port of its scheme
+		_, hookedPort, err := net.SplitHostPort(state.Host)
+		if err != nil || hookedPort == "" {
+			hookedPort = "80"
+			if state.Scheme == "https" {
+				hookedPort = "443"
+			}
+		}
+		// the target may listen on another port than the attack origin, e.g. with TProxy
+		if name.TargetPort > 0 {
+			hookedPort = strconv.Itoa(name.TargetPort)
+		}
+		if hookedPort != port {
+			continue
+		}
+		if host == name.ResponseReboundIPAddr || (ip != nil && ip.Equal(net.ParseIP(name.ResponseReboundIPAddr))) {
+			return session, state, true
+		}
+	}
+	return "", nil, false
+}
@@ -0,0 +1,193 @@
+package singularity
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+	"github.com/nccgroup/singularity/golang"
+)
+
+// defaultStaticRecordTTL is the TTL of static records if not set
+const defaultStaticRecordTTL = 60
+
+// StaticDNSRecord is a fixed answer for a name under the attacker domain,
+// e.g. to host a landing page next to the rebinding infrastructure.
+// Name may start with "*." to match any name under a domain,
+// except Singularity names which are always rebound.
+type StaticDNSRecord struct {
+	Name  string // e.g. "www.rebind.it" or "*.landing.rebind.it"
+	Type  string // "A", "AAAA", "CNAME" or "TXT"
+	Value string
+	TTL   *int `json:",omitempty"` // defaultStaticRecordTTL if not set
+}
+
+// ParseStaticDNSRecord parses a static record written as "<name> [<ttl>] <type> <value>",
+// e.g. "www.rebind.it A 1.2.3.4" or "info.rebind.it 300 TXT hello world".
+func ParseStaticDNSRecord(s string) (StaticDNSRecord, error) {
+	fields := strings.Fields(s)
+	record := StaticDNSRecord{}
+	if len(fields) >= 4 {
+		if ttl, err := strconv.Atoi(fields[1]); err == nil {
+			record.TTL = &ttl
+			fields = append(fields[:1], fields[2:]...)
+		}
+	}
+	if len(fields) < 3 {
+		return record, fmt.Errorf("invalid static record %q: expected <name> [<ttl>] <type> <value>", s)
+	}
+	record.Name = fields[0]
+	record.Type = strings.ToUpper(fields[1])
+	record.Value = strings.Join(fields[2:], " ")
+	return record, record.validate()
+}
+
+// LoadStaticZoneFile reads static records from a file, one per line
+// in the format of ParseStaticDNSRecord. Empty lines and lines starting with "#" are ignored.
+func LoadStaticZoneFile(path string) ([]StaticDNSRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []StaticDNSRecord{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		record, err := ParseStaticDNSRecord(text)
+		if err != nil {
+			return nil, fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+		records = append(records, record)
+	}
+	return records, scanner.Err()
+}
+
+// ReadStaticZoneFile reads the static records of StaticZoneFile, if set,
+// replacing the records read before. They answer queries like StaticRecords.
+func (appConfig *AppConfig) ReadStaticZoneFile() error {
+	appConfig.staticZoneRecords = nil
+	if appConfig.StaticZoneFile == "" {
+		return nil
+	}
+	records, err := LoadStaticZoneFile(appConfig.StaticZoneFile)
+	if err != nil {
+		return err
+	}
+	appConfig.staticZoneRecords = records
+	return nil
+}
+
+// ReloadStaticZoneFile reads StaticZoneFile again and answers with its records,
+// e.g. when the configuration is not read from a file that can be reloaded.
+func (appConfig *AppConfig) ReloadStaticZoneFile() error {
+	newConfig := appConfig.snapshot()
+	if err := newConfig.ReadStaticZoneFile(); err != nil {
+		return err
+	}
+	if err := ValidateAppConfig(newConfig); err != nil {
+		return err
+	}
+	appConfigMutex.Lock()
+	appConfig.staticZoneRecords = newConfig.staticZoneRecords
+	appConfigMutex.Unlock()
+	return nil
+}
+
+// validate checks the name, type and value of a static record
+func (record StaticDNSRecord) validate() error {
+	name := strings.TrimPrefix(record.Name, "*.")
+	if !golang.IsDomainName(name) {
+		return fmt.Errorf("invalid static record name %q", record.Name)
+	}
+	if record.TTL != nil && *record.TTL < 0 {
+		return fmt.Errorf("invalid static record TTL %v of %v: must not be negative", *record.TTL, record.Name)
+	}
+	ip := net.ParseIP(record.Value)
+	switch record.Type {
+	case "A":
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid A record value %q of %v", record.Value, record.Name)
+		}
+	case "AAAA":
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid AAAA record value %q of %v", record.Value, record.Name)
+		}
+	case "CNAME":
+		if !golang.IsDomainName(record.Value) {
+			return fmt.Errorf("invalid CNAME record value %q of %v", record.Value, record.Name)
+		}
+	case "TXT":
+		if len(record.Value) > maxTXTValueLength {
+			return fmt.Errorf("invalid TXT record value of %v: longer than %v characters", record.Name, maxTXTValueLength)
+		}
+	default:
+		return fmt.Errorf("unsupported static record type %q of %v", record.Type, record.Name)
+	}
+	return nil
+}
+
+// matches checks whether a static record applies to a query name
+func (record StaticDNSRecord) matches(qname string) bool {
+	name := strings.ToLower(strings.Trim(qname, "."))
+	recordName := strings.ToLower(strings.Trim(record.Name, "."))
+	if strings.HasPrefix(recordName, "*.") {
+		return strings.HasSuffix(name, recordName[1:]) && startTagIndex(qname) == -1
+	}
+	return name == recordName
+}
+
+// staticAnswers returns the answers of static records to a query,
+// of StaticRecords and of StaticZoneFile, and whether the query name has static records.
+// Records of the exact name take precedence over wildcard records,
+// and CNAME records answer queries of any type.
+func staticAnswers(appConfig *AppConfig, q dns.Question) ([]dns.RR, bool) {
+	var matched []StaticDNSRecord
+	for _, wildcard := range []bool{false, true} {
+		for _, records := range [][]StaticDNSRecord{appConfig.StaticRecords, appConfig.staticZoneRecords} {
+			for _, record := range records {
+				if strings.HasPrefix(record.Name, "*.") == wildcard && record.matches(q.Name) {
+					matched = append(matched, record)
+				}
+			}
+		}
+		if len(matched) > 0 {
+			break
+		}
+	}
+	if len(matched) == 0 {
+		return nil, false
+	}
+
+	answers := []dns.RR{}
+	for _, record := range matched {
+		if record.Type != dns.TypeToString[q.Qtype] && record.Type != "CNAME" {
+			continue
+		}
+		ttl := defaultStaticRecordTTL
+		if record.TTL != nil {
+			ttl = *record.TTL
+		}
+		value := record.Value
+		switch record.Type {
+		case "CNAME":
+			value = dns.Fqdn(value)
+		case "TXT":
+			answers = append(answers, txtRecord(q.Name, uint32(ttl), value))
+			continue
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", q.Name, ttl, record.Type, value))
+		if err == nil {
+			answers = append(answers, rr)
+		}
+	}
+	return answers, true
+}
@@ -0,0 +1,235 @@
+//go:build linux
+// +build linux
+
+package singularity
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Linux Transparent Proxy Support
+// https://www.kernel.org/doc/Documentation/networking/tproxy.txt
+// e.g. `sudo iptables -t mangle -I PREROUTING -d ext_ip_address
+// -p tcp --dport 8080 -j TPROXY --on-port=80 --on-ip=ext_ip_address
+// will redirect external port 8080 on port 80 of Singularity.
+// LinuxTProxyRules installs such rules for AppConfig.LinuxTProxyPortRange.
+// Connections to ports listed in AppConfig.LinuxTProxyRelayPorts
+// are relayed to their original destination (e.g. port 8080) instead.
+func useIPTransparent(network, address string, conn syscall.RawConn) error {
+	return conn.Control(func(descriptor uintptr) {
+		syscall.SetsockoptInt(int(descriptor), syscall.IPPROTO_IP, syscall.IP_TRANSPARENT, 1)
+	})
+}
+
+// tproxyRelayListener wraps a transparent proxy (TProxy) listener.
+// Connections intercepted for one of the relay ports are relayed
+// to their original destination instead of being served by the HTTP server.
+// With TProxy, the local address of a connection is its original destination.
+type tproxyRelayListener struct {
+	net.Listener
+	relayPorts map[int]bool
+}
+
+const tproxyRelayDialTimeout = time.Second * 10
+
+func newTProxyRelayListener(l net.Listener, ports []int) *tproxyRelayListener {
+	relayPorts := make(map[int]bool)
+	for _, port := range ports {
+		relayPorts[port] = true
+	}
+	return &tproxyRelayListener{Listener: l, relayPorts: relayPorts}
+}
+
+// Accept returns the next connection that is not relayed
+func (l *tproxyRelayListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		dst, ok := conn.LocalAddr().(*net.TCPAddr)
+		listenAddr, listenOk := l.Listener.Addr().(*net.TCPAddr)
+		if !ok || !listenOk || dst.Port == listenAddr.Port || !l.relayPorts[dst.Port] {
+			return conn, nil
+		}
+
+		go relayTProxyConn(conn, net.JoinHostPort(dst.IP.String(), strconv.Itoa(dst.Port)))
+	}
+}
+
+// relayTProxyConn copies bytes both ways between an intercepted connection
+// and its original destination until both sides are done.
+func relayTProxyConn(conn net.Conn, dst string) {
+	defer conn.Close()
+
+	target, err := net.DialTimeout("tcp", dst, tproxyRelayDialTimeout)
+	if err != nil {
+		logEvent(LogWarn, "HTTP", connFields(conn.RemoteAddr()), "could not relay %v to %v: %v", conn.RemoteAddr(), dst, err)
+		return
+	}
+	defer target.Close()
+
+	logEvent(LogInfo, "HTTP", connFields(conn.RemoteAddr()), "relaying %v to %v", conn.RemoteAddr(), dst)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go relayCopy(target, conn, &wg)
+	go relayCopy(conn, target, &wg)
+	wg.Wait()
+}
+
+// relayCopy copies src to dst then half closes dst
+// so that the other side sees the end of the stream.
+func relayCopy(dst net.Conn, src net.Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	io.Copy(dst, src)
+	if tcpConn, ok := dst.(*net.TCPConn); ok {
+		tcpConn.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+const ipCommand = "/sbin/ip"
+
+// TProxy rules live in their own mangle chain so they are removed at once.
+// Packets they mark are routed locally with policy routing table tproxyRouteTable.
+const (
+	tproxyChain      = "SINGULARITY_TPROXY"
+	tproxyMark       = "0x1/0x1"
+	tproxyRouteTable = "100"
+)
+
+// LinuxTProxyRules installs the iptables and policy routing rules
+// redirecting connections to a range of external ports
+// to a Singularity HTTP server listening with Linux TProxy support on OnPort:
+//
+//	iptables -t mangle -N SINGULARITY_TPROXY
+//	iptables -t mangle -A SINGULARITY_TPROXY -p tcp --dport 22 -j RETURN
+//	iptables -t mangle -A SINGULARITY_TPROXY -p tcp --dport 1:65535 -j TPROXY --on-port 80 --tproxy-mark 0x1/0x1
+//	iptables -t mangle -I PREROUTING -p tcp -j SINGULARITY_TPROXY
+//	ip rule add fwmark 0x1/0x1 lookup 100
+//	ip route add local 0.0.0.0/0 dev lo table 100
+//
+// Connections to ExcludePorts, e.g. SSH and the other Singularity listeners, are not redirected.
+// Rules in dry run mode log the commands they would run instead of running them.
+// Only IPv4 connections are redirected.
+type LinuxTProxyRules struct {
+	FirstPort    int
+	LastPort     int
+	OnPort       int
+	ExcludePorts []int
+	DryRun       bool
+}
+
+// installCommands returns the commands installing the rules
+func (tr *LinuxTProxyRules) installCommands() [][]string {
+	commands := [][]string{{iptablesCommand, "-t", "mangle", "-N", tproxyChain}}
+	for _, port := range tr.ExcludePorts {
+		commands = append(commands, []string{iptablesCommand, "-t", "mangle", "-A", tproxyChain,
+			"-p", "tcp", "--dport", strconv.Itoa(port), "-j", "RETURN"})
+	}
+	return append(commands,
+		[]string{iptablesCommand, "-t", "mangle", "-A", tproxyChain,
+			"-p", "tcp", "--dport", fmt.Sprintf("%v:%v", tr.FirstPort, tr.LastPort),
+			"-j", "TPROXY", "--on-port", strconv.Itoa(tr.OnPort), "--tproxy-mark", tproxyMark},
+		[]string{iptablesCommand, "-t", "mangle", "-I", "PREROUTING", "-p", "tcp", "-j", tproxyChain},
+		[]string{ipCommand, "rule", "add", "fwmark", tproxyMark, "lookup", tproxyRouteTable},
+		[]string{ipCommand, "route", "add", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyRouteTable})
+}
+
+// removeCommands returns the commands removing the rules, in reverse order of installation
+func (tr *LinuxTProxyRules) removeCommands() [][]string {
+	return [][]string{
+		{ipCommand, "route", "del", "local", "0.0.0.0/0", "dev", "lo", "table", tproxyRouteTable},
+		{ipCommand, "rule", "del", "fwmark", tproxyMark, "lookup", tproxyRouteTable},
+		{iptablesCommand, "-t", "mangle", "-D", "PREROUTING", "-p", "tcp", "-j", tproxyChain},
+		{iptablesCommand, "-t", "mangle", "-F", tproxyChain},
+		{iptablesCommand, "-t", "mangle", "-X", tproxyChain},
+	}
+}
+
+// Install installs the rules. Rules installed before a failure are removed.
+func (tr *LinuxTProxyRules) Install() error {
+	for _, command := range tr.installCommands() {
+		if _, err := runFirewallCommand(tr.DryRun, exec.Command(command[0], command[1:]...)); err != nil {
+			tr.Remove()
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes the rules, carrying on after failures
+// so that rules left over by a previous run are removed too.
+// It returns the first error.
+func (tr *LinuxTProxyRules) Remove() error {
+	var firstErr error
+	for _, command := range tr.removeCommands() {
+		if _, err := runFirewallCommand(tr.DryRun, exec.Command(command[0], command[1:]...)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// NewLinuxTProxyRules returns the TProxy rules of appConfig
+// redirecting LinuxTProxyPortRange to the first HTTP server port.
+// LinuxTProxyExcludePorts and the ports of the other listeners are excluded.
+func NewLinuxTProxyRules(appConfig *AppConfig) (*LinuxTProxyRules, error) {
+	first, last, err := ParseTProxyPortRange(appConfig.LinuxTProxyPortRange)
+	if err != nil {
+		return nil, err
+	}
+	if len(appConfig.HTTPServerPorts) == 0 {
+		return nil, errors.New("TProxy rules require an HTTP server port")
+	}
+	onPort := appConfig.HTTPServerPorts[0]
+	return &LinuxTProxyRules{FirstPort: first, LastPort: last, OnPort: onPort,
+		ExcludePorts: tproxyExcludePorts(appConfig, onPort), DryRun: appConfig.LinuxTProxyRulesDryRun}, nil
+}
+
+// tproxyExcludePorts returns, sorted, LinuxTProxyExcludePorts and the TCP ports
+// Singularity listens on other than onPort, so that they still reach their listener
+func tproxyExcludePorts(appConfig *AppConfig, onPort int) []int {
+	ports := append([]int{}, appConfig.LinuxTProxyExcludePorts...)
+	ports = append(ports, appConfig.HTTPServerPorts...)
+	ports = append(ports, appConfig.HTTPSServerPorts...)
+	ports = append(ports, appConfig.DynamicHTTPServerPorts...)
+	ports = append(ports, appConfig.WsHTTPProxyServerPort)
+	for _, addr := range []string{appConfig.AdminAddr, appConfig.GRPCAddr, appConfig.SOCKSBridgeAddr} {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			if p, err := strconv.Atoi(port); err == nil {
+				ports = append(ports, p)
+			}
+		}
+	}
+	if appConfig.EnableDNSOverTLS {
+		if appConfig.DNSOverTLSPort == 0 {
+			ports = append(ports, defaultDNSOverTLSPort)
+		} else {
+			ports = append(ports, appConfig.DNSOverTLSPort)
+		}
+	}
+
+	excluded := make(map[int]bool)
+	excludePorts := []int{}
+	for _, port := range ports {
+		if validPort(port) && port != onPort && !excluded[port] {
+			excluded[port] = true
+			excludePorts = append(excludePorts, port)
+		}
+	}
+	sort.Ints(excludePorts)
+	return excludePorts
+}
@@ -0,0 +1,48 @@
+//go:build !linux
+// +build !linux
+
+package singularity
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// errTProxyUnsupported is returned by Linux TProxy support on other platforms
+var errTProxyUnsupported = errors.New("Linux TProxy support is only available on Linux")
+
+// useIPTransparent fails, TProxy listeners require Linux
+func useIPTransparent(network, address string, conn syscall.RawConn) error {
+	return errTProxyUnsupported
+}
+
+// newTProxyRelayListener returns l, TProxy listeners require Linux
+func newTProxyRelayListener(l net.Listener, ports []int) net.Listener {
+	return l
+}
+
+// LinuxTProxyRules installs the rules redirecting a range of external ports
+// to a Singularity HTTP server with Linux TProxy. They cannot be installed on other platforms.
+type LinuxTProxyRules struct {
+	FirstPort    int
+	LastPort     int
+	OnPort       int
+	ExcludePorts []int
+	DryRun       bool
+}
+
+// Install fails, TProxy rules require Linux
+func (tr *LinuxTProxyRules) Install() error {
+	return errTProxyUnsupported
+}
+
+// Remove does nothing, TProxy rules cannot be installed on other platforms
+func (tr *LinuxTProxyRules) Remove() error {
+	return nil
+}
+
+// NewLinuxTProxyRules fails, TProxy rules require Linux
+func NewLinuxTProxyRules(appConfig *AppConfig) (*LinuxTProxyRules, error) {
+	return nil, errTProxyUnsupported
+}
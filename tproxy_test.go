@@ -0,0 +1,47 @@
+//go:build linux
+// +build linux
+
+package singularity
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestLinuxTProxyRules(t *testing.T) {
+	rules, err := NewLinuxTProxyRules(&AppConfig{HTTPServerPorts: []int{8080, 80}, LinuxTProxyPortRange: "1-65535",
+		LinuxTProxyExcludePorts: []int{22}, LinuxTProxyRulesDryRun: true, HTTPSServerPorts: []int{8443},
+		DynamicHTTPServerPorts: []int{9000, 9001}, WsHTTPProxyServerPort: 3129, AdminAddr: "127.0.0.1:8000",
+		SOCKSBridgeAddr: ":1080", EnableDNSOverTLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []int{22, 80, 853, 1080, 3129, 8000, 8443, 9000, 9001}
+	if fmt.Sprint(rules.ExcludePorts) != fmt.Sprint(want) {
+		t.Errorf("expected excluded ports %v, got %v", want, rules.ExcludePorts)
+	}
+	commands := []string{}
+	for _, command := range rules.installCommands() {
+		commands = append(commands, strings.Join(command, " "))
+	}
+	for _, want := range []string{
+		iptablesCommand + " -t mangle -A SINGULARITY_TPROXY -p tcp --dport 22 -j RETURN",
+		iptablesCommand + " -t mangle -A SINGULARITY_TPROXY -p tcp --dport 1:65535 -j TPROXY --on-port 8080 --tproxy-mark 0x1/0x1",
+		ipCommand + " rule add fwmark 0x1/0x1 lookup 100",
+	} {
+		if !strings.Contains(strings.Join(commands, "\n"), want) {
+			t.Errorf("expected command %q, got %v", want, commands)
+		}
+	}
+	if err := rules.Install(); err != nil {
+		t.Errorf("unexpected dry run error: %v", err)
+	}
+	if err := rules.Remove(); err != nil {
+		t.Errorf("unexpected dry run error: %v", err)
+	}
+
+	if _, err := NewLinuxTProxyRules(&AppConfig{LinuxTProxyPortRange: "1-65535"}); err == nil {
+		t.Error("expected an error without HTTP server port")
+	}
+}
@@ -0,0 +1,181 @@
+package singularity
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/nccgroup/singularity/golang"
+)
+
+// txtRecordsAPIPath is the route of the TXT records management API
+const txtRecordsAPIPath = "/api/dns/txt"
+
+// maxTXTValueLength is the maximum length of a TXT record character string
+const maxTXTValueLength = 255
+
+// txtRecord returns a TXT record of name with value,
+// split into character strings of at most maxTXTValueLength bytes.
+// dns.TXT strings are unescaped when packed, so backslashes are escaped.
+func txtRecord(name string, ttl uint32, value string) *dns.TXT {
+	rr := &dns.TXT{Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl}}
+	for {
+		chunk := value
+		if len(chunk) > maxTXTValueLength {
+			chunk = chunk[:maxTXTValueLength]
+		}
+		rr.Txt = append(rr.Txt, strings.ReplaceAll(chunk, `\`, `\\`))
+		value = value[len(chunk):]
+		if value == "" {
+			return rr
+		}
+	}
+}
+
+// TXTRecord is a TXT record served by the DNS server, e.g. an ACME DNS-01 challenge
+type TXTRecord struct {
+	Name   string // fully qualified, e.g. "_acme-challenge.rebind.it."
+	Values []string
+}
+
+// TXTRecordStore holds TXT records defined by operators, keyed by lower case name
+type TXTRecordStore struct {
+	sync.RWMutex
+	records map[string][]string
+}
+
+// NewTXTRecordStore returns an empty TXT record store
+func NewTXTRecordStore() *TXTRecordStore {
+	return &TXTRecordStore{records: make(map[string][]string)}
+}
+
+// normalizeTXTRecordName returns the lower case fully qualified form of name
+func normalizeTXTRecordName(name string) string {
+	return strings.ToLower(dns.Fqdn(name))
+}
+
+// Get returns the values of the TXT record of a name, if any
+func (ts *TXTRecordStore) Get(name string) ([]string, bool) {
+	if ts == nil {
+		return nil, false
+	}
+	ts.RLock()
+	defer ts.RUnlock()
+	values, ok := ts.records[normalizeTXTRecordName(name)]
+	return values, ok
+}
+
+// Set defines the TXT record of a name, replacing its previous values
+func (ts *TXTRecordStore) Set(name string, values []string) {
+	ts.Lock()
+	ts.records[normalizeTXTRecordName(name)] = values
+	ts.Unlock()
+}
+
+// Delete removes the TXT record of a name
+func (ts *TXTRecordStore) Delete(name string) bool {
+	ts.Lock()
+	defer ts.Unlock()
+	name = normalizeTXTRecordName(name)
+	_, ok := ts.records[name]
+	delete(ts.records, name)
+	return ok
+}
+
+// List returns the TXT records sorted by name
+func (ts *TXTRecordStore) List() []TXTRecord {
+	ts.RLock()
+	records := make([]TXTRecord, 0, len(ts.records))
+	for name, values := range ts.records {
+		records = append(records, TXTRecord{Name: name, Values: values})
+	}
+	ts.RUnlock()
+	sort.Slice(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	return records
+}
+
+// TXTRecordsAPIHandler is a HTTP handler to manage TXT records served by the DNS server,
+// e.g. from the authentication hook of an ACME client solving DNS-01 challenges:
+//
+//	GET    /api/dns/txt               lists TXT records
+//	GET    /api/dns/txt/<name>        returns a TXT record
+//	PUT    /api/dns/txt/<name>        sets a TXT record from {"Values": ["..."]}
+//	DELETE /api/dns/txt/<name>        deletes a TXT record
+//
+// Names must be under the allowed domains, if set.
+// It is served behind AdminHandler.
+type TXTRecordsAPIHandler struct {
+	hss *HTTPServerStoreHandler
+}
+
+func (tah *TXTRecordsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logHTTPRequest(r)
+
+	appConfig := tah.hss.appConfig()
+	records := appConfig.TXTRecords
+	if records == nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, txtRecordsAPIPath), "/")
+	if name == "" {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, records.List())
+		return
+	}
+
+	if !golang.IsDomainName(name) ||
+		!nameUnderAllowedDomains(name, appConfig.AllowedDomains) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		values, ok := records.Get(name)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, TXTRecord{Name: normalizeTXTRecordName(name), Values: values})
+
+	case "PUT":
+		body, err := tah.hss.readRequestBody(r)
+		if err == errRequestBodyTooLarge {
+			http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		record := TXTRecord{}
+		if err != nil || json.Unmarshal(body, &record) != nil || len(record.Values) == 0 {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		for _, value := range record.Values {
+			if len(value) > maxTXTValueLength {
+				http.Error(w, "Bad request", http.StatusBadRequest)
+				return
+			}
+		}
+		records.Set(name, record.Values)
+		logEvent(LogInfo, "HTTP", LogFields{"qname": normalizeTXTRecordName(name)}, "set TXT record %v: %v", name, record.Values)
+		writeJSON(w, TXTRecord{Name: normalizeTXTRecordName(name), Values: record.Values})
+
+	case "DELETE":
+		if !records.Delete(name) {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+		logEvent(LogInfo, "HTTP", LogFields{"qname": normalizeTXTRecordName(name)}, "deleted TXT record %v", name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
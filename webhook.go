@@ -0,0 +1,141 @@
+package singularity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RebindingEvent is posted as JSON to AppConfig.WebhookURL
+// on the session events selected by AppConfig.WebhookEvents.
+type RebindingEvent struct {
+	Event        string
+	Session      string
+	ClientIP     string
+	ClientSubnet string `json:",omitempty"` // EDNS Client Subnet, if any
+	Strategy     string
+	Timestamp    time.Time
+	Port         string `json:",omitempty"` // attacked HTTP port of firewall events
+}
+
+// Webhook events
+const (
+	// a DNS session is created
+	webhookEventSession = "session"
+	// a DNS session first serves the rebound host without the first host
+	webhookEventRebinding = "rebinding"
+	// a multiple A records firewall rule is applied
+	webhookEventFirewall = "firewall"
+	// a payload connects back to Singularity with websockets
+	webhookEventCallback = "callback"
+)
+
+var webhookEvents = []string{webhookEventSession, webhookEventRebinding, webhookEventFirewall, webhookEventCallback}
+
+// notifyWebhook posts event in the background to WebhookURL if set
+// and if the event is selected by WebhookEvents, all events if empty.
+// The event is dropped if webhookQueueSize events are already waiting to be posted.
+func (appConfig *AppConfig) notifyWebhook(event *RebindingEvent) {
+	if appConfig == nil {
+		return
+	}
+	c := appConfig.snapshot()
+	if c.WebhookURL == "" {
+		return
+	}
+	if len(c.WebhookEvents) > 0 && !stringInSlice(event.Event, c.WebhookEvents) {
+		return
+	}
+	if !webhooks.enqueue(c.WebhookURL, event) {
+		logEvent(LogWarn, "Webhook", LogFields{"url": c.WebhookURL, "session": event.Session},
+			"too many pending notifications, dropping %v event of session: %v", event.Event, event.Session)
+	}
+}
+
+const (
+	// webhookQueueSize is the number of events waiting to be posted beyond which events are dropped
+	webhookQueueSize = 1024
+	// webhookWorkers is the number of events posted at once
+	webhookWorkers = 4
+)
+
+// webhookNotification is an event waiting to be posted to url
+type webhookNotification struct {
+	url   string
+	event *RebindingEvent
+}
+
+// webhookQueue posts events with a fixed number of workers,
+// started with the first event
+type webhookQueue struct {
+	startWorkers sync.Once
+	workers      int
+	queue        chan webhookNotification
+}
+
+func newWebhookQueue(size int, workers int) *webhookQueue {
+	return &webhookQueue{workers: workers, queue: make(chan webhookNotification, size)}
+}
+
+// webhooks posts the events of notifyWebhook
+var webhooks = newWebhookQueue(webhookQueueSize, webhookWorkers)
+
+// enqueue queues event to be posted to url
+// and returns false without waiting if the queue is full.
+func (wq *webhookQueue) enqueue(url string, event *RebindingEvent) bool {
+	wq.startWorkers.Do(func() {
+		for i := 0; i < wq.workers; i++ {
+			go func() {
+				for n := range wq.queue {
+					NotifyWebhook(n.url, n.event)
+				}
+			}()
+		}
+	})
+	select {
+	case wq.queue <- webhookNotification{url: url, event: event}:
+		return true
+	default:
+		return false
+	}
+}
+
+func stringInSlice(s string, slice []string) bool {
+	for _, element := range slice {
+		if element == s {
+			return true
+		}
+	}
+	return false
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// NotifyWebhook posts an event to url and logs any failure.
+// It blocks until the request completes.
+func NotifyWebhook(url string, event *RebindingEvent) {
+	if err := postWebhook(url, event); err != nil {
+		logEvent(LogWarn, "Webhook", LogFields{"url": url}, "could not notify %v: %v", url, err)
+	}
+}
+
+func postWebhook(url string, event *RebindingEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status: %v", resp.Status)
+	}
+	return nil
+}
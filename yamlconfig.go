@@ -0,0 +1,48 @@
+package singularity
+
+import (
+	"fmt"
+
+	"gopkg.in/yaml.v2"
+)
+
+// parseYAMLConfig parses a YAML configuration into values that encoding/json can marshal:
+//
+//	# comment
+//	ResponseIPAddr: 1.2.3.4
+//	HTTPServerPorts: [8080, 8081]
+//	AllowedDomains:
+//	  - rebind.it
+//	CustomResponseHeaders:
+//	  X-Frame-Options: DENY
+//
+// Duplicate keys are rejected.
+func parseYAMLConfig(data []byte) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if err := yaml.UnmarshalStrict(data, &values); err != nil {
+		return nil, err
+	}
+	return yamlToJSONValue(values).(map[string]interface{}), nil
+}
+
+// yamlToJSONValue converts the mappings decoded by yaml, which have keys of any type,
+// to mappings with string keys
+func yamlToJSONValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		mapping := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			mapping[fmt.Sprint(key)] = yamlToJSONValue(elem)
+		}
+		return mapping
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = yamlToJSONValue(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = yamlToJSONValue(elem)
+		}
+	}
+	return value
+}